@@ -1,5 +1,9 @@
 package api
 
+import "github.com/LunaNode/cloug/provider/common"
+import "github.com/LunaNode/cloug/service/compute"
+
+import "context"
 import "crypto/sha1"
 import "crypto/hmac"
 import "encoding/json"
@@ -10,13 +14,45 @@ import "io/ioutil"
 import "net/url"
 import "net/http"
 import "sort"
+import "strconv"
 import "strings"
+import "time"
+
+const DEFAULT_JOB_POLL_INTERVAL = 2 * time.Second
+const DEFAULT_JOB_TIMEOUT = 30 * time.Minute
 
 type API struct {
 	TargetURL string
 	ZoneID    string
 	APIKey    string
 	SecretKey string
+
+	// Client used for API requests. Defaults to http.DefaultClient.
+	Client *http.Client
+
+	// Interval between job status requests while waiting for asynchronous jobs.
+	// Defaults to DEFAULT_JOB_POLL_INTERVAL.
+	JobPollInterval time.Duration
+
+	// Total time to wait for an asynchronous job; negative to wait until the
+	// context is done. Defaults to DEFAULT_JOB_TIMEOUT.
+	JobTimeout time.Duration
+
+	ctx context.Context
+}
+
+// Returns a copy of the API that sends requests with the given context.
+func (api *API) WithContext(ctx context.Context) *API {
+	contextAPI := *api
+	contextAPI.ctx = ctx
+	return &contextAPI
+}
+
+func (api *API) context() context.Context {
+	if api.ctx == nil {
+		return context.Background()
+	}
+	return api.ctx
 }
 
 func (api *API) request(command string, requestParams map[string]string, target interface{}) error {
@@ -48,7 +84,7 @@ func (api *API) request(command string, requestParams map[string]string, target
 	}
 	for _, k := range sortedParamKeys {
 		requestQuery.Set(k, params[k])
-		commandStrParts = append(commandStrParts, fmt.Sprintf("%s=%s", url.QueryEscape(k), url.QueryEscape(params[k])))
+		commandStrParts = append(commandStrParts, fmt.Sprintf("%s=%s", signatureEscape(k), signatureEscape(params[k])))
 	}
 	commandStr := strings.ToLower(strings.Join(commandStrParts, "&"))
 
@@ -64,47 +100,68 @@ func (api *API) request(command string, requestParams map[string]string, target
 	requestURL.RawQuery = requestQuery.Encode()
 
 	// perform request
-	response, err := http.Get(requestURL.String())
+	httpRequest, err := http.NewRequest("GET", requestURL.String(), nil)
 	if err != nil {
 		return err
 	}
-	responseBytes, err := ioutil.ReadAll(response.Body)
+	client := api.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(httpRequest.WithContext(api.context()))
 	if err != nil {
 		return err
 	}
+	responseBytes, err := ioutil.ReadAll(response.Body)
 	response.Body.Close()
+	if err != nil {
+		return err
+	}
 
-	// decode JSON
-	responseMap := make(map[string]interface{})
+	// decode JSON; CloudStack wraps the response in a single object keyed by
+	// the command, or by errorresponse if the request failed
+	responseMap := make(map[string]json.RawMessage)
 	err = json.Unmarshal(responseBytes, &responseMap)
+	if err != nil && (response.StatusCode < 200 || response.StatusCode >= 300) {
+		return common.HTTPStatusError(response.StatusCode, fmt.Errorf("%s failed with HTTP status %d", command, response.StatusCode))
+	} else if err != nil {
+		return fmt.Errorf("error decoding %s response: %v", command, err)
+	}
 	var objectKey string
-	var objectValue []byte
+	var objectValue json.RawMessage
 	for k, v := range responseMap {
 		objectKey = k
-		objectValue, err = json.Marshal(v)
-		if err != nil {
-			return err
-		}
+		objectValue = v
 	}
 
-	if objectKey == "errorresponse" || strings.Contains(string(objectValue), "errortext") {
-		var errorResponse ErrorResponse
-		err = json.Unmarshal(objectValue, &errorResponse)
-		if err != nil {
-			return err
-		} else {
-			return errors.New(errorResponse.ErrorText)
+	// the error text of a failed job is nested in its result, so only a
+	// top-level errortext indicates that the request failed
+	var errorResponse ErrorResponse
+	json.Unmarshal(objectValue, &errorResponse)
+	if objectKey == "errorresponse" || errorResponse.ErrorText != "" {
+		if errorResponse.ErrorText == "" {
+			errorResponse.ErrorText = fmt.Sprintf("%s failed with HTTP status %d", command, response.StatusCode)
 		}
+		return errorResponse.err()
+	} else if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return common.HTTPStatusError(response.StatusCode, fmt.Errorf("%s failed with HTTP status %d", command, response.StatusCode))
+	} else if len(responseMap) != 1 {
+		return fmt.Errorf("error decoding %s response: expected a single object, got %d", command, len(responseMap))
 	} else if target != nil {
 		err = json.Unmarshal(objectValue, target)
 		if err != nil {
-			return err
+			return fmt.Errorf("error decoding %s response: %v", command, err)
 		}
 	}
 
 	return nil
 }
 
+// CloudStack verifies the signature with spaces encoded as %20 rather than +.
+func signatureEscape(str string) string {
+	return strings.Replace(url.QueryEscape(str), "+", "%20", -1)
+}
+
 func (api *API) ListServiceOfferings() ([]ServiceOffering, error) {
 	var response ListServiceOfferingsResponse
 	err := api.request("listServiceOfferings", nil, &response)
@@ -147,50 +204,122 @@ func (api *API) DeployVirtualMachine(options *DeployVirtualMachineOptions) (stri
 	}
 }
 
+// Returns the result of the deploy job, or nil if the job is still pending.
 func (api *API) QueryDeployJob(jobid string) (*DeployVirtualMachineResult, error) {
-	type JobResult struct {
-		VirtualMachine *DeployVirtualMachineResult `json:"virtualmachine"`
+	job, err := api.getJob(jobid)
+	if err != nil || job.JobStatus == JOB_PENDING {
+		return nil, err
 	}
-	type Response struct {
-		Status int       `json:"jobstatus"`
-		Result JobResult `json:"jobresult"`
+	var result DeployVirtualMachineResult
+	err = job.result("virtualmachine", &result)
+	if err != nil {
+		return nil, err
 	}
-	var response Response
-	err := api.request("queryAsyncJobResult", map[string]string{"jobid": jobid}, &response)
+	return &result, nil
+}
+
+// Waits for the deploy job to complete and returns its result, which includes
+// the initial password if the template is password-enabled.
+func (api *API) WaitForDeployJob(jobid string) (*DeployVirtualMachineResult, error) {
+	var result DeployVirtualMachineResult
+	err := api.queryAsyncJobResult(jobid, "virtualmachine", &result)
 	if err != nil {
 		return nil, err
-	} else if response.Status == 0 {
-		return nil, nil
-	} else if response.Result.VirtualMachine == nil {
-		return nil, errors.New("deploy job completed, but no VM provided")
-	} else {
-		return response.Result.VirtualMachine, nil
 	}
+	return &result, nil
 }
 
-func (api *API) vmAction(id string, command string) error {
-	params := map[string]string{"id": id}
-	return api.request(command, params, nil)
+// Waits for the asynchronous job to complete.
+func (api *API) WaitForJob(jobid string) error {
+	return api.queryAsyncJobResult(jobid, "", nil)
+}
+
+func (api *API) getJob(jobid string) (*AsyncJobResult, error) {
+	if jobid == "" {
+		return nil, errors.New("response does not contain a job ID")
+	}
+	// jobstatus is left at -1 if the response does not include it, which
+	// would otherwise read as JOB_PENDING
+	job := AsyncJobResult{JobStatus: -1}
+	err := api.request("queryAsyncJobResult", map[string]string{"jobid": jobid}, &job)
+	if err != nil {
+		return nil, fmt.Errorf("error querying job %s: %w", jobid, err)
+	} else if job.JobStatus < JOB_PENDING || job.JobStatus > JOB_FAILED {
+		return nil, fmt.Errorf("error querying job %s: response does not contain a valid job status", jobid)
+	}
+	return &job, nil
+}
+
+// Polls the job until it completes, and decodes the object under resultKey in
+// the job result into target, if target is not nil. Returns the error text of
+// a failed job as the error. If the job timeout expires or the context is
+// done, the returned error wraps the context error.
+func (api *API) queryAsyncJobResult(jobid string, resultKey string, target interface{}) error {
+	interval := api.JobPollInterval
+	if interval <= 0 {
+		interval = DEFAULT_JOB_POLL_INTERVAL
+	}
+	ctx := api.context()
+	timeout := api.JobTimeout
+	if timeout == 0 {
+		timeout = DEFAULT_JOB_TIMEOUT
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	contextAPI := api.WithContext(ctx)
+
+	for {
+		job, err := contextAPI.getJob(jobid)
+		if ctx.Err() != nil {
+			return fmt.Errorf("error waiting for job %s: %w", jobid, ctx.Err())
+		} else if err != nil {
+			return err
+		} else if job.JobStatus != JOB_PENDING {
+			return job.result(resultKey, target)
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("error waiting for job %s: %w", jobid, ctx.Err())
+		}
+	}
+}
+
+// Runs the asynchronous VM or volume command and returns the ID of its job.
+func (api *API) vmAction(command string, params map[string]string) (string, error) {
+	var response AsyncJobResponse
+	err := api.request(command, params, &response)
+	if err != nil {
+		return "", err
+	} else {
+		return response.JobID, nil
+	}
 }
 
-func (api *API) StartVirtualMachine(id string) error {
-	return api.vmAction(id, "startVirtualMachine")
+func (api *API) StartVirtualMachine(id string) (string, error) {
+	return api.vmAction("startVirtualMachine", map[string]string{"id": id})
 }
 
-func (api *API) StopVirtualMachine(id string) error {
-	return api.vmAction(id, "stopVirtualMachine")
+func (api *API) StopVirtualMachine(id string) (string, error) {
+	return api.vmAction("stopVirtualMachine", map[string]string{"id": id})
 }
 
-func (api *API) RebootVirtualMachine(id string) error {
-	return api.vmAction(id, "rebootVirtualMachine")
+func (api *API) RebootVirtualMachine(id string) (string, error) {
+	return api.vmAction("rebootVirtualMachine", map[string]string{"id": id})
 }
 
-func (api *API) DestroyVirtualMachine(id string, expunge bool) error {
+func (api *API) DestroyVirtualMachine(id string, expunge bool) (string, error) {
 	params := map[string]string{"id": id}
 	if expunge {
 		params["expunge"] = "true"
 	}
-	return api.request("destroyVirtualMachine", params, nil)
+	return api.vmAction("destroyVirtualMachine", params)
 }
 
 func (api *API) GetVirtualMachine(id string) (*VirtualMachine, error) {
@@ -199,6 +328,8 @@ func (api *API) GetVirtualMachine(id string) (*VirtualMachine, error) {
 	err := api.request("listVirtualMachines", params, &response)
 	if err != nil {
 		return nil, err
+	} else if len(response.VirtualMachines) == 0 {
+		return nil, compute.Errorf(compute.ErrNotFound, "VM %s not found", id)
 	} else if len(response.VirtualMachines) != 1 {
 		return nil, fmt.Errorf("failed to get VM %s: response contains %d VMs, expected 1", id, len(response.VirtualMachines))
 	} else {
@@ -226,3 +357,81 @@ func (api *API) CreateVMSnapshot(id string) (string, error) {
 		return response.ID, nil
 	}
 }
+
+func (api *API) CreateVolume(options *CreateVolumeOptions) (string, string, error) {
+	params := map[string]string{
+		"name":           options.Name,
+		"diskofferingid": options.DiskOffering,
+	}
+	if options.Size != 0 {
+		params["size"] = strconv.Itoa(options.Size)
+	}
+
+	var response AsyncJobResponse
+	err := api.request("createVolume", params, &response)
+	if err != nil {
+		return "", "", err
+	} else {
+		return response.ID, response.JobID, nil
+	}
+}
+
+func (api *API) GetVolume(id string) (*Volume, error) {
+	params := map[string]string{"id": id}
+	var response ListVolumesResponse
+	err := api.request("listVolumes", params, &response)
+	if err != nil {
+		return nil, err
+	} else if len(response.Volumes) == 0 {
+		return nil, compute.Errorf(compute.ErrNotFound, "volume %s not found", id)
+	} else if len(response.Volumes) != 1 {
+		return nil, fmt.Errorf("failed to get volume %s: response contains %d volumes, expected 1", id, len(response.Volumes))
+	} else {
+		return &response.Volumes[0], nil
+	}
+}
+
+func (api *API) ListVolumes() ([]Volume, error) {
+	params := map[string]string{"type": "DATADISK"}
+	var response ListVolumesResponse
+	err := api.request("listVolumes", params, &response)
+	if err != nil {
+		return nil, err
+	} else {
+		return response.Volumes, nil
+	}
+}
+
+func (api *API) DeleteVolume(id string) error {
+	return api.request("deleteVolume", map[string]string{"id": id}, nil)
+}
+
+// Waits for the volume job to complete and returns the resulting volume.
+func (api *API) WaitForVolumeJob(jobid string) (*Volume, error) {
+	var volume Volume
+	err := api.queryAsyncJobResult(jobid, "volume", &volume)
+	if err != nil {
+		return nil, err
+	}
+	return &volume, nil
+}
+
+func (api *API) AttachVolume(id string, vmID string) (string, error) {
+	params := map[string]string{
+		"id":               id,
+		"virtualmachineid": vmID,
+	}
+	return api.vmAction("attachVolume", params)
+}
+
+func (api *API) DetachVolume(id string) (string, error) {
+	return api.vmAction("detachVolume", map[string]string{"id": id})
+}
+
+func (api *API) ResizeVolume(id string, size int) (string, error) {
+	params := map[string]string{
+		"id":   id,
+		"size": strconv.Itoa(size),
+	}
+	return api.vmAction("resizeVolume", params)
+}
@@ -1,10 +1,48 @@
 package api
 
+import "github.com/LunaNode/cloug/provider/common"
+import "github.com/LunaNode/cloug/service/compute"
+
+import "encoding/json"
+import "errors"
+import "fmt"
+
 type ErrorResponse struct {
 	ErrorCode int    `json:"errorcode"`
 	ErrorText string `json:"errortext"`
 }
 
+// Maps the CloudStack error code onto a compute error kind.
+// CloudStack reports missing objects as parameter errors, so we check the
+// message for those first.
+func (errorResponse *ErrorResponse) kind() error {
+	messageKind := common.MessageKind(errorResponse.ErrorText)
+	if messageKind == compute.ErrNotFound {
+		return messageKind
+	}
+
+	switch errorResponse.ErrorCode {
+	case 401, 531:
+		return compute.ErrAuth
+	case 429:
+		return compute.ErrRateLimited
+	case 430, 431:
+		return compute.ErrInvalidArgument
+	case 432:
+		return compute.ErrNotSupported
+	case 532:
+		return compute.ErrQuotaExceeded
+	case 536, 537:
+		return compute.ErrConflict
+	default:
+		return messageKind
+	}
+}
+
+func (errorResponse *ErrorResponse) err() error {
+	return compute.WrapError(errorResponse.kind(), errors.New(errorResponse.ErrorText))
+}
+
 type IDResponse struct {
 	ID string `json:"id"`
 }
@@ -52,11 +90,13 @@ type DeployVirtualMachineResponse struct {
 }
 
 type DeployVirtualMachineResult struct {
+	VirtualMachine
 	Password string `json:"password"`
 }
 
 type VirtualMachine struct {
 	ID       string `json:"id"`
+	Name     string `json:"name"`
 	State    string `json:"state"`
 	Nics     []Nic  `json:"nic"`
 	Hostname string `json:"hostname"`
@@ -65,3 +105,71 @@ type VirtualMachine struct {
 type ListVirtualMachinesResponse struct {
 	VirtualMachines []VirtualMachine `json:"virtualmachine"`
 }
+
+type Volume struct {
+	ID               string `json:"id"`
+	Name             string `json:"name"`
+	Size             int64  `json:"size"`
+	State            string `json:"state"`
+	VirtualMachineID string `json:"virtualmachineid"`
+	ZoneName         string `json:"zonename"`
+}
+
+type ListVolumesResponse struct {
+	Volumes []Volume `json:"volume"`
+}
+
+type CreateVolumeOptions struct {
+	// Required options
+	Name         string
+	DiskOffering string
+
+	// Size in GB, only used for customized disk offerings
+	Size int
+}
+
+type AsyncJobResponse struct {
+	ID    string `json:"id"`
+	JobID string `json:"jobid"`
+}
+
+// Values of AsyncJobResult.JobStatus.
+const (
+	JOB_PENDING   = 0
+	JOB_SUCCEEDED = 1
+	JOB_FAILED    = 2
+)
+
+type AsyncJobResult struct {
+	JobID     string          `json:"jobid"`
+	JobStatus int             `json:"jobstatus"`
+	JobResult json.RawMessage `json:"jobresult"`
+}
+
+// Decodes the object under resultKey in the result of a completed job into
+// target, if target is not nil, or returns the error of a failed job.
+func (job *AsyncJobResult) result(resultKey string, target interface{}) error {
+	if job.JobStatus == JOB_FAILED {
+		var errorResponse ErrorResponse
+		json.Unmarshal(job.JobResult, &errorResponse)
+		if errorResponse.ErrorText == "" {
+			errorResponse.ErrorText = "unknown error"
+		}
+		return fmt.Errorf("job %s failed: %w", job.JobID, errorResponse.err())
+	} else if target == nil {
+		return nil
+	}
+
+	var result map[string]json.RawMessage
+	err := json.Unmarshal(job.JobResult, &result)
+	if err != nil {
+		return fmt.Errorf("json decode error: %v", err)
+	} else if result[resultKey] == nil {
+		return fmt.Errorf("job %s completed, but its result does not contain %s", job.JobID, resultKey)
+	}
+	err = json.Unmarshal(result[resultKey], target)
+	if err != nil {
+		return fmt.Errorf("json decode error: %v", err)
+	}
+	return nil
+}
@@ -5,29 +5,53 @@ import "github.com/LunaNode/cloug/provider/cloudstack/api"
 import "github.com/LunaNode/cloug/service/compute"
 import "github.com/LunaNode/cloug/utils"
 
+import "context"
 import "errors"
 import "fmt"
+import "net/http"
 import "strings"
 
 type CloudStack struct {
 	client *api.API
 }
 
-func MakeCloudStack(targetURL string, zoneID string, apiKey string, secretKey string) *CloudStack {
+// The API URL option takes precedence over targetURL.
+func MakeCloudStack(targetURL string, zoneID string, apiKey string, secretKey string, options ...common.Option) *CloudStack {
+	configOptions := []common.Option{common.WithAPIURL(targetURL), common.WithIdempotent(idempotentRequest)}
+	opts := common.MakeHTTPOptions(append(configOptions, options...)...)
 	cs := new(CloudStack)
 	cs.client = &api.API{
-		TargetURL: targetURL,
+		TargetURL: opts.APIURL,
 		ZoneID:    zoneID,
 		APIKey:    apiKey,
 		SecretKey: secretKey,
+		Client:    opts.HTTPClient(nil),
 	}
 	return cs
 }
 
+// Every API call is a GET, so only list and query commands are safe to retry.
+func idempotentRequest(req *http.Request) bool {
+	command := req.URL.Query().Get("command")
+	return strings.HasPrefix(command, "list") || strings.HasPrefix(command, "query")
+}
+
 func (cs *CloudStack) ComputeService() compute.Service {
 	return cs
 }
 
+func (cs *CloudStack) Capabilities() *compute.Capabilities {
+	return &compute.Capabilities{
+		Operations:     compute.ImplementedOperations(cs, compute.OpListFlavors),
+		InstanceFields: []compute.InstanceField{compute.FieldName, compute.FieldNetworkID},
+	}
+}
+
+// Returns a copy of the service whose API calls use the given context.
+func (cs *CloudStack) withContext(ctx context.Context) *CloudStack {
+	return &CloudStack{client: cs.client.WithContext(ctx)}
+}
+
 func (cs *CloudStack) mapInstanceStatus(status string) compute.InstanceStatus {
 	if status == "Running" {
 		return compute.StatusOnline
@@ -41,7 +65,7 @@ func (cs *CloudStack) mapInstanceStatus(status string) compute.InstanceStatus {
 func (cs *CloudStack) vmToInstance(vm *api.VirtualMachine) *compute.Instance {
 	instance := &compute.Instance{
 		ID:     vm.ID,
-		Name:   vm.Hostname,
+		Name:   vm.Name,
 		Status: cs.mapInstanceStatus(vm.State),
 	}
 
@@ -56,6 +80,8 @@ func (cs *CloudStack) vmToInstance(vm *api.VirtualMachine) *compute.Instance {
 	return instance
 }
 
+// Waits for the deploy job, so that the returned instance has the initial
+// password if the template is password-enabled.
 func (cs *CloudStack) CreateInstance(instance *compute.Instance) (*compute.Instance, error) {
 	if instance.Image.ID == "" {
 		return nil, errors.New("instance image ID must be set")
@@ -68,7 +94,7 @@ func (cs *CloudStack) CreateInstance(instance *compute.Instance) (*compute.Insta
 
 	parts := strings.Split(flavorID, "/")
 	if len(parts) != 2 {
-		return nil, fmt.Errorf("invalid service / disk offering: %s", flavorID)
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "invalid service / disk offering: %s", flavorID)
 	}
 
 	opts := api.DeployVirtualMachineOptions{
@@ -83,16 +109,28 @@ func (cs *CloudStack) CreateInstance(instance *compute.Instance) (*compute.Insta
 	if err != nil {
 		return nil, err
 	}
+	result, err := cs.client.WaitForDeployJob(jobid)
+	if err != nil {
+		return nil, fmt.Errorf("error deploying instance %s: %w", id, err)
+	}
 
-	return &compute.Instance{
-		ID:    id,
-		Name:  instance.Name,
-		JobID: jobid,
-	}, nil
+	createdInstance := cs.vmToInstance(&result.VirtualMachine)
+	createdInstance.ID = id
+	createdInstance.Password = result.Password
+	createdInstance.JobID = jobid
+	return createdInstance, nil
+}
+
+// Waits for the asynchronous job started by an API call to complete.
+func (cs *CloudStack) waitJob(jobid string, err error) error {
+	if err != nil {
+		return err
+	}
+	return cs.client.WaitForJob(jobid)
 }
 
 func (cs *CloudStack) DeleteInstance(instanceID string) error {
-	return cs.client.DestroyVirtualMachine(instanceID, true)
+	return cs.waitJob(cs.client.DestroyVirtualMachine(instanceID, true))
 }
 
 func (cs *CloudStack) ListInstances() ([]*compute.Instance, error) {
@@ -117,19 +155,47 @@ func (cs *CloudStack) GetInstance(instanceID string) (*compute.Instance, error)
 }
 
 func (cs *CloudStack) StartInstance(instanceID string) error {
-	return cs.client.StartVirtualMachine(instanceID)
+	return cs.waitJob(cs.client.StartVirtualMachine(instanceID))
 }
 
 func (cs *CloudStack) StopInstance(instanceID string) error {
-	return cs.client.StopVirtualMachine(instanceID)
+	return cs.waitJob(cs.client.StopVirtualMachine(instanceID))
 }
 
 func (cs *CloudStack) RebootInstance(instanceID string) error {
-	return cs.client.RebootVirtualMachine(instanceID)
+	return cs.waitJob(cs.client.RebootVirtualMachine(instanceID))
+}
+
+func (cs *CloudStack) CreateInstanceContext(ctx context.Context, instance *compute.Instance) (*compute.Instance, error) {
+	return cs.withContext(ctx).CreateInstance(instance)
+}
+
+func (cs *CloudStack) DeleteInstanceContext(ctx context.Context, instanceID string) error {
+	return cs.withContext(ctx).DeleteInstance(instanceID)
+}
+
+func (cs *CloudStack) ListInstancesContext(ctx context.Context) ([]*compute.Instance, error) {
+	return cs.withContext(ctx).ListInstances()
+}
+
+func (cs *CloudStack) GetInstanceContext(ctx context.Context, instanceID string) (*compute.Instance, error) {
+	return cs.withContext(ctx).GetInstance(instanceID)
+}
+
+func (cs *CloudStack) StartInstanceContext(ctx context.Context, instanceID string) error {
+	return cs.withContext(ctx).StartInstance(instanceID)
+}
+
+func (cs *CloudStack) StopInstanceContext(ctx context.Context, instanceID string) error {
+	return cs.withContext(ctx).StopInstance(instanceID)
+}
+
+func (cs *CloudStack) RebootInstanceContext(ctx context.Context, instanceID string) error {
+	return cs.withContext(ctx).RebootInstance(instanceID)
 }
 
 func (cs *CloudStack) ListFlavors() ([]*compute.Flavor, error) {
-	return nil, errors.New("operation not supported")
+	return nil, compute.ErrNotSupported
 }
 
 func (cs *CloudStack) findServiceOffering(cpu int, ram int) (string, error) {
@@ -185,3 +251,120 @@ func (cs *CloudStack) FindFlavor(flavor *compute.Flavor) (string, error) {
 
 	return fmt.Sprintf("%s/%s", serviceOffering, diskOffering), nil
 }
+
+func (cs *CloudStack) mapVolumeStatus(state string) compute.VolumeStatus {
+	// allocated volumes are not yet on primary storage, but can be attached
+	if state == "Ready" || state == "Allocated" {
+		return compute.VolumeAvailable
+	} else if state == "Creating" || state == "Resizing" || state == "UploadOp" {
+		return compute.VolumePending
+	} else {
+		return compute.VolumeStatus(strings.ToLower(state))
+	}
+}
+
+func (cs *CloudStack) mapVolume(apiVolume *api.Volume) *compute.Volume {
+	volume := &compute.Volume{
+		ID:         apiVolume.ID,
+		Name:       apiVolume.Name,
+		Region:     apiVolume.ZoneName,
+		SizeGB:     int(apiVolume.Size / 1024 / 1024 / 1024),
+		Status:     cs.mapVolumeStatus(apiVolume.State),
+		InstanceID: apiVolume.VirtualMachineID,
+	}
+	if volume.Status == compute.VolumeAvailable && volume.InstanceID != "" {
+		volume.Status = compute.VolumeInUse
+	}
+	return volume
+}
+
+// Finds a disk offering that can be used to create a volume of the given size.
+// Offerings with a matching fixed size are preferred over customized offerings.
+func (cs *CloudStack) findVolumeDiskOffering(size int) (string, bool, error) {
+	offerings, err := cs.client.ListDiskOfferings()
+	if err != nil {
+		return "", false, err
+	}
+	var customOffering string
+	for _, offering := range offerings {
+		if offering.IsCustomized {
+			if customOffering == "" {
+				customOffering = offering.ID
+			}
+		} else if offering.DiskSize == size {
+			return offering.ID, false, nil
+		}
+	}
+	if customOffering != "" {
+		return customOffering, true, nil
+	}
+	return "", false, fmt.Errorf("no disk offering with %d GB space", size)
+}
+
+func (cs *CloudStack) CreateVolume(volume *compute.Volume) (*compute.Volume, error) {
+	if volume.SizeGB <= 0 {
+		return nil, errors.New("volume size must be set")
+	}
+
+	diskOffering, custom, err := cs.findVolumeDiskOffering(volume.SizeGB)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := api.CreateVolumeOptions{
+		Name:         volume.Name,
+		DiskOffering: diskOffering,
+	}
+	if opts.Name == "" {
+		opts.Name = "cloug-" + utils.Uid(8)
+	}
+	if custom {
+		opts.Size = volume.SizeGB
+	}
+
+	_, jobid, err := cs.client.CreateVolume(&opts)
+	if err != nil {
+		return nil, err
+	}
+	apiVolume, err := cs.client.WaitForVolumeJob(jobid)
+	if err != nil {
+		return nil, err
+	}
+	return cs.mapVolume(apiVolume), nil
+}
+
+func (cs *CloudStack) ListVolumes() ([]*compute.Volume, error) {
+	apiVolumes, err := cs.client.ListVolumes()
+	if err != nil {
+		return nil, err
+	}
+	volumes := make([]*compute.Volume, len(apiVolumes))
+	for i := range apiVolumes {
+		volumes[i] = cs.mapVolume(&apiVolumes[i])
+	}
+	return volumes, nil
+}
+
+func (cs *CloudStack) GetVolume(volumeID string) (*compute.Volume, error) {
+	apiVolume, err := cs.client.GetVolume(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	return cs.mapVolume(apiVolume), nil
+}
+
+func (cs *CloudStack) DeleteVolume(volumeID string) error {
+	return cs.client.DeleteVolume(volumeID)
+}
+
+func (cs *CloudStack) AttachVolume(volumeID string, instanceID string) error {
+	return cs.waitJob(cs.client.AttachVolume(volumeID, instanceID))
+}
+
+func (cs *CloudStack) DetachVolume(volumeID string) error {
+	return cs.waitJob(cs.client.DetachVolume(volumeID))
+}
+
+func (cs *CloudStack) ResizeVolume(volumeID string, sizeGB int) error {
+	return cs.waitJob(cs.client.ResizeVolume(volumeID, sizeGB))
+}
@@ -0,0 +1,109 @@
+package cloudstack
+
+import "github.com/LunaNode/cloug/provider/cloudstack/simulator"
+import "github.com/LunaNode/cloug/service/compute"
+import "github.com/LunaNode/cloug/service/compute/conformance"
+
+import "context"
+import "errors"
+import "net/http"
+import "net/http/httptest"
+import "strings"
+import "testing"
+import "time"
+
+func TestConformance(t *testing.T) {
+	server := simulator.NewServer("apikey", "secret key")
+	defer server.Close()
+
+	cs := MakeCloudStack(server.APIURL(), server.ZoneID, server.APIKey, server.SecretKey)
+	cs.client.JobPollInterval = time.Millisecond
+	conformance.Run(t, cs, &conformance.Config{
+		Instance: compute.Instance{
+			Name:  "cloug test",
+			Image: compute.Image{ID: simulator.TEMPLATE_ID},
+		},
+		VolumeSizeGB: 15,
+		Wait:         compute.WaitOptions{Interval: 10 * time.Millisecond},
+	})
+}
+
+func TestBadSignature(t *testing.T) {
+	server := simulator.NewServer("apikey", "secret key")
+	defer server.Close()
+
+	cs := MakeCloudStack(server.APIURL(), server.ZoneID, server.APIKey, "wrong key")
+	if _, err := cs.ListInstances(); !errors.Is(err, compute.ErrAuth) {
+		t.Fatalf("expected auth error, got %v", err)
+	}
+}
+
+func TestJobs(t *testing.T) {
+	server := simulator.NewServer("apikey", "secret key")
+	defer server.Close()
+	server.JobErrors["stopVirtualMachine"] = "Insufficient capacity"
+
+	cs := MakeCloudStack(server.APIURL(), server.ZoneID, server.APIKey, server.SecretKey)
+	cs.client.JobPollInterval = time.Millisecond
+	instance, err := cs.CreateInstance(&compute.Instance{Image: compute.Image{ID: simulator.TEMPLATE_ID}})
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	} else if instance.Password == "" {
+		t.Fatalf("expected password from deploy job, got %+v", instance)
+	}
+	instance, err = compute.WaitForInstance(cs, instance.ID, compute.InstanceOnline, &compute.WaitOptions{Interval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("wait failed: %v", err)
+	}
+
+	err = cs.StopInstance(instance.ID)
+	if err == nil || !strings.Contains(err.Error(), "Insufficient capacity") {
+		t.Fatalf("expected job error text, got %v", err)
+	}
+
+	volume, err := cs.CreateVolume(&compute.Volume{SizeGB: 15})
+	if err != nil {
+		t.Fatalf("volume create failed: %v", err)
+	} else if volume.Status != compute.VolumeAvailable {
+		t.Fatalf("expected created volume to be available, got %+v", volume)
+	}
+	server.JobErrors["attachVolume"] = "Failed to attach volume"
+	if err := cs.AttachVolume(volume.ID, instance.ID); err == nil || !strings.Contains(err.Error(), "Failed to attach volume") {
+		t.Fatalf("expected attach job error text, got %v", err)
+	}
+
+	server.JobErrors["deployVirtualMachine"] = "Unable to create a deployment"
+	if _, err := cs.CreateInstance(&compute.Instance{Image: compute.Image{ID: simulator.TEMPLATE_ID}}); err == nil || !strings.Contains(err.Error(), "Unable to create a deployment") {
+		t.Fatalf("expected deploy job error text, got %v", err)
+	}
+}
+
+func TestBadResponses(t *testing.T) {
+	var body string
+	var status int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+	cs := MakeCloudStack(server.URL, "zone", "apikey", "secret key")
+	cs.client.JobPollInterval = time.Millisecond
+
+	body, status = "<html>Bad Gateway</html>", http.StatusBadGateway
+	if _, err := cs.ListInstances(); err == nil {
+		t.Fatalf("expected error for HTTP 502")
+	}
+	body, status = `{"listvirtualmachinesresponse":`, http.StatusOK
+	if _, err := cs.ListInstances(); err == nil {
+		t.Fatalf("expected error for truncated response")
+	}
+	body = `{"queryasyncjobresultresponse":{"jobid":"job"}}`
+	if err := cs.client.WaitForJob("job"); err == nil {
+		t.Fatalf("expected error for job without status")
+	}
+	body = `{"queryasyncjobresultresponse":{"jobid":"job","jobstatus":0}}`
+	cs.client.JobTimeout = 20 * time.Millisecond
+	if err := cs.client.WaitForJob("job"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected job timeout, got %v", err)
+	}
+}
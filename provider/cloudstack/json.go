@@ -1,5 +1,6 @@
 package cloudstack
 
+import "github.com/LunaNode/cloug/provider/common"
 import "github.com/LunaNode/cloug/service/compute"
 
 import "encoding/json"
@@ -9,13 +10,17 @@ type CloudStackJSONConfig struct {
 	ZoneID    string `json:"zone_id"`
 	ApiKey    string `json:"api_key"`
 	SecretKey string `json:"secret_key"`
+
+	// Overrides URL if set.
+	APIURL string `json:"api_url"`
 }
 
-func CloudStackFromJSON(jsonData []byte) (compute.Provider, error) {
+func CloudStackFromJSON(jsonData []byte, options ...common.Option) (compute.Provider, error) {
 	var cfg CloudStackJSONConfig
 	err := json.Unmarshal(jsonData, &cfg)
 	if err != nil {
 		return nil, err
 	}
-	return MakeCloudStack(cfg.URL, cfg.ZoneID, cfg.ApiKey, cfg.SecretKey), nil
+	options = append([]common.Option{common.WithAPIURL(cfg.APIURL)}, options...)
+	return MakeCloudStack(cfg.URL, cfg.ZoneID, cfg.ApiKey, cfg.SecretKey, options...), nil
 }
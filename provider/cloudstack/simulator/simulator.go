@@ -0,0 +1,656 @@
+// Package simulator provides a local stand-in for the CloudStack API.
+//
+// The server verifies the HMAC-SHA1 signature over the sorted, lowercased
+// query string, and keeps virtual machines, volumes and asynchronous jobs in
+// memory, so that the API client and the compute adapter can be tested
+// without a CloudStack deployment.
+package simulator
+
+import "crypto/hmac"
+import "crypto/sha1"
+import "encoding/base64"
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "net/http/httptest"
+import "net/url"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+
+const GIGABYTE = 1024 * 1024 * 1024
+
+// Template that is available for deploying virtual machines.
+const TEMPLATE_ID = "00000000-0000-4000-8000-000000000001"
+
+type serviceOffering struct {
+	id     string
+	name   string
+	cpu    int
+	memory int
+}
+
+type diskOffering struct {
+	id         string
+	name       string
+	size       int
+	customized bool
+}
+
+type vm struct {
+	id       string
+	name     string
+	state    string
+	ip       string
+	password string
+
+	// state that the VM transitions to after pendingPolls more list requests
+	nextState    string
+	pendingPolls int
+}
+
+type volume struct {
+	id    string
+	name  string
+	size  int64
+	state string
+	vmID  string
+
+	nextState    string
+	pendingPolls int
+}
+
+type job struct {
+	id string
+
+	// result object key and value reported once the job completes
+	resultKey    string
+	result       func() interface{}
+	pendingPolls int
+
+	// if set, the job fails with this error text
+	errorText string
+}
+
+type apiError struct {
+	code int
+	text string
+}
+
+func (err *apiError) Error() string {
+	return err.text
+}
+
+func errorf(code int, format string, a ...interface{}) *apiError {
+	return &apiError{code, fmt.Sprintf(format, a...)}
+}
+
+// Server is a CloudStack API simulator listening on a local port.
+type Server struct {
+	*httptest.Server
+
+	APIKey    string
+	SecretKey string
+	ZoneID    string
+	ZoneName  string
+
+	// Number of list requests for which new objects are still transitioning.
+	PendingPolls int
+
+	// Commands whose jobs fail, mapped to the error text of the job result.
+	JobErrors map[string]string
+
+	mu               sync.Mutex
+	nextID           int
+	serviceOfferings []*serviceOffering
+	diskOfferings    []*diskOffering
+	vms              map[string]*vm
+	volumes          map[string]*volume
+	jobs             map[string]*job
+}
+
+// Starts a simulator that accepts requests signed with the given keys.
+// The server has a single zone with a 1 vCPU / 512 MB service offering, fixed
+// 10 GB and 20 GB disk offerings and one customized disk offering.
+func NewServer(apiKey string, secretKey string) *Server {
+	s := &Server{
+		APIKey:       apiKey,
+		SecretKey:    secretKey,
+		ZoneID:       "00000000-0000-4000-8000-000000000002",
+		ZoneName:     "Simulator",
+		PendingPolls: 1,
+		JobErrors:    make(map[string]string),
+		nextID:       100,
+		vms:          make(map[string]*vm),
+		volumes:      make(map[string]*volume),
+		jobs:         make(map[string]*job),
+	}
+	s.serviceOfferings = []*serviceOffering{
+		{s.newID(), "Small Instance", 1, 512},
+		{s.newID(), "Medium Instance", 2, 2048},
+	}
+	s.diskOfferings = []*diskOffering{
+		{s.newID(), "Small", 10, false},
+		{s.newID(), "Medium", 20, false},
+		{s.newID(), "Custom", 0, true},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Returns the API endpoint URL that the client should use.
+func (s *Server) APIURL() string {
+	return s.URL + "/client/api"
+}
+
+func (s *Server) newID() string {
+	s.nextID++
+	return fmt.Sprintf("00000000-0000-4000-8000-%012d", s.nextID)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	command := query.Get("command")
+	responseKey := strings.ToLower(command) + "response"
+	if command == "" {
+		responseKey = "errorresponse"
+	}
+
+	result, err := s.handle(r.URL.Path, query)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(err.code)
+		result = map[string]interface{}{
+			"uuidList":    []string{},
+			"errorcode":   err.code,
+			"cserrorcode": 9999,
+			"errortext":   err.text,
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{responseKey: result})
+}
+
+// Returns the signature that the client should have computed for the query.
+func (s *Server) signature(query url.Values) string {
+	var keys []string
+	for k := range query {
+		if k != "signature" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%s", s.escape(k), s.escape(query.Get(k))))
+	}
+	hasher := hmac.New(sha1.New, []byte(s.SecretKey))
+	hasher.Write([]byte(strings.ToLower(strings.Join(parts, "&"))))
+	return base64.StdEncoding.EncodeToString(hasher.Sum(nil))
+}
+
+// CloudStack verifies signatures with spaces encoded as %20 rather than +.
+func (s *Server) escape(str string) string {
+	return strings.Replace(url.QueryEscape(str), "+", "%20", -1)
+}
+
+func (s *Server) handle(path string, query url.Values) (interface{}, *apiError) {
+	if path != "/client/api" {
+		return nil, errorf(http.StatusNotFound, "unknown API path %s", path)
+	} else if query.Get("response") != "json" {
+		return nil, errorf(431, "only JSON responses are supported by the simulator")
+	} else if query.Get("apiKey") != s.APIKey || !hmac.Equal([]byte(query.Get("signature")), []byte(s.signature(query))) {
+		return nil, errorf(401, "unable to verify user credentials and/or request signature")
+	} else if zoneID := query.Get("zoneid"); zoneID != "" && zoneID != s.ZoneID {
+		return nil, errorf(431, "Unable to execute API command due to invalid value. Invalid parameter zoneid value=%s due to incorrect long value format, or entity does not exist or due to incorrect parameter annotation for the field in api cmd class.", zoneID)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch query.Get("command") {
+	case "listServiceOfferings":
+		return s.listServiceOfferings()
+	case "listDiskOfferings":
+		return s.listDiskOfferings()
+	case "deployVirtualMachine":
+		return s.deployVirtualMachine(query)
+	case "listVirtualMachines":
+		return s.listVirtualMachines(query)
+	case "startVirtualMachine", "stopVirtualMachine", "rebootVirtualMachine", "destroyVirtualMachine":
+		return s.vmAction(query)
+	case "createVMSnapshot":
+		return s.createVMSnapshot(query)
+	case "createVolume":
+		return s.createVolume(query)
+	case "listVolumes":
+		return s.listVolumes(query)
+	case "deleteVolume":
+		return s.deleteVolume(query)
+	case "attachVolume", "detachVolume", "resizeVolume":
+		return s.volumeAction(query)
+	case "queryAsyncJobResult":
+		return s.queryAsyncJobResult(query)
+	default:
+		return nil, errorf(432, "The given command %s does not exist or it is not available for user", query.Get("command"))
+	}
+}
+
+func (s *Server) invalidParameter(name string, value string) *apiError {
+	return errorf(431, "Unable to execute API command due to invalid value. Invalid parameter %s value=%s due to incorrect long value format, or entity does not exist or due to incorrect parameter annotation for the field in api cmd class.", name, value)
+}
+
+func (s *Server) missingParameter(name string) *apiError {
+	return errorf(431, "Unable to execute API command due to missing parameter %s", name)
+}
+
+func (s *Server) findVM(param string, query url.Values) (*vm, *apiError) {
+	id := query.Get(param)
+	if id == "" {
+		return nil, s.missingParameter(param)
+	}
+	vm := s.vms[id]
+	if vm == nil {
+		return nil, s.invalidParameter(param, id)
+	}
+	return vm, nil
+}
+
+func (s *Server) findVolume(query url.Values) (*volume, *apiError) {
+	id := query.Get("id")
+	if id == "" {
+		return nil, s.missingParameter("id")
+	}
+	volume := s.volumes[id]
+	if volume == nil {
+		return nil, s.invalidParameter("id", id)
+	}
+	return volume, nil
+}
+
+func (s *Server) findDiskOffering(id string) *diskOffering {
+	for _, offering := range s.diskOfferings {
+		if offering.id == id {
+			return offering
+		}
+	}
+	return nil
+}
+
+func (s *Server) startJob(resultKey string, result func() interface{}) string {
+	job := &job{
+		id:           s.newID(),
+		resultKey:    resultKey,
+		result:       result,
+		pendingPolls: s.PendingPolls,
+	}
+	s.jobs[job.id] = job
+	return job.id
+}
+
+func (s *Server) startFailedJob(errorText string) string {
+	job := &job{
+		id:           s.newID(),
+		pendingPolls: s.PendingPolls,
+		errorText:    errorText,
+	}
+	s.jobs[job.id] = job
+	return job.id
+}
+
+func (s *Server) listServiceOfferings() (interface{}, *apiError) {
+	offerings := []interface{}{}
+	for _, offering := range s.serviceOfferings {
+		offerings = append(offerings, map[string]interface{}{
+			"id":        offering.id,
+			"name":      offering.name,
+			"cpunumber": offering.cpu,
+			"memory":    offering.memory,
+		})
+	}
+	return map[string]interface{}{
+		"count":           len(offerings),
+		"serviceoffering": offerings,
+	}, nil
+}
+
+func (s *Server) listDiskOfferings() (interface{}, *apiError) {
+	offerings := []interface{}{}
+	for _, offering := range s.diskOfferings {
+		offerings = append(offerings, map[string]interface{}{
+			"id":           offering.id,
+			"name":         offering.name,
+			"disksize":     offering.size,
+			"iscustomized": offering.customized,
+		})
+	}
+	return map[string]interface{}{
+		"count":        len(offerings),
+		"diskoffering": offerings,
+	}, nil
+}
+
+func (s *Server) deployVirtualMachine(query url.Values) (interface{}, *apiError) {
+	for _, param := range []string{"zoneid", "serviceofferingid", "templateid"} {
+		if query.Get(param) == "" {
+			return nil, s.missingParameter(param)
+		}
+	}
+	found := false
+	for _, offering := range s.serviceOfferings {
+		found = found || offering.id == query.Get("serviceofferingid")
+	}
+	if !found {
+		return nil, s.invalidParameter("serviceofferingid", query.Get("serviceofferingid"))
+	} else if query.Get("templateid") != TEMPLATE_ID {
+		return nil, s.invalidParameter("templateid", query.Get("templateid"))
+	} else if id := query.Get("diskofferingid"); id != "" && s.findDiskOffering(id) == nil {
+		return nil, s.invalidParameter("diskofferingid", id)
+	}
+
+	newVM := &vm{
+		id:           s.newID(),
+		name:         query.Get("name"),
+		state:        "Starting",
+		nextState:    "Running",
+		pendingPolls: s.PendingPolls,
+	}
+	if newVM.name == "" {
+		newVM.name = "VM-" + newVM.id
+	}
+	if errorText := s.JobErrors["deployVirtualMachine"]; errorText != "" {
+		newVM.state, newVM.nextState = "Error", ""
+		s.vms[newVM.id] = newVM
+		return map[string]interface{}{
+			"id":    newVM.id,
+			"jobid": s.startFailedJob(errorText),
+		}, nil
+	}
+	n := s.nextID
+	newVM.ip = fmt.Sprintf("10.1.1.%d", n%250+1)
+	newVM.password = fmt.Sprintf("pw%d", n)
+	s.vms[newVM.id] = newVM
+	jobID := s.startJob("virtualmachine", func() interface{} {
+		result := s.vmStruct(newVM)
+		result["password"] = newVM.password
+		return result
+	})
+	return map[string]interface{}{
+		"id":    newVM.id,
+		"jobid": jobID,
+	}, nil
+}
+
+func (s *Server) vmStruct(vm *vm) map[string]interface{} {
+	return map[string]interface{}{
+		"id":          vm.id,
+		"name":        vm.name,
+		"displayname": vm.name,
+		"state":       vm.state,
+		"zoneid":      s.ZoneID,
+		"zonename":    s.ZoneName,
+		"templateid":  TEMPLATE_ID,
+		"hostname":    "simulator-host",
+		"nic": []interface{}{
+			map[string]interface{}{
+				"ipaddress": vm.ip,
+				"isdefault": true,
+			},
+		},
+	}
+}
+
+// Advances a pending state transition, as observed by a list request.
+func (s *Server) advance(state *string, nextState *string, pendingPolls *int) {
+	if *nextState == "" {
+		return
+	} else if *pendingPolls > 0 {
+		*pendingPolls--
+	} else {
+		*state = *nextState
+		*nextState = ""
+	}
+}
+
+func (s *Server) listVirtualMachines(query url.Values) (interface{}, *apiError) {
+	var ids []string
+	for id, vm := range s.vms {
+		s.advance(&vm.state, &vm.nextState, &vm.pendingPolls)
+		if vm.state == "Expunging" {
+			delete(s.vms, id)
+		} else if query.Get("id") == "" || query.Get("id") == id {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	// like CloudStack, an empty list is reported without the object key
+	response := make(map[string]interface{})
+	if len(ids) > 0 {
+		vms := []interface{}{}
+		for _, id := range ids {
+			vms = append(vms, s.vmStruct(s.vms[id]))
+		}
+		response["count"] = len(vms)
+		response["virtualmachine"] = vms
+	}
+	return response, nil
+}
+
+func (s *Server) vmAction(query url.Values) (interface{}, *apiError) {
+	vm, err := s.findVM("id", query)
+	if err != nil {
+		return nil, err
+	} else if vm.nextState != "" {
+		return nil, errorf(431, "VM %s is in state %s and cannot be operated on", vm.id, vm.state)
+	} else if errorText := s.JobErrors[query.Get("command")]; errorText != "" {
+		return map[string]interface{}{"jobid": s.startFailedJob(errorText)}, nil
+	}
+
+	switch query.Get("command") {
+	case "startVirtualMachine":
+		if vm.state != "Stopped" {
+			return nil, errorf(431, "VM %s is in state %s, unable to start", vm.id, vm.state)
+		}
+		vm.state, vm.nextState = "Starting", "Running"
+	case "stopVirtualMachine":
+		if vm.state != "Running" {
+			return nil, errorf(431, "VM %s is in state %s, unable to stop", vm.id, vm.state)
+		}
+		vm.state, vm.nextState = "Stopping", "Stopped"
+	case "rebootVirtualMachine":
+		if vm.state != "Running" {
+			return nil, errorf(431, "VM %s is in state %s, unable to reboot", vm.id, vm.state)
+		}
+		vm.state, vm.nextState = "Starting", "Running"
+	case "destroyVirtualMachine":
+		for _, volume := range s.volumes {
+			if volume.vmID == vm.id {
+				volume.vmID = ""
+			}
+		}
+		vm.state, vm.nextState = "Destroyed", ""
+		if query.Get("expunge") == "true" {
+			vm.nextState = "Expunging"
+		}
+	}
+	vm.pendingPolls = s.PendingPolls
+	jobID := s.startJob("virtualmachine", func() interface{} {
+		return s.vmStruct(vm)
+	})
+	return map[string]interface{}{"jobid": jobID}, nil
+}
+
+func (s *Server) createVMSnapshot(query url.Values) (interface{}, *apiError) {
+	vm, err := s.findVM("virtualmachineid", query)
+	if err != nil {
+		return nil, err
+	}
+	id := s.newID()
+	jobID := s.startJob("vmsnapshot", func() interface{} {
+		return map[string]interface{}{
+			"id":               id,
+			"virtualmachineid": vm.id,
+			"state":            "Ready",
+		}
+	})
+	return map[string]interface{}{
+		"id":    id,
+		"jobid": jobID,
+	}, nil
+}
+
+func (s *Server) volumeStruct(volume *volume) map[string]interface{} {
+	result := map[string]interface{}{
+		"id":       volume.id,
+		"name":     volume.name,
+		"size":     volume.size,
+		"state":    volume.state,
+		"type":     "DATADISK",
+		"zoneid":   s.ZoneID,
+		"zonename": s.ZoneName,
+	}
+	if volume.vmID != "" {
+		result["virtualmachineid"] = volume.vmID
+	}
+	return result
+}
+
+func (s *Server) createVolume(query url.Values) (interface{}, *apiError) {
+	if query.Get("name") == "" {
+		return nil, s.missingParameter("name")
+	} else if query.Get("diskofferingid") == "" {
+		return nil, s.missingParameter("diskofferingid")
+	}
+	offering := s.findDiskOffering(query.Get("diskofferingid"))
+	if offering == nil {
+		return nil, s.invalidParameter("diskofferingid", query.Get("diskofferingid"))
+	}
+	size := offering.size
+	if offering.customized {
+		var err error
+		size, err = strconv.Atoi(query.Get("size"))
+		if err != nil || size <= 0 {
+			return nil, errorf(431, "Disk offering is customized, a valid size must be specified")
+		}
+	} else if query.Get("size") != "" {
+		return nil, errorf(431, "Disk offering does not support a custom size")
+	}
+
+	volume := &volume{
+		id:    s.newID(),
+		name:  query.Get("name"),
+		size:  int64(size) * GIGABYTE,
+		state: "Allocated",
+	}
+	s.volumes[volume.id] = volume
+	jobID := s.startJob("volume", func() interface{} {
+		return s.volumeStruct(volume)
+	})
+	return map[string]interface{}{
+		"id":    volume.id,
+		"jobid": jobID,
+	}, nil
+}
+
+func (s *Server) listVolumes(query url.Values) (interface{}, *apiError) {
+	var ids []string
+	for id, volume := range s.volumes {
+		s.advance(&volume.state, &volume.nextState, &volume.pendingPolls)
+		if query.Get("id") == "" || query.Get("id") == id {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	response := make(map[string]interface{})
+	if len(ids) > 0 {
+		volumes := []interface{}{}
+		for _, id := range ids {
+			volumes = append(volumes, s.volumeStruct(s.volumes[id]))
+		}
+		response["count"] = len(volumes)
+		response["volume"] = volumes
+	}
+	return response, nil
+}
+
+func (s *Server) deleteVolume(query url.Values) (interface{}, *apiError) {
+	volume, err := s.findVolume(query)
+	if err != nil {
+		return nil, err
+	} else if volume.vmID != "" {
+		return nil, errorf(431, "Please specify a volume that is not attached to any VM.")
+	}
+	delete(s.volumes, volume.id)
+	return map[string]interface{}{"success": "true"}, nil
+}
+
+func (s *Server) volumeAction(query url.Values) (interface{}, *apiError) {
+	volume, err := s.findVolume(query)
+	if err != nil {
+		return nil, err
+	} else if volume.nextState != "" {
+		return nil, errorf(431, "Volume %s is in state %s and cannot be operated on", volume.id, volume.state)
+	} else if errorText := s.JobErrors[query.Get("command")]; errorText != "" {
+		return map[string]interface{}{"jobid": s.startFailedJob(errorText)}, nil
+	}
+
+	switch query.Get("command") {
+	case "attachVolume":
+		vm, err := s.findVM("virtualmachineid", query)
+		if err != nil {
+			return nil, err
+		} else if volume.vmID != "" {
+			return nil, errorf(431, "Volume %s is already attached to VM %s", volume.id, volume.vmID)
+		}
+		volume.vmID = vm.id
+		volume.state = "Ready"
+	case "detachVolume":
+		if volume.vmID == "" {
+			return nil, errorf(431, "Volume %s is not attached to a VM", volume.id)
+		}
+		volume.vmID = ""
+	case "resizeVolume":
+		size, err := strconv.ParseInt(query.Get("size"), 10, 64)
+		if err != nil || size*GIGABYTE <= volume.size {
+			return nil, errorf(431, "Going from existing size of %d to size of %s would shrink the volume", volume.size, query.Get("size"))
+		}
+		volume.size = size * GIGABYTE
+		volume.nextState = volume.state
+		volume.state = "Resizing"
+		volume.pendingPolls = s.PendingPolls
+	}
+	jobID := s.startJob("volume", func() interface{} {
+		return s.volumeStruct(volume)
+	})
+	return map[string]interface{}{"jobid": jobID}, nil
+}
+
+func (s *Server) queryAsyncJobResult(query url.Values) (interface{}, *apiError) {
+	job := s.jobs[query.Get("jobid")]
+	if job == nil {
+		return nil, s.invalidParameter("jobid", query.Get("jobid"))
+	}
+	response := map[string]interface{}{
+		"jobid":         job.id,
+		"jobstatus":     0,
+		"jobresultcode": 0,
+	}
+	if job.pendingPolls > 0 {
+		job.pendingPolls--
+		return response, nil
+	}
+	response["jobresulttype"] = "object"
+	if job.errorText != "" {
+		response["jobstatus"] = 2
+		response["jobresultcode"] = 530
+		response["jobresult"] = map[string]interface{}{
+			"errorcode": 530,
+			"errortext": job.errorText,
+		}
+	} else {
+		response["jobstatus"] = 1
+		response["jobresult"] = map[string]interface{}{job.resultKey: job.result()}
+	}
+	return response, nil
+}
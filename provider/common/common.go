@@ -4,6 +4,7 @@ import "github.com/LunaNode/cloug/service/compute"
 import "github.com/LunaNode/cloug/utils"
 
 import "fmt"
+import "strings"
 
 func GetMatchingImageID(service compute.ImageService, image *compute.Image) (string, error) {
 	if image.ID == "" {
@@ -58,6 +59,12 @@ func MatchFlavor(target *compute.Flavor, options []*compute.Flavor) string {
 	return ""
 }
 
+// Returns true if version is target or a more specific version of it, so that
+// target "22" matches "22.04" but not "2" or "220".
+func MatchVersion(target string, version string) bool {
+	return version == target || strings.HasPrefix(version, target+".")
+}
+
 // Wraps VM creation with a raw SSH key for KeypairServices.
 // Calls ImportPublicKey, then CreateInstance, and finally RemovePublicKey.
 func KeypairServiceCreateWrapper(service compute.Service, keypair compute.KeypairService, instance *compute.Instance) (*compute.Instance, error) {
@@ -0,0 +1,87 @@
+package common
+
+import "github.com/LunaNode/cloug/service/compute"
+
+import "errors"
+import "net/http"
+import "strings"
+
+// Returns the error kind corresponding to an HTTP status code, or nil if the
+// status code does not correspond to any kind.
+func HTTPStatusKind(status int) error {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return compute.ErrInvalidArgument
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return compute.ErrAuth
+	case http.StatusNotFound:
+		return compute.ErrNotFound
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return compute.ErrNotSupported
+	case http.StatusConflict:
+		return compute.ErrConflict
+	case http.StatusTooManyRequests:
+		return compute.ErrRateLimited
+	default:
+		return nil
+	}
+}
+
+// Classifies err based on the HTTP status code of the failed API response.
+// Since APIs report quota and rate limit failures with a variety of status
+// codes, the error message is checked for those first.
+func HTTPStatusError(status int, err error) error {
+	kind := HTTPStatusKind(status)
+	if messageKind := MessageKind(err.Error()); messageKind == compute.ErrQuotaExceeded || messageKind == compute.ErrRateLimited {
+		kind = messageKind
+	} else if kind == nil {
+		kind = messageKind
+	}
+	return compute.WrapError(kind, err)
+}
+
+var messageKinds = []struct {
+	kind     error
+	keywords []string
+}{
+	{compute.ErrRateLimited, []string{"rate limit", "too many requests", "throttl"}},
+	{compute.ErrQuotaExceeded, []string{"quota", "limit exceeded", "exceeds limit", "resource limit", "insufficient funds", "insufficient credit"}},
+	{compute.ErrAuth, []string{"authentication", "unauthorized", "not authorized", "permission denied", "invalid api", "invalid signature", "invalid key", "invalid id or key", "access denied"}},
+	{compute.ErrNotFound, []string{"not found", "does not exist", "unable to find", "no such"}},
+	{compute.ErrConflict, []string{"already exists", "already in use", "is in use", "currently in use", "conflict", "duplicate", "is locked"}},
+	{compute.ErrInvalidArgument, []string{"invalid", "must be", "missing", "malformed", "required"}},
+	{compute.ErrNotSupported, []string{"not supported", "not implemented", "unsupported"}},
+}
+
+// Returns the error kind that an API error message most likely corresponds to,
+// or nil if the message does not look like any kind.
+// This is used for APIs that only report failures as free-form text.
+func MessageKind(message string) error {
+	message = strings.ToLower(message)
+	for _, messageKind := range messageKinds {
+		for _, keyword := range messageKind.keywords {
+			if strings.Contains(message, keyword) {
+				return messageKind.kind
+			}
+		}
+	}
+	return nil
+}
+
+// Creates an error from an API error message, classified by MessageKind.
+func MessageError(message string) error {
+	return compute.WrapError(MessageKind(message), errors.New(message))
+}
+
+// Classifies an error from an API library that does not expose structured errors.
+// Errors that are already classified are returned unchanged.
+func ClassifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var classified *compute.Error
+	if errors.As(err, &classified) {
+		return err
+	}
+	return compute.WrapError(MessageKind(err.Error()), err)
+}
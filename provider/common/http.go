@@ -0,0 +1,155 @@
+package common
+
+import "net/http"
+
+// Settings that override how a provider reaches its API.
+type HTTPOptions struct {
+	// Base URL of the API, replacing the provider's default endpoint.
+	APIURL string
+
+	// Client used for API requests.
+	Client *http.Client
+
+	// Transport used for API requests when Client is not set.
+	Transport http.RoundTripper
+
+	// Retry behavior for API requests; nil disables retries.
+	// Defaults to a RetryPolicy with default settings.
+	Retry *RetryPolicy
+
+	// Limits the rate of API requests, if set.
+	Limiter *RateLimiter
+
+	// Used in place of the policy's Idempotent function if that is nil. It is
+	// set by providers whose APIs do not follow HTTP method semantics.
+	Idempotent func(req *http.Request) bool
+}
+
+// Option modifies HTTPOptions; it is accepted by provider constructors.
+type Option func(*HTTPOptions)
+
+// Overrides the API base URL. An empty URL keeps the default.
+func WithAPIURL(apiURL string) Option {
+	return func(opts *HTTPOptions) {
+		if apiURL != "" {
+			opts.APIURL = apiURL
+		}
+	}
+}
+
+// Sends API requests through the given client.
+func WithHTTPClient(client *http.Client) Option {
+	return func(opts *HTTPOptions) {
+		opts.Client = client
+	}
+}
+
+// Sends API requests through the given transport.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(opts *HTTPOptions) {
+		opts.Transport = transport
+	}
+}
+
+// Retries failed requests according to policy; nil disables retries.
+func WithRetry(policy *RetryPolicy) Option {
+	return func(opts *HTTPOptions) {
+		opts.Retry = policy
+	}
+}
+
+// Limits API requests to rate per second, with bursts of up to burst requests.
+// A rate that is not positive removes the limit.
+func WithRateLimit(rate float64, burst int) Option {
+	return func(opts *HTTPOptions) {
+		if rate > 0 {
+			opts.Limiter = NewRateLimiter(rate, burst)
+		} else {
+			opts.Limiter = nil
+		}
+	}
+}
+
+// Sets the function that decides which requests are safe to send again.
+func WithIdempotent(idempotent func(req *http.Request) bool) Option {
+	return func(opts *HTTPOptions) {
+		opts.Idempotent = idempotent
+	}
+}
+
+// Rate limit settings for provider JSON configs.
+type RateLimitConfig struct {
+	// Requests per second. Zero keeps the provider's default limit, and a
+	// negative rate removes the limit.
+	RateLimit float64 `json:"rate_limit"`
+
+	// Maximum burst of requests. Zero keeps the provider's default burst.
+	RateLimitBurst int `json:"rate_limit_burst"`
+}
+
+// Returns an option that applies the configured limit, using the provider's
+// defaults for settings that are not configured.
+func (cfg *RateLimitConfig) Option(defaultRate float64, defaultBurst int) Option {
+	rate := cfg.RateLimit
+	if rate == 0 {
+		rate = defaultRate
+	}
+	burst := cfg.RateLimitBurst
+	if burst == 0 {
+		burst = defaultBurst
+	}
+	return WithRateLimit(rate, burst)
+}
+
+// Applies the options in order, so later options take precedence.
+func MakeHTTPOptions(options ...Option) *HTTPOptions {
+	opts := &HTTPOptions{
+		Retry: &RetryPolicy{},
+	}
+	for _, option := range options {
+		option(opts)
+	}
+	return opts
+}
+
+// Returns true if a client or transport was injected.
+func (opts *HTTPOptions) HasClient() bool {
+	return opts.Client != nil || opts.Transport != nil
+}
+
+// Returns the injected client, a client using the injected transport, or
+// fallback if neither is set. Unless retries and rate limiting are both
+// disabled, the returned client is a copy whose transport is wrapped in a
+// RetryTransport; a nil fallback is then treated as http.DefaultClient.
+func (opts *HTTPOptions) HTTPClient(fallback *http.Client) *http.Client {
+	var client *http.Client
+	if opts.Client != nil {
+		client = opts.Client
+	} else if opts.Transport != nil {
+		client = &http.Client{Transport: opts.Transport}
+	} else {
+		client = fallback
+	}
+
+	if opts.Retry == nil && opts.Limiter == nil {
+		return client
+	} else if client == nil {
+		client = http.DefaultClient
+	}
+
+	var policy *RetryPolicy
+	if opts.Retry != nil {
+		retryCopy := *opts.Retry
+		if retryCopy.Idempotent == nil {
+			retryCopy.Idempotent = opts.Idempotent
+		}
+		policy = &retryCopy
+	}
+	wrapped := *client
+	wrapped.Transport = &RetryTransport{
+		Base:    client.Transport,
+		Policy:  policy,
+		Limiter: opts.Limiter,
+	}
+	return &wrapped
+}
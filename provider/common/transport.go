@@ -0,0 +1,222 @@
+package common
+
+import "context"
+import "io"
+import "io/ioutil"
+import "math/rand"
+import "net/http"
+import "strconv"
+import "sync"
+import "time"
+
+const DEFAULT_MAX_RETRIES = 4
+const DEFAULT_MIN_BACKOFF = 500 * time.Millisecond
+const DEFAULT_MAX_BACKOFF = 30 * time.Second
+
+// Controls how RetryTransport retries failed requests.
+type RetryPolicy struct {
+	// Number of retries after the first attempt; negative to never retry.
+	// Defaults to DEFAULT_MAX_RETRIES.
+	MaxRetries int
+
+	// Delay before the first retry; it doubles after each retry.
+	// Defaults to DEFAULT_MIN_BACKOFF.
+	MinBackoff time.Duration
+
+	// Upper bound on the delay between retries. It does not limit the delay
+	// requested by a Retry-After header.
+	// Defaults to DEFAULT_MAX_BACKOFF.
+	MaxBackoff time.Duration
+
+	// Reports whether a request may be sent again after a network error or a
+	// 503 response, when the server may already have acted on it.
+	// Defaults to IdempotentMethod.
+	Idempotent func(req *http.Request) bool
+}
+
+// Returns true for HTTP methods that do not modify state.
+func IdempotentMethod(req *http.Request) bool {
+	return req.Method == "GET" || req.Method == "HEAD" || req.Method == "OPTIONS"
+}
+
+// Token bucket rate limiter: it holds up to burst tokens, refilled at rate
+// tokens per second, and each request takes one token. The rate must be
+// positive.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Blocks until a token is available or the context is done.
+func (limiter *RateLimiter) Wait(ctx context.Context) error {
+	limiter.mu.Lock()
+	now := time.Now()
+	limiter.tokens += now.Sub(limiter.last).Seconds() * limiter.rate
+	if limiter.tokens > limiter.burst {
+		limiter.tokens = limiter.burst
+	}
+	limiter.last = now
+
+	// take the token now, even if it is not available yet, so that waiting
+	// callers are served in order
+	limiter.tokens--
+	var delay time.Duration
+	if limiter.tokens < 0 {
+		delay = time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+	}
+	limiter.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	if err := sleep(ctx, delay); err != nil {
+		limiter.mu.Lock()
+		limiter.tokens++
+		limiter.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// http.RoundTripper that rate limits requests and retries them with
+// exponential backoff.
+//
+// Responses with status 429 are always retried, since the server did not act
+// on the request. Network errors and 503 responses are retried only for
+// idempotent requests. A Retry-After header on 429 and 503 responses
+// overrides the backoff delay.
+type RetryTransport struct {
+	// Transport that sends the requests; defaults to http.DefaultTransport.
+	Base http.RoundTripper
+
+	// Retry behavior; if nil, requests are not retried.
+	Policy *RetryPolicy
+
+	// If set, every attempt waits for a token.
+	Limiter *RateLimiter
+}
+
+func (t *RetryTransport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	} else {
+		return http.DefaultTransport
+	}
+}
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	policy := t.Policy
+	if policy == nil {
+		policy = &RetryPolicy{MaxRetries: -1}
+	}
+	maxRetries := policy.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = DEFAULT_MAX_RETRIES
+	}
+	backoff := policy.MinBackoff
+	if backoff <= 0 {
+		backoff = DEFAULT_MIN_BACKOFF
+	}
+	maxBackoff := policy.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DEFAULT_MAX_BACKOFF
+	}
+	idempotent := policy.Idempotent
+	if idempotent == nil {
+		idempotent = IdempotentMethod
+	}
+
+	// a request body can only be sent again if it can be recreated
+	canRewind := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	for attempt := 0; ; attempt++ {
+		if t.Limiter != nil {
+			if err := t.Limiter.Wait(req.Context()); err != nil {
+				return nil, err
+			}
+		}
+
+		attemptReq := req
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+
+		response, err := t.base().RoundTrip(attemptReq)
+		if attempt >= maxRetries || !canRewind || req.Context().Err() != nil {
+			return response, err
+		}
+
+		var delay time.Duration
+		if err != nil {
+			if !idempotent(req) {
+				return nil, err
+			}
+		} else if response.StatusCode == http.StatusTooManyRequests || (response.StatusCode == http.StatusServiceUnavailable && idempotent(req)) {
+			delay = retryAfter(response.Header.Get("Retry-After"))
+			io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64*1024))
+			response.Body.Close()
+		} else {
+			return response, nil
+		}
+
+		if delay <= 0 {
+			// wait between half and all of the backoff so that clients that
+			// were limited together do not retry together
+			delay = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+
+		if err := sleep(req.Context(), delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Parses a Retry-After header given in seconds or as an HTTP date.
+// Returns zero if the header is missing or invalid.
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	} else if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		return time.Until(date)
+	} else {
+		return 0
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
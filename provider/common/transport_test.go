@@ -0,0 +1,138 @@
+package common
+
+import "context"
+import "encoding/json"
+import "net/http"
+import "net/http/httptest"
+import "strings"
+import "sync/atomic"
+import "testing"
+import "time"
+
+// Returns a server that responds with the given statuses in order, then 200.
+func statusServer(statuses ...int) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&requests, 1))
+		if n <= len(statuses) {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(statuses[n-1])
+		}
+	}))
+	return server, &requests
+}
+
+func testClient(options ...Option) *http.Client {
+	options = append([]Option{WithRetry(&RetryPolicy{MinBackoff: time.Millisecond})}, options...)
+	return MakeHTTPOptions(options...).HTTPClient(&http.Client{})
+}
+
+func TestRetry(t *testing.T) {
+	server, requests := statusServer(429, 503)
+	defer server.Close()
+	response, err := testClient().Get(server.URL)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != 200 || *requests != 3 {
+		t.Fatalf("got status %d after %d requests, expected 200 after 3", response.StatusCode, *requests)
+	}
+
+	// POST is retried after 429 with its body, but not after 503
+	server, requests = statusServer(429, 503)
+	defer server.Close()
+	response, err = testClient().Post(server.URL, "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != 503 || *requests != 2 {
+		t.Fatalf("got status %d after %d requests, expected 503 after 2", response.StatusCode, *requests)
+	}
+
+	// the provider's idempotent function allows retrying the POST
+	server, requests = statusServer(503)
+	defer server.Close()
+	idempotent := func(req *http.Request) bool { return true }
+	response, err = testClient(WithIdempotent(idempotent)).Post(server.URL, "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != 200 || *requests != 2 {
+		t.Fatalf("got status %d after %d requests, expected 200 after 2", response.StatusCode, *requests)
+	}
+
+	// disabled retries
+	server, requests = statusServer(429)
+	defer server.Close()
+	response, err = testClient(WithRetry(nil)).Get(server.URL)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != 429 || *requests != 1 {
+		t.Fatalf("got status %d after %d requests, expected 429 after 1", response.StatusCode, *requests)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	if d := retryAfter("3"); d != 3*time.Second {
+		t.Fatalf("retryAfter(3) = %v", d)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if d := retryAfter(date); d <= 50*time.Second || d > time.Minute {
+		t.Fatalf("retryAfter(%s) = %v", date, d)
+	}
+	if d := retryAfter("soon"); d != 0 {
+		t.Fatalf("retryAfter(soon) = %v", d)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(100, 2)
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := limiter.Wait(context.Background()); err != nil {
+			t.Fatalf("wait: %v", err)
+		}
+	}
+	// two tokens from the burst, then two at 10ms each
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Fatalf("four requests took %v, expected at least 20ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	limiter = NewRateLimiter(0.001, 1)
+	limiter.Wait(ctx)
+	if err := limiter.Wait(ctx); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestRateLimitConfig(t *testing.T) {
+	tests := []struct {
+		json  string
+		rate  float64
+		burst float64
+	}{
+		{`{}`, 2, 10},
+		{`{"rate_limit": 5}`, 5, 10},
+		{`{"rate_limit_burst": 1}`, 2, 1},
+		{`{"rate_limit": -1}`, 0, 0},
+	}
+	for _, test := range tests {
+		var cfg RateLimitConfig
+		if err := json.Unmarshal([]byte(test.json), &cfg); err != nil {
+			t.Fatalf("%s: %v", test.json, err)
+		}
+		limiter := MakeHTTPOptions(cfg.Option(2, 10)).Limiter
+		if test.rate == 0 && limiter != nil {
+			t.Fatalf("%s: expected no rate limit", test.json)
+		} else if test.rate != 0 && (limiter == nil || limiter.rate != test.rate || limiter.burst != test.burst) {
+			t.Fatalf("%s: expected rate %v with burst %v, got %+v", test.json, test.rate, test.burst, limiter)
+		}
+	}
+}
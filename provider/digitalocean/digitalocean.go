@@ -7,8 +7,11 @@ import "github.com/LunaNode/cloug/utils"
 import "github.com/digitalocean/godo"
 import "golang.org/x/oauth2"
 
+import "context"
 import "errors"
 import "fmt"
+import "net/http"
+import "net/url"
 import "strconv"
 import "strings"
 import "time"
@@ -16,6 +19,14 @@ import "time"
 const DEFAULT_NAME = "cloug"
 const DEFAULT_REGION = "nyc3"
 
+// DigitalOcean allows 5000 requests per hour and 250 per minute, so the
+// bucket refills at the hourly rate and holds a minute's worth of requests.
+const RATE_LIMIT = 5000.0 / 3600
+const RATE_LIMIT_BURST = 250
+
+const DEFAULT_ACTION_POLL_INTERVAL = time.Second
+const DEFAULT_ACTION_TIMEOUT = 5 * time.Minute
+
 type TokenSource struct {
 	AccessToken string
 }
@@ -28,23 +39,90 @@ func (t *TokenSource) Token() (*oauth2.Token, error) {
 }
 
 type DigitalOcean struct {
+	// Interval between status requests while waiting for actions.
+	// Defaults to DEFAULT_ACTION_POLL_INTERVAL.
+	ActionPollInterval time.Duration
+
+	// Total time to wait for an action to complete; negative to wait until the
+	// context is done. Defaults to DEFAULT_ACTION_TIMEOUT.
+	ActionTimeout time.Duration
+
 	client *godo.Client
+
+	// client without a context attached, so that withContext can replace it
+	httpClient *http.Client
+	ctx        context.Context
 }
 
-func MakeDigitalOcean(token string) *DigitalOcean {
+// A malformed API URL option is ignored; DigitalOceanFromJSON reports it as an error.
+func MakeDigitalOcean(token string, options ...common.Option) *DigitalOcean {
+	opts := common.MakeHTTPOptions(append([]common.Option{common.WithRateLimit(RATE_LIMIT, RATE_LIMIT_BURST)}, options...)...)
 	do := new(DigitalOcean)
 	tokenSource := &TokenSource{
 		AccessToken: token,
 	}
-	oauthClient := oauth2.NewClient(oauth2.NoContext, tokenSource)
-	do.client = godo.NewClient(oauthClient)
+
+	// oauth2 wraps the client from the context
+	ctx := context.WithValue(oauth2.NoContext, oauth2.HTTPClient, opts.HTTPClient(nil))
+	do.httpClient = oauth2.NewClient(ctx, tokenSource)
+	do.client = godo.NewClient(do.httpClient)
+
+	if baseURL, err := parseBaseURL(opts.APIURL); err == nil && baseURL != nil {
+		do.client.BaseURL = baseURL
+	}
 	return do
 }
 
+// godo resolves request paths relative to the base URL, so it needs a trailing slash.
+func parseBaseURL(apiURL string) (*url.URL, error) {
+	if apiURL == "" {
+		return nil, nil
+	}
+	return url.Parse(strings.TrimRight(apiURL, "/") + "/")
+}
+
 func (do *DigitalOcean) ComputeService() compute.Service {
 	return do
 }
 
+func (do *DigitalOcean) Capabilities() *compute.Capabilities {
+	return &compute.Capabilities{
+		Operations:     compute.ImplementedOperations(do),
+		ImageSources:   []compute.ImageSource{compute.ImageSourceInstance},
+		InstanceFields: []compute.InstanceField{compute.FieldName, compute.FieldRegion, compute.FieldPassword, compute.FieldPublicKey},
+	}
+}
+
+// Returns a copy of the service whose API calls use the given context.
+// godo does not accept a context, so we attach it at the HTTP client instead.
+func (do *DigitalOcean) withContext(ctx context.Context) *DigitalOcean {
+	httpClient := utils.ContextHTTPClient(ctx, do.httpClient)
+	client := godo.NewClient(httpClient)
+	client.BaseURL = do.client.BaseURL
+	return &DigitalOcean{
+		ActionPollInterval: do.ActionPollInterval,
+		ActionTimeout:      do.ActionTimeout,
+		client:             client,
+		httpClient:         do.httpClient,
+		ctx:                ctx,
+	}
+}
+
+func (do *DigitalOcean) context() context.Context {
+	if do.ctx == nil {
+		return context.Background()
+	}
+	return do.ctx
+}
+
+// Classifies errors returned by godo according to the HTTP status code.
+func (do *DigitalOcean) mapError(err error) error {
+	if errorResponse, ok := err.(*godo.ErrorResponse); ok && errorResponse.Response != nil {
+		return common.HTTPStatusError(errorResponse.Response.StatusCode, err)
+	}
+	return err
+}
+
 func (do *DigitalOcean) mapInstanceStatus(status string) compute.InstanceStatus {
 	if status == "active" {
 		return compute.StatusOnline
@@ -75,21 +153,56 @@ func (do *DigitalOcean) dropletToInstance(droplet *godo.Droplet) *compute.Instan
 }
 
 func (do *DigitalOcean) processAction(dropletID int, actionID int) error {
-	for i := 0; i < 10; i++ {
-		action, _, err := do.client.DropletActions.Get(dropletID, actionID)
-		if err != nil {
-			return err
+	return do.waitAction(func(client *godo.Client) (*godo.Action, *godo.Response, error) {
+		return client.DropletActions.Get(dropletID, actionID)
+	})
+}
+
+func (do *DigitalOcean) processVolumeAction(volumeID string, actionID int) error {
+	return do.waitAction(func(client *godo.Client) (*godo.Action, *godo.Response, error) {
+		return client.StorageActions.Get(volumeID, actionID)
+	})
+}
+
+// Polls the action until it completes. If the action timeout expires or the
+// context is done first, the returned error wraps the context error.
+func (do *DigitalOcean) waitAction(get func(client *godo.Client) (*godo.Action, *godo.Response, error)) error {
+	interval := do.ActionPollInterval
+	if interval <= 0 {
+		interval = DEFAULT_ACTION_POLL_INTERVAL
+	}
+	ctx := do.context()
+	timeout := do.ActionTimeout
+	if timeout == 0 {
+		timeout = DEFAULT_ACTION_TIMEOUT
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	client := do.withContext(ctx).client
+
+	for {
+		action, _, err := get(client)
+		if ctx.Err() != nil {
+			return fmt.Errorf("error waiting for action: %w", ctx.Err())
+		} else if err != nil {
+			return do.mapError(err)
 		} else if action.Status == "completed" {
 			return nil
 		} else if action.Status != "in-progress" {
 			return errors.New("action status is " + action.Status)
 		}
-		time.Sleep(time.Second)
-	}
 
-	// still not done after 10 seconds?
-	// for now, we assume it will eventually complete...
-	return nil
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("action %d did not complete: %w", action.ID, ctx.Err())
+		}
+	}
 }
 
 func (do *DigitalOcean) imageID(image *compute.Image) (int, error) {
@@ -111,11 +224,14 @@ func (do *DigitalOcean) imageID(image *compute.Image) (int, error) {
 			return 0, err
 		}
 		imageIDStr = image.ID
+		if imageIDStr == "" {
+			return 0, fmt.Errorf("image is still pending")
+		}
 	}
 
-	imageID, err := strconv.Atoi(image.ID)
+	imageID, err := strconv.Atoi(imageIDStr)
 	if err != nil {
-		panic(err)
+		return 0, fmt.Errorf("invalid image ID %s", imageIDStr)
 	}
 
 	return imageID, nil
@@ -164,7 +280,7 @@ func (do *DigitalOcean) CreateInstance(instance *compute.Instance) (*compute.Ins
 	if instance.PublicKey.ID != "" {
 		keyID, err := strconv.Atoi(instance.PublicKey.ID)
 		if err != nil {
-			return nil, fmt.Errorf("invalid key ID")
+			return nil, compute.Errorf(compute.ErrInvalidArgument, "invalid key ID")
 		}
 		createRequest.SSHKeys = []godo.DropletCreateSSHKey{godo.DropletCreateSSHKey{
 			ID: keyID,
@@ -174,7 +290,7 @@ func (do *DigitalOcean) CreateInstance(instance *compute.Instance) (*compute.Ins
 	droplet, _, err := do.client.Droplets.Create(createRequest)
 
 	if err != nil {
-		return nil, err
+		return nil, do.mapError(err)
 	} else {
 		return &compute.Instance{
 			ID:       fmt.Sprintf("%d", droplet.ID),
@@ -189,16 +305,16 @@ func (do *DigitalOcean) CreateInstance(instance *compute.Instance) (*compute.Ins
 func (do *DigitalOcean) DeleteInstance(instanceID string) error {
 	dropletID, err := strconv.Atoi(instanceID)
 	if err != nil {
-		return fmt.Errorf("invalid instance ID %s", instanceID)
+		return compute.Errorf(compute.ErrNotFound, "instance %s not found: invalid instance ID", instanceID)
 	}
 	_, err = do.client.Droplets.Delete(dropletID)
-	return err
+	return do.mapError(err)
 }
 
 func (do *DigitalOcean) ListInstances() ([]*compute.Instance, error) {
 	droplets, _, err := do.client.Droplets.List(&godo.ListOptions{PerPage: 500})
 	if err != nil {
-		return nil, err
+		return nil, do.mapError(err)
 	}
 
 	instances := make([]*compute.Instance, len(droplets))
@@ -211,12 +327,12 @@ func (do *DigitalOcean) ListInstances() ([]*compute.Instance, error) {
 func (do *DigitalOcean) GetInstance(instanceID string) (*compute.Instance, error) {
 	dropletID, err := strconv.Atoi(instanceID)
 	if err != nil {
-		return nil, fmt.Errorf("invalid instance ID %s", instanceID)
+		return nil, compute.Errorf(compute.ErrNotFound, "instance %s not found: invalid instance ID", instanceID)
 	}
 
 	droplet, _, err := do.client.Droplets.Get(dropletID)
 	if err != nil {
-		return nil, fmt.Errorf("error getting droplet: %v", err)
+		return nil, fmt.Errorf("error getting droplet: %w", do.mapError(err))
 	}
 
 	instance := do.dropletToInstance(droplet)
@@ -248,12 +364,12 @@ type DropletActionFunc func(id int) (*godo.Action, *godo.Response, error)
 func (do *DigitalOcean) doAction(instanceID string, f DropletActionFunc) error {
 	dropletID, err := strconv.Atoi(instanceID)
 	if err != nil {
-		return fmt.Errorf("invalid instance ID %s", instanceID)
+		return compute.Errorf(compute.ErrNotFound, "instance %s not found: invalid instance ID", instanceID)
 	}
 
 	action, _, err := f(dropletID)
 	if err != nil {
-		return err
+		return do.mapError(err)
 	} else {
 		return do.processAction(dropletID, action.ID)
 	}
@@ -271,6 +387,34 @@ func (do *DigitalOcean) RebootInstance(instanceID string) error {
 	return do.doAction(instanceID, do.client.DropletActions.Reboot)
 }
 
+func (do *DigitalOcean) CreateInstanceContext(ctx context.Context, instance *compute.Instance) (*compute.Instance, error) {
+	return do.withContext(ctx).CreateInstance(instance)
+}
+
+func (do *DigitalOcean) DeleteInstanceContext(ctx context.Context, instanceID string) error {
+	return do.withContext(ctx).DeleteInstance(instanceID)
+}
+
+func (do *DigitalOcean) ListInstancesContext(ctx context.Context) ([]*compute.Instance, error) {
+	return do.withContext(ctx).ListInstances()
+}
+
+func (do *DigitalOcean) GetInstanceContext(ctx context.Context, instanceID string) (*compute.Instance, error) {
+	return do.withContext(ctx).GetInstance(instanceID)
+}
+
+func (do *DigitalOcean) StartInstanceContext(ctx context.Context, instanceID string) error {
+	return do.withContext(ctx).StartInstance(instanceID)
+}
+
+func (do *DigitalOcean) StopInstanceContext(ctx context.Context, instanceID string) error {
+	return do.withContext(ctx).StopInstance(instanceID)
+}
+
+func (do *DigitalOcean) RebootInstanceContext(ctx context.Context, instanceID string) error {
+	return do.withContext(ctx).RebootInstance(instanceID)
+}
+
 func (do *DigitalOcean) RenameInstance(instanceID string, name string) error {
 	return do.doAction(instanceID, func(id int) (*godo.Action, *godo.Response, error) {
 		return do.client.DropletActions.Rename(id, name)
@@ -317,7 +461,7 @@ func (do *DigitalOcean) CreateImage(image *compute.Image) (*compute.Image, error
 			}, nil
 		}
 	} else if image.SourceURL != "" {
-		return nil, errors.New("fetching image from URL is not supported")
+		return nil, compute.Errorf(compute.ErrNotSupported, "fetching image from URL is not supported")
 	} else {
 		return nil, errors.New("neither source instance nor source URL is set")
 	}
@@ -337,7 +481,7 @@ func (do *DigitalOcean) mapImage(apiImage *godo.Image) *compute.Image {
 func (do *DigitalOcean) FindImage(image *compute.Image) (string, error) {
 	apiImages, _, err := do.client.Images.ListDistribution(&godo.ListOptions{PerPage: 500})
 	if err != nil {
-		return "", fmt.Errorf("error listing distribution images: %v", err)
+		return "", fmt.Errorf("error listing distribution images: %w", do.mapError(err))
 	}
 
 	matchDistribution := "ubuntu"
@@ -357,6 +501,10 @@ func (do *DigitalOcean) FindImage(image *compute.Image) (string, error) {
 			continue
 		} else if !strings.Contains(apiImage.Name, matchArchitecture) {
 			continue
+		} else if image.Name != "" && image.Name != apiImage.Name && image.Name != do.mapImage(&apiImage).Name {
+			continue
+		} else if image.Version != "" && !common.MatchVersion(image.Version, strings.Fields(apiImage.Name)[0]) {
+			continue
 		}
 		if bestImage == nil || apiImage.ID > bestImage.ID {
 			bestImage = &apiImage
@@ -373,7 +521,7 @@ func (do *DigitalOcean) FindImage(image *compute.Image) (string, error) {
 func (do *DigitalOcean) ListImages() ([]*compute.Image, error) {
 	apiImages, _, err := do.client.Images.ListDistribution(&godo.ListOptions{PerPage: 500})
 	if err != nil {
-		return nil, err
+		return nil, do.mapError(err)
 	}
 	images := make([]*compute.Image, len(apiImages))
 	for i, apiImage := range apiImages {
@@ -388,7 +536,7 @@ func (do *DigitalOcean) GetImage(imageID string) (*compute.Image, error) {
 		if parts[0] == "snapshot" {
 			images, _, err := do.client.Images.ListUser(&godo.ListOptions{PerPage: 500})
 			if err != nil {
-				return nil, err
+				return nil, do.mapError(err)
 			}
 			for _, image := range images {
 				if image.Name == parts[1] {
@@ -400,16 +548,16 @@ func (do *DigitalOcean) GetImage(imageID string) (*compute.Image, error) {
 				Status: compute.ImagePending,
 			}, nil
 		} else {
-			return nil, fmt.Errorf("invalid image prefix %s", parts[0])
+			return nil, compute.Errorf(compute.ErrNotFound, "image %s not found: invalid image prefix %s", imageID, parts[0])
 		}
 	} else {
 		id, err := strconv.Atoi(imageID)
 		if err != nil {
-			return nil, fmt.Errorf("invalid image ID: %s", imageID)
+			return nil, compute.Errorf(compute.ErrNotFound, "image %s not found: invalid image ID", imageID)
 		}
 		image, _, err := do.client.Images.GetByID(id)
 		if err != nil {
-			return nil, err
+			return nil, do.mapError(err)
 		} else {
 			return do.mapImage(image), nil
 		}
@@ -424,13 +572,13 @@ func (do *DigitalOcean) DeleteImage(imageIDStr string) error {
 		return err
 	}
 	_, err = do.client.Images.Delete(imageID)
-	return err
+	return do.mapError(err)
 }
 
 func (do *DigitalOcean) ListFlavors() ([]*compute.Flavor, error) {
 	sizes, _, err := do.client.Sizes.List(&godo.ListOptions{PerPage: 500})
 	if err != nil {
-		return nil, err
+		return nil, do.mapError(err)
 	}
 	flavors := make([]*compute.Flavor, len(sizes))
 	for i, size := range sizes {
@@ -448,17 +596,17 @@ func (do *DigitalOcean) ListFlavors() ([]*compute.Flavor, error) {
 }
 
 func (do *DigitalOcean) FindFlavor(flavor *compute.Flavor) (string, error) {
-	if flavor.MemoryMB < 1024 {
-		return "512mb", nil
-	} else {
-		return fmt.Sprintf("%dgb", flavor.MemoryMB/1024), nil
+	flavors, err := do.ListFlavors()
+	if err != nil {
+		return "", err
 	}
+	return common.MatchFlavor(flavor, flavors), nil
 }
 
 func (do *DigitalOcean) ListPublicKeys() ([]*compute.PublicKey, error) {
 	keys, _, err := do.client.Keys.List(&godo.ListOptions{PerPage: 500})
 	if err != nil {
-		return nil, err
+		return nil, do.mapError(err)
 	}
 	publicKeys := make([]*compute.PublicKey, len(keys))
 	for i, key := range keys {
@@ -478,7 +626,7 @@ func (do *DigitalOcean) ImportPublicKey(key *compute.PublicKey) (*compute.Public
 			PublicKey: key,
 		})
 		if err != nil {
-			return "", err
+			return "", do.mapError(err)
 		} else {
 			return strconv.Itoa(doKey.ID), nil
 		}
@@ -488,8 +636,130 @@ func (do *DigitalOcean) ImportPublicKey(key *compute.PublicKey) (*compute.Public
 func (do *DigitalOcean) RemovePublicKey(keyID string) error {
 	id, err := strconv.Atoi(keyID)
 	if err != nil {
-		return fmt.Errorf("invalid key ID")
+		return compute.Errorf(compute.ErrNotFound, "key %s not found: invalid key ID", keyID)
 	}
 	_, err = do.client.Keys.DeleteByID(id)
-	return err
+	return do.mapError(err)
+}
+
+func (do *DigitalOcean) mapVolume(apiVolume *godo.Volume) *compute.Volume {
+	volume := &compute.Volume{
+		ID:     apiVolume.ID,
+		Name:   apiVolume.Name,
+		SizeGB: int(apiVolume.SizeGigaBytes),
+		Status: compute.VolumeAvailable,
+	}
+	if apiVolume.Region != nil {
+		volume.Region = apiVolume.Region.Slug
+	}
+	if len(apiVolume.DropletIDs) > 0 {
+		volume.InstanceID = strconv.Itoa(apiVolume.DropletIDs[0])
+		volume.Status = compute.VolumeInUse
+	}
+	return volume
+}
+
+func (do *DigitalOcean) CreateVolume(volume *compute.Volume) (*compute.Volume, error) {
+	if volume.SizeGB <= 0 {
+		return nil, errors.New("volume size must be set")
+	}
+
+	createRequest := &godo.VolumeCreateRequest{
+		Name:          volume.Name,
+		Region:        volume.Region,
+		SizeGigaBytes: int64(volume.SizeGB),
+	}
+
+	// volume names must be lowercase alphanumeric, so we cannot use DEFAULT_NAME directly
+	if createRequest.Name == "" {
+		createRequest.Name = DEFAULT_NAME + "-" + utils.UidAlphabet(8, []rune("abcdefghijklmnopqrstuvwxyz0123456789"))
+	}
+	if createRequest.Region == "" {
+		createRequest.Region = DEFAULT_REGION
+	}
+
+	apiVolume, _, err := do.client.Storage.CreateVolume(createRequest)
+	if err != nil {
+		return nil, do.mapError(err)
+	} else {
+		return do.mapVolume(apiVolume), nil
+	}
+}
+
+func (do *DigitalOcean) ListVolumes() ([]*compute.Volume, error) {
+	var volumes []*compute.Volume
+	opts := &godo.ListOptions{PerPage: 200}
+	for {
+		apiVolumes, resp, err := do.client.Storage.ListVolumes(opts)
+		if err != nil {
+			return nil, do.mapError(err)
+		}
+		for i := range apiVolumes {
+			volumes = append(volumes, do.mapVolume(&apiVolumes[i]))
+		}
+		if resp.Links == nil || resp.Links.IsLastPage() {
+			return volumes, nil
+		}
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return nil, fmt.Errorf("error reading volume list page: %v", err)
+		}
+		opts.Page = page + 1
+	}
+}
+
+func (do *DigitalOcean) GetVolume(volumeID string) (*compute.Volume, error) {
+	apiVolume, _, err := do.client.Storage.GetVolume(volumeID)
+	if err != nil {
+		return nil, do.mapError(err)
+	} else {
+		return do.mapVolume(apiVolume), nil
+	}
+}
+
+func (do *DigitalOcean) DeleteVolume(volumeID string) error {
+	_, err := do.client.Storage.DeleteVolume(volumeID)
+	return do.mapError(err)
+}
+
+func (do *DigitalOcean) AttachVolume(volumeID string, instanceID string) error {
+	dropletID, err := strconv.Atoi(instanceID)
+	if err != nil {
+		return compute.Errorf(compute.ErrNotFound, "instance %s not found: invalid instance ID", instanceID)
+	}
+	action, _, err := do.client.StorageActions.Attach(volumeID, dropletID)
+	if err != nil {
+		return do.mapError(err)
+	} else {
+		return do.processVolumeAction(volumeID, action.ID)
+	}
+}
+
+func (do *DigitalOcean) DetachVolume(volumeID string) error {
+	// the API requires the droplet that the volume is attached to
+	apiVolume, _, err := do.client.Storage.GetVolume(volumeID)
+	if err != nil {
+		return do.mapError(err)
+	} else if len(apiVolume.DropletIDs) == 0 {
+		return compute.Errorf(compute.ErrConflict, "volume %s is not attached", volumeID)
+	}
+	action, _, err := do.client.StorageActions.DetachByDropletID(volumeID, apiVolume.DropletIDs[0])
+	if err != nil {
+		return do.mapError(err)
+	} else {
+		return do.processVolumeAction(volumeID, action.ID)
+	}
+}
+
+func (do *DigitalOcean) ResizeVolume(volumeID string, sizeGB int) error {
+	volume, err := do.GetVolume(volumeID)
+	if err != nil {
+		return err
+	}
+	action, _, err := do.client.StorageActions.Resize(volumeID, sizeGB, volume.Region)
+	if err != nil {
+		return do.mapError(err)
+	} else {
+		return do.processVolumeAction(volumeID, action.ID)
+	}
 }
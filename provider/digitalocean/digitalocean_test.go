@@ -0,0 +1,27 @@
+package digitalocean
+
+import "github.com/LunaNode/cloug/provider/common"
+import "github.com/LunaNode/cloug/provider/digitalocean/simulator"
+import "github.com/LunaNode/cloug/service/compute"
+import "github.com/LunaNode/cloug/service/compute/conformance"
+
+import "testing"
+import "time"
+
+func TestConformance(t *testing.T) {
+	server := simulator.NewServer("token")
+	defer server.Close()
+
+	do := MakeDigitalOcean("token", common.WithAPIURL(server.APIURL()))
+	do.ActionPollInterval = 10 * time.Millisecond
+	conformance.Run(t, do, &conformance.Config{
+		Instance: compute.Instance{
+			Region: "nyc3",
+			Image:  compute.Image{Distribution: "ubuntu", Version: "22.04"},
+			Flavor: compute.Flavor{MemoryMB: 512},
+		},
+		PublicKey:    []byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJ0S1uMTNPZdfSW6GYaCwMPPVM4oFgNbXx0DMSWf1b4I conformance"),
+		VolumeSizeGB: 10,
+		Wait:         compute.WaitOptions{Interval: 10 * time.Millisecond},
+	})
+}
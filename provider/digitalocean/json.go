@@ -1,18 +1,27 @@
 package digitalocean
 
+import "github.com/LunaNode/cloug/provider/common"
 import "github.com/LunaNode/cloug/service/compute"
 
 import "encoding/json"
 
 type DigitalOceanJSONConfig struct {
-	Token string `json:"token"`
+	Token  string `json:"token"`
+	APIURL string `json:"api_url"`
+
+	// Defaults to RATE_LIMIT and RATE_LIMIT_BURST.
+	common.RateLimitConfig
 }
 
-func DigitalOceanFromJSON(jsonData []byte) (compute.Provider, error) {
+func DigitalOceanFromJSON(jsonData []byte, options ...common.Option) (compute.Provider, error) {
 	var cfg DigitalOceanJSONConfig
 	err := json.Unmarshal(jsonData, &cfg)
 	if err != nil {
 		return nil, err
 	}
-	return MakeDigitalOcean(cfg.Token), nil
+	options = append([]common.Option{common.WithAPIURL(cfg.APIURL), cfg.Option(RATE_LIMIT, RATE_LIMIT_BURST)}, options...)
+	if _, err := parseBaseURL(common.MakeHTTPOptions(options...).APIURL); err != nil {
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "invalid api_url: %v", err)
+	}
+	return MakeDigitalOcean(cfg.Token, options...), nil
 }
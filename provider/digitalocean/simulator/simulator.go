@@ -0,0 +1,774 @@
+// Package simulator provides a local stand-in for the DigitalOcean API v2.
+//
+// Requests must carry the bearer token, and requests and responses use the
+// types of godo. Regions, sizes and distribution images are fixed, while
+// droplets, snapshots, SSH keys, volumes and their actions are kept in
+// memory, so that the compute adapter can be tested without an account.
+package simulator
+
+import "github.com/digitalocean/godo"
+
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "net/http/httptest"
+import "regexp"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+// Maximum number of items in a list page, whatever per_page asks for.
+const MAX_PER_PAGE = 200
+
+var REGIONS = []godo.Region{
+	{Slug: "nyc3", Name: "New York 3", Available: true},
+	{Slug: "sfo3", Name: "San Francisco 3", Available: true},
+	{Slug: "ams3", Name: "Amsterdam 3", Available: true},
+}
+
+var SIZES = []godo.Size{
+	{Slug: "512mb", Memory: 512, Vcpus: 1, Disk: 20, Transfer: 1, PriceMonthly: 5, Available: true},
+	{Slug: "1gb", Memory: 1024, Vcpus: 1, Disk: 30, Transfer: 2, PriceMonthly: 10, Available: true},
+	{Slug: "2gb", Memory: 2048, Vcpus: 2, Disk: 40, Transfer: 3, PriceMonthly: 20, Available: true},
+}
+
+// Public distribution images, which are available in every region.
+var DISTRIBUTION_IMAGES = []godo.Image{
+	{ID: 1001, Name: "20.04 (LTS) x64", Distribution: "Ubuntu", Slug: "ubuntu-20-04-x64", MinDiskSize: 15},
+	{ID: 1002, Name: "22.04 (LTS) x64", Distribution: "Ubuntu", Slug: "ubuntu-22-04-x64", MinDiskSize: 15},
+	{ID: 1003, Name: "12 x64", Distribution: "Debian", Slug: "debian-12-x64", MinDiskSize: 15},
+}
+
+var nameRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([-.a-zA-Z0-9]*[a-zA-Z0-9])?$`)
+var volumeNameRegexp = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,62})$`)
+
+type apiError struct {
+	code    int
+	id      string
+	message string
+}
+
+func newError(code int, id string, format string, args ...interface{}) *apiError {
+	return &apiError{code, id, fmt.Sprintf(format, args...)}
+}
+
+func notFound() *apiError {
+	return newError(http.StatusNotFound, "not_found", "The resource you were accessing could not be found.")
+}
+
+func unprocessable(format string, args ...interface{}) *apiError {
+	return newError(http.StatusUnprocessableEntity, "unprocessable_entity", format, args...)
+}
+
+type droplet struct {
+	*godo.Droplet
+	ip string
+}
+
+type action struct {
+	*godo.Action
+
+	// volume of a volume action, whose resource ID is left zero
+	volumeID string
+
+	// number of gets before the action completes
+	pendingPolls int
+
+	// applies the action once it completes
+	complete func()
+}
+
+// Server is a DigitalOcean API simulator listening on a local port.
+type Server struct {
+	*httptest.Server
+
+	Token string
+
+	// Number of gets for which actions, including the creation of a droplet,
+	// stay in progress.
+	PendingPolls int
+
+	mu       sync.Mutex
+	nextID   int
+	droplets map[int]*droplet
+	images   []*godo.Image
+	keys     []*godo.Key
+	volumes  map[string]*godo.Volume
+	actions  []*action
+}
+
+// Starts a simulator that accepts the given token.
+func NewServer(token string) *Server {
+	s := &Server{
+		Token:        token,
+		PendingPolls: 1,
+		nextID:       5000,
+		droplets:     make(map[int]*droplet),
+		volumes:      make(map[string]*godo.Volume),
+	}
+	for i := range DISTRIBUTION_IMAGES {
+		image := DISTRIBUTION_IMAGES[i]
+		image.Type = "snapshot"
+		image.Public = true
+		image.Regions = regionSlugs()
+		image.Created = "2024-01-01T00:00:00Z"
+		s.images = append(s.images, &image)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Returns the API URL, which godo resolves the v2 paths against.
+func (s *Server) APIURL() string {
+	return s.URL + "/"
+}
+
+func regionSlugs() []string {
+	var slugs []string
+	for _, region := range REGIONS {
+		slugs = append(slugs, region.Slug)
+	}
+	return slugs
+}
+
+func findRegion(slug string) *godo.Region {
+	for i := range REGIONS {
+		if REGIONS[i].Slug == slug {
+			region := REGIONS[i]
+			return &region
+		}
+	}
+	return nil
+}
+
+func findSize(slug string) *godo.Size {
+	for i := range SIZES {
+		if SIZES[i].Slug == slug {
+			size := SIZES[i]
+			return &size
+		}
+	}
+	return nil
+}
+
+func timestamp() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	s.mu.Lock()
+	code, response, err := s.handle(r)
+	s.mu.Unlock()
+	if err != nil {
+		w.WriteHeader(err.code)
+		json.NewEncoder(w).Encode(map[string]string{
+			"id":      err.id,
+			"message": err.message,
+		})
+		return
+	}
+	w.WriteHeader(code)
+	if response != nil {
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func (s *Server) handle(r *http.Request) (int, interface{}, *apiError) {
+	if r.Header.Get("Authorization") != "Bearer "+s.Token {
+		return 0, nil, newError(http.StatusUnauthorized, "unauthorized", "Unable to authenticate you.")
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	if path == r.URL.Path {
+		return 0, nil, notFound()
+	}
+	parts := strings.Split(strings.TrimSuffix(path, "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "sizes" && r.Method == "GET":
+		var sizes []interface{}
+		for _, size := range SIZES {
+			size.Regions = regionSlugs()
+			sizes = append(sizes, size)
+		}
+		return s.page(r, "sizes", sizes)
+	case len(parts) == 1 && parts[0] == "images" && r.Method == "GET":
+		return s.listImages(r)
+	case len(parts) == 2 && parts[0] == "images":
+		return s.imageRequest(r.Method, parts[1])
+	case len(parts) == 2 && parts[0] == "account" && parts[1] == "keys" && r.Method == "GET":
+		var keys []interface{}
+		for _, key := range s.keys {
+			keys = append(keys, key)
+		}
+		return s.page(r, "ssh_keys", keys)
+	case len(parts) == 2 && parts[0] == "account" && parts[1] == "keys" && r.Method == "POST":
+		return s.createKey(r)
+	case len(parts) == 3 && parts[0] == "account" && parts[1] == "keys" && r.Method == "DELETE":
+		return s.deleteKey(parts[2])
+	case len(parts) == 1 && parts[0] == "droplets" && r.Method == "POST":
+		return s.createDroplet(r)
+	case len(parts) == 1 && parts[0] == "droplets" && r.Method == "GET":
+		return s.listDroplets(r)
+	case len(parts) >= 2 && parts[0] == "droplets":
+		id, err := strconv.Atoi(parts[1])
+		if err != nil || s.droplets[id] == nil {
+			return 0, nil, notFound()
+		}
+		return s.dropletRequest(r, s.droplets[id], parts[2:])
+	case len(parts) == 1 && parts[0] == "volumes" && r.Method == "POST":
+		return s.createVolume(r)
+	case len(parts) == 1 && parts[0] == "volumes" && r.Method == "GET":
+		return s.listVolumes(r)
+	case len(parts) >= 2 && parts[0] == "volumes":
+		volume := s.volumes[parts[1]]
+		if volume == nil {
+			return 0, nil, notFound()
+		}
+		return s.volumeRequest(r, volume, parts[2:])
+	}
+	return 0, nil, notFound()
+}
+
+// Returns a page of the items under the key, along with the links and meta
+// objects, according to the page and per_page parameters.
+func (s *Server) page(r *http.Request, key string, items []interface{}) (int, interface{}, *apiError) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if perPage < 1 {
+		perPage = 20
+	} else if perPage > MAX_PER_PAGE {
+		perPage = MAX_PER_PAGE
+	}
+	lastPage := (len(items) + perPage - 1) / perPage
+	if lastPage < 1 {
+		lastPage = 1
+	}
+
+	pageItems := []interface{}{}
+	for i := (page - 1) * perPage; i < len(items) && i < page*perPage; i++ {
+		pageItems = append(pageItems, items[i])
+	}
+	pageURL := func(n int) string {
+		query := r.URL.Query()
+		query.Set("page", strconv.Itoa(n))
+		query.Set("per_page", strconv.Itoa(perPage))
+		return s.URL + r.URL.Path + "?" + query.Encode()
+	}
+	pages := make(map[string]string)
+	if page > 1 {
+		pages["first"] = pageURL(1)
+		pages["prev"] = pageURL(page - 1)
+	}
+	if page < lastPage {
+		pages["next"] = pageURL(page + 1)
+		pages["last"] = pageURL(lastPage)
+	}
+	return http.StatusOK, map[string]interface{}{
+		key:     pageItems,
+		"links": map[string]interface{}{"pages": pages},
+		"meta":  map[string]int{"total": len(items)},
+	}, nil
+}
+
+func decode(r *http.Request, request interface{}) *apiError {
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		return newError(http.StatusBadRequest, "bad_request", "Unable to parse request body: %v", err)
+	}
+	return nil
+}
+
+// Actions
+
+func (s *Server) newAction(actionType string, resourceID int, resourceType string, region string, complete func()) *action {
+	s.nextID++
+	a := &action{
+		Action: &godo.Action{
+			ID:           s.nextID,
+			Status:       "in-progress",
+			Type:         actionType,
+			StartedAt:    &godo.Timestamp{Time: time.Now().UTC()},
+			ResourceID:   resourceID,
+			ResourceType: resourceType,
+			RegionSlug:   region,
+			Region:       findRegion(region),
+		},
+		pendingPolls: s.PendingPolls,
+		complete:     complete,
+	}
+	s.actions = append(s.actions, a)
+	return a
+}
+
+// Counts a get of the action, and completes it once it has been polled
+// enough.
+func (s *Server) poll(a *action) {
+	if a.Status != "in-progress" {
+		return
+	} else if a.pendingPolls > 0 {
+		a.pendingPolls--
+		return
+	}
+	a.Status = "completed"
+	a.CompletedAt = &godo.Timestamp{Time: time.Now().UTC()}
+	if a.complete != nil {
+		a.complete()
+	}
+}
+
+func (s *Server) findAction(id string, resourceType string, resourceID int) *action {
+	for _, a := range s.actions {
+		if strconv.Itoa(a.ID) == id && a.ResourceType == resourceType && a.ResourceID == resourceID {
+			return a
+		}
+	}
+	return nil
+}
+
+// Returns true if an action on the droplet is in progress.
+func (s *Server) locked(dropletID int) bool {
+	for _, a := range s.actions {
+		if a.ResourceType == "droplet" && a.ResourceID == dropletID && a.Status == "in-progress" {
+			return true
+		}
+	}
+	return false
+}
+
+// Images
+
+func (s *Server) listImages(r *http.Request) (int, interface{}, *apiError) {
+	query := r.URL.Query()
+	var images []interface{}
+	for _, image := range s.images {
+		if query.Get("type") == "distribution" && (!image.Public || image.Distribution == "") {
+			continue
+		} else if query.Get("private") == "true" && image.Public {
+			continue
+		}
+		images = append(images, image)
+	}
+	return s.page(r, "images", images)
+}
+
+func (s *Server) imageRequest(method string, idOrSlug string) (int, interface{}, *apiError) {
+	for i, image := range s.images {
+		if strconv.Itoa(image.ID) != idOrSlug && (image.Slug == "" || image.Slug != idOrSlug) {
+			continue
+		}
+		switch method {
+		case "GET":
+			return http.StatusOK, map[string]interface{}{"image": image}, nil
+		case "DELETE":
+			if image.Public {
+				return 0, nil, notFound()
+			}
+			s.images = append(s.images[:i], s.images[i+1:]...)
+			return http.StatusNoContent, nil, nil
+		}
+		return 0, nil, newError(http.StatusMethodNotAllowed, "method_not_allowed", "Method %s is not allowed", method)
+	}
+	return 0, nil, notFound()
+}
+
+func (s *Server) findImage(id int) *godo.Image {
+	for _, image := range s.images {
+		if image.ID == id {
+			return image
+		}
+	}
+	return nil
+}
+
+// SSH keys
+
+func (s *Server) createKey(r *http.Request) (int, interface{}, *apiError) {
+	var request godo.KeyCreateRequest
+	if err := decode(r, &request); err != nil {
+		return 0, nil, err
+	} else if request.Name == "" {
+		return 0, nil, unprocessable("Name is required")
+	}
+	fields := strings.Fields(request.PublicKey)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "ssh-") {
+		return 0, nil, unprocessable("Key invalid, type not supported")
+	}
+	for _, key := range s.keys {
+		if strings.Fields(key.PublicKey)[1] == fields[1] {
+			return 0, nil, unprocessable("SSH Key is already in use on your account")
+		}
+	}
+	s.nextID++
+	key := &godo.Key{
+		ID:          s.nextID,
+		Name:        request.Name,
+		PublicKey:   request.PublicKey,
+		Fingerprint: fmt.Sprintf("00:00:00:00:00:00:00:00:00:00:00:00:00:%02x:%02x:%02x", (s.nextID>>16)&0xff, (s.nextID>>8)&0xff, s.nextID&0xff),
+	}
+	s.keys = append(s.keys, key)
+	return http.StatusCreated, map[string]interface{}{"ssh_key": key}, nil
+}
+
+func (s *Server) deleteKey(idOrFingerprint string) (int, interface{}, *apiError) {
+	for i, key := range s.keys {
+		if strconv.Itoa(key.ID) == idOrFingerprint || key.Fingerprint == idOrFingerprint {
+			s.keys = append(s.keys[:i], s.keys[i+1:]...)
+			return http.StatusNoContent, nil, nil
+		}
+	}
+	return 0, nil, notFound()
+}
+
+// Droplets
+
+func (s *Server) createDroplet(r *http.Request) (int, interface{}, *apiError) {
+	var request struct {
+		Name              string            `json:"name"`
+		Region            string            `json:"region"`
+		Size              string            `json:"size"`
+		Image             json.RawMessage   `json:"image"`
+		SSHKeys           []json.RawMessage `json:"ssh_keys"`
+		IPv6              bool              `json:"ipv6"`
+		PrivateNetworking bool              `json:"private_networking"`
+		UserData          string            `json:"user_data"`
+	}
+	if err := decode(r, &request); err != nil {
+		return 0, nil, err
+	} else if !nameRegexp.MatchString(request.Name) {
+		return 0, nil, unprocessable("Name Only valid hostname characters are allowed. (a-z, A-Z, 0-9, . and -)")
+	}
+	region := findRegion(request.Region)
+	size := findSize(request.Size)
+	if region == nil {
+		return 0, nil, unprocessable("You specified an invalid region for Droplet creation.")
+	} else if size == nil {
+		return 0, nil, unprocessable("You specified an invalid size for Droplet creation.")
+	}
+
+	var image *godo.Image
+	var imageID int
+	var imageSlug string
+	if json.Unmarshal(request.Image, &imageID) == nil {
+		image = s.findImage(imageID)
+	} else if json.Unmarshal(request.Image, &imageSlug) == nil {
+		for _, candidate := range s.images {
+			if candidate.Slug != "" && candidate.Slug == imageSlug {
+				image = candidate
+			}
+		}
+	}
+	if image == nil {
+		return 0, nil, unprocessable("You specified an invalid image for Droplet creation.")
+	} else if size.Disk < image.MinDiskSize {
+		return 0, nil, unprocessable("This image requires a disk of at least %d GB.", image.MinDiskSize)
+	}
+	for _, rawKey := range request.SSHKeys {
+		var keyID int
+		var fingerprint string
+		found := false
+		if json.Unmarshal(rawKey, &keyID) == nil {
+			fingerprint = strconv.Itoa(keyID)
+		} else {
+			json.Unmarshal(rawKey, &fingerprint)
+		}
+		for _, key := range s.keys {
+			found = found || strconv.Itoa(key.ID) == fingerprint || key.Fingerprint == fingerprint
+		}
+		if !found {
+			return 0, nil, unprocessable("You specified an invalid SSH key: %s", string(rawKey))
+		}
+	}
+
+	s.nextID++
+	d := &droplet{
+		Droplet: &godo.Droplet{
+			ID:        s.nextID,
+			Name:      request.Name,
+			Memory:    size.Memory,
+			Vcpus:     size.Vcpus,
+			Disk:      size.Disk,
+			Region:    region,
+			Image:     image,
+			Size:      size,
+			SizeSlug:  size.Slug,
+			Status:    "new",
+			Networks:  &godo.Networks{V4: []godo.NetworkV4{}, V6: []godo.NetworkV6{}},
+			Created:   timestamp(),
+			VolumeIDs: []string{},
+		},
+		ip: fmt.Sprintf("203.0.113.%d", s.nextID%250+2),
+	}
+	if request.PrivateNetworking {
+		d.Features = append(d.Features, "private_networking")
+	}
+	if request.IPv6 {
+		d.Features = append(d.Features, "ipv6")
+	}
+	s.droplets[d.ID] = d
+	s.newAction("create", d.ID, "droplet", region.Slug, func() {
+		d.Status = "active"
+		d.Networks.V4 = []godo.NetworkV4{{IPAddress: d.ip, Netmask: "255.255.255.0", Gateway: "203.0.113.1", Type: "public"}}
+		if request.PrivateNetworking {
+			d.Networks.V4 = append(d.Networks.V4, godo.NetworkV4{IPAddress: fmt.Sprintf("10.132.0.%d", d.ID%250+2), Netmask: "255.255.0.0", Type: "private"})
+		}
+	})
+	return http.StatusAccepted, map[string]interface{}{"droplet": d.Droplet}, nil
+}
+
+func (s *Server) listDroplets(r *http.Request) (int, interface{}, *apiError) {
+	var ids []int
+	for id := range s.droplets {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	var droplets []interface{}
+	for _, id := range ids {
+		droplets = append(droplets, s.droplets[id].Droplet)
+	}
+	return s.page(r, "droplets", droplets)
+}
+
+func (s *Server) dropletRequest(r *http.Request, d *droplet, parts []string) (int, interface{}, *apiError) {
+	switch {
+	case len(parts) == 0 && r.Method == "GET":
+		for _, a := range s.actions {
+			if a.ResourceType == "droplet" && a.ResourceID == d.ID {
+				s.poll(a)
+			}
+		}
+		d.Locked = s.locked(d.ID)
+		return http.StatusOK, map[string]interface{}{"droplet": d.Droplet}, nil
+	case len(parts) == 0 && r.Method == "DELETE":
+		delete(s.droplets, d.ID)
+		for _, volume := range s.volumes {
+			if len(volume.DropletIDs) > 0 && volume.DropletIDs[0] == d.ID {
+				volume.DropletIDs = []int{}
+			}
+		}
+		return http.StatusNoContent, nil, nil
+	case len(parts) == 1 && parts[0] == "actions" && r.Method == "GET":
+		var actions []interface{}
+		for _, a := range s.actions {
+			if a.ResourceType == "droplet" && a.ResourceID == d.ID {
+				actions = append(actions, a.Action)
+			}
+		}
+		return s.page(r, "actions", actions)
+	case len(parts) == 1 && parts[0] == "actions" && r.Method == "POST":
+		return s.dropletAction(r, d)
+	case len(parts) == 2 && parts[0] == "actions" && r.Method == "GET":
+		a := s.findAction(parts[1], "droplet", d.ID)
+		if a == nil {
+			return 0, nil, notFound()
+		}
+		s.poll(a)
+		return http.StatusOK, map[string]interface{}{"action": a.Action}, nil
+	}
+	return 0, nil, notFound()
+}
+
+func (s *Server) dropletAction(r *http.Request, d *droplet) (int, interface{}, *apiError) {
+	var request map[string]interface{}
+	if err := decode(r, &request); err != nil {
+		return 0, nil, err
+	} else if s.locked(d.ID) {
+		return 0, nil, unprocessable("Droplet already has a pending event.")
+	}
+	actionType, _ := request["type"].(string)
+	var complete func()
+	switch actionType {
+	case "power_on":
+		complete = func() { d.Status = "active" }
+	case "power_off", "shutdown":
+		complete = func() { d.Status = "off" }
+	case "reboot", "power_cycle":
+		if d.Status != "active" && actionType == "reboot" {
+			return 0, nil, unprocessable("Droplet is currently off.")
+		}
+		complete = func() { d.Status = "active" }
+	case "rename":
+		name, _ := request["name"].(string)
+		if !nameRegexp.MatchString(name) {
+			return 0, nil, unprocessable("Name Only valid hostname characters are allowed. (a-z, A-Z, 0-9, . and -)")
+		}
+		complete = func() { d.Name = name }
+	case "rebuild":
+		imageID, _ := request["image"].(float64)
+		image := s.findImage(int(imageID))
+		if image == nil {
+			return 0, nil, unprocessable("You specified an invalid image for the rebuild.")
+		}
+		complete = func() { d.Image = image }
+	case "resize":
+		size := findSize(fmt.Sprint(request["size"]))
+		if size == nil {
+			return 0, nil, unprocessable("You specified an invalid size.")
+		} else if d.Status != "off" {
+			return 0, nil, unprocessable("Droplet must be powered off to resize.")
+		} else if disk, _ := request["disk"].(bool); !disk && size.Disk < d.Disk {
+			return 0, nil, unprocessable("The disk cannot be shrunk.")
+		}
+		complete = func() {
+			d.Size = size
+			d.SizeSlug = size.Slug
+			d.Memory = size.Memory
+			d.Vcpus = size.Vcpus
+			if disk, _ := request["disk"].(bool); disk {
+				d.Disk = size.Disk
+			}
+		}
+	case "snapshot":
+		name, _ := request["name"].(string)
+		if name == "" {
+			return 0, nil, unprocessable("Name is required")
+		}
+		complete = func() {
+			s.nextID++
+			s.images = append(s.images, &godo.Image{
+				ID:           s.nextID,
+				Name:         name,
+				Type:         "snapshot",
+				Distribution: d.Image.Distribution,
+				Regions:      []string{d.Region.Slug},
+				MinDiskSize:  d.Disk,
+				Created:      timestamp(),
+			})
+		}
+	default:
+		return 0, nil, unprocessable("Action type is not valid: %s", actionType)
+	}
+	a := s.newAction(actionType, d.ID, "droplet", d.Region.Slug, complete)
+	return http.StatusCreated, map[string]interface{}{"action": a.Action}, nil
+}
+
+// Volumes
+
+func (s *Server) createVolume(r *http.Request) (int, interface{}, *apiError) {
+	var request godo.VolumeCreateRequest
+	if err := decode(r, &request); err != nil {
+		return 0, nil, err
+	} else if !volumeNameRegexp.MatchString(request.Name) {
+		return 0, nil, unprocessable("name must be lowercase letters, numbers and dashes, starting with a letter")
+	} else if findRegion(request.Region) == nil {
+		return 0, nil, unprocessable("region %s is invalid", request.Region)
+	} else if request.SizeGigaBytes < 1 || request.SizeGigaBytes > 16384 {
+		return 0, nil, unprocessable("size_gigabytes must be between 1 and 16384")
+	}
+	for _, volume := range s.volumes {
+		if volume.Name == request.Name && volume.Region.Slug == request.Region {
+			return 0, nil, newError(http.StatusConflict, "conflict", "a volume with the same name already exists in the region")
+		}
+	}
+	s.nextID++
+	volume := &godo.Volume{
+		ID:            fmt.Sprintf("00000000-0000-4000-8000-%012d", s.nextID),
+		Region:        findRegion(request.Region),
+		Name:          request.Name,
+		SizeGigaBytes: request.SizeGigaBytes,
+		Description:   request.Description,
+		DropletIDs:    []int{},
+		CreatedAt:     time.Now().UTC(),
+	}
+	s.volumes[volume.ID] = volume
+	return http.StatusCreated, map[string]interface{}{"volume": volume}, nil
+}
+
+func (s *Server) listVolumes(r *http.Request) (int, interface{}, *apiError) {
+	var ids []string
+	for id := range s.volumes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var volumes []interface{}
+	for _, id := range ids {
+		volumes = append(volumes, s.volumes[id])
+	}
+	return s.page(r, "volumes", volumes)
+}
+
+func (s *Server) volumeRequest(r *http.Request, volume *godo.Volume, parts []string) (int, interface{}, *apiError) {
+	switch {
+	case len(parts) == 0 && r.Method == "GET":
+		return http.StatusOK, map[string]interface{}{"volume": volume}, nil
+	case len(parts) == 0 && r.Method == "DELETE":
+		if len(volume.DropletIDs) > 0 {
+			return 0, nil, newError(http.StatusConflict, "conflict", "volume is currently attached to a droplet")
+		}
+		delete(s.volumes, volume.ID)
+		return http.StatusNoContent, nil, nil
+	case len(parts) == 1 && parts[0] == "actions" && r.Method == "POST":
+		return s.volumeAction(r, volume)
+	case len(parts) == 2 && parts[0] == "actions" && r.Method == "GET":
+		for _, a := range s.actions {
+			if strconv.Itoa(a.ID) == parts[1] && a.volumeID == volume.ID {
+				s.poll(a)
+				return http.StatusOK, map[string]interface{}{"action": a.Action}, nil
+			}
+		}
+		return 0, nil, notFound()
+	}
+	return 0, nil, notFound()
+}
+
+// Volume actions name the droplet in droplet_id, which attach and detach
+// require.
+func (s *Server) volumeAction(r *http.Request, volume *godo.Volume) (int, interface{}, *apiError) {
+	var request struct {
+		Type          string `json:"type"`
+		DropletID     int    `json:"droplet_id"`
+		SizeGigaBytes int64  `json:"size_gigabytes"`
+		Region        string `json:"region"`
+	}
+	if err := decode(r, &request); err != nil {
+		return 0, nil, err
+	}
+	var complete func()
+	switch request.Type {
+	case "attach":
+		d := s.droplets[request.DropletID]
+		if d == nil {
+			return 0, nil, unprocessable("droplet_id is required and must be a droplet on your account")
+		} else if d.Region.Slug != volume.Region.Slug {
+			return 0, nil, unprocessable("volume and droplet must be in the same region")
+		} else if len(volume.DropletIDs) > 0 {
+			return 0, nil, unprocessable("volume is already attached to a droplet")
+		}
+		volume.DropletIDs = []int{d.ID}
+		complete = func() { d.VolumeIDs = append(d.VolumeIDs, volume.ID) }
+	case "detach":
+		if request.DropletID == 0 {
+			return 0, nil, unprocessable("droplet_id is required")
+		} else if len(volume.DropletIDs) == 0 || volume.DropletIDs[0] != request.DropletID {
+			return 0, nil, unprocessable("volume is not attached to droplet %d", request.DropletID)
+		}
+		volume.DropletIDs = []int{}
+		if d := s.droplets[request.DropletID]; d != nil {
+			complete = func() {
+				for i, id := range d.VolumeIDs {
+					if id == volume.ID {
+						d.VolumeIDs = append(d.VolumeIDs[:i], d.VolumeIDs[i+1:]...)
+						break
+					}
+				}
+			}
+		}
+	case "resize":
+		if request.SizeGigaBytes <= volume.SizeGigaBytes {
+			return 0, nil, unprocessable("new size must be larger than the current size")
+		} else if request.Region != volume.Region.Slug {
+			return 0, nil, unprocessable("region %s does not match the volume", request.Region)
+		}
+		size := request.SizeGigaBytes
+		complete = func() { volume.SizeGigaBytes = size }
+	default:
+		return 0, nil, unprocessable("Action type is not valid: %s", request.Type)
+	}
+	a := s.newAction(request.Type+"_volume", 0, "volume", volume.Region.Slug, complete)
+	a.volumeID = volume.ID
+	return http.StatusAccepted, map[string]interface{}{"action": a.Action}, nil
+}
@@ -5,17 +5,41 @@ import "github.com/LunaNode/cloug/service/compute"
 import "github.com/LunaNode/cloug/utils"
 
 import "github.com/aws/aws-sdk-go/aws"
+import "github.com/aws/aws-sdk-go/aws/awserr"
 import "github.com/aws/aws-sdk-go/aws/credentials"
 import "github.com/aws/aws-sdk-go/aws/session"
 import "github.com/aws/aws-sdk-go/service/ec2"
 
+import "context"
 import "encoding/base64"
 import "errors"
 import "fmt"
+import "regexp"
+import "sort"
 import "strings"
+import "sync"
+import "time"
 
 const DEFAULT_NAME = "cloug"
 const DEFAULT_REGION = "us-west-2"
+const FLAVOR_CACHE_TTL = time.Hour
+
+// Name of the security group created by cloug that allows SSH from anywhere.
+const MANAGED_SECURITY_GROUP = "cloug-ssh"
+
+// Public image owners whose images are included in ListImages and FindImage.
+// Only images matching one of the name patterns are considered, and Version
+// extracts the distribution version from the image name.
+var PUBLIC_IMAGE_OWNERS = []struct {
+	Distribution string
+	OwnerID      string
+	NamePatterns []string
+	Version      *regexp.Regexp
+}{
+	{"ubuntu", "099720109477", []string{"ubuntu/images/hvm-ssd*/ubuntu-*-server-*"}, regexp.MustCompile(`/ubuntu-[a-z]+-(\d+\.\d+)-(amd64|arm64)-server-`)},
+	{"debian", "136693071363", []string{"debian-*"}, regexp.MustCompile(`^debian-(\d+)-(amd64|arm64)-`)},
+	{"amazon", "137112412989", []string{"al2023-ami-2023*", "amzn2-ami-hvm-*-gp2"}, regexp.MustCompile(`^(?:al|amzn)(\d+)-ami-`)},
+}
 
 func encodeID(id string, region string) string {
 	return region + ":" + id
@@ -52,12 +76,32 @@ func Int64(x *int64) int64 {
 
 type EC2 struct {
 	Session *session.Session
+
+	// Regions searched by list operations. If empty, all regions enabled for
+	// the account are searched.
+	Regions []string
+
+	flavorCache *flavorCache
+	ctx         context.Context
 }
 
-func MakeEC2(keyID string, secretKey string, apiToken string) (*EC2, error) {
+// The API URL option replaces the regional EC2 endpoint for every region.
+// The AWS SDK retries throttled requests itself, so retries are disabled
+// unless enabled by an option.
+func MakeEC2(keyID string, secretKey string, apiToken string, options ...common.Option) (*EC2, error) {
+	opts := common.MakeHTTPOptions(append([]common.Option{common.WithRetry(nil)}, options...)...)
 	creds := credentials.NewStaticCredentials(keyID, secretKey, apiToken)
 	config := &aws.Config{Credentials: creds}
-	e := &EC2{Session: session.New(config)}
+	if opts.APIURL != "" {
+		config.Endpoint = aws.String(opts.APIURL)
+	}
+	if client := opts.HTTPClient(nil); client != nil {
+		config.HTTPClient = client
+	}
+	e := &EC2{
+		Session:     session.New(config),
+		flavorCache: new(flavorCache),
+	}
 	return e, nil
 }
 
@@ -65,10 +109,65 @@ func (e *EC2) ComputeService() compute.Service {
 	return e
 }
 
+func (e *EC2) Capabilities() *compute.Capabilities {
+	return &compute.Capabilities{
+		Operations:     compute.ImplementedOperations(e),
+		ImageSources:   []compute.ImageSource{compute.ImageSourceInstance},
+		InstanceFields: []compute.InstanceField{compute.FieldRegion, compute.FieldPassword, compute.FieldPublicKey, compute.FieldDiskGB, compute.FieldNetworkID},
+	}
+}
+
+// Returns a copy of the service whose API calls use the given context.
+func (e *EC2) withContext(ctx context.Context) *EC2 {
+	return &EC2{
+		Session:     e.Session,
+		Regions:     e.Regions,
+		flavorCache: e.flavorCache,
+		ctx:         ctx,
+	}
+}
+
+func (e *EC2) context() context.Context {
+	if e.ctx == nil {
+		return context.Background()
+	}
+	return e.ctx
+}
+
 func (e *EC2) getService(region string) *ec2.EC2 {
 	return ec2.New(e.Session, &aws.Config{Region: aws.String(region)})
 }
 
+// Classifies errors returned by the AWS SDK according to the EC2 error code.
+func (e *EC2) mapError(err error) error {
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return err
+	}
+	code := awsErr.Code()
+	switch {
+	case strings.HasSuffix(code, ".NotFound") || strings.HasSuffix(code, ".Unavailable") || strings.HasSuffix(strings.ToLower(code), "id.malformed"):
+		// a malformed ID, e.g. InvalidInstanceID.Malformed, cannot exist
+		return compute.WrapError(compute.ErrNotFound, err)
+	case code == "AuthFailure" || code == "UnauthorizedOperation" || code == "Blocked" || code == "OptInRequired":
+		return compute.WrapError(compute.ErrAuth, err)
+	case code == "RequestLimitExceeded" || code == "Throttling":
+		return compute.WrapError(compute.ErrRateLimited, err)
+	case strings.HasSuffix(code, "LimitExceeded") || code == "InsufficientInstanceCapacity":
+		return compute.WrapError(compute.ErrQuotaExceeded, err)
+	case strings.HasSuffix(code, ".Duplicate") || strings.HasSuffix(code, ".InUse") || strings.HasPrefix(code, "IncorrectState") || code == "IncorrectInstanceState":
+		return compute.WrapError(compute.ErrConflict, err)
+	case strings.HasPrefix(code, "InvalidParameter") || strings.HasSuffix(code, ".Malformed") || code == "MissingParameter" || code == "ValidationError":
+		return compute.WrapError(compute.ErrInvalidArgument, err)
+	case code == "Unsupported" || code == "UnsupportedOperation":
+		return compute.WrapError(compute.ErrNotSupported, err)
+	}
+	if requestErr, ok := err.(awserr.RequestFailure); ok {
+		return common.HTTPStatusError(requestErr.StatusCode(), err)
+	}
+	return err
+}
+
 func (e *EC2) mapInstanceStatus(state string) compute.InstanceStatus {
 	if state == "running" {
 		return compute.StatusOnline
@@ -80,29 +179,232 @@ func (e *EC2) mapInstanceStatus(state string) compute.InstanceStatus {
 }
 
 func (e *EC2) mapInstance(instance *ec2.Instance, region string) *compute.Instance {
-	return &compute.Instance{
-		ID:     encodeID(String(instance.InstanceId), region),
-		Status: e.mapInstanceStatus(String(instance.State.Name)),
-		IP:     String(instance.PublicIpAddress),
+	computeInstance := &compute.Instance{
+		ID:        encodeID(String(instance.InstanceId), region),
+		Region:    region,
+		Status:    e.mapInstanceStatus(String(instance.State.Name)),
+		IP:        String(instance.PublicIpAddress),
+		PrivateIP: String(instance.PrivateIpAddress),
 	}
+	if instance.InstanceType != nil {
+		computeInstance.Flavor.ID = String(instance.InstanceType)
+	}
+	if instance.ImageId != nil {
+		computeInstance.Image.ID = encodeID(String(instance.ImageId), region)
+	}
+	for _, tag := range instance.Tags {
+		if String(tag.Key) == "Name" {
+			computeInstance.Name = String(tag.Value)
+		}
+	}
+	computeInstance.NetworkID = String(instance.SubnetId)
+	var groups []string
+	for _, group := range instance.SecurityGroups {
+		groups = append(groups, String(group.GroupId))
+	}
+	computeInstance.Details = map[string]string{
+		"vpc_id":          String(instance.VpcId),
+		"security_groups": strings.Join(groups, ","),
+	}
+	return computeInstance
 }
 
-func (e *EC2) CreateInstance(instance *compute.Instance) (*compute.Instance, error) {
-	imageID, err := common.GetMatchingImageID(e, &instance.Image)
+// Returns the ID of the cloug-managed security group in the VPC, creating it
+// if needed. The SSH rule is re-applied to an existing group that lacks it,
+// e.g. because authorizing it failed after the group was created.
+func (e *EC2) managedSecurityGroup(svc *ec2.EC2, vpcID string) (string, error) {
+	findGroup := func() (*ec2.SecurityGroup, error) {
+		resp, err := svc.DescribeSecurityGroupsWithContext(e.context(), &ec2.DescribeSecurityGroupsInput{
+			Filters: []*ec2.Filter{
+				{Name: aws.String("group-name"), Values: []*string{aws.String(MANAGED_SECURITY_GROUP)}},
+				{Name: aws.String("vpc-id"), Values: []*string{aws.String(vpcID)}},
+			},
+		})
+		if err != nil {
+			return nil, e.mapError(err)
+		} else if len(resp.SecurityGroups) == 0 {
+			return nil, nil
+		} else {
+			return resp.SecurityGroups[0], nil
+		}
+	}
+
+	group, err := findGroup()
 	if err != nil {
-		return nil, err
+		return "", err
+	} else if group != nil {
+		if !allowsSSH(group) {
+			err := e.authorizeSSH(svc, String(group.GroupId))
+			if err != nil && !errors.Is(err, compute.ErrConflict) {
+				return "", err
+			}
+		}
+		return String(group.GroupId), nil
+	}
+
+	resp, err := svc.CreateSecurityGroupWithContext(e.context(), &ec2.CreateSecurityGroupInput{
+		GroupName:   aws.String(MANAGED_SECURITY_GROUP),
+		Description: aws.String("Allows SSH, managed by cloug"),
+		VpcId:       aws.String(vpcID),
+	})
+	if err != nil {
+		if err = e.mapError(err); !errors.Is(err, compute.ErrConflict) {
+			return "", err
+		}
+		// another caller created the group concurrently
+		group, err := findGroup()
+		if err != nil {
+			return "", err
+		} else if group == nil {
+			return "", fmt.Errorf("security group %s was created concurrently but not found", MANAGED_SECURITY_GROUP)
+		}
+		return String(group.GroupId), nil
 	}
-	flavorID, err := common.GetMatchingFlavorID(e, &instance.Flavor)
+	groupID := String(resp.GroupId)
+	err = e.authorizeSSH(svc, groupID)
 	if err != nil {
-		return nil, err
+		// a group without the SSH rule would be reused by later creates
+		svc.DeleteSecurityGroupWithContext(e.context(), &ec2.DeleteSecurityGroupInput{GroupId: aws.String(groupID)})
+		return "", err
+	}
+	return groupID, nil
+}
+
+func (e *EC2) authorizeSSH(svc *ec2.EC2, groupID string) error {
+	_, err := svc.AuthorizeSecurityGroupIngressWithContext(e.context(), &ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId: aws.String(groupID),
+		IpPermissions: []*ec2.IpPermission{{
+			IpProtocol: aws.String("tcp"),
+			FromPort:   aws.Int64(22),
+			ToPort:     aws.Int64(22),
+			IpRanges:   []*ec2.IpRange{{CidrIp: aws.String("0.0.0.0/0")}},
+			Ipv6Ranges: []*ec2.Ipv6Range{{CidrIpv6: aws.String("::/0")}},
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to allow SSH in security group %s: %w", groupID, e.mapError(err))
+	}
+	return nil
+}
+
+// Returns whether the security group allows SSH from anywhere over IPv4.
+func allowsSSH(group *ec2.SecurityGroup) bool {
+	for _, permission := range group.IpPermissions {
+		if String(permission.IpProtocol) != "tcp" || permission.FromPort == nil || permission.ToPort == nil {
+			continue
+		} else if *permission.FromPort > 22 || *permission.ToPort < 22 {
+			continue
+		}
+		for _, ipRange := range permission.IpRanges {
+			if String(ipRange.CidrIp) == "0.0.0.0/0" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the VPC of the subnet, or the default VPC if subnetID is empty.
+func (e *EC2) findVPC(svc *ec2.EC2, subnetID string) (string, error) {
+	if subnetID != "" {
+		resp, err := svc.DescribeSubnetsWithContext(e.context(), &ec2.DescribeSubnetsInput{
+			SubnetIds: []*string{aws.String(subnetID)},
+		})
+		if err != nil {
+			return "", e.mapError(err)
+		} else if len(resp.Subnets) != 1 {
+			return "", compute.Errorf(compute.ErrNotFound, "subnet %s not found", subnetID)
+		}
+		return String(resp.Subnets[0].VpcId), nil
+	}
+
+	resp, err := svc.DescribeVpcsWithContext(e.context(), &ec2.DescribeVpcsInput{
+		Filters: []*ec2.Filter{{Name: aws.String("isDefault"), Values: []*string{aws.String("true")}}},
+	})
+	if err != nil {
+		return "", e.mapError(err)
+	} else if len(resp.Vpcs) == 0 {
+		return "", compute.Errorf(compute.ErrInvalidArgument, "region has no default VPC, so a subnet must be set in NetworkID")
 	}
+	return String(resp.Vpcs[0].VpcId), nil
+}
 
+// Sets the subnet, security groups and public IP assignment of the instance.
+// The subnet is taken from NetworkID; without one, the default VPC is used.
+// The security_groups detail lists security group IDs separated by commas,
+// ssh_security_group "true" adds the cloug-managed group that allows SSH, and
+// public_ip "true" or "false" overrides the subnet's public IP setting.
+func (e *EC2) setPlacement(svc *ec2.EC2, instance *compute.Instance, opts *ec2.RunInstancesInput) error {
+	var groups []*string
+	for _, group := range strings.Split(instance.Detail("security_groups", ""), ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, aws.String(group))
+		}
+	}
+	if instance.Detail("ssh_security_group", "") == "true" {
+		vpcID, err := e.findVPC(svc, instance.NetworkID)
+		if err != nil {
+			return err
+		}
+		groupID, err := e.managedSecurityGroup(svc, vpcID)
+		if err != nil {
+			return fmt.Errorf("error finding managed security group: %w", err)
+		}
+		groups = append(groups, aws.String(groupID))
+	}
+
+	publicIP := instance.Detail("public_ip", "")
+	if publicIP != "" && publicIP != "true" && publicIP != "false" {
+		return compute.Errorf(compute.ErrInvalidArgument, "public_ip must be true or false, got %q", publicIP)
+	}
+
+	if publicIP != "" {
+		// public IP assignment can only be set on a network interface, which
+		// then also carries the subnet and security groups
+		networkInterface := &ec2.InstanceNetworkInterfaceSpecification{
+			DeviceIndex:              aws.Int64(0),
+			AssociatePublicIpAddress: aws.Bool(publicIP == "true"),
+			Groups:                   groups,
+		}
+		if instance.NetworkID != "" {
+			networkInterface.SubnetId = aws.String(instance.NetworkID)
+		}
+		opts.NetworkInterfaces = []*ec2.InstanceNetworkInterfaceSpecification{networkInterface}
+	} else {
+		if instance.NetworkID != "" {
+			opts.SubnetId = aws.String(instance.NetworkID)
+		}
+		opts.SecurityGroupIds = groups
+	}
+	return nil
+}
+
+func (e *EC2) CreateInstance(instance *compute.Instance) (*compute.Instance, error) {
 	region := DEFAULT_REGION
 	if instance.Region != "" {
 		region = instance.Region
 	}
 	svc := e.getService(region)
 
+	// AMIs and instance types are regional, so search in the instance region
+	image := instance.Image
+	if len(image.Regions) == 0 {
+		image.Regions = []string{region}
+	}
+	imageID, err := common.GetMatchingImageID(e, &image)
+	if err != nil {
+		return nil, err
+	}
+	imageID, _ = decodeID(imageID)
+	flavor := instance.Flavor
+	if len(flavor.Regions) == 0 {
+		flavor.Regions = []string{region}
+	}
+	flavorID, err := common.GetMatchingFlavorID(e, &flavor)
+	if err != nil {
+		return nil, err
+	}
+
 	opts := ec2.RunInstancesInput{
 		ImageId:      aws.String(imageID),
 		InstanceType: aws.String(flavorID),
@@ -129,24 +431,29 @@ func (e *EC2) CreateInstance(instance *compute.Instance) (*compute.Instance, err
 		}
 	}
 
+	if err := e.setPlacement(svc, instance, &opts); err != nil {
+		return nil, err
+	}
+
 	if len(instance.PublicKey.Key) > 0 {
 		keyName := utils.Uid(8)
-		_, err := svc.ImportKeyPair(&ec2.ImportKeyPairInput{
+		_, err := svc.ImportKeyPairWithContext(e.context(), &ec2.ImportKeyPairInput{
 			KeyName:           aws.String(keyName),
 			PublicKeyMaterial: instance.PublicKey.Key,
 		})
 		if err != nil {
-			return nil, fmt.Errorf("failed to import public key: %v", err)
+			return nil, fmt.Errorf("failed to import public key: %w", e.mapError(err))
 		}
+		// clean up even if the context is done
 		defer svc.DeleteKeyPair(&ec2.DeleteKeyPairInput{
 			KeyName: aws.String(keyName),
 		})
 		opts.KeyName = aws.String(keyName)
 	}
 
-	res, err := svc.RunInstances(&opts)
+	res, err := svc.RunInstancesWithContext(e.context(), &opts)
 	if err != nil {
-		return nil, err
+		return nil, e.mapError(err)
 	} else if len(res.Instances) != 1 {
 		return nil, fmt.Errorf("attempted to provision a single instance, but reservation contains %d instances", len(res.Instances))
 	}
@@ -167,23 +474,51 @@ func (e *EC2) regionAction(encodedID string, f func(id string, svc *ec2.EC2) err
 
 func (e *EC2) DeleteInstance(instanceID string) error {
 	return e.regionAction(instanceID, func(id string, svc *ec2.EC2) error {
-		_, err := svc.TerminateInstances(&ec2.TerminateInstancesInput{
+		_, err := svc.TerminateInstancesWithContext(e.context(), &ec2.TerminateInstancesInput{
 			InstanceIds: []*string{aws.String(id)},
 		})
-		return err
+		return e.mapError(err)
 	})
 }
 
+// Lists instances in all searched regions concurrently. Terminated instances,
+// which EC2 keeps reporting for a while, are omitted.
 func (e *EC2) ListInstances() ([]*compute.Instance, error) {
-	return nil, fmt.Errorf("operation not supported")
+	var instances []*compute.Instance
+	var mu sync.Mutex
+	err := e.eachRegion(func(region string) error {
+		var regionInstances []*compute.Instance
+		err := e.getService(region).DescribeInstancesPagesWithContext(e.context(), &ec2.DescribeInstancesInput{}, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+			for _, reservation := range page.Reservations {
+				for _, instance := range reservation.Instances {
+					if instance.State != nil && String(instance.State.Name) == "terminated" {
+						continue
+					}
+					regionInstances = append(regionInstances, e.mapInstance(instance, region))
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return fmt.Errorf("error listing instances in %s: %w", region, e.mapError(err))
+		}
+		mu.Lock()
+		instances = append(instances, regionInstances...)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return instances, nil
 }
 
 func (e *EC2) getInstance(id string, svc *ec2.EC2) (*ec2.Instance, error) {
-	resp, err := svc.DescribeInstances(&ec2.DescribeInstancesInput{
+	resp, err := svc.DescribeInstancesWithContext(e.context(), &ec2.DescribeInstancesInput{
 		InstanceIds: []*string{aws.String(id)},
 	})
 	if err != nil {
-		return nil, err
+		return nil, e.mapError(err)
 	} else if len(resp.Reservations) != 1 || len(resp.Reservations[0].Instances) != 1 {
 		return nil, fmt.Errorf("DescribeInstances did not return one reservation with one instance")
 	} else {
@@ -204,31 +539,59 @@ func (e *EC2) GetInstance(instanceID string) (*compute.Instance, error) {
 
 func (e *EC2) StartInstance(instanceID string) error {
 	return e.regionAction(instanceID, func(id string, svc *ec2.EC2) error {
-		_, err := svc.StartInstances(&ec2.StartInstancesInput{
+		_, err := svc.StartInstancesWithContext(e.context(), &ec2.StartInstancesInput{
 			InstanceIds: []*string{aws.String(id)},
 		})
-		return err
+		return e.mapError(err)
 	})
 }
 
 func (e *EC2) StopInstance(instanceID string) error {
 	return e.regionAction(instanceID, func(id string, svc *ec2.EC2) error {
-		_, err := svc.StopInstances(&ec2.StopInstancesInput{
+		_, err := svc.StopInstancesWithContext(e.context(), &ec2.StopInstancesInput{
 			InstanceIds: []*string{aws.String(id)},
 		})
-		return err
+		return e.mapError(err)
 	})
 }
 
 func (e *EC2) RebootInstance(instanceID string) error {
 	return e.regionAction(instanceID, func(id string, svc *ec2.EC2) error {
-		_, err := svc.RebootInstances(&ec2.RebootInstancesInput{
+		_, err := svc.RebootInstancesWithContext(e.context(), &ec2.RebootInstancesInput{
 			InstanceIds: []*string{aws.String(id)},
 		})
-		return err
+		return e.mapError(err)
 	})
 }
 
+func (e *EC2) CreateInstanceContext(ctx context.Context, instance *compute.Instance) (*compute.Instance, error) {
+	return e.withContext(ctx).CreateInstance(instance)
+}
+
+func (e *EC2) DeleteInstanceContext(ctx context.Context, instanceID string) error {
+	return e.withContext(ctx).DeleteInstance(instanceID)
+}
+
+func (e *EC2) ListInstancesContext(ctx context.Context) ([]*compute.Instance, error) {
+	return e.withContext(ctx).ListInstances()
+}
+
+func (e *EC2) GetInstanceContext(ctx context.Context, instanceID string) (*compute.Instance, error) {
+	return e.withContext(ctx).GetInstance(instanceID)
+}
+
+func (e *EC2) StartInstanceContext(ctx context.Context, instanceID string) error {
+	return e.withContext(ctx).StartInstance(instanceID)
+}
+
+func (e *EC2) StopInstanceContext(ctx context.Context, instanceID string) error {
+	return e.withContext(ctx).StopInstance(instanceID)
+}
+
+func (e *EC2) RebootInstanceContext(ctx context.Context, instanceID string) error {
+	return e.withContext(ctx).RebootInstance(instanceID)
+}
+
 func (e *EC2) CreateImage(imageTemplate *compute.Image) (*compute.Image, error) {
 	if imageTemplate.SourceInstance != "" {
 		instanceID, region := decodeID(imageTemplate.SourceInstance)
@@ -239,12 +602,12 @@ func (e *EC2) CreateImage(imageTemplate *compute.Image) (*compute.Image, error)
 			name = imageTemplate.Name
 		}
 
-		resp, err := svc.CreateImage(&ec2.CreateImageInput{
+		resp, err := svc.CreateImageWithContext(e.context(), &ec2.CreateImageInput{
 			InstanceId: aws.String(instanceID),
 			Name:       aws.String(name),
 		})
 		if err != nil {
-			return nil, err
+			return nil, e.mapError(err)
 		} else {
 			return &compute.Image{
 				ID:             encodeID(String(resp.ImageId), region),
@@ -253,7 +616,7 @@ func (e *EC2) CreateImage(imageTemplate *compute.Image) (*compute.Image, error)
 			}, nil
 		}
 	} else if imageTemplate.SourceURL != "" {
-		return nil, errors.New("CreateImage from URL is not implemented")
+		return nil, compute.Errorf(compute.ErrNotSupported, "CreateImage from URL is not implemented")
 	} else {
 		return nil, errors.New("neither source instance nor source URL is set")
 	}
@@ -261,15 +624,39 @@ func (e *EC2) CreateImage(imageTemplate *compute.Image) (*compute.Image, error)
 
 func (e *EC2) mapImage(apiImage *ec2.Image, region string) *compute.Image {
 	image := &compute.Image{
-		ID:     encodeID(String(apiImage.ImageId), region),
-		Name:   String(apiImage.Name),
-		Public: Bool(apiImage.Public),
+		ID:      encodeID(String(apiImage.ImageId), region),
+		Name:    String(apiImage.Name),
+		Regions: []string{region},
+		Type:    compute.TemplateImage,
+		Public:  Bool(apiImage.Public),
+		Details: map[string]string{
+			"owner_id":      String(apiImage.OwnerId),
+			"creation_date": String(apiImage.CreationDate),
+		},
 	}
 
-	if len(apiImage.BlockDeviceMappings) > 0 {
+	if len(apiImage.BlockDeviceMappings) > 0 && apiImage.BlockDeviceMappings[0].Ebs != nil {
 		image.Size = Int64(apiImage.BlockDeviceMappings[0].Ebs.VolumeSize)
 	}
 
+	switch String(apiImage.Architecture) {
+	case "x86_64":
+		image.Architecture = compute.ArchAMD64
+	case "i386":
+		image.Architecture = compute.Archi386
+	case "arm64":
+		image.Architecture = compute.ArchARM64
+	}
+	for _, owner := range PUBLIC_IMAGE_OWNERS {
+		if String(apiImage.OwnerId) != owner.OwnerID {
+			continue
+		}
+		if match := owner.Version.FindStringSubmatch(image.Name); match != nil {
+			image.Distribution = owner.Distribution
+			image.Version = match[1]
+		}
+	}
+
 	if String(apiImage.State) == "available" {
 		image.Status = compute.ImageAvailable
 	} else if String(apiImage.State) == "error" || String(apiImage.State) == "failed" || String(apiImage.State) == "invalid" {
@@ -281,22 +668,141 @@ func (e *EC2) mapImage(apiImage *ec2.Image, region string) *compute.Image {
 	return image
 }
 
+// Lists available images in a region that are owned by the account or by one
+// of PUBLIC_IMAGE_OWNERS.
+func (e *EC2) listRegionImages(region string) ([]*compute.Image, error) {
+	svc := e.getService(region)
+	inputs := []*ec2.DescribeImagesInput{{
+		Owners: []*string{aws.String("self")},
+	}}
+	for _, owner := range PUBLIC_IMAGE_OWNERS {
+		inputs = append(inputs, &ec2.DescribeImagesInput{
+			Owners: []*string{aws.String(owner.OwnerID)},
+			Filters: []*ec2.Filter{
+				{Name: aws.String("name"), Values: aws.StringSlice(owner.NamePatterns)},
+				{Name: aws.String("state"), Values: []*string{aws.String("available")}},
+			},
+		})
+	}
+
+	var images []*compute.Image
+	for _, input := range inputs {
+		resp, err := svc.DescribeImagesWithContext(e.context(), input)
+		if err != nil {
+			return nil, fmt.Errorf("error listing images in %s: %w", region, e.mapError(err))
+		}
+		for _, apiImage := range resp.Images {
+			images = append(images, e.mapImage(apiImage, region))
+		}
+	}
+	return images, nil
+}
+
+// Returns the image created last, or nil if images is empty.
+func newestImage(images []*compute.Image) *compute.Image {
+	var newest *compute.Image
+	for _, image := range images {
+		if newest == nil || image.Details["creation_date"] > newest.Details["creation_date"] {
+			newest = image
+		}
+	}
+	return newest
+}
+
+// Finds an image in the first region of image.Regions, or DEFAULT_REGION. If
+// the name is set, it must match exactly. Otherwise the newest public image
+// with matching distribution (default ubuntu), version and architecture
+// (default amd64) is selected; version 22 also matches 22.04.
 func (e *EC2) FindImage(image *compute.Image) (string, error) {
-	return "", errors.New("operation not supported")
+	region := DEFAULT_REGION
+	if len(image.Regions) > 0 {
+		region = image.Regions[0]
+	}
+	images, err := e.listRegionImages(region)
+	if err != nil {
+		return "", err
+	}
+
+	matchDistribution := "ubuntu"
+	if image.Distribution != "" {
+		matchDistribution = strings.ToLower(image.Distribution)
+	}
+	matchArchitecture := compute.ImageArchitecture(compute.ArchAMD64)
+	if image.Architecture != "" {
+		matchArchitecture = image.Architecture
+	}
+
+	var candidates []*compute.Image
+	for _, candidate := range images {
+		if image.Name != "" {
+			if candidate.Name == image.Name {
+				candidates = append(candidates, candidate)
+			}
+			continue
+		}
+		if candidate.Distribution != matchDistribution || candidate.Architecture != matchArchitecture {
+			continue
+		} else if image.Version != "" && !common.MatchVersion(image.Version, candidate.Version) {
+			continue
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	if newest := newestImage(candidates); newest != nil {
+		return newest.ID, nil
+	} else {
+		return "", nil
+	}
 }
 
+// Lists owned images, and the newest public image for each distribution,
+// version and architecture, in all searched regions.
 func (e *EC2) ListImages() ([]*compute.Image, error) {
-	return nil, errors.New("operation not supported")
+	var images []*compute.Image
+	var mu sync.Mutex
+	err := e.eachRegion(func(region string) error {
+		regionImages, err := e.listRegionImages(region)
+		if err != nil {
+			return err
+		}
+
+		var selected []*compute.Image
+		publicImages := make(map[string][]*compute.Image)
+		var publicKeys []string
+		for _, image := range regionImages {
+			if image.Distribution == "" {
+				selected = append(selected, image)
+				continue
+			}
+			key := image.Distribution + "/" + image.Version + "/" + string(image.Architecture)
+			if publicImages[key] == nil {
+				publicKeys = append(publicKeys, key)
+			}
+			publicImages[key] = append(publicImages[key], image)
+		}
+		for _, key := range publicKeys {
+			selected = append(selected, newestImage(publicImages[key]))
+		}
+
+		mu.Lock()
+		images = append(images, selected...)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
 }
 
 func (e *EC2) GetImage(imageID string) (*compute.Image, error) {
 	id, region := decodeID(imageID)
 	svc := e.getService(region)
-	resp, err := svc.DescribeImages(&ec2.DescribeImagesInput{
+	resp, err := svc.DescribeImagesWithContext(e.context(), &ec2.DescribeImagesInput{
 		ImageIds: []*string{aws.String(id)},
 	})
 	if err != nil {
-		return nil, err
+		return nil, e.mapError(err)
 	} else if len(resp.Images) != 1 {
 		return nil, fmt.Errorf("DescribeImages returned %d images, but expected a single image", len(resp.Images))
 	} else {
@@ -304,103 +810,438 @@ func (e *EC2) GetImage(imageID string) (*compute.Image, error) {
 	}
 }
 
+// Deregisters the image and deletes the EBS snapshots that back it.
 func (e *EC2) DeleteImage(imageID string) error {
-	return fmt.Errorf("operation not supported")
+	id, region := decodeID(imageID)
+	svc := e.getService(region)
+	resp, err := svc.DescribeImagesWithContext(e.context(), &ec2.DescribeImagesInput{
+		ImageIds: []*string{aws.String(id)},
+	})
+	if err != nil {
+		return e.mapError(err)
+	} else if len(resp.Images) != 1 {
+		return compute.Errorf(compute.ErrNotFound, "DescribeImages returned %d images, but expected a single image", len(resp.Images))
+	}
+
+	_, err = svc.DeregisterImageWithContext(e.context(), &ec2.DeregisterImageInput{
+		ImageId: aws.String(id),
+	})
+	if err != nil {
+		return e.mapError(err)
+	}
+
+	for _, mapping := range resp.Images[0].BlockDeviceMappings {
+		if mapping.Ebs == nil || mapping.Ebs.SnapshotId == nil {
+			continue
+		}
+		_, err := svc.DeleteSnapshotWithContext(e.context(), &ec2.DeleteSnapshotInput{
+			SnapshotId: mapping.Ebs.SnapshotId,
+		})
+		if err != nil {
+			return fmt.Errorf("image deregistered, but failed to delete snapshot %s: %w", String(mapping.Ebs.SnapshotId), e.mapError(err))
+		}
+	}
+	return nil
+}
+
+// Caches the flavor catalog, which rarely changes and takes one request per
+// region to load.
+type flavorCache struct {
+	mu      sync.Mutex
+	flavors []*compute.Flavor
+	expires time.Time
+
+	// The load in progress, if any, which concurrent callers wait for rather
+	// than each loading the catalog.
+	load *flavorLoad
+}
+
+type flavorLoad struct {
+	done    chan struct{}
+	flavors []*compute.Flavor
+	err     error
 }
 
+// Loads the instance types offered in each searched region. Types that
+// support x86_64 and current generation types are listed first, then types
+// are ordered by memory and cores, so that FindFlavor prefers small, modern
+// x86_64 types.
+func (e *EC2) loadFlavors() ([]*compute.Flavor, error) {
+	type flavorInfo struct {
+		flavor     *compute.Flavor
+		x86        bool
+		currentGen bool
+	}
+	infos := make(map[string]*flavorInfo)
+	var mu sync.Mutex
+
+	err := e.eachRegion(func(region string) error {
+		err := e.getService(region).DescribeInstanceTypesPagesWithContext(e.context(), &ec2.DescribeInstanceTypesInput{}, func(page *ec2.DescribeInstanceTypesOutput, lastPage bool) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, instanceType := range page.InstanceTypes {
+				id := String(instanceType.InstanceType)
+				info := infos[id]
+				if info == nil {
+					info = &flavorInfo{
+						flavor: &compute.Flavor{
+							ID:   id,
+							Name: id,
+						},
+						currentGen: Bool(instanceType.CurrentGeneration),
+					}
+					if instanceType.VCpuInfo != nil {
+						info.flavor.NumCores = int(Int64(instanceType.VCpuInfo.DefaultVCpus))
+					}
+					if instanceType.MemoryInfo != nil {
+						info.flavor.MemoryMB = int(Int64(instanceType.MemoryInfo.SizeInMiB))
+					}
+					if instanceType.InstanceStorageInfo != nil {
+						info.flavor.DiskGB = int(Int64(instanceType.InstanceStorageInfo.TotalSizeInGB))
+					}
+					if instanceType.ProcessorInfo != nil {
+						for _, arch := range instanceType.ProcessorInfo.SupportedArchitectures {
+							info.x86 = info.x86 || String(arch) == "x86_64"
+						}
+					}
+					infos[id] = info
+				}
+				info.flavor.Regions = append(info.flavor.Regions, region)
+			}
+			return true
+		})
+		if err != nil {
+			return fmt.Errorf("error listing instance types in %s: %w", region, e.mapError(err))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := make([]*flavorInfo, 0, len(infos))
+	for _, info := range infos {
+		sort.Strings(info.flavor.Regions)
+		sorted = append(sorted, info)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.x86 != b.x86 {
+			return a.x86
+		} else if a.currentGen != b.currentGen {
+			return a.currentGen
+		} else if a.flavor.MemoryMB != b.flavor.MemoryMB {
+			return a.flavor.MemoryMB < b.flavor.MemoryMB
+		} else if a.flavor.NumCores != b.flavor.NumCores {
+			return a.flavor.NumCores < b.flavor.NumCores
+		} else {
+			return a.flavor.ID < b.flavor.ID
+		}
+	})
+	flavors := make([]*compute.Flavor, len(sorted))
+	for i, info := range sorted {
+		flavors[i] = info.flavor
+	}
+	return flavors, nil
+}
+
+// Lists the instance types in the searched regions. The catalog is cached for
+// FLAVOR_CACHE_TTL. DiskGB is the instance store size, which is zero for
+// EBS-only types.
 func (e *EC2) ListFlavors() ([]*compute.Flavor, error) {
-	return []*compute.Flavor{
-		{
-			ID:       "t2.nano",
-			Name:     "t2.nano",
-			MemoryMB: 512,
-			NumCores: 1,
-		},
-		{
-			ID:       "t2.micro",
-			Name:     "t2.micro",
-			MemoryMB: 1024,
-			NumCores: 1,
-		},
-		{
-			ID:       "t2.small",
-			Name:     "t2.small",
-			MemoryMB: 2048,
-			NumCores: 1,
-		},
-		{
-			ID:       "t2.medium",
-			Name:     "t2.medium",
-			MemoryMB: 4096,
-			NumCores: 2,
-		},
-		{
-			ID:       "t2.large",
-			Name:     "t2.large",
-			MemoryMB: 8192,
-			NumCores: 2,
-		},
-		{
-			ID:       "m4.large",
-			Name:     "m4.large",
-			MemoryMB: 8192,
-			NumCores: 2,
-		},
-		{
-			ID:       "m4.xlarge",
-			Name:     "m4.xlarge",
-			MemoryMB: 16384,
-			NumCores: 4,
-		},
-		{
-			ID:       "m4.2xlarge",
-			Name:     "m4.2xlarge",
-			MemoryMB: 32768,
-			NumCores: 6,
-		},
-		{
-			ID:       "m4.4xlarge",
-			Name:     "m4.4xlarge",
-			MemoryMB: 65536,
-			NumCores: 16,
-		},
-		{
-			ID:       "m4.10xlarge",
-			Name:     "m4.10xlarge",
-			MemoryMB: 163840,
-			NumCores: 20,
-		},
-		{
-			ID:       "m3.medium",
-			Name:     "m3.medium",
-			MemoryMB: 3840,
-			NumCores: 1,
-		},
-		{
-			ID:       "m3.large",
-			Name:     "m3.large",
-			MemoryMB: 7680,
-			NumCores: 2,
-		},
-		{
-			ID:       "m3.xlarge",
-			Name:     "m3.xlarge",
-			MemoryMB: 15360,
-			NumCores: 4,
-		},
-		{
-			ID:       "m3.2xlarge",
-			Name:     "m3.2xlarge",
-			MemoryMB: 30720,
-			NumCores: 8,
-		},
-	}, nil
+	if e.flavorCache == nil {
+		return e.loadFlavors()
+	}
+	cache := e.flavorCache
+	cache.mu.Lock()
+	if cache.flavors != nil && time.Now().Before(cache.expires) {
+		flavors := cache.flavors
+		cache.mu.Unlock()
+		return copyFlavors(flavors), nil
+	}
+
+	// the lock is not held while loading, so that other callers are not
+	// blocked behind the requests
+	load := cache.load
+	if load == nil {
+		load = &flavorLoad{done: make(chan struct{})}
+		cache.load = load
+		cache.mu.Unlock()
+		load.flavors, load.err = e.loadFlavors()
+		cache.mu.Lock()
+		cache.load = nil
+		if load.err == nil {
+			cache.flavors = load.flavors
+			cache.expires = time.Now().Add(FLAVOR_CACHE_TTL)
+		}
+		cache.mu.Unlock()
+		close(load.done)
+	} else {
+		cache.mu.Unlock()
+		select {
+		case <-load.done:
+		case <-e.context().Done():
+			return nil, e.context().Err()
+		}
+	}
+	if load.err != nil {
+		return nil, load.err
+	}
+	return copyFlavors(load.flavors), nil
+}
+
+// Copies the cached flavors, so that callers cannot modify the cache.
+func copyFlavors(flavors []*compute.Flavor) []*compute.Flavor {
+	copies := make([]*compute.Flavor, len(flavors))
+	for i, flavor := range flavors {
+		flavorCopy := *flavor
+		flavorCopy.Regions = append([]string(nil), flavor.Regions...)
+		copies[i] = &flavorCopy
+	}
+	return copies
 }
 
+// The root volume size of an instance is set independently of its type, so
+// DiskGB is ignored when matching.
 func (e *EC2) FindFlavor(flavor *compute.Flavor) (string, error) {
 	flavors, err := e.ListFlavors()
 	if err != nil {
-		return "", fmt.Errorf("error listing flavors: %v", err)
+		return "", fmt.Errorf("error listing flavors: %w", e.mapError(err))
+	}
+	target := *flavor
+	target.DiskGB = 0
+	return common.MatchFlavor(&target, flavors), nil
+}
+
+func (e *EC2) mapVolume(apiVolume *ec2.Volume, region string) *compute.Volume {
+	volume := &compute.Volume{
+		ID:     encodeID(String(apiVolume.VolumeId), region),
+		Region: region,
+		SizeGB: int(Int64(apiVolume.Size)),
+		Details: map[string]string{
+			"availability_zone": String(apiVolume.AvailabilityZone),
+		},
+	}
+
+	for _, tag := range apiVolume.Tags {
+		if String(tag.Key) == "Name" {
+			volume.Name = String(tag.Value)
+		}
+	}
+
+	for _, attachment := range apiVolume.Attachments {
+		if String(attachment.State) == "attached" || String(attachment.State) == "attaching" {
+			volume.InstanceID = encodeID(String(attachment.InstanceId), region)
+		}
+	}
+
+	state := String(apiVolume.State)
+	if state == "available" {
+		volume.Status = compute.VolumeAvailable
+	} else if state == "in-use" {
+		volume.Status = compute.VolumeInUse
+	} else if state == "creating" {
+		volume.Status = compute.VolumePending
+	} else {
+		volume.Status = compute.VolumeStatus(state)
+	}
+
+	return volume
+}
+
+// Creates a volume. EBS volumes are bound to an availability zone, which can
+// be selected with the availability_zone detail; otherwise the first zone in
+// the region is used.
+func (e *EC2) CreateVolume(volume *compute.Volume) (*compute.Volume, error) {
+	if volume.SizeGB <= 0 {
+		return nil, errors.New("volume size must be set")
+	}
+
+	region := DEFAULT_REGION
+	if volume.Region != "" {
+		region = volume.Region
+	}
+	svc := e.getService(region)
+
+	zone := volume.Details["availability_zone"]
+	if zone == "" {
+		zone = region + "a"
+	}
+
+	opts := ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String(zone),
+		Size:             aws.Int64(int64(volume.SizeGB)),
+		VolumeType:       aws.String("gp2"),
+	}
+	if volume.Name != "" {
+		opts.TagSpecifications = []*ec2.TagSpecification{{
+			ResourceType: aws.String("volume"),
+			Tags: []*ec2.Tag{{
+				Key:   aws.String("Name"),
+				Value: aws.String(volume.Name),
+			}},
+		}}
+	}
+
+	apiVolume, err := svc.CreateVolumeWithContext(e.context(), &opts)
+	if err != nil {
+		return nil, e.mapError(err)
+	} else {
+		return e.mapVolume(apiVolume, region), nil
+	}
+}
+
+// Returns the configured regions, or else the regions enabled for the account.
+func (e *EC2) listRegions() ([]string, error) {
+	if len(e.Regions) > 0 {
+		return e.Regions, nil
+	}
+	resp, err := e.getService(DEFAULT_REGION).DescribeRegionsWithContext(e.context(), &ec2.DescribeRegionsInput{})
+	if err != nil {
+		return nil, e.mapError(err)
+	}
+	regions := make([]string, len(resp.Regions))
+	for i, region := range resp.Regions {
+		regions[i] = String(region.RegionName)
+	}
+	return regions, nil
+}
+
+// Calls f concurrently for each searched region, and returns the first error
+// in region order.
+func (e *EC2) eachRegion(f func(region string) error) error {
+	regions, err := e.listRegions()
+	if err != nil {
+		return fmt.Errorf("error listing regions: %w", err)
 	}
-	return common.MatchFlavor(flavor, flavors), nil
+	errs := make([]error, len(regions))
+	var wg sync.WaitGroup
+	for i, region := range regions {
+		wg.Add(1)
+		go func(i int, region string) {
+			defer wg.Done()
+			errs[i] = f(region)
+		}(i, region)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *EC2) ListVolumes() ([]*compute.Volume, error) {
+	regions, err := e.listRegions()
+	if err != nil {
+		return nil, fmt.Errorf("error listing regions: %w", e.mapError(err))
+	}
+
+	var volumes []*compute.Volume
+	for _, region := range regions {
+		err := e.getService(region).DescribeVolumesPagesWithContext(e.context(), &ec2.DescribeVolumesInput{}, func(page *ec2.DescribeVolumesOutput, lastPage bool) bool {
+			for _, apiVolume := range page.Volumes {
+				volumes = append(volumes, e.mapVolume(apiVolume, region))
+			}
+			return true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error listing volumes in %s: %w", region, e.mapError(err))
+		}
+	}
+	return volumes, nil
+}
+
+func (e *EC2) getVolume(id string, svc *ec2.EC2) (*ec2.Volume, error) {
+	resp, err := svc.DescribeVolumesWithContext(e.context(), &ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(id)},
+	})
+	if err != nil {
+		return nil, e.mapError(err)
+	} else if len(resp.Volumes) != 1 {
+		return nil, fmt.Errorf("DescribeVolumes returned %d volumes, but expected a single volume", len(resp.Volumes))
+	} else {
+		return resp.Volumes[0], nil
+	}
+}
+
+func (e *EC2) GetVolume(volumeID string) (*compute.Volume, error) {
+	id, region := decodeID(volumeID)
+	svc := e.getService(region)
+	apiVolume, err := e.getVolume(id, svc)
+	if err != nil {
+		return nil, err
+	} else {
+		return e.mapVolume(apiVolume, region), nil
+	}
+}
+
+func (e *EC2) DeleteVolume(volumeID string) error {
+	return e.regionAction(volumeID, func(id string, svc *ec2.EC2) error {
+		_, err := svc.DeleteVolumeWithContext(e.context(), &ec2.DeleteVolumeInput{
+			VolumeId: aws.String(id),
+		})
+		return e.mapError(err)
+	})
+}
+
+// Returns the first device name from /dev/sdf through /dev/sdp that is not
+// used by any block device on the instance.
+func (e *EC2) findFreeDevice(instance *ec2.Instance) (string, error) {
+	used := make(map[string]bool)
+	for _, mapping := range instance.BlockDeviceMappings {
+		used[String(mapping.DeviceName)] = true
+	}
+	for c := 'f'; c <= 'p'; c++ {
+		device := fmt.Sprintf("/dev/sd%c", c)
+		if !used[device] {
+			return device, nil
+		}
+	}
+	return "", errors.New("no free device name on instance")
+}
+
+func (e *EC2) AttachVolume(volumeID string, instanceID string) error {
+	id, region := decodeID(volumeID)
+	instanceID, instanceRegion := decodeID(instanceID)
+	if region != instanceRegion {
+		return fmt.Errorf("volume region %s does not match instance region %s", region, instanceRegion)
+	}
+	svc := e.getService(region)
+
+	instance, err := e.getInstance(instanceID, svc)
+	if err != nil {
+		return err
+	}
+	device, err := e.findFreeDevice(instance)
+	if err != nil {
+		return err
+	}
+
+	_, err = svc.AttachVolumeWithContext(e.context(), &ec2.AttachVolumeInput{
+		VolumeId:   aws.String(id),
+		InstanceId: aws.String(instanceID),
+		Device:     aws.String(device),
+	})
+	return e.mapError(err)
+}
+
+func (e *EC2) DetachVolume(volumeID string) error {
+	return e.regionAction(volumeID, func(id string, svc *ec2.EC2) error {
+		_, err := svc.DetachVolumeWithContext(e.context(), &ec2.DetachVolumeInput{
+			VolumeId: aws.String(id),
+		})
+		return e.mapError(err)
+	})
+}
+
+func (e *EC2) ResizeVolume(volumeID string, sizeGB int) error {
+	return e.regionAction(volumeID, func(id string, svc *ec2.EC2) error {
+		_, err := svc.ModifyVolumeWithContext(e.context(), &ec2.ModifyVolumeInput{
+			VolumeId: aws.String(id),
+			Size:     aws.Int64(int64(sizeGB)),
+		})
+		return e.mapError(err)
+	})
 }
@@ -0,0 +1,290 @@
+package ec2
+
+import "github.com/LunaNode/cloug/provider/common"
+import "github.com/LunaNode/cloug/provider/ec2/simulator"
+import "github.com/LunaNode/cloug/service/compute"
+import "github.com/LunaNode/cloug/service/compute/conformance"
+
+import "github.com/aws/aws-sdk-go/aws"
+import "github.com/aws/aws-sdk-go/service/ec2"
+
+import "errors"
+import "fmt"
+import "regexp"
+import "strings"
+import "testing"
+import "time"
+
+const CANONICAL_OWNER_ID = "099720109477"
+const AMAZON_OWNER_ID = "137112412989"
+
+// Starts a simulator and a provider that sends its requests to it.
+func makeTestEC2(t *testing.T) (*EC2, *simulator.Server) {
+	server := simulator.NewServer("AKIDEXAMPLE", "secret")
+	e, err := MakeEC2("AKIDEXAMPLE", "secret", "", common.WithAPIURL(server.URL))
+	if err != nil {
+		server.Close()
+		t.Fatalf("error initializing provider: %v", err)
+	}
+	return e, server
+}
+
+func addImage(server *simulator.Server, region string, owner string, name string, arch string, created string) string {
+	return server.AddImage(region, &ec2.Image{
+		Name:         aws.String(name),
+		OwnerId:      aws.String(owner),
+		Public:       aws.Bool(owner != simulator.OWNER_ID),
+		Architecture: aws.String(arch),
+		CreationDate: aws.String(created),
+	})
+}
+
+func TestConformance(t *testing.T) {
+	e, server := makeTestEC2(t)
+	defer server.Close()
+	imageID := addImage(server, DEFAULT_REGION, CANONICAL_OWNER_ID, "ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-amd64-server-20240301", "x86_64", "2024-03-01T00:00:00.000Z")
+
+	conformance.Run(t, e, &conformance.Config{
+		Instance: compute.Instance{
+			Image:  compute.Image{ID: encodeID(imageID, DEFAULT_REGION)},
+			Flavor: compute.Flavor{MemoryMB: 1024},
+		},
+		PublicKey:    []byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJ0S1uMTNPZdfSW6GYaCwMPPVM4oFgNbXx0DMSWf1b4I conformance"),
+		VolumeSizeGB: 10,
+		Wait:         compute.WaitOptions{Interval: 10 * time.Millisecond},
+	})
+}
+
+func TestFindImage(t *testing.T) {
+	e, server := makeTestEC2(t)
+	defer server.Close()
+	own := addImage(server, DEFAULT_REGION, simulator.OWNER_ID, "my-image", "x86_64", "2023-01-01T00:00:00.000Z")
+	// the newest images are neither the first nor the last that are listed
+	addImage(server, DEFAULT_REGION, CANONICAL_OWNER_ID, "ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-amd64-server-20240101", "x86_64", "2024-01-01T00:00:00.000Z")
+	focal := addImage(server, DEFAULT_REGION, CANONICAL_OWNER_ID, "ubuntu/images/hvm-ssd/ubuntu-focal-20.04-amd64-server-20240501", "x86_64", "2024-05-01T00:00:00.000Z")
+	jammy := addImage(server, DEFAULT_REGION, CANONICAL_OWNER_ID, "ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-amd64-server-20240301", "x86_64", "2024-03-01T00:00:00.000Z")
+	addImage(server, DEFAULT_REGION, CANONICAL_OWNER_ID, "ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-amd64-server-20240201", "x86_64", "2024-02-01T00:00:00.000Z")
+	addImage(server, DEFAULT_REGION, CANONICAL_OWNER_ID, "ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-amd64-minimal-20240601", "x86_64", "2024-06-01T00:00:00.000Z")
+	jammyARM := addImage(server, DEFAULT_REGION, CANONICAL_OWNER_ID, "ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-arm64-server-20240301", "arm64", "2024-03-01T00:00:00.000Z")
+	al2 := addImage(server, DEFAULT_REGION, AMAZON_OWNER_ID, "amzn2-ami-hvm-2.0.20240306.2-x86_64-gp2", "x86_64", "2024-03-06T00:00:00.000Z")
+	al2023 := addImage(server, DEFAULT_REGION, AMAZON_OWNER_ID, "al2023-ami-2023.3.20240312.0-kernel-6.1-x86_64", "x86_64", "2024-03-12T00:00:00.000Z")
+	euJammy := addImage(server, "eu-west-1", CANONICAL_OWNER_ID, "ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-amd64-server-20240201", "x86_64", "2024-02-01T00:00:00.000Z")
+
+	tests := []struct {
+		image compute.Image
+		id    string
+	}{
+		{compute.Image{Name: "my-image"}, encodeID(own, DEFAULT_REGION)},
+		// the newest amd64 server image of any version; the newer minimal
+		// image does not match the name patterns
+		{compute.Image{}, encodeID(focal, DEFAULT_REGION)},
+		{compute.Image{Version: "22.04"}, encodeID(jammy, DEFAULT_REGION)},
+		{compute.Image{Version: "22"}, encodeID(jammy, DEFAULT_REGION)},
+		{compute.Image{Version: "20"}, encodeID(focal, DEFAULT_REGION)},
+		{compute.Image{Version: "2"}, ""},
+		{compute.Image{Version: "22.0"}, ""},
+		{compute.Image{Distribution: "Ubuntu", Version: "22.04", Architecture: compute.ArchARM64}, encodeID(jammyARM, DEFAULT_REGION)},
+		{compute.Image{Distribution: "amazon"}, encodeID(al2023, DEFAULT_REGION)},
+		{compute.Image{Distribution: "amazon", Version: "2"}, encodeID(al2, DEFAULT_REGION)},
+		{compute.Image{Version: "22.04", Regions: []string{"eu-west-1"}}, encodeID(euJammy, "eu-west-1")},
+		{compute.Image{Version: "20.04", Regions: []string{"eu-west-1"}}, ""},
+		{compute.Image{Name: "my-image", Regions: []string{"eu-west-1"}}, ""},
+		{compute.Image{Distribution: "debian"}, ""},
+	}
+	for _, test := range tests {
+		id, err := e.FindImage(&test.image)
+		if err != nil {
+			t.Fatalf("FindImage(%+v): %v", test.image, err)
+		} else if id != test.id {
+			t.Fatalf("FindImage(%+v): expected %q, got %q", test.image, test.id, id)
+		}
+	}
+}
+
+// Instance and image IDs carry the region, which every later call must use.
+func TestRegionIDs(t *testing.T) {
+	e, server := makeTestEC2(t)
+	defer server.Close()
+	imageID := encodeID(addImage(server, "eu-west-1", CANONICAL_OWNER_ID, "ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-amd64-server-20240201", "x86_64", "2024-02-01T00:00:00.000Z"), "eu-west-1")
+
+	instance, err := e.CreateInstance(&compute.Instance{
+		Region: "eu-west-1",
+		Image:  compute.Image{ID: imageID},
+		Flavor: compute.Flavor{MemoryMB: 1024},
+	})
+	if err != nil {
+		t.Fatalf("CreateInstance: %v", err)
+	} else if !strings.HasPrefix(instance.ID, "eu-west-1:i-") {
+		t.Fatalf("expected an instance ID in eu-west-1, got %s", instance.ID)
+	}
+	fetched, err := e.GetInstance(instance.ID)
+	if err != nil {
+		t.Fatalf("GetInstance: %v", err)
+	} else if fetched.ID != instance.ID || fetched.Region != "eu-west-1" || fetched.Image.ID != imageID {
+		t.Fatalf("unexpected instance %s in %s from image %s", fetched.ID, fetched.Region, fetched.Image.ID)
+	}
+
+	// the instance does not exist in other regions, including the default
+	// region that an ID without a region refers to
+	rawID, _ := decodeID(instance.ID)
+	for _, id := range []string{encodeID(rawID, "us-east-1"), rawID, "eu-west-1:i-0123456789abcdef0"} {
+		if _, err := e.GetInstance(id); !errors.Is(err, compute.ErrNotFound) {
+			t.Fatalf("GetInstance(%s): expected not found, got %v", id, err)
+		}
+	}
+
+	// an image is not looked up in another region than the instance's
+	_, err = e.CreateInstance(&compute.Instance{
+		Region: "us-east-1",
+		Image:  compute.Image{ID: imageID},
+		Flavor: compute.Flavor{MemoryMB: 1024},
+	})
+	if !errors.Is(err, compute.ErrNotFound) {
+		t.Fatalf("expected not found for an image from eu-west-1 in us-east-1, got %v", err)
+	}
+
+	instances, err := e.ListInstances()
+	if err != nil {
+		t.Fatalf("ListInstances: %v", err)
+	} else if len(instances) != 1 || instances[0].ID != instance.ID {
+		t.Fatalf("expected only instance %s, got %v", instance.ID, instances)
+	}
+
+	// an error in any region fails the listing
+	server.Faults = []simulator.Fault{{Region: "us-east-1", Code: "AuthFailure"}}
+	if _, err := e.ListInstances(); !errors.Is(err, compute.ErrAuth) {
+		t.Fatalf("expected auth error from us-east-1, got %v", err)
+	} else if _, err := e.ListVolumes(); !errors.Is(err, compute.ErrAuth) {
+		t.Fatalf("expected auth error from ListVolumes, got %v", err)
+	}
+}
+
+func TestListFlavors(t *testing.T) {
+	e, server := makeTestEC2(t)
+	defer server.Close()
+	e.Regions = []string{"us-east-1", "eu-west-1"}
+
+	flavors, err := e.ListFlavors()
+	if err != nil {
+		t.Fatalf("ListFlavors: %v", err)
+	}
+	var ids []string
+	for _, flavor := range flavors {
+		ids = append(ids, flavor.ID)
+	}
+	// x86_64 first, then current generation, then by memory and cores
+	if fmt.Sprint(ids) != "[t3.nano t3.micro t3.small t2.micro t4g.micro]" {
+		t.Fatalf("unexpected flavor order %v", ids)
+	} else if fmt.Sprint(flavors[1].Regions) != "[eu-west-1 us-east-1]" || flavors[1].MemoryMB != 1024 || flavors[1].NumCores != 2 {
+		t.Fatalf("unexpected t3.micro flavor %+v", flavors[1])
+	}
+
+	// the catalog is cached, and not affected by changes to returned flavors
+	flavors[0].MemoryMB = 0
+	flavors[1].Regions[0] = "changed"
+	server.Faults = []simulator.Fault{{Action: "DescribeInstanceTypes", Code: "AuthFailure"}}
+	flavors, err = e.ListFlavors()
+	if err != nil {
+		t.Fatalf("ListFlavors from the cache: %v", err)
+	} else if flavors[0].MemoryMB != 512 || flavors[1].Regions[0] != "eu-west-1" {
+		t.Fatalf("cached flavors were modified: %+v, %+v", flavors[0], flavors[1])
+	}
+	if id, err := e.FindFlavor(&compute.Flavor{MemoryMB: 1024, DiskGB: 20}); err != nil || id != "t3.micro" {
+		t.Fatalf("expected t3.micro for 1 GB, got %q, %v", id, err)
+	}
+
+	uncached, err := MakeEC2("AKIDEXAMPLE", "secret", "", common.WithAPIURL(server.URL))
+	if err != nil {
+		t.Fatalf("error initializing provider: %v", err)
+	} else if _, err := uncached.FindFlavor(&compute.Flavor{MemoryMB: 1024}); !errors.Is(err, compute.ErrAuth) {
+		t.Fatalf("expected auth error from FindFlavor, got %v", err)
+	}
+}
+
+func TestSetPlacement(t *testing.T) {
+	tests := []struct {
+		networkID string
+		details   map[string]string
+		expected  string
+	}{
+		{"", nil, `{}`},
+		{"subnet-1", map[string]string{"security_groups": "sg-1, sg-2"}, `{SecurityGroupIds:["sg-1","sg-2"],SubnetId:"subnet-1"}`},
+		{"subnet-1", map[string]string{"security_groups": "sg-1", "public_ip": "true"}, `{NetworkInterfaces:[{AssociatePublicIpAddress:true,DeviceIndex:0,Groups:["sg-1"],SubnetId:"subnet-1"}]}`},
+		{"", map[string]string{"public_ip": "false"}, `{NetworkInterfaces:[{AssociatePublicIpAddress:false,DeviceIndex:0}]}`},
+	}
+	e := &EC2{}
+	space := regexp.MustCompile(`\s+`)
+	for _, test := range tests {
+		var opts ec2.RunInstancesInput
+		err := e.setPlacement(nil, &compute.Instance{NetworkID: test.networkID, Details: test.details}, &opts)
+		if err != nil {
+			t.Fatalf("setPlacement(%s, %v): %v", test.networkID, test.details, err)
+		}
+		// the AWS types print their set fields on one line
+		if actual := space.ReplaceAllString(opts.String(), ""); actual != test.expected {
+			t.Fatalf("setPlacement(%s, %v): expected %s, got %s", test.networkID, test.details, test.expected, actual)
+		}
+	}
+
+	var opts ec2.RunInstancesInput
+	err := e.setPlacement(nil, &compute.Instance{Details: map[string]string{"public_ip": "yes"}}, &opts)
+	if !errors.Is(err, compute.ErrInvalidArgument) {
+		t.Fatalf("expected invalid argument error for public_ip yes, got %v", err)
+	}
+}
+
+func TestManagedSecurityGroup(t *testing.T) {
+	e, server := makeTestEC2(t)
+	defer server.Close()
+	svc := e.getService(DEFAULT_REGION)
+	instance := &compute.Instance{Details: map[string]string{"ssh_security_group": "true"}}
+	findGroups := func() []*ec2.SecurityGroup {
+		resp, err := svc.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+			Filters: []*ec2.Filter{{Name: aws.String("group-name"), Values: []*string{aws.String(MANAGED_SECURITY_GROUP)}}},
+		})
+		if err != nil {
+			t.Fatalf("DescribeSecurityGroups: %v", err)
+		}
+		return resp.SecurityGroups
+	}
+
+	// a new group is deleted if the SSH rule cannot be added to it
+	server.Faults = []simulator.Fault{{Action: "AuthorizeSecurityGroupIngress", Code: "UnauthorizedOperation"}}
+	var opts ec2.RunInstancesInput
+	if err := e.setPlacement(svc, instance, &opts); !errors.Is(err, compute.ErrAuth) {
+		t.Fatalf("expected auth error, got %v", err)
+	} else if groups := findGroups(); len(groups) != 0 {
+		t.Fatalf("expected the group to be deleted, got %v", groups)
+	}
+
+	// an existing group without the SSH rule gets it
+	server.Faults = nil
+	vpcs, err := svc.DescribeVpcs(&ec2.DescribeVpcsInput{})
+	if err != nil {
+		t.Fatalf("DescribeVpcs: %v", err)
+	}
+	created, err := svc.CreateSecurityGroup(&ec2.CreateSecurityGroupInput{
+		GroupName:   aws.String(MANAGED_SECURITY_GROUP),
+		Description: aws.String("without SSH"),
+		VpcId:       vpcs.Vpcs[0].VpcId,
+	})
+	if err != nil {
+		t.Fatalf("CreateSecurityGroup: %v", err)
+	}
+	if err := e.setPlacement(svc, instance, &opts); err != nil {
+		t.Fatalf("setPlacement: %v", err)
+	} else if len(opts.SecurityGroupIds) != 1 || *opts.SecurityGroupIds[0] != *created.GroupId {
+		t.Fatalf("expected security group %s, got %v", *created.GroupId, opts.SecurityGroupIds)
+	} else if groups := findGroups(); len(groups) != 1 || !allowsSSH(groups[0]) {
+		t.Fatalf("expected one group that allows SSH, got %v", groups)
+	}
+
+	// a group with the SSH rule is used as is
+	server.Faults = []simulator.Fault{{Action: "AuthorizeSecurityGroupIngress", Code: "UnauthorizedOperation"}}
+	opts = ec2.RunInstancesInput{}
+	if err := e.setPlacement(svc, instance, &opts); err != nil {
+		t.Fatalf("setPlacement: %v", err)
+	} else if len(opts.SecurityGroupIds) != 1 || *opts.SecurityGroupIds[0] != *created.GroupId {
+		t.Fatalf("expected security group %s, got %v", *created.GroupId, opts.SecurityGroupIds)
+	}
+}
@@ -1,5 +1,6 @@
 package ec2
 
+import "github.com/LunaNode/cloug/provider/common"
 import "github.com/LunaNode/cloug/service/compute"
 
 import "encoding/json"
@@ -8,13 +9,22 @@ type EC2JSONConfig struct {
 	KeyID     string `json:"key_id"`
 	SecretKey string `json:"secret_key"`
 	Token     string `json:"token"`
+	APIURL    string `json:"api_url"`
+
+	// Regions searched by list operations; defaults to all enabled regions.
+	Regions []string `json:"regions"`
 }
 
-func EC2FromJSON(jsonData []byte) (compute.Provider, error) {
+func EC2FromJSON(jsonData []byte, options ...common.Option) (compute.Provider, error) {
 	var cfg EC2JSONConfig
 	err := json.Unmarshal(jsonData, &cfg)
 	if err != nil {
 		return nil, err
 	}
-	return MakeEC2(cfg.KeyID, cfg.SecretKey, cfg.Token)
+	e, err := MakeEC2(cfg.KeyID, cfg.SecretKey, cfg.Token, append([]common.Option{common.WithAPIURL(cfg.APIURL)}, options...)...)
+	if err != nil {
+		return nil, err
+	}
+	e.Regions = cfg.Regions
+	return e, nil
 }
@@ -0,0 +1,978 @@
+// Package simulator provides a local stand-in for the EC2 query API.
+//
+// The server verifies the SigV4 signature of every request and takes the
+// region from its credential scope, so one server stands in for every
+// regional endpoint. Instances, images, snapshots, volumes, key pairs and
+// security groups are kept in memory per region, and responses are encoded
+// from the AWS SDK output shapes, so that the compute adapter can be tested
+// without an account.
+package simulator
+
+import "github.com/aws/aws-sdk-go/aws"
+import "github.com/aws/aws-sdk-go/aws/credentials"
+import "github.com/aws/aws-sdk-go/aws/signer/v4"
+import "github.com/aws/aws-sdk-go/service/ec2"
+
+import "bytes"
+import "encoding/base64"
+import "encoding/xml"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "net/http/httptest"
+import "net/url"
+import "path"
+import "reflect"
+import "regexp"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+const XMLNS = "http://ec2.amazonaws.com/doc/2016-11-15/"
+
+// Account that owns the images created through the simulator.
+const OWNER_ID = "123456789012"
+
+var REGIONS = []string{"us-west-2", "us-east-1", "eu-west-1"}
+
+// Instance types offered in every region.
+var INSTANCE_TYPES = []*ec2.InstanceTypeInfo{
+	instanceType("t3.nano", "x86_64", true, 2, 512),
+	instanceType("t3.micro", "x86_64", true, 2, 1024),
+	instanceType("t3.small", "x86_64", true, 2, 2048),
+	instanceType("t2.micro", "x86_64", false, 1, 1024),
+	instanceType("t4g.micro", "arm64", true, 2, 1024),
+}
+
+func instanceType(name string, arch string, currentGen bool, cores int64, memoryMiB int64) *ec2.InstanceTypeInfo {
+	return &ec2.InstanceTypeInfo{
+		InstanceType:      aws.String(name),
+		CurrentGeneration: aws.Bool(currentGen),
+		VCpuInfo:          &ec2.VCpuInfo{DefaultVCpus: aws.Int64(cores)},
+		MemoryInfo:        &ec2.MemoryInfo{SizeInMiB: aws.Int64(memoryMiB)},
+		ProcessorInfo:     &ec2.ProcessorInfo{SupportedArchitectures: []*string{aws.String(arch)}},
+	}
+}
+
+var credentialRegexp = regexp.MustCompile(`Credential=([^/]+)/(\d{8})/([^/]+)/ec2/aws4_request`)
+var signedHeadersRegexp = regexp.MustCompile(`SignedHeaders=([^,]+)`)
+
+// Error returned for requests that match the region and action; an empty
+// field matches anything.
+type Fault struct {
+	Region string
+	Action string
+	Code   string
+}
+
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (err *apiError) Error() string {
+	return err.code + ": " + err.message
+}
+
+func clientError(code string, format string, args ...interface{}) *apiError {
+	return &apiError{http.StatusBadRequest, code, fmt.Sprintf(format, args...)}
+}
+
+// An object whose state changes to target after a number of describe requests.
+type transition struct {
+	target       string
+	pendingPolls int
+}
+
+func (t *transition) advance(state *string) {
+	if t.target == "" {
+		return
+	} else if t.pendingPolls > 0 {
+		t.pendingPolls--
+		return
+	}
+	*state = t.target
+	t.target = ""
+}
+
+type instance struct {
+	*ec2.Instance
+	transition
+}
+
+type image struct {
+	*ec2.Image
+	transition
+}
+
+type volume struct {
+	*ec2.Volume
+	transition
+}
+
+type region struct {
+	name           string
+	vpcID          string
+	subnetID       string
+	instances      map[string]*instance
+	images         map[string]*image
+	snapshots      map[string]bool
+	volumes        map[string]*volume
+	keyPairs       map[string]bool
+	securityGroups map[string]*ec2.SecurityGroup
+}
+
+// Server is an EC2 API simulator listening on a local port.
+type Server struct {
+	*httptest.Server
+
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// Number of describe requests for which objects stay in a transitional
+	// state, like pending or stopping.
+	PendingPolls int
+
+	// Errors injected into matching requests.
+	Faults []Fault
+
+	mu      sync.Mutex
+	nextID  int
+	regions map[string]*region
+}
+
+// Starts a simulator that accepts requests signed with the given credentials.
+// There are no images until they are added with AddImage.
+func NewServer(accessKeyID string, secretAccessKey string) *Server {
+	s := &Server{
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		PendingPolls:    1,
+		regions:         make(map[string]*region),
+	}
+	for _, name := range REGIONS {
+		s.regions[name] = &region{
+			name:           name,
+			vpcID:          s.newID("vpc"),
+			subnetID:       s.newID("subnet"),
+			instances:      make(map[string]*instance),
+			images:         make(map[string]*image),
+			snapshots:      make(map[string]bool),
+			volumes:        make(map[string]*volume),
+			keyPairs:       make(map[string]bool),
+			securityGroups: make(map[string]*ec2.SecurityGroup),
+		}
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Adds an available image to the region, and returns its ID. The image ID,
+// state and block device mappings are filled in if unset.
+func (s *Server) AddImage(regionName string, apiImage *ec2.Image) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.regions[regionName]
+	if apiImage.ImageId == nil {
+		apiImage.ImageId = aws.String(s.newID("ami"))
+	}
+	if apiImage.State == nil {
+		apiImage.State = aws.String("available")
+	}
+	if apiImage.BlockDeviceMappings == nil {
+		snapshotID := s.newID("snap")
+		r.snapshots[snapshotID] = true
+		apiImage.BlockDeviceMappings = []*ec2.BlockDeviceMapping{{
+			DeviceName: aws.String("/dev/xvda"),
+			Ebs:        &ec2.EbsBlockDevice{SnapshotId: aws.String(snapshotID), VolumeSize: aws.Int64(8)},
+		}}
+	}
+	r.images[*apiImage.ImageId] = &image{Image: apiImage}
+	return *apiImage.ImageId
+}
+
+func (s *Server) newID(prefix string) string {
+	s.nextID++
+	return fmt.Sprintf("%s-%017x", prefix, s.nextID)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	form, _ := url.ParseQuery(string(body))
+	action := form.Get("Action")
+
+	var buf bytes.Buffer
+	output, err := s.handle(r, body, form)
+	if err == nil {
+		buf.WriteString(xml.Header)
+		fmt.Fprintf(&buf, `<%sResponse xmlns="%s"><requestId>%s</requestId>`, action, XMLNS, s.requestID())
+		encoder := xml.NewEncoder(&buf)
+		if err := encodeFields(encoder, reflect.ValueOf(output)); err != nil {
+			panic(err)
+		}
+		encoder.Flush()
+		fmt.Fprintf(&buf, "</%sResponse>", action)
+		w.Header().Set("Content-Type", "text/xml;charset=UTF-8")
+	} else {
+		buf.WriteString(xml.Header)
+		buf.WriteString("<Response><Errors><Error><Code>")
+		xml.EscapeText(&buf, []byte(err.code))
+		buf.WriteString("</Code><Message>")
+		xml.EscapeText(&buf, []byte(err.message))
+		fmt.Fprintf(&buf, "</Message></Error></Errors><RequestID>%s</RequestID></Response>", s.requestID())
+		w.Header().Set("Content-Type", "text/xml;charset=UTF-8")
+		w.WriteHeader(err.status)
+	}
+	w.Write(buf.Bytes())
+}
+
+func (s *Server) requestID() string {
+	return fmt.Sprintf("%08x-0000-4000-8000-000000000000", time.Now().UnixNano()&0xffffffff)
+}
+
+// Checks the SigV4 signature by signing a copy of the request that has only
+// the signed headers, and returns the region of the credential scope.
+func (s *Server) verifySignature(r *http.Request, body []byte) (string, *apiError) {
+	authorization := r.Header.Get("Authorization")
+	credential := credentialRegexp.FindStringSubmatch(authorization)
+	signedHeaders := signedHeadersRegexp.FindStringSubmatch(authorization)
+	if credential == nil || signedHeaders == nil {
+		return "", &apiError{http.StatusUnauthorized, "AuthFailure", "missing or malformed Authorization header"}
+	} else if credential[1] != s.AccessKeyID {
+		return "", &apiError{http.StatusUnauthorized, "AuthFailure", "AWS was not able to validate the provided access credentials"}
+	}
+	signTime, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return "", &apiError{http.StatusUnauthorized, "AuthFailure", "missing or malformed X-Amz-Date"}
+	}
+
+	signed, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	for _, header := range strings.Split(signedHeaders[1], ";") {
+		if header != "host" {
+			signed.Header.Set(header, r.Header.Get(header))
+		}
+	}
+	signer := v4.NewSigner(credentials.NewStaticCredentials(s.AccessKeyID, s.SecretAccessKey, ""))
+	if _, err := signer.Sign(signed, bytes.NewReader(body), "ec2", credential[3], signTime); err != nil {
+		return "", &apiError{http.StatusUnauthorized, "AuthFailure", err.Error()}
+	} else if signed.Header.Get("Authorization") != authorization {
+		return "", &apiError{http.StatusUnauthorized, "AuthFailure", "request signature does not match"}
+	}
+	return credential[3], nil
+}
+
+func (s *Server) handle(r *http.Request, body []byte, form url.Values) (interface{}, *apiError) {
+	regionName, err := s.verifySignature(r, body)
+	if err != nil {
+		return nil, err
+	}
+	action := form.Get("Action")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, fault := range s.Faults {
+		if (fault.Region == "" || fault.Region == regionName) && (fault.Action == "" || fault.Action == action) {
+			return nil, clientError(fault.Code, "injected %s error", fault.Code)
+		}
+	}
+	region := s.regions[regionName]
+	if region == nil {
+		return nil, &apiError{http.StatusUnauthorized, "AuthFailure", "region " + regionName + " is not enabled for this account"}
+	}
+
+	switch action {
+	case "DescribeRegions":
+		output := &ec2.DescribeRegionsOutput{}
+		for _, name := range REGIONS {
+			output.Regions = append(output.Regions, &ec2.Region{
+				RegionName: aws.String(name),
+				Endpoint:   aws.String("ec2." + name + ".amazonaws.com"),
+			})
+		}
+		return output, nil
+	case "DescribeInstanceTypes":
+		return &ec2.DescribeInstanceTypesOutput{InstanceTypes: INSTANCE_TYPES}, nil
+	case "RunInstances":
+		return s.runInstances(region, form)
+	case "DescribeInstances":
+		return s.describeInstances(region, form)
+	case "StartInstances", "StopInstances", "TerminateInstances", "RebootInstances":
+		return s.instanceAction(region, action, form)
+	case "CreateImage":
+		return s.createImage(region, form)
+	case "DescribeImages":
+		return s.describeImages(region, form)
+	case "DeregisterImage":
+		image, err := findImage(region, form.Get("ImageId"))
+		if err != nil {
+			return nil, err
+		}
+		delete(region.images, *image.ImageId)
+		return &ec2.DeregisterImageOutput{}, nil
+	case "DeleteSnapshot":
+		return s.deleteSnapshot(region, form.Get("SnapshotId"))
+	case "CreateVolume":
+		return s.createVolume(region, form)
+	case "DescribeVolumes":
+		return s.describeVolumes(region, form)
+	case "DeleteVolume", "AttachVolume", "DetachVolume", "ModifyVolume":
+		return s.volumeAction(region, action, form)
+	case "ImportKeyPair":
+		name := form.Get("KeyName")
+		if region.keyPairs[name] {
+			return nil, clientError("InvalidKeyPair.Duplicate", "The keypair '%s' already exists.", name)
+		} else if _, err := base64.StdEncoding.DecodeString(form.Get("PublicKeyMaterial")); err != nil || name == "" {
+			return nil, clientError("InvalidParameterValue", "Value for parameter PublicKeyMaterial is invalid.")
+		}
+		region.keyPairs[name] = true
+		return &ec2.ImportKeyPairOutput{KeyName: aws.String(name), KeyFingerprint: aws.String("00:00")}, nil
+	case "DeleteKeyPair":
+		delete(region.keyPairs, form.Get("KeyName"))
+		return &ec2.DeleteKeyPairOutput{}, nil
+	case "DescribeVpcs":
+		return &ec2.DescribeVpcsOutput{Vpcs: []*ec2.Vpc{{VpcId: aws.String(region.vpcID), IsDefault: aws.Bool(true)}}}, nil
+	case "DescribeSubnets":
+		for _, subnetID := range listParam(form, "SubnetId") {
+			if subnetID != region.subnetID {
+				return nil, clientError("InvalidSubnetID.NotFound", "The subnet ID '%s' does not exist", subnetID)
+			}
+		}
+		return &ec2.DescribeSubnetsOutput{Subnets: []*ec2.Subnet{{SubnetId: aws.String(region.subnetID), VpcId: aws.String(region.vpcID)}}}, nil
+	case "DescribeSecurityGroups":
+		return s.describeSecurityGroups(region, form), nil
+	case "CreateSecurityGroup":
+		return s.createSecurityGroup(region, form)
+	case "AuthorizeSecurityGroupIngress":
+		return s.authorizeIngress(region, form)
+	case "DeleteSecurityGroup":
+		groupID := form.Get("GroupId")
+		if region.securityGroups[groupID] == nil {
+			return nil, clientError("InvalidGroup.NotFound", "The security group '%s' does not exist", groupID)
+		}
+		delete(region.securityGroups, groupID)
+		return &ec2.DeleteSecurityGroupOutput{}, nil
+	default:
+		return nil, clientError("InvalidAction", "The action %s is not valid for this web service.", action)
+	}
+}
+
+// Returns the values of a list parameter, like InstanceId.1 and InstanceId.2.
+func listParam(form url.Values, name string) []string {
+	var values []string
+	for i := 1; form.Get(fmt.Sprintf("%s.%d", name, i)) != ""; i++ {
+		values = append(values, form.Get(fmt.Sprintf("%s.%d", name, i)))
+	}
+	return values
+}
+
+// Returns the values of each Filter.N.Name.
+func filterParam(form url.Values) map[string][]string {
+	filters := make(map[string][]string)
+	for i := 1; form.Get(fmt.Sprintf("Filter.%d.Name", i)) != ""; i++ {
+		name := form.Get(fmt.Sprintf("Filter.%d.Name", i))
+		filters[name] = append(filters[name], listParam(form, fmt.Sprintf("Filter.%d.Value", i))...)
+	}
+	return filters
+}
+
+// Returns whether value matches one of the filter patterns, or true if there
+// is no filter.
+func matchFilter(patterns []string, value string) bool {
+	if patterns == nil {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the format of an ID, like EC2 does before looking it up.
+func checkID(prefix string, id string, codePrefix string) *apiError {
+	if !regexp.MustCompile(`^` + prefix + `-[0-9a-f]{8,17}$`).MatchString(id) {
+		return clientError(codePrefix+".Malformed", "Invalid id: \"%s\"", id)
+	}
+	return nil
+}
+
+// instances
+
+func (s *Server) findInstance(region *region, id string) (*instance, *apiError) {
+	if err := checkID("i", id, "InvalidInstanceID"); err != nil {
+		return nil, err
+	} else if instance := region.instances[id]; instance != nil {
+		return instance, nil
+	}
+	return nil, clientError("InvalidInstanceID.NotFound", "The instance ID '%s' does not exist", id)
+}
+
+func (s *Server) runInstances(region *region, form url.Values) (interface{}, *apiError) {
+	imageID := form.Get("ImageId")
+	image, err := findImage(region, imageID)
+	if err != nil {
+		return nil, err
+	} else if *image.State != "available" {
+		return nil, clientError("InvalidAMIID.Unavailable", "The image id '[%s]' is not available", imageID)
+	}
+	var instanceType *ec2.InstanceTypeInfo
+	for _, info := range INSTANCE_TYPES {
+		if *info.InstanceType == form.Get("InstanceType") {
+			instanceType = info
+		}
+	}
+	if instanceType == nil {
+		return nil, clientError("InvalidParameterValue", "Invalid value '%s' for InstanceType.", form.Get("InstanceType"))
+	} else if form.Get("MinCount") != "1" || form.Get("MaxCount") != "1" {
+		return nil, clientError("InvalidParameterCombination", "only single instances are simulated")
+	} else if name := form.Get("KeyName"); name != "" && !region.keyPairs[name] {
+		return nil, clientError("InvalidKeyPair.NotFound", "The key pair '%s' does not exist", name)
+	}
+
+	subnetID := form.Get("SubnetId")
+	if subnetID == "" {
+		subnetID = form.Get("NetworkInterface.1.SubnetId")
+	}
+	if subnetID == "" {
+		subnetID = region.subnetID
+	} else if subnetID != region.subnetID {
+		return nil, clientError("InvalidSubnetID.NotFound", "The subnet ID '%s' does not exist", subnetID)
+	}
+	groupIDs := listParam(form, "SecurityGroupId")
+	groupIDs = append(groupIDs, listParam(form, "NetworkInterface.1.SecurityGroupId")...)
+	var groups []*ec2.GroupIdentifier
+	for _, groupID := range groupIDs {
+		if region.securityGroups[groupID] == nil {
+			return nil, clientError("InvalidGroup.NotFound", "The security group '%s' does not exist", groupID)
+		}
+		groups = append(groups, &ec2.GroupIdentifier{GroupId: aws.String(groupID), GroupName: region.securityGroups[groupID].GroupName})
+	}
+
+	rootSize := *image.BlockDeviceMappings[0].Ebs.VolumeSize
+	if size := form.Get("BlockDeviceMapping.1.Ebs.VolumeSize"); size != "" {
+		rootSize, _ = strconv.ParseInt(size, 10, 64)
+	}
+	rootVolume := &volume{Volume: &ec2.Volume{
+		VolumeId:         aws.String(s.newID("vol")),
+		AvailabilityZone: aws.String(region.name + "a"),
+		Size:             aws.Int64(rootSize),
+		State:            aws.String("in-use"),
+		VolumeType:       aws.String("gp2"),
+	}}
+
+	id := s.newID("i")
+	octet := s.nextID%250 + 1
+	apiInstance := &ec2.Instance{
+		InstanceId:       aws.String(id),
+		ImageId:          aws.String(imageID),
+		InstanceType:     instanceType.InstanceType,
+		State:            &ec2.InstanceState{Code: aws.Int64(0), Name: aws.String("pending")},
+		Placement:        &ec2.Placement{AvailabilityZone: aws.String(region.name + "a")},
+		SubnetId:         aws.String(subnetID),
+		VpcId:            aws.String(region.vpcID),
+		PrivateIpAddress: aws.String(fmt.Sprintf("172.31.0.%d", octet)),
+		SecurityGroups:   groups,
+		LaunchTime:       aws.Time(time.Now().UTC().Truncate(time.Second)),
+		BlockDeviceMappings: []*ec2.InstanceBlockDeviceMapping{{
+			DeviceName: aws.String("/dev/xvda"),
+			Ebs:        &ec2.EbsInstanceBlockDevice{VolumeId: rootVolume.VolumeId, Status: aws.String("attached")},
+		}},
+	}
+	if name := form.Get("KeyName"); name != "" {
+		apiInstance.KeyName = aws.String(name)
+	}
+	if form.Get("NetworkInterface.1.AssociatePublicIpAddress") != "false" {
+		apiInstance.PublicIpAddress = aws.String(fmt.Sprintf("203.0.113.%d", octet))
+	}
+	rootVolume.Attachments = []*ec2.VolumeAttachment{{
+		VolumeId:   rootVolume.VolumeId,
+		InstanceId: aws.String(id),
+		Device:     aws.String("/dev/xvda"),
+		State:      aws.String("attached"),
+	}}
+	region.volumes[*rootVolume.VolumeId] = rootVolume
+	region.instances[id] = &instance{apiInstance, transition{"running", s.PendingPolls}}
+
+	return &ec2.Reservation{
+		ReservationId: aws.String(s.newID("r")),
+		OwnerId:       aws.String(OWNER_ID),
+		Instances:     []*ec2.Instance{apiInstance},
+	}, nil
+}
+
+var instanceStateCodes = map[string]int64{
+	"pending":       0,
+	"running":       16,
+	"shutting-down": 32,
+	"terminated":    48,
+	"stopping":      64,
+	"stopped":       80,
+}
+
+func (s *Server) describeInstances(region *region, form url.Values) (interface{}, *apiError) {
+	var instances []*instance
+	if ids := listParam(form, "InstanceId"); len(ids) > 0 {
+		for _, id := range ids {
+			instance, err := s.findInstance(region, id)
+			if err != nil {
+				return nil, err
+			}
+			instances = append(instances, instance)
+		}
+	} else {
+		for _, instance := range region.instances {
+			instances = append(instances, instance)
+		}
+		sort.Slice(instances, func(i, j int) bool { return *instances[i].InstanceId < *instances[j].InstanceId })
+	}
+
+	output := &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{}}
+	for _, instance := range instances {
+		instance.advance(instance.State.Name)
+		instance.State.Code = aws.Int64(instanceStateCodes[*instance.State.Name])
+		output.Reservations = append(output.Reservations, &ec2.Reservation{
+			ReservationId: aws.String("r-" + strings.TrimPrefix(*instance.InstanceId, "i-")),
+			OwnerId:       aws.String(OWNER_ID),
+			Instances:     []*ec2.Instance{instance.Instance},
+		})
+	}
+	return output, nil
+}
+
+func (s *Server) instanceAction(region *region, action string, form url.Values) (interface{}, *apiError) {
+	ids := listParam(form, "InstanceId")
+	if len(ids) == 0 {
+		return nil, clientError("MissingParameter", "The request must contain the parameter InstanceId")
+	}
+	var changes []*ec2.InstanceStateChange
+	for _, id := range ids {
+		instance, err := s.findInstance(region, id)
+		if err != nil {
+			return nil, err
+		}
+		state := *instance.State.Name
+		if state == "terminated" && action != "TerminateInstances" {
+			return nil, clientError("IncorrectInstanceState", "The instance '%s' is not in a state from which it can be started.", id)
+		}
+		change := &ec2.InstanceStateChange{
+			InstanceId:    instance.InstanceId,
+			PreviousState: &ec2.InstanceState{Name: aws.String(state), Code: aws.Int64(instanceStateCodes[state])},
+		}
+		switch action {
+		case "StartInstances":
+			if state == "stopped" {
+				*instance.State.Name = "pending"
+				instance.transition = transition{"running", s.PendingPolls}
+			} else if state != "running" && state != "pending" {
+				return nil, clientError("IncorrectInstanceState", "The instance '%s' is not in a state from which it can be started.", id)
+			}
+		case "StopInstances":
+			if state == "running" {
+				*instance.State.Name = "stopping"
+				instance.transition = transition{"stopped", s.PendingPolls}
+			} else if state != "stopped" && state != "stopping" {
+				return nil, clientError("IncorrectInstanceState", "The instance '%s' is not in a state from which it can be stopped.", id)
+			}
+		case "RebootInstances":
+			if state != "running" {
+				return nil, clientError("IncorrectInstanceState", "The instance '%s' is not in a state from which it can be rebooted.", id)
+			}
+		case "TerminateInstances":
+			if state != "terminated" {
+				*instance.State.Name = "shutting-down"
+				instance.transition = transition{"terminated", s.PendingPolls}
+				instance.PublicIpAddress = nil
+				for _, mapping := range instance.BlockDeviceMappings {
+					delete(region.volumes, *mapping.Ebs.VolumeId)
+				}
+				instance.BlockDeviceMappings = nil
+			}
+		}
+		change.CurrentState = &ec2.InstanceState{Name: aws.String(*instance.State.Name), Code: aws.Int64(instanceStateCodes[*instance.State.Name])}
+		changes = append(changes, change)
+	}
+
+	switch action {
+	case "StartInstances":
+		return &ec2.StartInstancesOutput{StartingInstances: changes}, nil
+	case "StopInstances":
+		return &ec2.StopInstancesOutput{StoppingInstances: changes}, nil
+	case "TerminateInstances":
+		return &ec2.TerminateInstancesOutput{TerminatingInstances: changes}, nil
+	default:
+		return &ec2.RebootInstancesOutput{}, nil
+	}
+}
+
+// images
+
+func findImage(region *region, id string) (*image, *apiError) {
+	if err := checkID("ami", id, "InvalidAMIID"); err != nil {
+		return nil, err
+	} else if image := region.images[id]; image != nil {
+		return image, nil
+	}
+	return nil, clientError("InvalidAMIID.NotFound", "The image id '[%s]' does not exist", id)
+}
+
+func (s *Server) createImage(region *region, form url.Values) (interface{}, *apiError) {
+	instance, err := s.findInstance(region, form.Get("InstanceId"))
+	if err != nil {
+		return nil, err
+	} else if *instance.State.Name != "running" && *instance.State.Name != "stopped" {
+		return nil, clientError("IncorrectInstanceState", "The instance '%s' is not in a state from which an image can be created.", *instance.InstanceId)
+	}
+	name := form.Get("Name")
+	for _, image := range region.images {
+		if aws.StringValue(image.Name) == name && aws.StringValue(image.OwnerId) == OWNER_ID {
+			return nil, clientError("InvalidAMIName.Duplicate", "AMI name %s is already in use by AMI %s", name, *image.ImageId)
+		}
+	}
+	rootVolume := region.volumes[*instance.BlockDeviceMappings[0].Ebs.VolumeId]
+	snapshotID := s.newID("snap")
+	region.snapshots[snapshotID] = true
+	apiImage := &ec2.Image{
+		ImageId:      aws.String(s.newID("ami")),
+		Name:         aws.String(name),
+		OwnerId:      aws.String(OWNER_ID),
+		Public:       aws.Bool(false),
+		Architecture: aws.String("x86_64"),
+		CreationDate: aws.String(time.Now().UTC().Format("2006-01-02T15:04:05.000Z")),
+		State:        aws.String("pending"),
+		BlockDeviceMappings: []*ec2.BlockDeviceMapping{{
+			DeviceName: aws.String("/dev/xvda"),
+			Ebs:        &ec2.EbsBlockDevice{SnapshotId: aws.String(snapshotID), VolumeSize: rootVolume.Size},
+		}},
+	}
+	region.images[*apiImage.ImageId] = &image{apiImage, transition{"available", s.PendingPolls}}
+	return &ec2.CreateImageOutput{ImageId: apiImage.ImageId}, nil
+}
+
+func (s *Server) describeImages(region *region, form url.Values) (interface{}, *apiError) {
+	var images []*image
+	if ids := listParam(form, "ImageId"); len(ids) > 0 {
+		for _, id := range ids {
+			image, err := findImage(region, id)
+			if err != nil {
+				return nil, err
+			}
+			images = append(images, image)
+		}
+	} else {
+		for _, image := range region.images {
+			images = append(images, image)
+		}
+		sort.Slice(images, func(i, j int) bool { return *images[i].ImageId < *images[j].ImageId })
+	}
+
+	owners := listParam(form, "Owner")
+	filters := filterParam(form)
+	output := &ec2.DescribeImagesOutput{Images: []*ec2.Image{}}
+	for _, image := range images {
+		image.advance(image.State)
+		ownerMatches := len(owners) == 0
+		for _, owner := range owners {
+			ownerMatches = ownerMatches || owner == aws.StringValue(image.OwnerId) || (owner == "self" && aws.StringValue(image.OwnerId) == OWNER_ID)
+		}
+		if ownerMatches && matchFilter(filters["name"], aws.StringValue(image.Name)) && matchFilter(filters["state"], *image.State) {
+			output.Images = append(output.Images, image.Image)
+		}
+	}
+	return output, nil
+}
+
+func (s *Server) deleteSnapshot(region *region, id string) (interface{}, *apiError) {
+	if err := checkID("snap", id, "InvalidSnapshotID"); err != nil {
+		return nil, err
+	} else if !region.snapshots[id] {
+		return nil, clientError("InvalidSnapshot.NotFound", "The snapshot '%s' does not exist.", id)
+	}
+	for _, image := range region.images {
+		for _, mapping := range image.BlockDeviceMappings {
+			if mapping.Ebs != nil && aws.StringValue(mapping.Ebs.SnapshotId) == id {
+				return nil, clientError("InvalidSnapshot.InUse", "The snapshot %s is currently in use by %s", id, *image.ImageId)
+			}
+		}
+	}
+	delete(region.snapshots, id)
+	return &ec2.DeleteSnapshotOutput{}, nil
+}
+
+// volumes
+
+func findVolume(region *region, id string) (*volume, *apiError) {
+	if err := checkID("vol", id, "InvalidVolumeID"); err != nil {
+		return nil, err
+	} else if volume := region.volumes[id]; volume != nil {
+		return volume, nil
+	}
+	return nil, clientError("InvalidVolume.NotFound", "The volume '%s' does not exist.", id)
+}
+
+func (s *Server) createVolume(region *region, form url.Values) (interface{}, *apiError) {
+	zone := form.Get("AvailabilityZone")
+	size, _ := strconv.ParseInt(form.Get("Size"), 10, 64)
+	if zone != region.name+"a" && zone != region.name+"b" && zone != region.name+"c" {
+		return nil, clientError("InvalidZone.NotFound", "The zone '%s' does not exist.", zone)
+	} else if size < 1 || size > 16384 {
+		return nil, clientError("InvalidParameterValue", "Volume of %d GiB is outside of the allowed range", size)
+	}
+	apiVolume := &ec2.Volume{
+		VolumeId:         aws.String(s.newID("vol")),
+		AvailabilityZone: aws.String(zone),
+		Size:             aws.Int64(size),
+		State:            aws.String("creating"),
+		VolumeType:       aws.String(form.Get("VolumeType")),
+		CreateTime:       aws.Time(time.Now().UTC().Truncate(time.Second)),
+	}
+	for i := 1; form.Get(fmt.Sprintf("TagSpecification.1.Tag.%d.Key", i)) != ""; i++ {
+		apiVolume.Tags = append(apiVolume.Tags, &ec2.Tag{
+			Key:   aws.String(form.Get(fmt.Sprintf("TagSpecification.1.Tag.%d.Key", i))),
+			Value: aws.String(form.Get(fmt.Sprintf("TagSpecification.1.Tag.%d.Value", i))),
+		})
+	}
+	region.volumes[*apiVolume.VolumeId] = &volume{apiVolume, transition{"available", s.PendingPolls}}
+	return apiVolume, nil
+}
+
+func (s *Server) describeVolumes(region *region, form url.Values) (interface{}, *apiError) {
+	var volumes []*volume
+	if ids := listParam(form, "VolumeId"); len(ids) > 0 {
+		for _, id := range ids {
+			volume, err := findVolume(region, id)
+			if err != nil {
+				return nil, err
+			}
+			volumes = append(volumes, volume)
+		}
+	} else {
+		for _, volume := range region.volumes {
+			volumes = append(volumes, volume)
+		}
+		sort.Slice(volumes, func(i, j int) bool { return *volumes[i].VolumeId < *volumes[j].VolumeId })
+	}
+
+	output := &ec2.DescribeVolumesOutput{Volumes: []*ec2.Volume{}}
+	for _, volume := range volumes {
+		volume.advance(volume.State)
+		output.Volumes = append(output.Volumes, volume.Volume)
+	}
+	return output, nil
+}
+
+func (s *Server) volumeAction(region *region, action string, form url.Values) (interface{}, *apiError) {
+	volume, err := findVolume(region, form.Get("VolumeId"))
+	if err != nil {
+		return nil, err
+	}
+	switch action {
+	case "DeleteVolume":
+		if *volume.State == "in-use" {
+			return nil, clientError("VolumeInUse", "Volume %s is currently attached", *volume.VolumeId)
+		}
+		delete(region.volumes, *volume.VolumeId)
+		return &ec2.DeleteVolumeOutput{}, nil
+	case "ModifyVolume":
+		size, _ := strconv.ParseInt(form.Get("Size"), 10, 64)
+		if size < *volume.Size {
+			return nil, clientError("InvalidParameterValue", "New size cannot be smaller than existing size")
+		}
+		volume.Size = aws.Int64(size)
+		return &ec2.ModifyVolumeOutput{VolumeModification: &ec2.VolumeModification{
+			VolumeId:          volume.VolumeId,
+			ModificationState: aws.String("modifying"),
+			TargetSize:        aws.Int64(size),
+		}}, nil
+	case "AttachVolume":
+		instance, err := s.findInstance(region, form.Get("InstanceId"))
+		if err != nil {
+			return nil, err
+		} else if *volume.State != "available" {
+			return nil, clientError("IncorrectState", "vol %s is not available", *volume.VolumeId)
+		} else if *volume.AvailabilityZone != *instance.Placement.AvailabilityZone {
+			return nil, clientError("InvalidVolume.ZoneMismatch", "The volume is not in the same availability zone as instance %s", *instance.InstanceId)
+		}
+		device := form.Get("Device")
+		for _, mapping := range instance.BlockDeviceMappings {
+			if *mapping.DeviceName == device {
+				return nil, clientError("InvalidParameterValue", "Invalid value '%s' for unixDevice. Attachment point %s is already in use", device, device)
+			}
+		}
+		attachment := &ec2.VolumeAttachment{
+			VolumeId:   volume.VolumeId,
+			InstanceId: instance.InstanceId,
+			Device:     aws.String(device),
+			State:      aws.String("attached"),
+		}
+		volume.State = aws.String("in-use")
+		volume.Attachments = []*ec2.VolumeAttachment{attachment}
+		instance.BlockDeviceMappings = append(instance.BlockDeviceMappings, &ec2.InstanceBlockDeviceMapping{
+			DeviceName: aws.String(device),
+			Ebs:        &ec2.EbsInstanceBlockDevice{VolumeId: volume.VolumeId, Status: aws.String("attached")},
+		})
+		return &ec2.VolumeAttachment{VolumeId: volume.VolumeId, InstanceId: instance.InstanceId, Device: aws.String(device), State: aws.String("attaching")}, nil
+	default:
+		if len(volume.Attachments) == 0 {
+			return nil, clientError("IncorrectState", "Volume '%s' is in the 'available' state.", *volume.VolumeId)
+		}
+		attachment := volume.Attachments[0]
+		if instance := region.instances[*attachment.InstanceId]; instance != nil {
+			var mappings []*ec2.InstanceBlockDeviceMapping
+			for _, mapping := range instance.BlockDeviceMappings {
+				if *mapping.Ebs.VolumeId != *volume.VolumeId {
+					mappings = append(mappings, mapping)
+				}
+			}
+			instance.BlockDeviceMappings = mappings
+		}
+		volume.State = aws.String("available")
+		volume.Attachments = nil
+		return &ec2.VolumeAttachment{VolumeId: volume.VolumeId, InstanceId: attachment.InstanceId, Device: attachment.Device, State: aws.String("detaching")}, nil
+	}
+}
+
+// security groups
+
+func (s *Server) describeSecurityGroups(region *region, form url.Values) interface{} {
+	filters := filterParam(form)
+	ids := listParam(form, "GroupId")
+	output := &ec2.DescribeSecurityGroupsOutput{SecurityGroups: []*ec2.SecurityGroup{}}
+	for _, group := range region.securityGroups {
+		if len(ids) > 0 && !matchFilter(ids, *group.GroupId) {
+			continue
+		} else if matchFilter(filters["group-name"], *group.GroupName) && matchFilter(filters["vpc-id"], *group.VpcId) {
+			output.SecurityGroups = append(output.SecurityGroups, group)
+		}
+	}
+	sort.Slice(output.SecurityGroups, func(i, j int) bool {
+		return *output.SecurityGroups[i].GroupId < *output.SecurityGroups[j].GroupId
+	})
+	return output
+}
+
+func (s *Server) createSecurityGroup(region *region, form url.Values) (interface{}, *apiError) {
+	name := form.Get("GroupName")
+	vpcID := form.Get("VpcId")
+	if name == "" || form.Get("GroupDescription") == "" {
+		return nil, clientError("MissingParameter", "The request must contain the parameters GroupName and GroupDescription")
+	} else if vpcID != region.vpcID {
+		return nil, clientError("InvalidVpcID.NotFound", "The vpc ID '%s' does not exist", vpcID)
+	}
+	for _, group := range region.securityGroups {
+		if *group.GroupName == name && *group.VpcId == vpcID {
+			return nil, clientError("InvalidGroup.Duplicate", "The security group '%s' already exists for VPC '%s'", name, vpcID)
+		}
+	}
+	group := &ec2.SecurityGroup{
+		GroupId:     aws.String(s.newID("sg")),
+		GroupName:   aws.String(name),
+		Description: aws.String(form.Get("GroupDescription")),
+		VpcId:       aws.String(vpcID),
+		OwnerId:     aws.String(OWNER_ID),
+	}
+	region.securityGroups[*group.GroupId] = group
+	return &ec2.CreateSecurityGroupOutput{GroupId: group.GroupId}, nil
+}
+
+func (s *Server) authorizeIngress(region *region, form url.Values) (interface{}, *apiError) {
+	group := region.securityGroups[form.Get("GroupId")]
+	if group == nil {
+		return nil, clientError("InvalidGroup.NotFound", "The security group '%s' does not exist", form.Get("GroupId"))
+	}
+	for i := 1; form.Get(fmt.Sprintf("IpPermissions.%d.IpProtocol", i)) != ""; i++ {
+		prefix := fmt.Sprintf("IpPermissions.%d.", i)
+		fromPort, _ := strconv.ParseInt(form.Get(prefix+"FromPort"), 10, 64)
+		toPort, _ := strconv.ParseInt(form.Get(prefix+"ToPort"), 10, 64)
+		permission := &ec2.IpPermission{
+			IpProtocol: aws.String(form.Get(prefix + "IpProtocol")),
+			FromPort:   aws.Int64(fromPort),
+			ToPort:     aws.Int64(toPort),
+		}
+		for j := 1; form.Get(fmt.Sprintf("%sIpRanges.%d.CidrIp", prefix, j)) != ""; j++ {
+			permission.IpRanges = append(permission.IpRanges, &ec2.IpRange{CidrIp: aws.String(form.Get(fmt.Sprintf("%sIpRanges.%d.CidrIp", prefix, j)))})
+		}
+		for j := 1; form.Get(fmt.Sprintf("%sIpv6Ranges.%d.CidrIpv6", prefix, j)) != ""; j++ {
+			permission.Ipv6Ranges = append(permission.Ipv6Ranges, &ec2.Ipv6Range{CidrIpv6: aws.String(form.Get(fmt.Sprintf("%sIpv6Ranges.%d.CidrIpv6", prefix, j)))})
+		}
+		for _, existing := range group.IpPermissions {
+			if existing.String() == permission.String() {
+				return nil, clientError("InvalidPermission.Duplicate", "the specified rule already exists")
+			}
+		}
+		group.IpPermissions = append(group.IpPermissions, permission)
+	}
+	return &ec2.AuthorizeSecurityGroupIngressOutput{Return: aws.Bool(true)}, nil
+}
+
+// XML encoding
+
+// Encodes the exported fields of an SDK output shape as child elements, named
+// by their locationName tags like the EC2 query protocol does.
+func encodeFields(e *xml.Encoder, value reflect.Value) error {
+	for value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+	t := value.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := field.Tag.Get("locationName")
+		if name == "" {
+			name = strings.ToLower(field.Name[:1]) + field.Name[1:]
+		}
+		if err := encodeValue(e, name, value.Field(i), field.Tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeValue(e *xml.Encoder, name string, value reflect.Value, tag reflect.StructTag) error {
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+
+	switch value.Kind() {
+	case reflect.Struct:
+		if timestamp, ok := value.Interface().(time.Time); ok {
+			return e.EncodeElement(timestamp.UTC().Format("2006-01-02T15:04:05.000Z"), start)
+		}
+		if err := e.EncodeToken(start); err != nil {
+			return err
+		} else if err := encodeFields(e, value); err != nil {
+			return err
+		}
+		return e.EncodeToken(start.End())
+	case reflect.Slice:
+		if value.IsNil() {
+			return nil
+		}
+		itemName := tag.Get("locationNameList")
+		if itemName == "" {
+			itemName = "item"
+		}
+		if err := e.EncodeToken(start); err != nil {
+			return err
+		}
+		for i := 0; i < value.Len(); i++ {
+			if err := encodeValue(e, itemName, value.Index(i), ""); err != nil {
+				return err
+			}
+		}
+		return e.EncodeToken(start.End())
+	case reflect.Map:
+		return fmt.Errorf("unsupported map field %s", name)
+	default:
+		return e.EncodeElement(fmt.Sprint(value.Interface()), start)
+	}
+}
@@ -0,0 +1,22 @@
+package fake
+
+import "github.com/LunaNode/cloug/service/compute"
+import "github.com/LunaNode/cloug/service/compute/conformance"
+
+import "testing"
+import "time"
+
+func TestConformance(t *testing.T) {
+	f := MakeFake()
+	f.TransitionDelay = 10 * time.Millisecond
+	conformance.Run(t, f, &conformance.Config{
+		Instance: compute.Instance{
+			Image:  compute.Image{Distribution: "ubuntu"},
+			Flavor: compute.Flavor{MemoryMB: 512},
+		},
+		ResizeFlavor: &compute.Flavor{MemoryMB: 1024},
+		PublicKey:    []byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJ0S1uMTNPZdfSW6GYaCwMPPVM4oFgNbXx0DMSWf1b4I conformance"),
+		VolumeSizeGB: 10,
+		Wait:         compute.WaitOptions{Interval: 5 * time.Millisecond},
+	})
+}
@@ -0,0 +1,967 @@
+package fake
+
+import "github.com/LunaNode/cloug/provider/common"
+import "github.com/LunaNode/cloug/service/compute"
+import "github.com/LunaNode/cloug/utils"
+
+import "fmt"
+import "sort"
+import "strconv"
+import "sync"
+import "time"
+
+const DEFAULT_NAME = "cloug"
+const DEFAULT_REGION = "fake-1"
+
+var REGIONS = []string{"fake-1", "fake-2"}
+
+// Statuses of instances that are transitioning between states.
+const (
+	StatusPending  compute.InstanceStatus = "pending"
+	StatusStarting compute.InstanceStatus = "starting"
+	StatusStopping compute.InstanceStatus = "stopping"
+)
+
+type fakeInstance struct {
+	instance  compute.Instance
+	addresses []*compute.Address
+
+	// status that the instance transitions to at readyAt
+	target  compute.InstanceStatus
+	readyAt time.Time
+}
+
+type fakeImage struct {
+	image   compute.Image
+	readyAt time.Time
+}
+
+type fakeVolume struct {
+	volume  compute.Volume
+	readyAt time.Time
+}
+
+// Fake is an in-memory provider that implements compute.Service and every
+// optional service interface. It is intended for tests.
+type Fake struct {
+	// Delay added to every API call.
+	Latency time.Duration
+
+	// Time it takes for instances, images and volumes to reach a stable state
+	// after they are created or an action is performed on them.
+	TransitionDelay time.Duration
+
+	mu        sync.Mutex
+	nextID    int
+	instances map[string]*fakeInstance
+	images    map[string]*fakeImage
+	flavors   []*compute.Flavor
+	keys      map[string]*compute.PublicKey
+	volumes   map[string]*fakeVolume
+	groups    map[string]*compute.SecurityGroup
+	failures  map[compute.Operation]error
+}
+
+func MakeFake() *Fake {
+	f := &Fake{
+		instances: make(map[string]*fakeInstance),
+		images:    make(map[string]*fakeImage),
+		keys:      make(map[string]*compute.PublicKey),
+		volumes:   make(map[string]*fakeVolume),
+		groups:    make(map[string]*compute.SecurityGroup),
+		failures:  make(map[compute.Operation]error),
+	}
+	for _, image := range []*compute.Image{
+		{Name: "Ubuntu 16.04", Distribution: "ubuntu", Version: "16.04"},
+		{Name: "Debian 8", Distribution: "debian", Version: "8"},
+		{Name: "CentOS 7", Distribution: "centos", Version: "7"},
+	} {
+		image.ID = f.newID()
+		image.Regions = REGIONS
+		image.Type = compute.TemplateImage
+		image.Status = compute.ImageAvailable
+		image.Public = true
+		image.Architecture = compute.ArchAMD64
+		f.images[image.ID] = &fakeImage{image: *image}
+	}
+	for i, memory := range []int{512, 1024, 2048, 4096} {
+		f.flavors = append(f.flavors, &compute.Flavor{
+			ID:         strconv.Itoa(i + 1),
+			Name:       fmt.Sprintf("m.%d", memory),
+			Regions:    REGIONS,
+			NumCores:   i + 1,
+			DiskGB:     memory / 512 * 10,
+			MemoryMB:   memory,
+			TransferGB: memory,
+		})
+	}
+	return f
+}
+
+func (f *Fake) ComputeService() compute.Service {
+	return f
+}
+
+func (f *Fake) Capabilities() *compute.Capabilities {
+	return &compute.Capabilities{
+		Operations:     compute.ImplementedOperations(f),
+		ImageSources:   []compute.ImageSource{compute.ImageSourceInstance, compute.ImageSourceURL},
+		InstanceFields: []compute.InstanceField{compute.FieldName, compute.FieldRegion, compute.FieldPassword, compute.FieldPublicKey, compute.FieldNetworkID, compute.FieldDiskGB},
+	}
+}
+
+// Makes every subsequent call of the operation fail with err.
+// Passing a nil err clears the failure.
+func (f *Fake) SetFailure(op compute.Operation, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		delete(f.failures, op)
+	} else {
+		f.failures[op] = err
+	}
+}
+
+// Simulates the API call latency and returns the injected failure, if any.
+// On success, the lock is held and must be released by the caller.
+func (f *Fake) begin(op compute.Operation) error {
+	if f.Latency > 0 {
+		time.Sleep(f.Latency)
+	}
+	f.mu.Lock()
+	if err := f.failures[op]; err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (f *Fake) newID() string {
+	f.nextID++
+	return strconv.Itoa(f.nextID)
+}
+
+func (f *Fake) fakeIP(prefix string) string {
+	n := f.nextID
+	return fmt.Sprintf("%s.%d.%d", prefix, n/250%250, n%250+1)
+}
+
+func (f *Fake) transition(inst *fakeInstance, status compute.InstanceStatus, target compute.InstanceStatus) {
+	inst.instance.Status = status
+	inst.target = target
+	inst.readyAt = time.Now().Add(f.TransitionDelay)
+}
+
+func (f *Fake) getInstance(instanceID string) (*fakeInstance, error) {
+	inst := f.instances[instanceID]
+	if inst == nil {
+		return nil, compute.Errorf(compute.ErrNotFound, "instance %s not found", instanceID)
+	}
+	if inst.target != "" && !time.Now().Before(inst.readyAt) {
+		inst.instance.Status = inst.target
+		inst.target = ""
+	}
+	return inst, nil
+}
+
+func (f *Fake) mapInstance(inst *fakeInstance) *compute.Instance {
+	instance := inst.instance
+	instance.Password = ""
+	instance.IP = ""
+	instance.PrivateIP = ""
+	if len(inst.addresses) > 0 {
+		instance.IP = inst.addresses[0].IP
+		instance.PrivateIP = inst.addresses[0].PrivateIP
+	}
+	instance.Details = make(map[string]string)
+	for k, v := range inst.instance.Details {
+		instance.Details[k] = v
+	}
+	return &instance
+}
+
+func (f *Fake) findImage(imageID string) (*fakeImage, error) {
+	image := f.images[imageID]
+	if image == nil {
+		return nil, compute.Errorf(compute.ErrNotFound, "image %s not found", imageID)
+	}
+	if image.image.Status == compute.ImagePending && !time.Now().Before(image.readyAt) {
+		image.image.Status = compute.ImageAvailable
+	}
+	return image, nil
+}
+
+func (f *Fake) findFlavor(flavorID string) (*compute.Flavor, error) {
+	for _, flavor := range f.flavors {
+		if flavor.ID == flavorID {
+			return flavor, nil
+		}
+	}
+	return nil, compute.Errorf(compute.ErrNotFound, "flavor %s not found", flavorID)
+}
+
+func (f *Fake) CreateInstance(instance *compute.Instance) (*compute.Instance, error) {
+	imageID, err := common.GetMatchingImageID(f, &instance.Image)
+	if err != nil {
+		return nil, err
+	}
+	flavorID, err := common.GetMatchingFlavorID(f, &instance.Flavor)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.begin(compute.OpCreateInstance); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+
+	image, err := f.findImage(imageID)
+	if err != nil {
+		return nil, compute.WrapError(compute.ErrInvalidArgument, err)
+	} else if image.image.Status != compute.ImageAvailable {
+		return nil, compute.Errorf(compute.ErrConflict, "image %s is not available", imageID)
+	}
+	flavor, err := f.findFlavor(flavorID)
+	if err != nil {
+		return nil, compute.WrapError(compute.ErrInvalidArgument, err)
+	}
+
+	region := instance.Region
+	if region == "" {
+		region = DEFAULT_REGION
+	} else if !utils.IsSliceSubset(REGIONS, []string{region}) {
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "invalid region %s", region)
+	}
+
+	name := instance.Name
+	if name == "" {
+		name = DEFAULT_NAME
+	}
+
+	password := instance.Password
+	if password == "" && len(instance.PublicKey.Key) == 0 && instance.PublicKey.ID == "" {
+		password = utils.Uid(16)
+	}
+
+	var publicKey compute.PublicKey
+	if instance.PublicKey.ID != "" {
+		key := f.keys[instance.PublicKey.ID]
+		if key == nil {
+			return nil, compute.Errorf(compute.ErrInvalidArgument, "invalid key ID: %s", instance.PublicKey.ID)
+		}
+		publicKey = *key
+	} else if len(instance.PublicKey.Key) > 0 {
+		publicKey = compute.PublicKey{
+			Label: instance.PublicKey.Label,
+			Key:   instance.PublicKey.Key,
+		}
+	}
+
+	instanceFlavor := *flavor
+	if instance.Flavor.DiskGB != 0 {
+		instanceFlavor.DiskGB = instance.Flavor.DiskGB
+	}
+
+	id := f.newID()
+	inst := &fakeInstance{
+		instance: compute.Instance{
+			ID:        id,
+			Name:      name,
+			Region:    region,
+			Image:     image.image,
+			Flavor:    instanceFlavor,
+			PublicKey: publicKey,
+			Username:  "root",
+			NetworkID: instance.NetworkID,
+			Details:   map[string]string{},
+		},
+		addresses: []*compute.Address{{
+			ID:        id,
+			IP:        f.fakeIP("198.18"),
+			PrivateIP: f.fakeIP("10.0"),
+			CanDNS:    true,
+		}},
+	}
+	f.transition(inst, StatusPending, compute.StatusOnline)
+	f.instances[id] = inst
+
+	return &compute.Instance{
+		ID:       id,
+		Name:     name,
+		Region:   region,
+		Username: "root",
+		Password: password,
+	}, nil
+}
+
+func (f *Fake) DeleteInstance(instanceID string) error {
+	if err := f.begin(compute.OpDeleteInstance); err != nil {
+		return err
+	}
+	defer f.mu.Unlock()
+	if _, err := f.getInstance(instanceID); err != nil {
+		return err
+	}
+	for _, volume := range f.volumes {
+		if volume.volume.InstanceID == instanceID {
+			volume.volume.InstanceID = ""
+			volume.volume.Status = compute.VolumeAvailable
+		}
+	}
+	delete(f.instances, instanceID)
+	return nil
+}
+
+func (f *Fake) ListInstances() ([]*compute.Instance, error) {
+	if err := f.begin(compute.OpListInstances); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+	var instances []*compute.Instance
+	for id := range f.instances {
+		inst, _ := f.getInstance(id)
+		instances = append(instances, f.mapInstance(inst))
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		a, _ := strconv.Atoi(instances[i].ID)
+		b, _ := strconv.Atoi(instances[j].ID)
+		return a < b
+	})
+	return instances, nil
+}
+
+func (f *Fake) GetInstance(instanceID string) (*compute.Instance, error) {
+	if err := f.begin(compute.OpGetInstance); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+	inst, err := f.getInstance(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	return f.mapInstance(inst), nil
+}
+
+func (f *Fake) withInstance(op compute.Operation, instanceID string, fn func(inst *fakeInstance) error) error {
+	if err := f.begin(op); err != nil {
+		return err
+	}
+	defer f.mu.Unlock()
+	inst, err := f.getInstance(instanceID)
+	if err != nil {
+		return err
+	}
+	return fn(inst)
+}
+
+// Performs an action on an instance that is not transitioning between states.
+func (f *Fake) instanceAction(op compute.Operation, instanceID string, action func(inst *fakeInstance) error) error {
+	return f.withInstance(op, instanceID, func(inst *fakeInstance) error {
+		if inst.target != "" {
+			return compute.Errorf(compute.ErrConflict, "instance %s is %s", instanceID, inst.instance.Status)
+		}
+		return action(inst)
+	})
+}
+
+func (f *Fake) StartInstance(instanceID string) error {
+	return f.instanceAction(compute.OpStartInstance, instanceID, func(inst *fakeInstance) error {
+		if inst.instance.Status != compute.StatusOnline {
+			f.transition(inst, StatusStarting, compute.StatusOnline)
+		}
+		return nil
+	})
+}
+
+func (f *Fake) StopInstance(instanceID string) error {
+	return f.instanceAction(compute.OpStopInstance, instanceID, func(inst *fakeInstance) error {
+		if inst.instance.Status != compute.StatusOffline {
+			f.transition(inst, StatusStopping, compute.StatusOffline)
+		}
+		return nil
+	})
+}
+
+func (f *Fake) RebootInstance(instanceID string) error {
+	return f.instanceAction(compute.OpRebootInstance, instanceID, func(inst *fakeInstance) error {
+		f.transition(inst, StatusStarting, compute.StatusOnline)
+		return nil
+	})
+}
+
+func (f *Fake) GetVNC(instanceID string) (string, error) {
+	var url string
+	err := f.withInstance(compute.OpGetVNC, instanceID, func(inst *fakeInstance) error {
+		if inst.instance.Status != compute.StatusOnline {
+			return compute.Errorf(compute.ErrConflict, "instance %s is not online", instanceID)
+		}
+		url = fmt.Sprintf("https://vnc.fake.invalid/%s?token=%s", instanceID, utils.Uid(16))
+		return nil
+	})
+	return url, err
+}
+
+func (f *Fake) RenameInstance(instanceID string, name string) error {
+	if name == "" {
+		return compute.Errorf(compute.ErrInvalidArgument, "name must not be empty")
+	}
+	return f.withInstance(compute.OpRenameInstance, instanceID, func(inst *fakeInstance) error {
+		inst.instance.Name = name
+		return nil
+	})
+}
+
+func (f *Fake) ReimageInstance(instanceID string, image *compute.Image) error {
+	imageID, err := common.GetMatchingImageID(f, image)
+	if err != nil {
+		return err
+	}
+	return f.instanceAction(compute.OpReimageInstance, instanceID, func(inst *fakeInstance) error {
+		image, err := f.findImage(imageID)
+		if err != nil {
+			return compute.WrapError(compute.ErrInvalidArgument, err)
+		}
+		inst.instance.Image = image.image
+		f.transition(inst, StatusPending, compute.StatusOnline)
+		return nil
+	})
+}
+
+func (f *Fake) ResizeInstance(instanceID string, flavor *compute.Flavor) error {
+	flavorID, err := common.GetMatchingFlavorID(f, flavor)
+	if err != nil {
+		return err
+	}
+	return f.instanceAction(compute.OpResizeInstance, instanceID, func(inst *fakeInstance) error {
+		flavor, err := f.findFlavor(flavorID)
+		if err != nil {
+			return compute.WrapError(compute.ErrInvalidArgument, err)
+		}
+		inst.instance.Flavor = *flavor
+		return nil
+	})
+}
+
+func (f *Fake) CreateImage(imageTemplate *compute.Image) (*compute.Image, error) {
+	if err := f.begin(compute.OpCreateImage); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+
+	image := compute.Image{
+		Name:           imageTemplate.Name,
+		Type:           compute.TemplateImage,
+		Status:         compute.ImagePending,
+		SourceInstance: imageTemplate.SourceInstance,
+		SourceURL:      imageTemplate.SourceURL,
+	}
+	if image.Name == "" {
+		image.Name = DEFAULT_NAME
+	}
+
+	if imageTemplate.SourceInstance != "" {
+		inst, err := f.getInstance(imageTemplate.SourceInstance)
+		if err != nil {
+			return nil, err
+		}
+		image.Regions = []string{inst.instance.Region}
+		image.Size = int64(inst.instance.Flavor.DiskGB) * 1024 * 1024 * 1024
+		image.Distribution = inst.instance.Image.Distribution
+		image.Version = inst.instance.Image.Version
+		image.Architecture = inst.instance.Image.Architecture
+	} else if imageTemplate.SourceURL != "" {
+		if imageTemplate.Format == "" {
+			return nil, compute.Errorf(compute.ErrInvalidArgument, "missing image format")
+		} else if len(imageTemplate.Regions) > 1 {
+			return nil, compute.Errorf(compute.ErrInvalidArgument, "image can only be fetched to one region")
+		}
+		image.Format = imageTemplate.Format
+		image.Regions = imageTemplate.Regions
+		if len(image.Regions) == 0 {
+			image.Regions = []string{DEFAULT_REGION}
+		}
+		if image.Format == "iso" {
+			image.Type = compute.ISOImage
+		}
+	} else {
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "neither source instance nor source URL is set")
+	}
+
+	image.ID = f.newID()
+	f.images[image.ID] = &fakeImage{
+		image:   image,
+		readyAt: time.Now().Add(f.TransitionDelay),
+	}
+	result := image
+	return &result, nil
+}
+
+func (f *Fake) FindImage(image *compute.Image) (string, error) {
+	if err := f.begin(compute.OpFindImage); err != nil {
+		return "", err
+	}
+	f.mu.Unlock()
+	images, err := f.ListImages()
+	if err != nil {
+		return "", err
+	}
+	for _, option := range images {
+		if image.Name != "" && image.Name != option.Name {
+			continue
+		} else if image.Distribution != "" && image.Distribution != option.Distribution {
+			continue
+		} else if image.Version != "" && image.Version != option.Version {
+			continue
+		} else if image.Architecture != "" && image.Architecture != option.Architecture {
+			continue
+		}
+		return option.ID, nil
+	}
+	return "", nil
+}
+
+func (f *Fake) ListImages() ([]*compute.Image, error) {
+	if err := f.begin(compute.OpListImages); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+	var images []*compute.Image
+	for id := range f.images {
+		image, _ := f.findImage(id)
+		result := image.image
+		images = append(images, &result)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		a, _ := strconv.Atoi(images[i].ID)
+		b, _ := strconv.Atoi(images[j].ID)
+		return a < b
+	})
+	return images, nil
+}
+
+func (f *Fake) GetImage(imageID string) (*compute.Image, error) {
+	if err := f.begin(compute.OpGetImage); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+	image, err := f.findImage(imageID)
+	if err != nil {
+		return nil, err
+	}
+	result := image.image
+	return &result, nil
+}
+
+func (f *Fake) DeleteImage(imageID string) error {
+	if err := f.begin(compute.OpDeleteImage); err != nil {
+		return err
+	}
+	defer f.mu.Unlock()
+	if _, err := f.findImage(imageID); err != nil {
+		return err
+	}
+	delete(f.images, imageID)
+	return nil
+}
+
+func (f *Fake) ListInstanceAddresses(instanceID string) ([]*compute.Address, error) {
+	var addresses []*compute.Address
+	err := f.withInstance(compute.OpListInstanceAddresses, instanceID, func(inst *fakeInstance) error {
+		for _, address := range inst.addresses {
+			result := *address
+			addresses = append(addresses, &result)
+		}
+		return nil
+	})
+	return addresses, err
+}
+
+func (f *Fake) AddAddressToInstance(instanceID string, address *compute.Address) error {
+	return f.withInstance(compute.OpAddAddressToInstance, instanceID, func(inst *fakeInstance) error {
+		id := f.newID()
+		newAddress := &compute.Address{
+			ID:        id,
+			IP:        address.IP,
+			PrivateIP: address.PrivateIP,
+			CanDNS:    true,
+		}
+		if newAddress.IP == "" {
+			newAddress.IP = f.fakeIP("198.18")
+		}
+		inst.addresses = append(inst.addresses, newAddress)
+		return nil
+	})
+}
+
+func (f *Fake) RemoveAddressFromInstance(instanceID string, addressID string) error {
+	return f.withInstance(compute.OpRemoveAddressFromInstance, instanceID, func(inst *fakeInstance) error {
+		for i, address := range inst.addresses {
+			if address.ID == addressID {
+				inst.addresses = append(inst.addresses[:i], inst.addresses[i+1:]...)
+				return nil
+			}
+		}
+		return compute.Errorf(compute.ErrNotFound, "address %s not found", addressID)
+	})
+}
+
+func (f *Fake) SetAddressHostname(addressID string, hostname string) error {
+	if err := f.begin(compute.OpSetAddressHostname); err != nil {
+		return err
+	}
+	defer f.mu.Unlock()
+	for _, inst := range f.instances {
+		for _, address := range inst.addresses {
+			if address.ID == addressID {
+				address.Hostname = hostname
+				return nil
+			}
+		}
+	}
+	return compute.Errorf(compute.ErrNotFound, "address %s not found", addressID)
+}
+
+func (f *Fake) ListFlavors() ([]*compute.Flavor, error) {
+	if err := f.begin(compute.OpListFlavors); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+	var flavors []*compute.Flavor
+	for _, flavor := range f.flavors {
+		result := *flavor
+		flavors = append(flavors, &result)
+	}
+	return flavors, nil
+}
+
+func (f *Fake) FindFlavor(flavor *compute.Flavor) (string, error) {
+	if err := f.begin(compute.OpFindFlavor); err != nil {
+		return "", err
+	}
+	f.mu.Unlock()
+	flavors, err := f.ListFlavors()
+	if err != nil {
+		return "", fmt.Errorf("error listing flavors: %w", err)
+	}
+	return common.MatchFlavor(flavor, flavors), nil
+}
+
+func (f *Fake) ListPublicKeys() ([]*compute.PublicKey, error) {
+	if err := f.begin(compute.OpListPublicKeys); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+	var keys []*compute.PublicKey
+	for _, key := range f.keys {
+		result := *key
+		keys = append(keys, &result)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, _ := strconv.Atoi(keys[i].ID)
+		b, _ := strconv.Atoi(keys[j].ID)
+		return a < b
+	})
+	return keys, nil
+}
+
+func (f *Fake) ImportPublicKey(key *compute.PublicKey) (*compute.PublicKey, error) {
+	if len(key.Key) == 0 {
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "public key is empty")
+	}
+	if err := f.begin(compute.OpImportPublicKey); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+	label := key.Label
+	if label == "" {
+		label = DEFAULT_NAME
+	}
+	newKey := &compute.PublicKey{
+		ID:    f.newID(),
+		Label: label,
+		Key:   key.Key,
+	}
+	f.keys[newKey.ID] = newKey
+	result := *newKey
+	return &result, nil
+}
+
+func (f *Fake) RemovePublicKey(keyID string) error {
+	if err := f.begin(compute.OpRemovePublicKey); err != nil {
+		return err
+	}
+	defer f.mu.Unlock()
+	if f.keys[keyID] == nil {
+		return compute.Errorf(compute.ErrNotFound, "key %s not found", keyID)
+	}
+	delete(f.keys, keyID)
+	return nil
+}
+
+func (f *Fake) getVolume(volumeID string) (*fakeVolume, error) {
+	volume := f.volumes[volumeID]
+	if volume == nil {
+		return nil, compute.Errorf(compute.ErrNotFound, "volume %s not found", volumeID)
+	}
+	if volume.volume.Status == compute.VolumePending && !time.Now().Before(volume.readyAt) {
+		volume.volume.Status = compute.VolumeAvailable
+	}
+	return volume, nil
+}
+
+func (f *Fake) CreateVolume(volume *compute.Volume) (*compute.Volume, error) {
+	if volume.SizeGB <= 0 {
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "volume size must be positive")
+	}
+	if err := f.begin(compute.OpCreateVolume); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+
+	region := volume.Region
+	if region == "" {
+		region = DEFAULT_REGION
+	} else if !utils.IsSliceSubset(REGIONS, []string{region}) {
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "invalid region %s", region)
+	}
+	name := volume.Name
+	if name == "" {
+		name = DEFAULT_NAME
+	}
+
+	newVolume := &fakeVolume{
+		volume: compute.Volume{
+			ID:     f.newID(),
+			Name:   name,
+			Region: region,
+			SizeGB: volume.SizeGB,
+			Status: compute.VolumePending,
+		},
+		readyAt: time.Now().Add(f.TransitionDelay),
+	}
+	f.volumes[newVolume.volume.ID] = newVolume
+	result := newVolume.volume
+	return &result, nil
+}
+
+func (f *Fake) ListVolumes() ([]*compute.Volume, error) {
+	if err := f.begin(compute.OpListVolumes); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+	var volumes []*compute.Volume
+	for id := range f.volumes {
+		volume, _ := f.getVolume(id)
+		result := volume.volume
+		volumes = append(volumes, &result)
+	}
+	sort.Slice(volumes, func(i, j int) bool {
+		a, _ := strconv.Atoi(volumes[i].ID)
+		b, _ := strconv.Atoi(volumes[j].ID)
+		return a < b
+	})
+	return volumes, nil
+}
+
+func (f *Fake) GetVolume(volumeID string) (*compute.Volume, error) {
+	if err := f.begin(compute.OpGetVolume); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+	volume, err := f.getVolume(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	result := volume.volume
+	return &result, nil
+}
+
+func (f *Fake) DeleteVolume(volumeID string) error {
+	if err := f.begin(compute.OpDeleteVolume); err != nil {
+		return err
+	}
+	defer f.mu.Unlock()
+	volume, err := f.getVolume(volumeID)
+	if err != nil {
+		return err
+	} else if volume.volume.InstanceID != "" {
+		return compute.Errorf(compute.ErrConflict, "volume %s is attached to instance %s", volumeID, volume.volume.InstanceID)
+	}
+	delete(f.volumes, volumeID)
+	return nil
+}
+
+func (f *Fake) AttachVolume(volumeID string, instanceID string) error {
+	return f.withInstance(compute.OpAttachVolume, instanceID, func(inst *fakeInstance) error {
+		volume, err := f.getVolume(volumeID)
+		if err != nil {
+			return err
+		} else if volume.volume.Status != compute.VolumeAvailable {
+			return compute.Errorf(compute.ErrConflict, "volume %s is %s", volumeID, volume.volume.Status)
+		} else if volume.volume.Region != inst.instance.Region {
+			return compute.Errorf(compute.ErrInvalidArgument, "volume region %s does not match instance region %s", volume.volume.Region, inst.instance.Region)
+		}
+		volume.volume.InstanceID = instanceID
+		volume.volume.Status = compute.VolumeInUse
+		return nil
+	})
+}
+
+func (f *Fake) DetachVolume(volumeID string) error {
+	if err := f.begin(compute.OpDetachVolume); err != nil {
+		return err
+	}
+	defer f.mu.Unlock()
+	volume, err := f.getVolume(volumeID)
+	if err != nil {
+		return err
+	} else if volume.volume.InstanceID == "" {
+		return compute.Errorf(compute.ErrConflict, "volume %s is not attached", volumeID)
+	}
+	volume.volume.InstanceID = ""
+	volume.volume.Status = compute.VolumeAvailable
+	return nil
+}
+
+func (f *Fake) ResizeVolume(volumeID string, sizeGB int) error {
+	if err := f.begin(compute.OpResizeVolume); err != nil {
+		return err
+	}
+	defer f.mu.Unlock()
+	volume, err := f.getVolume(volumeID)
+	if err != nil {
+		return err
+	} else if sizeGB < volume.volume.SizeGB {
+		return compute.Errorf(compute.ErrInvalidArgument, "volumes cannot be shrunk")
+	}
+	volume.volume.SizeGB = sizeGB
+	return nil
+}
+
+// Returns a deep copy of the security group.
+func copySecurityGroup(group *compute.SecurityGroup) *compute.SecurityGroup {
+	result := *group
+	result.Rules = nil
+	for _, rule := range group.Rules {
+		ruleCopy := *rule
+		result.Rules = append(result.Rules, &ruleCopy)
+	}
+	return &result
+}
+
+// Returns a copy of the rule with the default direction filled in, or an error
+// if the rule is invalid.
+func (f *Fake) makeRule(rule *compute.SecurityGroupRule) (*compute.SecurityGroupRule, error) {
+	result := *rule
+	if result.Direction == "" {
+		result.Direction = compute.RuleIngress
+	} else if result.Direction != compute.RuleIngress && result.Direction != compute.RuleEgress {
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "invalid rule direction %s", rule.Direction)
+	}
+	if result.PortMin > result.PortMax {
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "invalid port range %d-%d", rule.PortMin, rule.PortMax)
+	}
+	result.ID = f.newID()
+	return &result, nil
+}
+
+func (f *Fake) CreateSecurityGroup(group *compute.SecurityGroup) (*compute.SecurityGroup, error) {
+	if group.Name == "" {
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "security group name is empty")
+	}
+	if err := f.begin(compute.OpCreateSecurityGroup); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+	newGroup := &compute.SecurityGroup{
+		ID:          f.newID(),
+		Name:        group.Name,
+		Description: group.Description,
+	}
+	for _, rule := range group.Rules {
+		newRule, err := f.makeRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		newGroup.Rules = append(newGroup.Rules, newRule)
+	}
+	f.groups[newGroup.ID] = newGroup
+	return copySecurityGroup(newGroup), nil
+}
+
+func (f *Fake) ListSecurityGroups() ([]*compute.SecurityGroup, error) {
+	if err := f.begin(compute.OpListSecurityGroups); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+	var groups []*compute.SecurityGroup
+	for _, group := range f.groups {
+		groups = append(groups, copySecurityGroup(group))
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		a, _ := strconv.Atoi(groups[i].ID)
+		b, _ := strconv.Atoi(groups[j].ID)
+		return a < b
+	})
+	return groups, nil
+}
+
+func (f *Fake) GetSecurityGroup(groupID string) (*compute.SecurityGroup, error) {
+	if err := f.begin(compute.OpGetSecurityGroup); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+	group := f.groups[groupID]
+	if group == nil {
+		return nil, compute.Errorf(compute.ErrNotFound, "security group %s not found", groupID)
+	}
+	return copySecurityGroup(group), nil
+}
+
+func (f *Fake) DeleteSecurityGroup(groupID string) error {
+	if err := f.begin(compute.OpDeleteSecurityGroup); err != nil {
+		return err
+	}
+	defer f.mu.Unlock()
+	if f.groups[groupID] == nil {
+		return compute.Errorf(compute.ErrNotFound, "security group %s not found", groupID)
+	}
+	delete(f.groups, groupID)
+	return nil
+}
+
+func (f *Fake) AddSecurityGroupRule(groupID string, rule *compute.SecurityGroupRule) (*compute.SecurityGroupRule, error) {
+	if err := f.begin(compute.OpAddSecurityGroupRule); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+	group := f.groups[groupID]
+	if group == nil {
+		return nil, compute.Errorf(compute.ErrNotFound, "security group %s not found", groupID)
+	}
+	newRule, err := f.makeRule(rule)
+	if err != nil {
+		return nil, err
+	}
+	group.Rules = append(group.Rules, newRule)
+	result := *newRule
+	return &result, nil
+}
+
+func (f *Fake) RemoveSecurityGroupRule(groupID string, ruleID string) error {
+	if err := f.begin(compute.OpRemoveSecurityGroupRule); err != nil {
+		return err
+	}
+	defer f.mu.Unlock()
+	group := f.groups[groupID]
+	if group == nil {
+		return compute.Errorf(compute.ErrNotFound, "security group %s not found", groupID)
+	}
+	for i, rule := range group.Rules {
+		if rule.ID == ruleID {
+			group.Rules = append(group.Rules[:i], group.Rules[i+1:]...)
+			return nil
+		}
+	}
+	return compute.Errorf(compute.ErrNotFound, "rule %s not found in security group %s", ruleID, groupID)
+}
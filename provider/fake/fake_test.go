@@ -0,0 +1,68 @@
+package fake
+
+import "github.com/LunaNode/cloug/service/compute"
+
+import "errors"
+import "testing"
+import "time"
+
+func TestInstanceTransitions(t *testing.T) {
+	f := MakeFake()
+	f.TransitionDelay = 20 * time.Millisecond
+	instance, err := f.CreateInstance(&compute.Instance{
+		Image:  compute.Image{Distribution: "debian"},
+		Flavor: compute.Flavor{MemoryMB: 1024},
+	})
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	instance, err = f.GetInstance(instance.ID)
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	} else if instance.Status != StatusPending {
+		t.Fatalf("expected pending instance, got %s", instance.Status)
+	} else if err := f.StopInstance(instance.ID); !errors.Is(err, compute.ErrConflict) {
+		t.Fatalf("expected conflict stopping pending instance, got %v", err)
+	}
+
+	instance, err = compute.WaitForInstance(f, instance.ID, compute.InstanceOnline, &compute.WaitOptions{Interval: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("wait failed: %v", err)
+	} else if instance.Image.Distribution != "debian" || instance.Flavor.MemoryMB != 1024 || instance.IP == "" {
+		t.Fatalf("unexpected instance %+v", instance)
+	}
+
+	if err := f.DeleteInstance(instance.ID); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	} else if _, err := f.GetInstance(instance.ID); !errors.Is(err, compute.ErrNotFound) {
+		t.Fatalf("expected not found after delete, got %v", err)
+	}
+}
+
+func TestSetFailure(t *testing.T) {
+	f := MakeFake()
+	f.SetFailure(compute.OpListInstances, compute.ErrRateLimited)
+	if _, err := f.ListInstances(); err != compute.ErrRateLimited {
+		t.Fatalf("expected injected failure, got %v", err)
+	}
+	f.SetFailure(compute.OpListInstances, nil)
+	if _, err := f.ListInstances(); err != nil {
+		t.Fatalf("expected failure to be cleared, got %v", err)
+	}
+}
+
+func TestSetFailureFind(t *testing.T) {
+	f := MakeFake()
+	f.SetFailure(compute.OpFindImage, compute.ErrRateLimited)
+	if _, err := f.FindImage(&compute.Image{}); err != compute.ErrRateLimited {
+		t.Fatalf("expected injected FindImage failure, got %v", err)
+	}
+	f.SetFailure(compute.OpFindFlavor, compute.ErrAuth)
+	if _, err := f.FindFlavor(&compute.Flavor{}); err != compute.ErrAuth {
+		t.Fatalf("expected injected FindFlavor failure, got %v", err)
+	}
+	if _, err := f.ListFlavors(); err != nil {
+		t.Fatalf("expected ListFlavors to be unaffected, got %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package fake
+
+import "github.com/LunaNode/cloug/provider/common"
+import "github.com/LunaNode/cloug/service/compute"
+
+import "encoding/json"
+import "fmt"
+import "time"
+
+type FakeJSONConfig struct {
+	Latency         string `json:"latency"`
+	TransitionDelay string `json:"transition_delay"`
+}
+
+// HTTP options are accepted for compatibility with the other providers, but
+// are ignored since the fake does not make any requests.
+func FakeFromJSON(jsonData []byte, options ...common.Option) (compute.Provider, error) {
+	var cfg FakeJSONConfig
+	err := json.Unmarshal(jsonData, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	f := MakeFake()
+	if cfg.Latency != "" {
+		f.Latency, err = time.ParseDuration(cfg.Latency)
+		if err != nil {
+			return nil, fmt.Errorf("invalid latency: %v", err)
+		}
+	}
+	if cfg.TransitionDelay != "" {
+		f.TransitionDelay, err = time.ParseDuration(cfg.TransitionDelay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid transition_delay: %v", err)
+		}
+	}
+	return f, nil
+}
@@ -10,11 +10,33 @@ import "golang.org/x/oauth2/jwt"
 import gcompute "google.golang.org/api/compute/v1"
 import "google.golang.org/api/googleapi"
 
+import "context"
+import "errors"
 import "fmt"
+import "regexp"
+import "sort"
 import "strings"
 import "time"
 
+const DEFAULT_NAME = "cloug"
 const DEFAULT_REGION = "us-central1-f"
+const DEFAULT_USERNAME = "cloug"
+
+// Label set on instances created by cloug.
+const LABEL_KEY = "cloug"
+const LABEL_VALUE = "true"
+
+// Public image projects included in ListImages and FindImage. Family extracts
+// the distribution version from the image family; a second group holds the
+// minor version.
+var PUBLIC_IMAGE_PROJECTS = []struct {
+	Distribution string
+	Project      string
+	Family       *regexp.Regexp
+}{
+	{"debian", "debian-cloud", regexp.MustCompile(`^debian-(\d+)(?:-arm64)?$`)},
+	{"ubuntu", "ubuntu-os-cloud", regexp.MustCompile(`^ubuntu-(\d{2})(\d{2})(?:-lts)?(?:-amd64|-arm64)?$`)},
+}
 
 type OperationCall interface {
 	Do(opts ...googleapi.CallOption) (*gcompute.Operation, error)
@@ -23,20 +45,31 @@ type OperationCall interface {
 type GoogleCompute struct {
 	project string
 	service *gcompute.Service
+	ctx     context.Context
 }
 
-func MakeGoogleCompute(email string, privateKey string, project string) (*GoogleCompute, error) {
+func MakeGoogleCompute(email string, privateKey string, project string, options ...common.Option) (*GoogleCompute, error) {
+	opts := common.MakeHTTPOptions(options...)
 	conf := &jwt.Config{
 		Email:      email,
 		PrivateKey: []byte(privateKey),
 		Scopes:     []string{"https://www.googleapis.com/auth/compute"},
 		TokenURL:   google.JWTTokenURL,
 	}
-	client := conf.Client(oauth2.NoContext)
+
+	// oauth2 wraps the client from the context, if any
+	ctx := oauth2.NoContext
+	if client := opts.HTTPClient(nil); client != nil {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, client)
+	}
+	client := conf.Client(ctx)
 	service, err := gcompute.New(client)
 	if err != nil {
 		return nil, err
 	}
+	if opts.APIURL != "" {
+		service.BasePath = strings.TrimRight(opts.APIURL, "/") + "/"
+	}
 	return &GoogleCompute{
 		service: service,
 		project: project,
@@ -47,33 +80,98 @@ func (gc *GoogleCompute) ComputeService() compute.Service {
 	return gc
 }
 
+func (gc *GoogleCompute) Capabilities() *compute.Capabilities {
+	return &compute.Capabilities{
+		Operations:     compute.ImplementedOperations(gc, compute.OpListInstances),
+		ImageSources:   []compute.ImageSource{compute.ImageSourceInstance, compute.ImageSourceURL},
+		InstanceFields: []compute.InstanceField{compute.FieldName, compute.FieldRegion, compute.FieldPassword, compute.FieldPublicKey, compute.FieldDiskGB},
+	}
+}
+
+// Returns a copy of the service whose API calls use the given context.
+func (gc *GoogleCompute) withContext(ctx context.Context) *GoogleCompute {
+	return &GoogleCompute{
+		project: gc.project,
+		service: gc.service,
+		ctx:     ctx,
+	}
+}
+
+func (gc *GoogleCompute) context() context.Context {
+	if gc.ctx == nil {
+		return context.Background()
+	}
+	return gc.ctx
+}
+
+// Performs the call and polls the resulting operation until it is done or
+// until the context is done.
 func (gc *GoogleCompute) waitForOperation(call OperationCall) (*gcompute.Operation, error) {
 	operation, err := call.Do()
 	if err != nil {
-		return nil, err
+		return nil, gc.mapError(err)
 	}
-	for range time.Tick(time.Second) {
-		operation, err = gc.service.ZoneOperations.Get(gc.project, basename(operation.Zone), operation.Name).Do()
-		if err != nil {
-			return nil, fmt.Errorf("error getting update on operation: %v", err)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for operation.Status != "DONE" {
+		select {
+		case <-ticker.C:
+		case <-gc.context().Done():
+			return nil, gc.context().Err()
 		}
 
-		if operation.Status == "DONE" {
-			break
+		if operation.Zone != "" {
+			operation, err = gc.service.ZoneOperations.Get(gc.project, basename(operation.Zone), operation.Name).Context(gc.context()).Do()
+		} else {
+			operation, err = gc.service.GlobalOperations.Get(gc.project, operation.Name).Context(gc.context()).Do()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error getting update on operation: %w", gc.mapError(err))
 		}
 	}
-	if operation.Error != nil {
+	if operation.Error != nil && len(operation.Error.Errors) > 0 {
 		opErr := operation.Error.Errors[0]
-		return nil, fmt.Errorf("%s: %s", opErr.Code, opErr.Message)
+		return nil, compute.Errorf(operationErrorKinds[opErr.Code], "%s: %s", opErr.Code, opErr.Message)
+	} else if operation.Error != nil {
+		return nil, fmt.Errorf("operation %s failed", operation.Name)
 	} else {
 		return operation, nil
 	}
 }
 
+// Error kinds for the error codes reported by failed operations.
+var operationErrorKinds = map[string]error{
+	"QUOTA_EXCEEDED":                      compute.ErrQuotaExceeded,
+	"RESOURCE_NOT_FOUND":                  compute.ErrNotFound,
+	"RESOURCE_ALREADY_EXISTS":             compute.ErrConflict,
+	"RESOURCE_IN_USE_BY_ANOTHER_RESOURCE": compute.ErrConflict,
+	"ZONE_RESOURCE_POOL_EXHAUSTED":        compute.ErrQuotaExceeded,
+	"INVALID_FIELD_VALUE":                 compute.ErrInvalidArgument,
+	"PERMISSIONS_ERROR":                   compute.ErrAuth,
+}
+
+// Classifies errors returned by the Google API client.
+func (gc *GoogleCompute) mapError(err error) error {
+	apiErr, ok := err.(*googleapi.Error)
+	if !ok {
+		return err
+	}
+	for _, item := range apiErr.Errors {
+		switch item.Reason {
+		case "quotaExceeded":
+			return compute.WrapError(compute.ErrQuotaExceeded, err)
+		case "rateLimitExceeded", "userRateLimitExceeded":
+			return compute.WrapError(compute.ErrRateLimited, err)
+		}
+	}
+	return common.HTTPStatusError(apiErr.Code, err)
+}
+
 func (gc *GoogleCompute) mapInstanceStatus(state string) compute.InstanceStatus {
 	if state == "RUNNING" {
 		return compute.StatusOnline
-	} else if state == "STOPPED" {
+	} else if state == "TERMINATED" || state == "SUSPENDED" {
+		// stopped instances are TERMINATED until they are deleted
 		return compute.StatusOffline
 	} else {
 		return compute.InstanceStatus(strings.ToLower(state))
@@ -104,20 +202,26 @@ func (gc *GoogleCompute) CreateInstance(instance *compute.Instance) (*compute.In
 	if err != nil {
 		return nil, err
 	}
-	flavorID, err := common.GetMatchingFlavorID(gc, &instance.Flavor)
-	if err != nil {
-		return nil, err
-	}
-
-	name := utils.UidAlphabet(24, []rune("abcdefghijklmnopqrstuvwxyz"))
-
 	region := instance.Region
 	if region == "" {
 		region = DEFAULT_REGION
 	}
 
+	// machine types are zonal, so search in the instance zone
+	flavor := instance.Flavor
+	if len(flavor.Regions) == 0 {
+		flavor.Regions = []string{region}
+	}
+	flavorID, err := common.GetMatchingFlavorID(gc, &flavor)
+	if err != nil {
+		return nil, err
+	}
+
+	name := uniqueName(instance.Name)
+
 	apiInstance := gcompute.Instance{
 		Name:        name,
+		Labels:      map[string]string{LABEL_KEY: LABEL_VALUE},
 		MachineType: fmt.Sprintf("zones/%s/machineTypes/%s", region, flavorID),
 		Disks: []*gcompute.AttachedDisk{
 			&gcompute.AttachedDisk{
@@ -157,12 +261,31 @@ func (gc *GoogleCompute) CreateInstance(instance *compute.Instance) (*compute.In
 		},
 	}
 
-	operation, err := gc.waitForOperation(gc.service.Instances.Insert(gc.project, region, &apiInstance))
+	// the guest environment creates the user and installs the key
+	username := instance.Username
+	if username == "" {
+		username = DEFAULT_USERNAME
+	}
+	if len(instance.PublicKey.Key) > 0 {
+		publicKey, err := utils.PublicKeyToAuthorizedKeysFormat(string(instance.PublicKey.Key))
+		if err != nil {
+			return nil, compute.Errorf(compute.ErrInvalidArgument, "failed to convert provided key to authorized_keys format: %v", err)
+		}
+		sshKeys := username + ":" + publicKey
+		apiInstance.Metadata.Items = append(apiInstance.Metadata.Items, &gcompute.MetadataItems{
+			Key:   "ssh-keys",
+			Value: &sshKeys,
+		})
+	}
+
+	operation, err := gc.waitForOperation(gc.service.Instances.Insert(gc.project, region, &apiInstance).Context(gc.context()))
 	if err != nil {
 		return nil, err
 	} else {
 		return &compute.Instance{
 			ID:       fmt.Sprintf("%s:%s", basename(operation.Zone), name),
+			Name:     name,
+			Username: username,
 			Password: password,
 		}, nil
 	}
@@ -171,7 +294,7 @@ func (gc *GoogleCompute) CreateInstance(instance *compute.Instance) (*compute.In
 func (gc *GoogleCompute) instanceAction(instanceID string, f func(string, string) error) error {
 	parts := strings.Split(instanceID, ":")
 	if len(parts) != 2 {
-		return fmt.Errorf("instance ID does not contain two colon-separated parts")
+		return compute.Errorf(compute.ErrNotFound, "instance ID does not contain two colon-separated parts")
 	}
 	zone := parts[0]
 	name := parts[1]
@@ -180,21 +303,21 @@ func (gc *GoogleCompute) instanceAction(instanceID string, f func(string, string
 
 func (gc *GoogleCompute) DeleteInstance(instanceID string) error {
 	return gc.instanceAction(instanceID, func(zone string, name string) error {
-		_, err := gc.waitForOperation(gc.service.Instances.Delete(gc.project, zone, name))
+		_, err := gc.waitForOperation(gc.service.Instances.Delete(gc.project, zone, name).Context(gc.context()))
 		return err
 	})
 }
 
 func (gc *GoogleCompute) ListInstances() ([]*compute.Instance, error) {
-	return nil, fmt.Errorf("operation not supported")
+	return nil, compute.ErrNotSupported
 }
 
 func (gc *GoogleCompute) GetInstance(instanceID string) (*compute.Instance, error) {
 	var instance *compute.Instance
 	err := gc.instanceAction(instanceID, func(zone string, name string) error {
-		apiInstance, err := gc.service.Instances.Get(gc.project, zone, name).Do()
+		apiInstance, err := gc.service.Instances.Get(gc.project, zone, name).Context(gc.context()).Do()
 		if err != nil {
-			return err
+			return gc.mapError(err)
 		}
 		instance = gc.mapInstance(apiInstance)
 		return nil
@@ -204,34 +327,119 @@ func (gc *GoogleCompute) GetInstance(instanceID string) (*compute.Instance, erro
 
 func (gc *GoogleCompute) StartInstance(instanceID string) error {
 	return gc.instanceAction(instanceID, func(zone string, name string) error {
-		_, err := gc.waitForOperation(gc.service.Instances.Start(gc.project, zone, name))
+		_, err := gc.waitForOperation(gc.service.Instances.Start(gc.project, zone, name).Context(gc.context()))
 		return err
 	})
 }
 
 func (gc *GoogleCompute) StopInstance(instanceID string) error {
 	return gc.instanceAction(instanceID, func(zone string, name string) error {
-		_, err := gc.waitForOperation(gc.service.Instances.Stop(gc.project, zone, name))
+		_, err := gc.waitForOperation(gc.service.Instances.Stop(gc.project, zone, name).Context(gc.context()))
 		return err
 	})
 }
 
 func (gc *GoogleCompute) RebootInstance(instanceID string) error {
 	return gc.instanceAction(instanceID, func(zone string, name string) error {
-		_, err := gc.waitForOperation(gc.service.Instances.Reset(gc.project, zone, name))
+		_, err := gc.waitForOperation(gc.service.Instances.Reset(gc.project, zone, name).Context(gc.context()))
 		return err
 	})
 }
 
+func (gc *GoogleCompute) CreateInstanceContext(ctx context.Context, instance *compute.Instance) (*compute.Instance, error) {
+	return gc.withContext(ctx).CreateInstance(instance)
+}
+
+func (gc *GoogleCompute) DeleteInstanceContext(ctx context.Context, instanceID string) error {
+	return gc.withContext(ctx).DeleteInstance(instanceID)
+}
+
+func (gc *GoogleCompute) ListInstancesContext(ctx context.Context) ([]*compute.Instance, error) {
+	return gc.withContext(ctx).ListInstances()
+}
+
+func (gc *GoogleCompute) GetInstanceContext(ctx context.Context, instanceID string) (*compute.Instance, error) {
+	return gc.withContext(ctx).GetInstance(instanceID)
+}
+
+func (gc *GoogleCompute) StartInstanceContext(ctx context.Context, instanceID string) error {
+	return gc.withContext(ctx).StartInstance(instanceID)
+}
+
+func (gc *GoogleCompute) StopInstanceContext(ctx context.Context, instanceID string) error {
+	return gc.withContext(ctx).StopInstance(instanceID)
+}
+
+func (gc *GoogleCompute) RebootInstanceContext(ctx context.Context, instanceID string) error {
+	return gc.withContext(ctx).RebootInstance(instanceID)
+}
+
+// Creates an image from the boot disk of an instance, or from a disk image
+// archive in Cloud Storage given as a gs:// or https:// URL. Instances need
+// not be stopped, but the image is more consistent if they are.
 func (gc *GoogleCompute) CreateImage(imageTemplate *compute.Image) (*compute.Image, error) {
-	return nil, fmt.Errorf("not implemented")
+	name := uniqueName(imageTemplate.Name)
+	apiImage := &gcompute.Image{
+		Name:        name,
+		Description: imageTemplate.Name,
+	}
+
+	if imageTemplate.SourceInstance != "" {
+		err := gc.instanceAction(imageTemplate.SourceInstance, func(zone string, instanceName string) error {
+			apiInstance, err := gc.service.Instances.Get(gc.project, zone, instanceName).Context(gc.context()).Do()
+			if err != nil {
+				return gc.mapError(err)
+			}
+			for _, disk := range apiInstance.Disks {
+				if disk.Boot {
+					apiImage.SourceDisk = disk.Source
+				}
+			}
+			if apiImage.SourceDisk == "" {
+				return fmt.Errorf("instance %s has no boot disk", imageTemplate.SourceInstance)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else if imageTemplate.SourceURL != "" {
+		source := imageTemplate.SourceURL
+		if strings.HasPrefix(source, "gs://") {
+			source = "https://storage.googleapis.com/" + strings.TrimPrefix(source, "gs://")
+		} else if !strings.HasPrefix(source, "https://storage.googleapis.com/") {
+			return nil, compute.Errorf(compute.ErrInvalidArgument, "source URL must refer to Cloud Storage")
+		}
+		apiImage.RawDisk = &gcompute.ImageRawDisk{Source: source}
+	} else {
+		return nil, errors.New("neither source instance nor source URL is set")
+	}
+
+	operation, err := gc.waitForOperation(gc.service.Images.Insert(gc.project, apiImage).ForceCreate(true).Context(gc.context()))
+	if err != nil {
+		return nil, err
+	}
+	return &compute.Image{
+		ID:             operation.TargetLink,
+		Name:           name,
+		Status:         compute.ImageAvailable,
+		SourceInstance: imageTemplate.SourceInstance,
+		SourceURL:      imageTemplate.SourceURL,
+	}, nil
 }
 
-func (gc *GoogleCompute) mapImage(apiImage *gcompute.Image, region string) *compute.Image {
+func (gc *GoogleCompute) mapImage(apiImage *gcompute.Image, project string) *compute.Image {
 	image := &compute.Image{
-		ID:   apiImage.SelfLink,
-		Name: apiImage.Name,
-		Size: apiImage.DiskSizeGb * 1024 * 1024 * 1024,
+		ID:     apiImage.SelfLink,
+		Name:   apiImage.Name,
+		Type:   compute.TemplateImage,
+		Public: project != gc.project,
+		Size:   apiImage.DiskSizeGb * 1024 * 1024 * 1024,
+		Details: map[string]string{
+			"project":            project,
+			"family":             apiImage.Family,
+			"creation_timestamp": apiImage.CreationTimestamp,
+		},
 	}
 
 	if apiImage.Status == "READY" {
@@ -242,33 +450,176 @@ func (gc *GoogleCompute) mapImage(apiImage *gcompute.Image, region string) *comp
 		image.Status = compute.ImageStatus(strings.ToLower(apiImage.Status))
 	}
 
+	switch apiImage.Architecture {
+	case "X86_64", "":
+		image.Architecture = compute.ArchAMD64
+	case "ARM64":
+		image.Architecture = compute.ArchARM64
+	}
+	for _, public := range PUBLIC_IMAGE_PROJECTS {
+		if project != public.Project {
+			continue
+		}
+		if match := public.Family.FindStringSubmatch(apiImage.Family); match != nil {
+			image.Distribution = public.Distribution
+			image.Version = match[1]
+			if len(match) > 2 && match[2] != "" {
+				image.Version += "." + match[2]
+			}
+		}
+	}
+
 	return image
 }
 
+// Lists the images of a project, skipping deprecated ones.
+func (gc *GoogleCompute) listProjectImages(project string) ([]*compute.Image, error) {
+	var images []*compute.Image
+	err := gc.service.Images.List(project).Pages(gc.context(), func(page *gcompute.ImageList) error {
+		for _, apiImage := range page.Items {
+			if apiImage.Deprecated != nil && apiImage.Deprecated.State != "" {
+				continue
+			}
+			images = append(images, gc.mapImage(apiImage, project))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing images in %s: %w", project, gc.mapError(err))
+	}
+	return images, nil
+}
+
+// Finds an image by exact name, or else the newest public image with matching
+// distribution (default ubuntu), version and architecture (default amd64);
+// version 22 also matches 22.04.
 func (gc *GoogleCompute) FindImage(image *compute.Image) (string, error) {
-	return "", fmt.Errorf("operation not supported")
+	images, err := gc.ListImages()
+	if err != nil {
+		return "", err
+	}
+
+	matchDistribution := "ubuntu"
+	if image.Distribution != "" {
+		matchDistribution = strings.ToLower(image.Distribution)
+	}
+	matchArchitecture := compute.ImageArchitecture(compute.ArchAMD64)
+	if image.Architecture != "" {
+		matchArchitecture = image.Architecture
+	}
+
+	var bestImage *compute.Image
+	for _, candidate := range images {
+		if image.Name != "" {
+			if candidate.Name != image.Name {
+				continue
+			}
+		} else if candidate.Distribution != matchDistribution || candidate.Architecture != matchArchitecture {
+			continue
+		} else if image.Version != "" && !common.MatchVersion(image.Version, candidate.Version) {
+			continue
+		}
+		if bestImage == nil || candidate.Details["creation_timestamp"] > bestImage.Details["creation_timestamp"] {
+			bestImage = candidate
+		}
+	}
+
+	if bestImage == nil {
+		return "", nil
+	}
+	return bestImage.ID, nil
 }
 
+// Lists the project's images and the current images of PUBLIC_IMAGE_PROJECTS.
 func (gc *GoogleCompute) ListImages() ([]*compute.Image, error) {
-	return nil, fmt.Errorf("operation not supported")
+	images, err := gc.listProjectImages(gc.project)
+	if err != nil {
+		return nil, err
+	}
+	for _, public := range PUBLIC_IMAGE_PROJECTS {
+		publicImages, err := gc.listProjectImages(public.Project)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, publicImages...)
+	}
+	return images, nil
 }
 
+// The image ID is the image URL, as returned by ListImages, or an image name
+// in the project.
 func (gc *GoogleCompute) GetImage(imageID string) (*compute.Image, error) {
-	return nil, fmt.Errorf("operation not supported")
+	project, name := parseImageID(imageID, gc.project)
+	apiImage, err := gc.service.Images.Get(project, name).Context(gc.context()).Do()
+	if err != nil {
+		return nil, gc.mapError(err)
+	}
+	return gc.mapImage(apiImage, project), nil
 }
 
 func (gc *GoogleCompute) DeleteImage(imageID string) error {
-	return fmt.Errorf("operation not supported")
+	project, name := parseImageID(imageID, gc.project)
+	if project != gc.project {
+		return compute.Errorf(compute.ErrInvalidArgument, "image belongs to project %s", project)
+	}
+	_, err := gc.waitForOperation(gc.service.Images.Delete(project, name).Context(gc.context()))
+	return err
 }
 
+// Lists the machine types of all zones. Each flavor lists the zones that offer
+// it in Regions; flavors are ordered by memory and cores.
 func (gc *GoogleCompute) ListFlavors() ([]*compute.Flavor, error) {
-	return nil, fmt.Errorf("operation not supported")
+	flavorMap := make(map[string]*compute.Flavor)
+	err := gc.service.MachineTypes.AggregatedList(gc.project).Pages(gc.context(), func(page *gcompute.MachineTypeAggregatedList) error {
+		for _, scopedList := range page.Items {
+			for _, machineType := range scopedList.MachineTypes {
+				if machineType.Deprecated != nil && machineType.Deprecated.State != "" {
+					continue
+				}
+				flavor := flavorMap[machineType.Name]
+				if flavor == nil {
+					flavor = &compute.Flavor{
+						ID:       machineType.Name,
+						Name:     machineType.Name,
+						NumCores: int(machineType.GuestCpus),
+						MemoryMB: int(machineType.MemoryMb),
+					}
+					flavorMap[machineType.Name] = flavor
+				}
+				flavor.Regions = append(flavor.Regions, machineType.Zone)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing machine types: %w", gc.mapError(err))
+	}
+
+	flavors := make([]*compute.Flavor, 0, len(flavorMap))
+	for _, flavor := range flavorMap {
+		sort.Strings(flavor.Regions)
+		flavors = append(flavors, flavor)
+	}
+	sort.Slice(flavors, func(i, j int) bool {
+		if flavors[i].MemoryMB != flavors[j].MemoryMB {
+			return flavors[i].MemoryMB < flavors[j].MemoryMB
+		} else if flavors[i].NumCores != flavors[j].NumCores {
+			return flavors[i].NumCores < flavors[j].NumCores
+		} else {
+			return flavors[i].ID < flavors[j].ID
+		}
+	})
+	return flavors, nil
 }
 
+// The boot disk size is set independently of the machine type, so DiskGB is
+// ignored when matching.
 func (gc *GoogleCompute) FindFlavor(flavor *compute.Flavor) (string, error) {
 	flavors, err := gc.ListFlavors()
 	if err != nil {
 		return "", fmt.Errorf("error listing flavors: %v", err)
 	}
-	return common.MatchFlavor(flavor, flavors), nil
+	target := *flavor
+	target.DiskGB = 0
+	return common.MatchFlavor(&target, flavors), nil
 }
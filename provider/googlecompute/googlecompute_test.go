@@ -0,0 +1,220 @@
+package googlecompute
+
+import "github.com/LunaNode/cloug/provider/googlecompute/simulator"
+import "github.com/LunaNode/cloug/service/compute"
+import "github.com/LunaNode/cloug/service/compute/conformance"
+
+import "golang.org/x/oauth2"
+import gcompute "google.golang.org/api/compute/v1"
+
+import "context"
+import "errors"
+import "fmt"
+import "strings"
+import "testing"
+import "time"
+
+const TEST_PROJECT = "cloug-test"
+
+// Starts a simulator and a provider for TEST_PROJECT that sends its requests
+// to it with a bearer token.
+func makeTestGoogleCompute(t *testing.T) (*GoogleCompute, *simulator.Server) {
+	server := simulator.NewServer(TEST_PROJECT)
+	server.AccessToken = "token"
+	client := oauth2.NewClient(context.Background(), oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"}))
+	service, err := gcompute.New(client)
+	if err != nil {
+		server.Close()
+		t.Fatalf("error initializing service: %v", err)
+	}
+	service.BasePath = server.URL + "/"
+	return &GoogleCompute{project: TEST_PROJECT, service: service}, server
+}
+
+func addImage(server *simulator.Server, project string, name string, family string, arch string, created string) string {
+	return server.AddImage(project, &gcompute.Image{
+		Name:              name,
+		Family:            family,
+		Architecture:      arch,
+		CreationTimestamp: created,
+	})
+}
+
+func TestConformance(t *testing.T) {
+	gc, server := makeTestGoogleCompute(t)
+	defer server.Close()
+	addImage(server, "ubuntu-os-cloud", "ubuntu-2204-jammy-v20240301", "ubuntu-2204-lts", "X86_64", "2024-03-01T00:00:00Z")
+
+	conformance.Run(t, gc, &conformance.Config{
+		Instance: compute.Instance{
+			Image:  compute.Image{Distribution: "ubuntu", Version: "22.04"},
+			Flavor: compute.Flavor{MemoryMB: 2048},
+		},
+		PublicKey: []byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJ0S1uMTNPZdfSW6GYaCwMPPVM4oFgNbXx0DMSWf1b4I conformance"),
+		Wait:      compute.WaitOptions{Interval: 10 * time.Millisecond},
+	})
+}
+
+func TestFindImage(t *testing.T) {
+	gc, server := makeTestGoogleCompute(t)
+	defer server.Close()
+	// two images per page, so that the newest images are on middle pages
+	server.PageSize = 2
+	own := addImage(server, TEST_PROJECT, "my-image", "", "", "2023-01-01T00:00:00Z")
+	addImage(server, "ubuntu-os-cloud", "ubuntu-2204-jammy-v20240101", "ubuntu-2204-lts", "X86_64", "2024-01-01T00:00:00Z")
+	focal := addImage(server, "ubuntu-os-cloud", "ubuntu-2004-focal-v20240101", "ubuntu-2004-lts", "X86_64", "2024-01-01T00:00:00Z")
+	jammy := addImage(server, "ubuntu-os-cloud", "ubuntu-2204-jammy-v20240301", "ubuntu-2204-lts", "X86_64", "2024-03-01T00:00:00Z")
+	jammyARM := addImage(server, "ubuntu-os-cloud", "ubuntu-2204-jammy-arm64-v20240301", "ubuntu-2204-lts-arm64", "ARM64", "2024-03-01T00:00:00Z")
+	addImage(server, "ubuntu-os-cloud", "ubuntu-2204-jammy-v20240201", "ubuntu-2204-lts", "X86_64", "2024-02-01T00:00:00Z")
+	debian := addImage(server, "debian-cloud", "debian-12-bookworm-v20240301", "debian-12", "X86_64", "2024-03-01T00:00:00Z")
+	server.AddImage("debian-cloud", &gcompute.Image{
+		Name:              "debian-12-bookworm-v20240601",
+		Family:            "debian-12",
+		Architecture:      "X86_64",
+		CreationTimestamp: "2024-06-01T00:00:00Z",
+		Deprecated:        &gcompute.DeprecationStatus{State: "DEPRECATED"},
+	})
+
+	tests := []struct {
+		image compute.Image
+		id    string
+	}{
+		{compute.Image{Name: "my-image"}, own},
+		{compute.Image{}, jammy},
+		{compute.Image{Version: "20.04"}, focal},
+		// a version matches releases that it is a dotted prefix of
+		{compute.Image{Version: "22"}, jammy},
+		{compute.Image{Version: "2"}, ""},
+		{compute.Image{Version: "22.0"}, ""},
+		{compute.Image{Architecture: compute.ArchARM64}, jammyARM},
+		// the newer debian image is deprecated
+		{compute.Image{Distribution: "Debian"}, debian},
+		{compute.Image{Distribution: "debian", Version: "1"}, ""},
+	}
+	for _, test := range tests {
+		id, err := gc.FindImage(&test.image)
+		if err != nil {
+			t.Fatalf("FindImage(%+v): %v", test.image, err)
+		} else if id != test.id {
+			t.Fatalf("FindImage(%+v): expected %q, got %q", test.image, test.id, id)
+		}
+	}
+}
+
+func TestZoneIDs(t *testing.T) {
+	gc, server := makeTestGoogleCompute(t)
+	defer server.Close()
+	image := addImage(server, "debian-cloud", "debian-12-bookworm-v20240301", "debian-12", "X86_64", "2024-03-01T00:00:00Z")
+
+	key := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJ0S1uMTNPZdfSW6GYaCwMPPVM4oFgNbXx0DMSWf1b4I blah@example.com"
+	instance, err := gc.CreateInstance(&compute.Instance{
+		Name:      "Web Server 1",
+		Region:    "europe-west1-b",
+		Image:     compute.Image{ID: image},
+		Flavor:    compute.Flavor{ID: "e2-small"},
+		Username:  "admin",
+		PublicKey: compute.PublicKey{Key: []byte(key + "\r\n")},
+	})
+	if err != nil {
+		t.Fatalf("CreateInstance: %v", err)
+	} else if !strings.HasPrefix(instance.Name, "web-server-1-") || instance.ID != "europe-west1-b:"+instance.Name {
+		t.Fatalf("expected ID and name from sanitized name, got %s and %s", instance.ID, instance.Name)
+	} else if _, err := gc.GetInstance(instance.ID); err != nil {
+		t.Fatalf("GetInstance(%s): %v", instance.ID, err)
+	}
+
+	apiInstances := server.Instances()
+	if len(apiInstances) != 1 || apiInstances[0].Labels[LABEL_KEY] != LABEL_VALUE {
+		t.Fatalf("expected one instance labeled by cloug, got %v", apiInstances)
+	}
+	var sshKeys string
+	for _, item := range apiInstances[0].Metadata.Items {
+		if item.Key == "ssh-keys" && item.Value != nil {
+			sshKeys = *item.Value
+		}
+	}
+	if sshKeys != "admin:"+key {
+		t.Fatalf("expected ssh-keys admin:<key>, got %q", sshKeys)
+	}
+
+	for _, id := range []string{"us-central1-f:" + instance.Name, instance.Name, "europe-west1-b:" + instance.Name + ":x", "europe-west1-b:bogus"} {
+		if _, err := gc.GetInstance(id); !errors.Is(err, compute.ErrNotFound) {
+			t.Fatalf("GetInstance(%s): expected not found error, got %v", id, err)
+		}
+	}
+
+	_, err = gc.CreateInstance(&compute.Instance{
+		Image:     compute.Image{ID: image},
+		Flavor:    compute.Flavor{ID: "e2-small"},
+		PublicKey: compute.PublicKey{Key: []byte("not a key")},
+	})
+	if !errors.Is(err, compute.ErrInvalidArgument) {
+		t.Fatalf("expected invalid argument error for bad key, got %v", err)
+	} else if len(server.Instances()) != 1 {
+		t.Fatalf("expected no instance for bad key, got %d instances", len(server.Instances()))
+	}
+
+	// quota errors are reported by the operation rather than the request
+	server.InstanceQuota = 1
+	_, err = gc.CreateInstance(&compute.Instance{
+		Image:  compute.Image{ID: image},
+		Flavor: compute.Flavor{ID: "e2-small"},
+	})
+	if !errors.Is(err, compute.ErrQuotaExceeded) {
+		t.Fatalf("expected quota exceeded error, got %v", err)
+	}
+}
+
+func TestListFlavors(t *testing.T) {
+	gc, server := makeTestGoogleCompute(t)
+	defer server.Close()
+
+	flavors, err := gc.ListFlavors()
+	if err != nil {
+		t.Fatalf("ListFlavors: %v", err)
+	}
+	var ids []string
+	for _, flavor := range flavors {
+		ids = append(ids, flavor.ID)
+	}
+	if fmt.Sprint(ids) != "[e2-micro e2-small e2-medium]" {
+		t.Fatalf("expected flavors ordered by memory without deprecated types, got %v", ids)
+	} else if fmt.Sprint(flavors[0].Regions) != "[europe-west1-b us-central1-a us-central1-f]" {
+		t.Fatalf("expected e2-micro in every zone, got %v", flavors[0].Regions)
+	}
+
+	// the boot disk size does not restrict the machine type
+	if id, err := gc.FindFlavor(&compute.Flavor{MemoryMB: 2048, DiskGB: 500}); err != nil || id != "e2-small" {
+		t.Fatalf("FindFlavor: expected e2-small, got %q (%v)", id, err)
+	}
+}
+
+func TestImages(t *testing.T) {
+	gc, server := makeTestGoogleCompute(t)
+	defer server.Close()
+	public := addImage(server, "debian-cloud", "debian-12-bookworm-v20240301", "debian-12", "X86_64", "2024-03-01T00:00:00Z")
+
+	// a gs:// source is imported from its Cloud Storage URL
+	image, err := gc.CreateImage(&compute.Image{Name: "Imported", SourceURL: "gs://bucket/disk.tar.gz"})
+	if err != nil {
+		t.Fatalf("CreateImage: %v", err)
+	} else if project, name := parseImageID(image.ID, TEST_PROJECT); project != TEST_PROJECT || name != image.Name {
+		t.Fatalf("expected image %s in %s, got ID %s", image.Name, TEST_PROJECT, image.ID)
+	} else if _, err := gc.GetImage(image.Name); err != nil {
+		t.Fatalf("GetImage(%s): %v", image.Name, err)
+	}
+	if _, err := gc.CreateImage(&compute.Image{SourceURL: "https://example.com/disk.tar.gz"}); !errors.Is(err, compute.ErrInvalidArgument) {
+		t.Fatalf("expected invalid argument error for source outside Cloud Storage, got %v", err)
+	}
+
+	if err := gc.DeleteImage(public); !errors.Is(err, compute.ErrInvalidArgument) {
+		t.Fatalf("expected invalid argument error for public image, got %v", err)
+	} else if _, err := gc.GetImage(public); err != nil {
+		t.Fatalf("GetImage(%s): %v", public, err)
+	}
+	if err := gc.DeleteImage(image.ID); err != nil {
+		t.Fatalf("DeleteImage: %v", err)
+	} else if _, err := gc.GetImage(image.ID); !errors.Is(err, compute.ErrNotFound) {
+		t.Fatalf("expected not found error for deleted image, got %v", err)
+	}
+}
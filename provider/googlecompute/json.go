@@ -1,5 +1,6 @@
 package googlecompute
 
+import "github.com/LunaNode/cloug/provider/common"
 import "github.com/LunaNode/cloug/service/compute"
 
 import "encoding/json"
@@ -8,13 +9,14 @@ type GoogleComputeJSONConfig struct {
 	Email      string `json:"email"`
 	PrivateKey string `json:"private_key"`
 	Project    string `json:"project"`
+	APIURL     string `json:"api_url"`
 }
 
-func GoogleComputeFromJSON(jsonData []byte) (compute.Provider, error) {
+func GoogleComputeFromJSON(jsonData []byte, options ...common.Option) (compute.Provider, error) {
 	var cfg GoogleComputeJSONConfig
 	err := json.Unmarshal(jsonData, &cfg)
 	if err != nil {
 		return nil, err
 	}
-	return MakeGoogleCompute(cfg.Email, cfg.PrivateKey, cfg.Project)
+	return MakeGoogleCompute(cfg.Email, cfg.PrivateKey, cfg.Project, append([]common.Option{common.WithAPIURL(cfg.APIURL)}, options...)...)
 }
@@ -0,0 +1,551 @@
+// Package simulator provides a local stand-in for the Compute Engine API.
+//
+// Instances, their boot disks and images are kept in memory, and requests
+// and responses use the types of the Google API client, so that the compute
+// adapter can be tested without a project. Images of other projects, like
+// the public image projects, are read-only and added with AddImage.
+package simulator
+
+import gcompute "google.golang.org/api/compute/v1"
+
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "net/http/httptest"
+import "regexp"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+var ZONES = []string{"us-central1-a", "us-central1-f", "europe-west1-b"}
+
+// Machine types offered in every zone.
+var MACHINE_TYPES = []*gcompute.MachineType{
+	{Name: "e2-micro", GuestCpus: 2, MemoryMb: 1024},
+	{Name: "e2-small", GuestCpus: 2, MemoryMb: 2048},
+	{Name: "e2-medium", GuestCpus: 2, MemoryMb: 4096},
+	{Name: "n1-standard-1", GuestCpus: 1, MemoryMb: 3840, Deprecated: &gcompute.DeprecationStatus{State: "DEPRECATED"}},
+}
+
+// Public image projects, which are readable by every project.
+var PUBLIC_PROJECTS = []string{"debian-cloud", "ubuntu-os-cloud"}
+
+var nameRegexp = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+type apiError struct {
+	code    int
+	reason  string
+	message string
+}
+
+func newError(code int, reason string, format string, args ...interface{}) *apiError {
+	return &apiError{code, reason, fmt.Sprintf(format, args...)}
+}
+
+func notFound(resource string) *apiError {
+	return newError(http.StatusNotFound, "notFound", "The resource '%s' was not found", resource)
+}
+
+type instance struct {
+	*gcompute.Instance
+
+	// Status that the instance changes to after pendingPolls gets.
+	target       string
+	pendingPolls int
+}
+
+type operation struct {
+	*gcompute.Operation
+	pendingPolls int
+}
+
+// Server is a Compute Engine API simulator listening on a local port.
+type Server struct {
+	*httptest.Server
+
+	// Project that instances and images can be created in.
+	Project string
+
+	// Bearer token that requests must carry, if set.
+	AccessToken string
+
+	// Number of gets for which instances stay in a transitional status, like
+	// PROVISIONING or STOPPING.
+	PendingPolls int
+
+	// Number of gets for which operations stay RUNNING.
+	OperationPolls int
+
+	// Maximum number of items in a list page.
+	PageSize int
+
+	// Maximum number of instances, if set. Like Compute Engine, the simulator
+	// reports exceeded quota as an error of the insert operation.
+	InstanceQuota int
+
+	mu         sync.Mutex
+	nextID     uint64
+	instances  map[string]*instance
+	disks      map[string]*gcompute.Disk
+	images     map[string][]*gcompute.Image
+	operations map[string]*operation
+}
+
+// Starts a simulator for the project. There are no images until they are
+// created through the API or added with AddImage.
+func NewServer(project string) *Server {
+	s := &Server{
+		Project:      project,
+		PendingPolls: 1,
+		PageSize:     500,
+		instances:    make(map[string]*instance),
+		disks:        make(map[string]*gcompute.Disk),
+		images:       make(map[string][]*gcompute.Image),
+		operations:   make(map[string]*operation),
+	}
+	for _, project := range PUBLIC_PROJECTS {
+		s.images[project] = []*gcompute.Image{}
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Adds a ready image to a project, and returns its URL. The self link, status
+// and size are filled in if unset.
+func (s *Server) AddImage(project string, image *gcompute.Image) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if image.SelfLink == "" {
+		image.SelfLink = s.link(project, "global/images/"+image.Name)
+	}
+	if image.Status == "" {
+		image.Status = "READY"
+	}
+	if image.DiskSizeGb == 0 {
+		image.DiskSizeGb = 10
+	}
+	s.images[project] = append(s.images[project], image)
+	return image.SelfLink
+}
+
+func (s *Server) link(project string, path string) string {
+	return s.URL + "/projects/" + project + "/" + path
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	response, err := s.handle(r)
+	if err != nil {
+		w.WriteHeader(err.code)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": map[string]interface{}{
+				"code":    err.code,
+				"message": err.message,
+				"errors": []map[string]string{{
+					"domain":  "global",
+					"reason":  err.reason,
+					"message": err.message,
+				}},
+			},
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) handle(r *http.Request) (interface{}, *apiError) {
+	if s.AccessToken != "" && r.Header.Get("Authorization") != "Bearer "+s.AccessToken {
+		return nil, newError(http.StatusUnauthorized, "authError", "Request had invalid authentication credentials.")
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/projects/")
+	if path == r.URL.Path {
+		return nil, notFound(r.URL.Path)
+	}
+	parts := strings.Split(path, "/")
+	project := parts[0]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if project != s.Project && s.images[project] == nil {
+		return nil, newError(http.StatusNotFound, "notFound", "The resource 'projects/%s' was not found", project)
+	} else if project != s.Project && r.Method != "GET" {
+		return nil, newError(http.StatusForbidden, "forbidden", "Required permission for 'projects/%s' is missing", project)
+	}
+
+	switch {
+	case len(parts) == 3 && parts[1] == "aggregated" && parts[2] == "machineTypes" && r.Method == "GET":
+		return s.listMachineTypes(project), nil
+	case len(parts) == 3 && parts[1] == "global" && parts[2] == "images" && r.Method == "GET":
+		return s.listImages(project, r.URL.Query().Get("pageToken"))
+	case len(parts) == 3 && parts[1] == "global" && parts[2] == "images" && r.Method == "POST":
+		return s.insertImage(r)
+	case len(parts) == 4 && parts[1] == "global" && parts[2] == "images":
+		return s.imageRequest(r.Method, project, parts[3])
+	case len(parts) == 4 && parts[1] == "global" && parts[2] == "operations" && r.Method == "GET":
+		return s.getOperation("global/operations/" + parts[3])
+	case len(parts) >= 4 && parts[1] == "zones":
+		if !validZone(parts[2]) {
+			return nil, notFound("projects/" + project + "/zones/" + parts[2])
+		}
+		return s.handleZone(r, parts[2], parts[3:])
+	}
+	return nil, notFound(r.URL.Path)
+}
+
+func validZone(zone string) bool {
+	for _, z := range ZONES {
+		if z == zone {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) handleZone(r *http.Request, zone string, parts []string) (interface{}, *apiError) {
+	switch {
+	case len(parts) == 1 && parts[0] == "instances" && r.Method == "POST":
+		return s.insertInstance(r, zone)
+	case len(parts) == 2 && parts[0] == "instances":
+		return s.instanceRequest(r.Method, zone, parts[1])
+	case len(parts) == 3 && parts[0] == "instances" && r.Method == "POST":
+		return s.instanceAction(zone, parts[1], parts[2])
+	case len(parts) == 2 && parts[0] == "disks" && r.Method == "GET":
+		if disk := s.disks["zones/"+zone+"/disks/"+parts[1]]; disk != nil {
+			return disk, nil
+		}
+		return nil, notFound(fmt.Sprintf("projects/%s/zones/%s/disks/%s", s.Project, zone, parts[1]))
+	case len(parts) == 2 && parts[0] == "operations" && r.Method == "GET":
+		return s.getOperation("zones/" + zone + "/operations/" + parts[1])
+	}
+	return nil, notFound(r.URL.Path)
+}
+
+// Starts an operation on the target; the change is applied at once, but the
+// operation is reported as RUNNING for OperationPolls gets.
+func (s *Server) newOperation(zone string, operationType string, targetLink string) *gcompute.Operation {
+	return s.failOperation(zone, operationType, targetLink, nil)
+}
+
+// Starts an operation like newOperation that ends with the error, if set;
+// the caller does not apply the change then.
+func (s *Server) failOperation(zone string, operationType string, targetLink string, opErr *gcompute.OperationErrorErrors) *gcompute.Operation {
+	s.nextID++
+	op := &gcompute.Operation{
+		Id:            s.nextID,
+		Name:          fmt.Sprintf("operation-%d", s.nextID),
+		OperationType: operationType,
+		TargetLink:    targetLink,
+		Status:        "DONE",
+		Progress:      100,
+	}
+	if opErr != nil {
+		op.Error = &gcompute.OperationError{Errors: []*gcompute.OperationErrorErrors{opErr}}
+	}
+	key := "global/operations/" + op.Name
+	if zone != "" {
+		op.Zone = s.link(s.Project, "zones/"+zone)
+		key = "zones/" + zone + "/operations/" + op.Name
+	}
+	op.SelfLink = s.link(s.Project, key)
+	s.operations[key] = &operation{op, s.OperationPolls}
+	return s.reportOperation(s.operations[key])
+}
+
+func (s *Server) reportOperation(op *operation) *gcompute.Operation {
+	if op.pendingPolls > 0 {
+		op.pendingPolls--
+		report := *op.Operation
+		report.Status = "RUNNING"
+		report.Progress = 50
+		return &report
+	}
+	return op.Operation
+}
+
+func (s *Server) getOperation(key string) (interface{}, *apiError) {
+	if op := s.operations[key]; op != nil {
+		return s.reportOperation(op), nil
+	}
+	return nil, notFound("projects/" + s.Project + "/" + key)
+}
+
+// machine types
+
+func (s *Server) listMachineTypes(project string) interface{} {
+	list := &gcompute.MachineTypeAggregatedList{Items: make(map[string]gcompute.MachineTypesScopedList)}
+	for _, zone := range ZONES {
+		var machineTypes []*gcompute.MachineType
+		for _, machineType := range MACHINE_TYPES {
+			zoneType := *machineType
+			zoneType.Zone = zone
+			zoneType.SelfLink = s.link(project, "zones/"+zone+"/machineTypes/"+machineType.Name)
+			machineTypes = append(machineTypes, &zoneType)
+		}
+		list.Items["zones/"+zone] = gcompute.MachineTypesScopedList{MachineTypes: machineTypes}
+	}
+	return list
+}
+
+func findMachineType(name string) *gcompute.MachineType {
+	for _, machineType := range MACHINE_TYPES {
+		if machineType.Name == name {
+			return machineType
+		}
+	}
+	return nil
+}
+
+// images
+
+func (s *Server) listImages(project string, pageToken string) (interface{}, *apiError) {
+	images := s.images[project]
+	start := 0
+	if pageToken != "" {
+		var err error
+		if start, err = strconv.Atoi(pageToken); err != nil || start > len(images) {
+			return nil, newError(http.StatusBadRequest, "invalid", "Invalid value for field 'pageToken': '%s'", pageToken)
+		}
+	}
+	list := &gcompute.ImageList{Items: []*gcompute.Image{}}
+	end := len(images)
+	if s.PageSize > 0 && end-start > s.PageSize {
+		end = start + s.PageSize
+		list.NextPageToken = strconv.Itoa(end)
+	}
+	list.Items = append(list.Items, images[start:end]...)
+	return list, nil
+}
+
+func (s *Server) findImage(project string, name string) (int, *gcompute.Image) {
+	for i, image := range s.images[project] {
+		if image.Name == name {
+			return i, image
+		}
+	}
+	return -1, nil
+}
+
+// Resolves an image given by URL or by partial URL like
+// projects/debian-cloud/global/images/debian-12.
+func (s *Server) resolveImage(source string) *gcompute.Image {
+	if i := strings.Index(source, "/projects/"); i >= 0 {
+		source = source[i+1:]
+	}
+	parts := strings.Split(source, "/")
+	if len(parts) == 5 && parts[0] == "projects" && parts[2] == "global" && parts[3] == "images" {
+		_, image := s.findImage(parts[1], parts[4])
+		return image
+	} else if len(parts) == 3 && parts[0] == "global" && parts[1] == "images" {
+		_, image := s.findImage(s.Project, parts[2])
+		return image
+	}
+	return nil
+}
+
+func (s *Server) imageRequest(method string, project string, name string) (interface{}, *apiError) {
+	i, image := s.findImage(project, name)
+	if image == nil {
+		return nil, notFound("projects/" + project + "/global/images/" + name)
+	}
+	switch method {
+	case "GET":
+		return image, nil
+	case "DELETE":
+		s.images[project] = append(s.images[project][:i], s.images[project][i+1:]...)
+		return s.newOperation("", "delete", image.SelfLink), nil
+	}
+	return nil, newError(http.StatusMethodNotAllowed, "badRequest", "method %s is not allowed", method)
+}
+
+func (s *Server) insertImage(r *http.Request) (interface{}, *apiError) {
+	var image gcompute.Image
+	if err := json.NewDecoder(r.Body).Decode(&image); err != nil {
+		return nil, newError(http.StatusBadRequest, "parseError", "Parse Error: %v", err)
+	} else if !nameRegexp.MatchString(image.Name) {
+		return nil, newError(http.StatusBadRequest, "invalid", "Invalid value for field 'resource.name': '%s'", image.Name)
+	} else if _, existing := s.findImage(s.Project, image.Name); existing != nil {
+		return nil, newError(http.StatusConflict, "alreadyExists", "The resource 'projects/%s/global/images/%s' already exists", s.Project, image.Name)
+	}
+
+	if image.SourceDisk != "" {
+		key := strings.TrimPrefix(image.SourceDisk, s.link(s.Project, ""))
+		disk := s.disks[key]
+		if disk == nil {
+			return nil, notFound(image.SourceDisk)
+		}
+		// without forceCreate, images can only be created from detached disks
+		if len(disk.Users) > 0 && r.URL.Query().Get("forceCreate") != "true" {
+			return nil, newError(http.StatusBadRequest, "resourceInUseByAnotherResource", "The disk resource '%s' is already being used by '%s'", image.SourceDisk, disk.Users[0])
+		}
+		image.DiskSizeGb = disk.SizeGb
+	} else if image.RawDisk == nil || !strings.HasPrefix(image.RawDisk.Source, "https://storage.googleapis.com/") {
+		return nil, newError(http.StatusBadRequest, "invalid", "Exactly one of sourceDisk or rawDisk.source from Cloud Storage must be set")
+	} else {
+		image.DiskSizeGb = 10
+	}
+
+	s.nextID++
+	image.Id = s.nextID
+	image.SelfLink = s.link(s.Project, "global/images/"+image.Name)
+	image.Status = "READY"
+	image.CreationTimestamp = time.Now().Format(time.RFC3339)
+	image.Architecture = "X86_64"
+	s.images[s.Project] = append(s.images[s.Project], &image)
+	return s.newOperation("", "insert", image.SelfLink), nil
+}
+
+// instances
+
+func (s *Server) findInstance(zone string, name string) (*instance, *apiError) {
+	if instance := s.instances[zone+"/"+name]; instance != nil {
+		return instance, nil
+	}
+	return nil, notFound(fmt.Sprintf("projects/%s/zones/%s/instances/%s", s.Project, zone, name))
+}
+
+func (s *Server) insertInstance(r *http.Request, zone string) (interface{}, *apiError) {
+	var apiInstance gcompute.Instance
+	if err := json.NewDecoder(r.Body).Decode(&apiInstance); err != nil {
+		return nil, newError(http.StatusBadRequest, "parseError", "Parse Error: %v", err)
+	} else if !nameRegexp.MatchString(apiInstance.Name) {
+		return nil, newError(http.StatusBadRequest, "invalid", "Invalid value for field 'resource.name': '%s'", apiInstance.Name)
+	} else if s.instances[zone+"/"+apiInstance.Name] != nil {
+		return nil, newError(http.StatusConflict, "alreadyExists", "The resource 'projects/%s/zones/%s/instances/%s' already exists", s.Project, zone, apiInstance.Name)
+	}
+
+	machineTypeParts := strings.Split(apiInstance.MachineType, "/")
+	machineType := findMachineType(machineTypeParts[len(machineTypeParts)-1])
+	if machineType == nil || (len(machineTypeParts) >= 3 && machineTypeParts[len(machineTypeParts)-3] != zone) {
+		return nil, newError(http.StatusBadRequest, "invalid", "Invalid value for field 'resource.machineType': '%s'", apiInstance.MachineType)
+	} else if len(apiInstance.Disks) != 1 || !apiInstance.Disks[0].Boot || apiInstance.Disks[0].InitializeParams == nil {
+		return nil, newError(http.StatusBadRequest, "invalid", "Instances must have a single boot disk with initialize parameters")
+	} else if len(apiInstance.NetworkInterfaces) != 1 || !strings.HasSuffix(apiInstance.NetworkInterfaces[0].Network, "global/networks/default") {
+		return nil, newError(http.StatusBadRequest, "invalid", "Instances must have a single interface on the default network")
+	}
+	params := apiInstance.Disks[0].InitializeParams
+	image := s.resolveImage(params.SourceImage)
+	if image == nil {
+		return nil, notFound(params.SourceImage)
+	} else if params.DiskSizeGb != 0 && params.DiskSizeGb < image.DiskSizeGb {
+		return nil, newError(http.StatusBadRequest, "invalid", "Requested disk size cannot be smaller than the image size (%d GB)", image.DiskSizeGb)
+	}
+
+	if s.InstanceQuota > 0 && len(s.instances) >= s.InstanceQuota {
+		return s.failOperation(zone, "insert", s.link(s.Project, "zones/"+zone+"/instances/"+apiInstance.Name), &gcompute.OperationErrorErrors{
+			Code:    "QUOTA_EXCEEDED",
+			Message: fmt.Sprintf("Quota 'INSTANCES' exceeded.  Limit: %d.0 globally.", s.InstanceQuota),
+		}), nil
+	}
+
+	s.nextID++
+	apiInstance.Id = s.nextID
+	apiInstance.Zone = s.link(s.Project, "zones/"+zone)
+	apiInstance.SelfLink = s.link(s.Project, "zones/"+zone+"/instances/"+apiInstance.Name)
+	apiInstance.MachineType = s.link(s.Project, "zones/"+zone+"/machineTypes/"+machineType.Name)
+	apiInstance.Status = "PROVISIONING"
+	apiInstance.CreationTimestamp = time.Now().Format(time.RFC3339)
+
+	disk := &gcompute.Disk{
+		Name:        apiInstance.Name,
+		SizeGb:      params.DiskSizeGb,
+		SourceImage: image.SelfLink,
+		Zone:        apiInstance.Zone,
+		SelfLink:    s.link(s.Project, "zones/"+zone+"/disks/"+apiInstance.Name),
+		Status:      "READY",
+		Users:       []string{apiInstance.SelfLink},
+	}
+	if disk.SizeGb == 0 {
+		disk.SizeGb = image.DiskSizeGb
+	}
+	s.disks["zones/"+zone+"/disks/"+disk.Name] = disk
+	apiInstance.Disks[0].Source = disk.SelfLink
+	apiInstance.Disks[0].DiskSizeGb = disk.SizeGb
+	apiInstance.Disks[0].InitializeParams = nil
+
+	nic := apiInstance.NetworkInterfaces[0]
+	nic.Name = "nic0"
+	nic.NetworkIP = fmt.Sprintf("10.128.0.%d", apiInstance.Id%250+2)
+	for _, accessConfig := range nic.AccessConfigs {
+		accessConfig.NatIP = fmt.Sprintf("34.66.0.%d", apiInstance.Id%250+2)
+	}
+
+	s.instances[zone+"/"+apiInstance.Name] = &instance{&apiInstance, "RUNNING", s.PendingPolls}
+	return s.newOperation(zone, "insert", apiInstance.SelfLink), nil
+}
+
+func (s *Server) instanceRequest(method string, zone string, name string) (interface{}, *apiError) {
+	instance, err := s.findInstance(zone, name)
+	if err != nil {
+		return nil, err
+	}
+	switch method {
+	case "GET":
+		if instance.target != "" {
+			if instance.pendingPolls > 0 {
+				instance.pendingPolls--
+			} else {
+				instance.Status = instance.target
+				instance.target = ""
+			}
+		}
+		return instance.Instance, nil
+	case "DELETE":
+		delete(s.instances, zone+"/"+name)
+		for _, attached := range instance.Disks {
+			key := strings.TrimPrefix(attached.Source, s.link(s.Project, ""))
+			if attached.AutoDelete {
+				delete(s.disks, key)
+			} else if disk := s.disks[key]; disk != nil {
+				disk.Users = nil
+			}
+		}
+		return s.newOperation(zone, "delete", instance.SelfLink), nil
+	}
+	return nil, newError(http.StatusMethodNotAllowed, "badRequest", "method %s is not allowed", method)
+}
+
+func (s *Server) instanceAction(zone string, name string, action string) (interface{}, *apiError) {
+	instance, err := s.findInstance(zone, name)
+	if err != nil {
+		return nil, err
+	}
+	switch action {
+	case "start":
+		if instance.Status == "TERMINATED" {
+			instance.Status = "STAGING"
+			instance.target = "RUNNING"
+			instance.pendingPolls = s.PendingPolls
+		}
+	case "stop":
+		if instance.Status != "TERMINATED" {
+			instance.Status = "STOPPING"
+			instance.target = "TERMINATED"
+			instance.pendingPolls = s.PendingPolls
+		}
+	case "reset":
+		if instance.Status != "RUNNING" {
+			return nil, newError(http.StatusBadRequest, "resourceNotReady", "The resource 'projects/%s/zones/%s/instances/%s' is not ready", s.Project, zone, name)
+		}
+	default:
+		return nil, notFound(instance.SelfLink + "/" + action)
+	}
+	return s.newOperation(zone, action, instance.SelfLink), nil
+}
+
+// Lists the instances of the project in all zones, ordered by zone and name.
+func (s *Server) Instances() []*gcompute.Instance {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.instances {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	instances := make([]*gcompute.Instance, len(keys))
+	for i, key := range keys {
+		instances[i] = s.instances[key].Instance
+	}
+	return instances
+}
@@ -1,8 +1,54 @@
 package googlecompute
 
+import "github.com/LunaNode/cloug/utils"
+
 import "strings"
 
 func basename(url string) string {
 	parts := strings.Split(url, "/")
 	return parts[len(parts)-1]
 }
+
+// Returns the project and name of an image given by URL, by partial URL
+// like projects/debian-cloud/global/images/debian-12, or by name in project.
+func parseImageID(imageID string, project string) (string, string) {
+	parts := strings.Split(imageID, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == "projects" {
+			return parts[i+1], parts[len(parts)-1]
+		}
+	}
+	return project, basename(imageID)
+}
+
+// Converts a name to a valid resource name: at most 63 characters of lowercase
+// letters, digits and hyphens, starting with a letter and not ending with a
+// hyphen. Returns an empty string if no valid characters remain.
+func sanitizeName(name string) string {
+	var sanitized []rune
+	for _, c := range strings.ToLower(name) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			sanitized = append(sanitized, c)
+		} else if len(sanitized) > 0 && sanitized[len(sanitized)-1] != '-' {
+			sanitized = append(sanitized, '-')
+		}
+	}
+	str := strings.TrimLeft(string(sanitized), "0123456789-")
+	if len(str) > 63 {
+		str = str[:63]
+	}
+	return strings.TrimRight(str, "-")
+}
+
+// Returns the sanitized name, or DEFAULT_NAME if it is empty, with a random
+// suffix so that it does not collide with existing resources.
+func uniqueName(name string) string {
+	name = sanitizeName(name)
+	if name == "" {
+		name = DEFAULT_NAME
+	}
+	if len(name) > 54 {
+		name = strings.TrimRight(name[:54], "-")
+	}
+	return name + "-" + utils.UidAlphabet(8, []rune("abcdefghijklmnopqrstuvwxyz0123456789"))
+}
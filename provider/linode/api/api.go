@@ -0,0 +1,320 @@
+// Package api is a client for the Linode API v3, where every call is an
+// api_action with form parameters and errors are reported in ERRORARRAY.
+package api
+
+import (
+	"github.com/LunaNode/cloug/provider/common"
+	"github.com/LunaNode/cloug/service/compute"
+
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Error kinds for the ERRORCODE values that the API documents.
+var errorKinds = map[int]error{
+	1:  compute.ErrInvalidArgument, // bad request
+	3:  compute.ErrNotSupported,    // class does not exist
+	4:  compute.ErrAuth,            // authentication failed
+	5:  compute.ErrNotFound,        // object not found
+	6:  compute.ErrInvalidArgument, // required property missing
+	7:  compute.ErrInvalidArgument, // property is invalid
+	8:  compute.ErrInvalidArgument, // data validation error
+	9:  compute.ErrNotSupported,    // method not implemented
+	13: compute.ErrAuth,            // permission denied
+	14: compute.ErrRateLimited,     // API rate limit exceeded
+	30: compute.ErrQuotaExceeded,   // charging the credit card failed
+	31: compute.ErrQuotaExceeded,   // credit card is expired
+	40: compute.ErrQuotaExceeded,   // limit of Linodes added per hour reached
+	41: compute.ErrConflict,        // Linode must have no disks before delete
+}
+
+type API struct {
+	ApiKey string
+
+	// Endpoint that api_action requests are sent to. Defaults to LINODE_API_URL.
+	URL string
+
+	// Client used for API requests. Defaults to http.DefaultClient.
+	Client *http.Client
+
+	ctx context.Context
+}
+
+func MakeAPI(apiKey string) *API {
+	return &API{ApiKey: apiKey}
+}
+
+// Returns a copy of the API that sends requests with the given context.
+func (api *API) WithContext(ctx context.Context) *API {
+	contextAPI := *api
+	contextAPI.ctx = ctx
+	return &contextAPI
+}
+
+func (api *API) context() context.Context {
+	if api.ctx == nil {
+		return context.Background()
+	}
+	return api.ctx
+}
+
+// Returns true if the action only reads state, so that it is safe to retry.
+func IsReadAction(action string) bool {
+	return strings.HasPrefix(action, "avail.") || strings.HasSuffix(action, ".list")
+}
+
+// Performs the action and decodes DATA into target.
+// The action is passed in the query string and the parameters in the POST body,
+// so that the action can be inspected without reading the body.
+func (api *API) request(action string, params map[string]string, target interface{}) error {
+	targetUrl := api.URL
+	if targetUrl == "" {
+		targetUrl = LINODE_API_URL
+	}
+	targetUrl += "?" + url.Values{"api_action": {action}}.Encode()
+
+	values := url.Values{}
+	values.Set("api_key", api.ApiKey)
+	for k, v := range params {
+		values.Set(k, v)
+	}
+	httpRequest, err := http.NewRequest("POST", targetUrl, strings.NewReader(values.Encode()))
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	client := api.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(httpRequest.WithContext(api.context()))
+	if err != nil {
+		return err
+	}
+	responseBytes, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	var genericResponse GenericResponse
+	if err := json.Unmarshal(responseBytes, &genericResponse); err != nil {
+		if response.StatusCode != http.StatusOK {
+			return common.HTTPStatusError(response.StatusCode, fmt.Errorf("API returned %s", response.Status))
+		}
+		return err
+	} else if len(genericResponse.Errors) > 0 {
+		entry := genericResponse.Errors[0]
+		err := fmt.Errorf("%s failed: %s (code %d)", action, entry.Message, entry.Code)
+		if kind, ok := errorKinds[entry.Code]; ok {
+			return compute.WrapError(kind, err)
+		} else {
+			return common.ClassifyError(err)
+		}
+	}
+
+	if target != nil && len(genericResponse.Data) > 0 {
+		if err := json.Unmarshal(genericResponse.Data, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linodes
+
+func (api *API) CreateLinode(datacenterID int, planID int) (int, error) {
+	var response LinodeResponse
+	err := api.request("linode.create", map[string]string{
+		"DatacenterID": strconv.Itoa(datacenterID),
+		"PlanID":       strconv.Itoa(planID),
+	}, &response)
+	return response.LinodeID, err
+}
+
+func (api *API) DeleteLinode(linodeID int, skipChecks bool) error {
+	params := map[string]string{"LinodeID": strconv.Itoa(linodeID)}
+	if skipChecks {
+		params["skipChecks"] = "true"
+	}
+	return api.request("linode.delete", params, nil)
+}
+
+func (api *API) ListLinodes() ([]*Linode, error) {
+	var linodes []*Linode
+	err := api.request("linode.list", nil, &linodes)
+	return linodes, err
+}
+
+func (api *API) GetLinode(linodeID int) (*Linode, error) {
+	var linodes []*Linode
+	err := api.request("linode.list", map[string]string{"LinodeID": strconv.Itoa(linodeID)}, &linodes)
+	if err != nil {
+		return nil, err
+	} else if len(linodes) == 0 {
+		return nil, compute.Errorf(compute.ErrNotFound, "linode %d not found", linodeID)
+	} else {
+		return linodes[0], nil
+	}
+}
+
+func (api *API) linodeJob(action string, linodeID int) (int, error) {
+	var response JobResponse
+	err := api.request(action, map[string]string{"LinodeID": strconv.Itoa(linodeID)}, &response)
+	return response.JobID, err
+}
+
+func (api *API) BootLinode(linodeID int) (int, error) {
+	return api.linodeJob("linode.boot", linodeID)
+}
+
+func (api *API) ShutdownLinode(linodeID int) (int, error) {
+	return api.linodeJob("linode.shutdown", linodeID)
+}
+
+func (api *API) RebootLinode(linodeID int) (int, error) {
+	return api.linodeJob("linode.reboot", linodeID)
+}
+
+func (api *API) ListIP(linodeID int) ([]*IP, error) {
+	var ips []*IP
+	err := api.request("linode.ip.list", map[string]string{"LinodeID": strconv.Itoa(linodeID)}, &ips)
+	return ips, err
+}
+
+func (api *API) CreateConfig(linodeID int, kernelID int, label string, diskIDs []int) (int, error) {
+	disks := make([]string, len(diskIDs))
+	for i, diskID := range diskIDs {
+		disks[i] = strconv.Itoa(diskID)
+	}
+	var response ConfigResponse
+	err := api.request("linode.config.create", map[string]string{
+		"LinodeID": strconv.Itoa(linodeID),
+		"KernelID": strconv.Itoa(kernelID),
+		"Label":    label,
+		"DiskList": strings.Join(disks, ","),
+	}, &response)
+	return response.ConfigID, err
+}
+
+// disks
+
+func (api *API) createDisk(action string, params map[string]string) (int, int, error) {
+	var response DiskResponse
+	err := api.request(action, params, &response)
+	return response.DiskID, response.JobID, err
+}
+
+// Creates a disk of the given size in megabytes from a distribution.
+// Returns the disk ID and job ID.
+func (api *API) CreateDiskFromDistribution(linodeID int, label string, distributionID int, size int, rootPass string, rootSSHKey string) (int, int, error) {
+	return api.createDisk("linode.disk.createfromdistribution", map[string]string{
+		"LinodeID":       strconv.Itoa(linodeID),
+		"DistributionID": strconv.Itoa(distributionID),
+		"Label":          label,
+		"Size":           strconv.Itoa(size),
+		"rootPass":       rootPass,
+		"rootSSHKey":     rootSSHKey,
+	})
+}
+
+// Creates a disk of the given size in megabytes from an image.
+// Returns the disk ID and job ID.
+func (api *API) CreateDiskFromImage(linodeID int, label string, imageID int, size int, rootPass string, rootSSHKey string) (int, int, error) {
+	return api.createDisk("linode.disk.createfromimage", map[string]string{
+		"LinodeID":   strconv.Itoa(linodeID),
+		"ImageID":    strconv.Itoa(imageID),
+		"Label":      label,
+		"size":       strconv.Itoa(size),
+		"rootPass":   rootPass,
+		"rootSSHKey": rootSSHKey,
+	})
+}
+
+// Creates an empty disk of the given type and size in megabytes.
+// Returns the disk ID and job ID.
+func (api *API) CreateDisk(linodeID int, label string, diskType string, size int) (int, int, error) {
+	return api.createDisk("linode.disk.create", map[string]string{
+		"LinodeID": strconv.Itoa(linodeID),
+		"Label":    label,
+		"Type":     diskType,
+		"Size":     strconv.Itoa(size),
+	})
+}
+
+func (api *API) ListDisks(linodeID int) ([]*Disk, error) {
+	var disks []*Disk
+	err := api.request("linode.disk.list", map[string]string{"LinodeID": strconv.Itoa(linodeID)}, &disks)
+	return disks, err
+}
+
+// Creates an image from the disk. Returns the image ID and job ID.
+func (api *API) ImagizeDisk(linodeID int, diskID int, description string) (int, int, error) {
+	var response ImagizeResponse
+	err := api.request("linode.disk.imagize", map[string]string{
+		"LinodeID":    strconv.Itoa(linodeID),
+		"DiskID":      strconv.Itoa(diskID),
+		"Description": description,
+	}, &response)
+	return response.ImageID, response.JobID, err
+}
+
+// images
+
+func (api *API) ListImages(pending bool) ([]*Image, error) {
+	params := make(map[string]string)
+	if pending {
+		params["pending"] = "1"
+	}
+	var images []*Image
+	err := api.request("image.list", params, &images)
+	return images, err
+}
+
+func (api *API) GetImage(imageID int) (*Image, error) {
+	var images []*Image
+	err := api.request("image.list", map[string]string{"ImageID": strconv.Itoa(imageID), "pending": "1"}, &images)
+	if err != nil {
+		return nil, err
+	} else if len(images) == 0 {
+		return nil, compute.Errorf(compute.ErrNotFound, "image %d not found", imageID)
+	} else {
+		return images[0], nil
+	}
+}
+
+func (api *API) DeleteImage(imageID int) error {
+	return api.request("image.delete", map[string]string{"ImageID": strconv.Itoa(imageID)}, nil)
+}
+
+// availability
+
+func (api *API) ListDatacenters() ([]*Datacenter, error) {
+	var datacenters []*Datacenter
+	err := api.request("avail.datacenters", nil, &datacenters)
+	return datacenters, err
+}
+
+func (api *API) ListDistributions() ([]*Distribution, error) {
+	var distributions []*Distribution
+	err := api.request("avail.distributions", nil, &distributions)
+	return distributions, err
+}
+
+func (api *API) ListKernels() ([]*Kernel, error) {
+	var kernels []*Kernel
+	err := api.request("avail.kernels", nil, &kernels)
+	return kernels, err
+}
+
+func (api *API) ListPlans() ([]*Plan, error) {
+	var plans []*Plan
+	err := api.request("avail.linodeplans", nil, &plans)
+	return plans, err
+}
@@ -0,0 +1,125 @@
+package api
+
+import "encoding/json"
+
+const LINODE_API_URL = "https://api.linode.com/"
+
+type ErrorEntry struct {
+	Code    int    `json:"ERRORCODE"`
+	Message string `json:"ERRORMESSAGE"`
+}
+
+type GenericResponse struct {
+	Errors []ErrorEntry    `json:"ERRORARRAY"`
+	Action string          `json:"ACTION"`
+	Data   json.RawMessage `json:"DATA"`
+}
+
+// linodes
+
+type Linode struct {
+	ID           int    `json:"LINODEID"`
+	Label        string `json:"LABEL"`
+	Status       int    `json:"STATUS"`
+	DatacenterID int    `json:"DATACENTERID"`
+	PlanID       int    `json:"PLANID"`
+	TotalHD      int    `json:"TOTALHD"`
+	TotalRAM     int    `json:"TOTALRAM"`
+}
+
+var linodeStatuses = map[int]string{
+	-2: "Boot Failed",
+	-1: "Being Created",
+	0:  "Brand New",
+	1:  "Running",
+	2:  "Powered Off",
+	3:  "Shutting Down",
+	4:  "Saved to Disk",
+}
+
+func (linode *Linode) StatusString() string {
+	if status, ok := linodeStatuses[linode.Status]; ok {
+		return status
+	} else {
+		return "Unknown"
+	}
+}
+
+type IP struct {
+	ID       int    `json:"IPADDRESSID"`
+	LinodeID int    `json:"LINODEID"`
+	IsPublic int    `json:"ISPUBLIC"`
+	Address  string `json:"IPADDRESS"`
+}
+
+type Disk struct {
+	ID       int    `json:"DISKID"`
+	LinodeID int    `json:"LINODEID"`
+	Label    string `json:"LABEL"`
+	Type     string `json:"TYPE"`
+	Size     int    `json:"SIZE"`
+	Status   int    `json:"STATUS"`
+}
+
+type JobResponse struct {
+	JobID int `json:"JobID"`
+}
+
+type LinodeResponse struct {
+	LinodeID int `json:"LinodeID"`
+}
+
+type DiskResponse struct {
+	JobID  int `json:"JobID"`
+	DiskID int `json:"DiskID"`
+}
+
+type ConfigResponse struct {
+	ConfigID int `json:"ConfigID"`
+}
+
+// images
+
+type Image struct {
+	ID          int    `json:"IMAGEID"`
+	Label       string `json:"LABEL"`
+	Description string `json:"DESCRIPTION"`
+	MinSize     int    `json:"MINSIZE"`
+	Status      string `json:"STATUS"`
+	Type        string `json:"TYPE"`
+}
+
+type ImagizeResponse struct {
+	JobID   int `json:"JobID"`
+	ImageID int `json:"ImageID"`
+}
+
+// availability
+
+type Datacenter struct {
+	ID           int    `json:"DATACENTERID"`
+	Location     string `json:"LOCATION"`
+	Abbreviation string `json:"ABBR"`
+}
+
+type Distribution struct {
+	ID      int    `json:"DISTRIBUTIONID"`
+	Label   string `json:"LABEL"`
+	Is64Bit int    `json:"IS64BIT"`
+	MinSize int    `json:"MINIMAGESIZE"`
+}
+
+type Kernel struct {
+	ID    int    `json:"KERNELID"`
+	Label string `json:"LABEL"`
+}
+
+type Plan struct {
+	ID        int     `json:"PLANID"`
+	Label     string  `json:"LABEL"`
+	RAM       int     `json:"RAM"`
+	Disk      int     `json:"DISK"`
+	Bandwidth int     `json:"XFER"`
+	Cores     int     `json:"CORES"`
+	Price     float64 `json:"PRICE"`
+}
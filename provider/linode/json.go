@@ -1,18 +1,20 @@
 package linode
 
+import "github.com/LunaNode/cloug/provider/common"
 import "github.com/LunaNode/cloug/service/compute"
 
 import "encoding/json"
 
 type LinodeJSONConfig struct {
 	ApiKey string `json:"api_key"`
+	APIURL string `json:"api_url"`
 }
 
-func LinodeFromJSON(jsonData []byte) (compute.Provider, error) {
+func LinodeFromJSON(jsonData []byte, options ...common.Option) (compute.Provider, error) {
 	var cfg LinodeJSONConfig
 	err := json.Unmarshal(jsonData, &cfg)
 	if err != nil {
 		return nil, err
 	}
-	return MakeLinode(cfg.ApiKey), nil
+	return MakeLinode(cfg.ApiKey, append([]common.Option{common.WithAPIURL(cfg.APIURL)}, options...)...), nil
 }
@@ -1,13 +1,13 @@
 package linode
 
 import "github.com/LunaNode/cloug/provider/common"
+import "github.com/LunaNode/cloug/provider/linode/api"
 import "github.com/LunaNode/cloug/service/compute"
 import "github.com/LunaNode/cloug/utils"
 
-import "github.com/LunaNode/go-linode"
-
 import "errors"
 import "fmt"
+import "net/http"
 import "strconv"
 import "strings"
 
@@ -15,19 +15,36 @@ const DEFAULT_DATACENTER = "newark"
 const DEFAULT_STORAGE = 10
 
 type Linode struct {
-	client       *linode.Client
+	client *api.API
 }
 
-func MakeLinode(apiKey string) *Linode {
-	return &Linode{
-		client: linode.NewClient(apiKey),
-	}
+// Options may set the API URL, the HTTP client and a retry policy. Only
+// actions that read state are retried.
+func MakeLinode(apiKey string, options ...common.Option) *Linode {
+	opts := common.MakeHTTPOptions(append([]common.Option{common.WithIdempotent(idempotentRequest)}, options...)...)
+	client := api.MakeAPI(apiKey)
+	client.URL = opts.APIURL
+	client.Client = opts.HTTPClient(nil)
+	return &Linode{client}
+}
+
+// Every API call is a POST with the action in the query string.
+func idempotentRequest(req *http.Request) bool {
+	return api.IsReadAction(req.URL.Query().Get("api_action"))
 }
 
 func (ln *Linode) ComputeService() compute.Service {
 	return ln
 }
 
+func (ln *Linode) Capabilities() *compute.Capabilities {
+	return &compute.Capabilities{
+		Operations:     compute.ImplementedOperations(ln, compute.OpFindImage),
+		ImageSources:   []compute.ImageSource{compute.ImageSourceInstance},
+		InstanceFields: []compute.InstanceField{compute.FieldRegion, compute.FieldPassword, compute.FieldDiskGB},
+	}
+}
+
 func (ln *Linode) mapInstanceStatus(status string) compute.InstanceStatus {
 	if status == "Running" {
 		return compute.StatusOnline
@@ -38,16 +55,16 @@ func (ln *Linode) mapInstanceStatus(status string) compute.InstanceStatus {
 	}
 }
 
-func (ln *Linode) linodeToInstance(linode *linode.Linode, ips []*linode.IP) *compute.Instance {
+func (ln *Linode) linodeToInstance(linode *api.Linode, ips []*api.IP) *compute.Instance {
 	instance := &compute.Instance{
-		ID:        strconv.Itoa(linode.ID),
-		Name:      linode.Label,
-		Flavor:    compute.Flavor{
-			ID: strconv.Itoa(linode.Plan),
-			DiskGB: linode.TotalHD / 1024,
+		ID:   strconv.Itoa(linode.ID),
+		Name: linode.Label,
+		Flavor: compute.Flavor{
+			ID:       strconv.Itoa(linode.PlanID),
+			DiskGB:   linode.TotalHD / 1024,
 			MemoryMB: linode.TotalRAM,
 		},
-		Status: ln.mapInstanceStatus(linode.StatusString),
+		Status: ln.mapInstanceStatus(linode.StatusString()),
 	}
 
 	for _, ip := range ips {
@@ -64,7 +81,7 @@ func (ln *Linode) linodeToInstance(linode *linode.Linode, ips []*linode.IP) *com
 func (ln *Linode) findKernel() (int, error) {
 	kernels, err := ln.client.ListKernels()
 	if err != nil {
-		return 0, err
+		return 0, common.ClassifyError(err)
 	}
 	for _, kernel := range kernels {
 		if strings.Contains(kernel.Label, "Latest 64 bit") {
@@ -77,7 +94,7 @@ func (ln *Linode) findKernel() (int, error) {
 func (ln *Linode) findDatacenter(abbreviation string) (int, error) {
 	datacenters, err := ln.client.ListDatacenters()
 	if err != nil {
-		return 0, err
+		return 0, common.ClassifyError(err)
 	}
 	for _, datacenter := range datacenters {
 		if datacenter.Abbreviation == abbreviation {
@@ -87,18 +104,18 @@ func (ln *Linode) findDatacenter(abbreviation string) (int, error) {
 	return 0, errors.New("no matching datacenter found")
 }
 
-func (ln *Linode) findMatchingPlan(flavor *compute.Flavor) (*linode.Plan, error) {
+func (ln *Linode) findMatchingPlan(flavor *compute.Flavor) (*api.Plan, error) {
 	flavorID, err := common.GetMatchingFlavorID(ln, flavor)
 	if err != nil {
 		return nil, err
 	}
 	planID, err := strconv.Atoi(flavorID)
 	if err != nil {
-		return nil, fmt.Errorf("invalid flavor ID %s", flavorID)
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "invalid flavor ID %s", flavorID)
 	}
 	plans, err := ln.client.ListPlans()
 	if err != nil {
-		return nil, fmt.Errorf("failed to list plans")
+		return nil, fmt.Errorf("failed to list plans: %w", err)
 	}
 	for _, plan := range plans {
 		if plan.ID == planID {
@@ -138,7 +155,7 @@ func (ln *Linode) CreateInstance(instance *compute.Instance) (*compute.Instance,
 	// create linode
 	linodeID, err := ln.client.CreateLinode(datacenterID, plan.ID)
 	if err != nil {
-		return nil, err
+		return nil, common.ClassifyError(err)
 	}
 
 	// create disks
@@ -161,33 +178,33 @@ func (ln *Linode) CreateInstance(instance *compute.Instance) (*compute.Instance,
 		diskID, _, err = ln.client.CreateDiskFromDistribution(linodeID, "cloug", distributionID, diskSize, password, "")
 		if err != nil {
 			ln.client.DeleteLinode(linodeID, false)
-			return nil, err
+			return nil, common.ClassifyError(err)
 		}
 	} else if imageParts[0] == "image" {
 		imageID, _ := strconv.Atoi(imageParts[1])
 		diskID, _, err = ln.client.CreateDiskFromImage(linodeID, "cloug", imageID, diskSize, password, "")
 		if err != nil {
 			ln.client.DeleteLinode(linodeID, false)
-			return nil, err
+			return nil, common.ClassifyError(err)
 		}
 	} else {
-		return nil, errors.New("invalid image type " + imageParts[0])
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "invalid image type %s", imageParts[0])
 	}
 
-	swapID, _, err := ln.client.CreateDisk(linodeID, "cloug-swap", "swap", swapSize, linode.CreateDiskOptions{})
+	swapID, _, err := ln.client.CreateDisk(linodeID, "cloug-swap", "swap", swapSize)
 	if err != nil {
 		ln.client.DeleteLinode(linodeID, false)
-		return nil, err
+		return nil, common.ClassifyError(err)
 	}
 
-	_, err = ln.client.CreateConfig(linodeID, kernelID, "cloug", []int{diskID, swapID}, linode.CreateConfigOptions{})
+	_, err = ln.client.CreateConfig(linodeID, kernelID, "cloug", []int{diskID, swapID})
 	if err != nil {
 		ln.client.DeleteLinode(linodeID, false)
-		return nil, err
+		return nil, common.ClassifyError(err)
 	} else {
 		ln.client.BootLinode(linodeID)
 		return &compute.Instance{
-			ID: strconv.Itoa(linodeID),
+			ID:       strconv.Itoa(linodeID),
 			Password: password,
 		}, nil
 	}
@@ -196,7 +213,7 @@ func (ln *Linode) CreateInstance(instance *compute.Instance) (*compute.Instance,
 func (ln *Linode) instanceAction(instanceID string, f func(id int) error) error {
 	instanceIDInt, err := strconv.Atoi(instanceID)
 	if err != nil {
-		return fmt.Errorf("invalid instance ID: %s", instanceID)
+		return compute.Errorf(compute.ErrNotFound, "instance %s not found: invalid instance ID", instanceID)
 	} else {
 		return f(instanceIDInt)
 	}
@@ -204,14 +221,14 @@ func (ln *Linode) instanceAction(instanceID string, f func(id int) error) error
 
 func (ln *Linode) DeleteInstance(instanceID string) error {
 	return ln.instanceAction(instanceID, func(id int) error {
-		return ln.client.DeleteLinode(id, true)
+		return common.ClassifyError(ln.client.DeleteLinode(id, true))
 	})
 }
 
 func (ln *Linode) ListInstances() ([]*compute.Instance, error) {
 	linodes, err := ln.client.ListLinodes()
 	if err != nil {
-		return nil, err
+		return nil, common.ClassifyError(err)
 	}
 	instances := make([]*compute.Instance, len(linodes))
 	for i, linode := range linodes {
@@ -221,14 +238,17 @@ func (ln *Linode) ListInstances() ([]*compute.Instance, error) {
 }
 
 func (ln *Linode) GetInstance(instanceID string) (*compute.Instance, error) {
-	linodeID, _ := strconv.Atoi(instanceID)
+	linodeID, err := strconv.Atoi(instanceID)
+	if err != nil {
+		return nil, compute.Errorf(compute.ErrNotFound, "instance %s not found: invalid instance ID", instanceID)
+	}
 	linode, err := ln.client.GetLinode(linodeID)
 	if err != nil {
-		return nil, err
+		return nil, common.ClassifyError(err)
 	}
 	ips, err := ln.client.ListIP(linodeID)
 	if err != nil {
-		return nil, err
+		return nil, common.ClassifyError(err)
 	}
 	return ln.linodeToInstance(linode, ips), nil
 }
@@ -236,28 +256,28 @@ func (ln *Linode) GetInstance(instanceID string) (*compute.Instance, error) {
 func (ln *Linode) StartInstance(instanceID string) error {
 	return ln.instanceAction(instanceID, func(id int) error {
 		_, err := ln.client.BootLinode(id)
-		return err
+		return common.ClassifyError(err)
 	})
 }
 
 func (ln *Linode) StopInstance(instanceID string) error {
 	return ln.instanceAction(instanceID, func(id int) error {
 		_, err := ln.client.ShutdownLinode(id)
-		return err
+		return common.ClassifyError(err)
 	})
 }
 
 func (ln *Linode) RebootInstance(instanceID string) error {
 	return ln.instanceAction(instanceID, func(id int) error {
 		_, err := ln.client.RebootLinode(id)
-		return err
+		return common.ClassifyError(err)
 	})
 }
 
 func (ln *Linode) getDiskID(linodeID int) (int, error) {
 	disks, err := ln.client.ListDisks(linodeID)
 	if err != nil {
-		return 0, err
+		return 0, common.ClassifyError(err)
 	}
 	for _, disk := range disks {
 		if disk.Type != "swap" {
@@ -271,7 +291,7 @@ func (ln *Linode) CreateImage(imageTemplate *compute.Image) (*compute.Image, err
 	if imageTemplate.SourceInstance != "" {
 		linodeID, err := strconv.Atoi(imageTemplate.SourceInstance)
 		if err != nil {
-			return nil, fmt.Errorf("invalid instance ID: %s", imageTemplate.SourceInstance)
+			return nil, compute.Errorf(compute.ErrInvalidArgument, "invalid instance ID: %s", imageTemplate.SourceInstance)
 		}
 
 		diskID, err := ln.getDiskID(linodeID)
@@ -280,7 +300,7 @@ func (ln *Linode) CreateImage(imageTemplate *compute.Image) (*compute.Image, err
 		}
 		imageID, _, err := ln.client.ImagizeDisk(linodeID, diskID, "cloug image")
 		if err != nil {
-			return nil, err
+			return nil, common.ClassifyError(err)
 		} else {
 			return &compute.Image{
 				ID:             fmt.Sprintf("image:%d", imageID),
@@ -288,17 +308,17 @@ func (ln *Linode) CreateImage(imageTemplate *compute.Image) (*compute.Image, err
 			}, nil
 		}
 	} else if imageTemplate.SourceURL != "" {
-		return nil, fmt.Errorf("creating image from source URL is not supported on linode provider")
+		return nil, compute.Errorf(compute.ErrNotSupported, "creating image from source URL is not supported on linode provider")
 	} else {
 		return nil, errors.New("neither source instance nor source URL is set")
 	}
 }
 
-func (ln *Linode) mapImage(apiImage *linode.Image) *compute.Image {
+func (ln *Linode) mapImage(apiImage *api.Image) *compute.Image {
 	image := &compute.Image{
-		ID:      fmt.Sprintf("image:%d", apiImage.ID),
-		Name:    apiImage.Label,
-		Size:    int64(apiImage.MinSize) * 1024 * 1024,
+		ID:   fmt.Sprintf("image:%d", apiImage.ID),
+		Name: apiImage.Label,
+		Size: int64(apiImage.MinSize) * 1024 * 1024,
 	}
 
 	if apiImage.Status == "available" {
@@ -311,7 +331,7 @@ func (ln *Linode) mapImage(apiImage *linode.Image) *compute.Image {
 }
 
 func (ln *Linode) FindImage(image *compute.Image) (string, error) {
-	return "", fmt.Errorf("operation not supported")
+	return "", compute.ErrNotSupported
 }
 
 func (ln *Linode) ListImages() ([]*compute.Image, error) {
@@ -319,7 +339,7 @@ func (ln *Linode) ListImages() ([]*compute.Image, error) {
 
 	apiImages, err := ln.client.ListImages(false)
 	if err != nil {
-		return nil, err
+		return nil, common.ClassifyError(err)
 	}
 	for _, apiImage := range apiImages {
 		images = append(images, ln.mapImage(apiImage))
@@ -327,7 +347,7 @@ func (ln *Linode) ListImages() ([]*compute.Image, error) {
 
 	distributions, err := ln.client.ListDistributions()
 	if err != nil {
-		return nil, err
+		return nil, common.ClassifyError(err)
 	}
 	for _, distribution := range distributions {
 		images = append(images, &compute.Image{
@@ -342,17 +362,17 @@ func (ln *Linode) ListImages() ([]*compute.Image, error) {
 func (ln *Linode) GetImage(imageID string) (*compute.Image, error) {
 	imageParts := strings.SplitN(imageID, ":", 2)
 	if len(imageParts) != 2 {
-		return nil, fmt.Errorf("malformed image identification: missing colon")
+		return nil, compute.Errorf(compute.ErrNotFound, "image %s not found: missing colon", imageID)
 	} else if imageParts[0] != "image" {
-		return nil, fmt.Errorf("can only fetch info for images")
+		return nil, compute.Errorf(compute.ErrNotSupported, "can only fetch info for images")
 	}
 	imageIDInt, err := strconv.Atoi(imageParts[1])
-	image, err := ln.client.GetImage(imageIDInt)
 	if err != nil {
-		return nil, fmt.Errorf("invalid image ID: %s", imageID)
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "invalid image ID: %s", imageID)
 	}
+	image, err := ln.client.GetImage(imageIDInt)
 	if err != nil {
-		return nil, err
+		return nil, common.ClassifyError(err)
 	} else {
 		return ln.mapImage(image), nil
 	}
@@ -361,21 +381,21 @@ func (ln *Linode) GetImage(imageID string) (*compute.Image, error) {
 func (ln *Linode) DeleteImage(imageID string) error {
 	imageParts := strings.SplitN(imageID, ":", 2)
 	if len(imageParts) != 2 {
-		return errors.New("malformed image identification: missing colon")
+		return compute.Errorf(compute.ErrNotFound, "image %s not found: missing colon", imageID)
 	} else if imageParts[0] != "image" {
-		return errors.New("can only delete images")
+		return compute.Errorf(compute.ErrNotSupported, "can only delete images")
 	}
 	imageIDInt, err := strconv.Atoi(imageParts[1])
 	if err != nil {
-		return fmt.Errorf("invalid image ID: %s", imageID)
+		return compute.Errorf(compute.ErrInvalidArgument, "invalid image ID: %s", imageID)
 	}
-	return ln.client.DeleteImage(imageIDInt)
+	return common.ClassifyError(ln.client.DeleteImage(imageIDInt))
 }
 
 func (ln *Linode) ListFlavors() ([]*compute.Flavor, error) {
 	apiPlans, err := ln.client.ListPlans()
 	if err != nil {
-		return nil, err
+		return nil, common.ClassifyError(err)
 	}
 	flavors := make([]*compute.Flavor, len(apiPlans))
 	for i, plan := range apiPlans {
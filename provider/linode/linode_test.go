@@ -0,0 +1,75 @@
+package linode
+
+import "github.com/LunaNode/cloug/provider/common"
+import "github.com/LunaNode/cloug/provider/linode/simulator"
+import "github.com/LunaNode/cloug/service/compute"
+import "github.com/LunaNode/cloug/service/compute/conformance"
+
+import "errors"
+import "fmt"
+import "net/http"
+import "net/http/httptest"
+import "testing"
+import "time"
+
+func TestConformance(t *testing.T) {
+	server := simulator.NewServer("key")
+	defer server.Close()
+
+	conformance.Run(t, MakeLinode("key", common.WithAPIURL(server.APIURL())), &conformance.Config{
+		Instance: compute.Instance{
+			Image:  compute.Image{ID: fmt.Sprintf("distribution:%d", simulator.DISTRIBUTION_ID)},
+			Flavor: compute.Flavor{MemoryMB: 1024},
+		},
+		Wait: compute.WaitOptions{Interval: 10 * time.Millisecond},
+	})
+}
+
+// Read actions are retried after a 503 through the injected client, while
+// other actions are sent once.
+func TestOptions(t *testing.T) {
+	requests := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action := r.URL.Query().Get("api_action")
+		requests[action]++
+		if r.FormValue("api_key") != "key" {
+			w.Write([]byte(`{"ERRORARRAY":[{"ERRORCODE":4,"ERRORMESSAGE":"Authentication failed"}],"DATA":{}}`))
+		} else if requests[action] == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.Write([]byte(`{"ERRORARRAY":[],"DATA":[{"PLANID":1,"LABEL":"Linode 1024","RAM":1024}]}`))
+		}
+	}))
+	defer server.Close()
+
+	transport := &countingTransport{}
+	ln := MakeLinode("key", common.WithAPIURL(server.URL), common.WithTransport(transport), common.WithRetry(&common.RetryPolicy{MinBackoff: time.Millisecond}))
+	flavors, err := ln.ListFlavors()
+	if err != nil {
+		t.Fatalf("error listing flavors: %v", err)
+	} else if len(flavors) != 1 || flavors[0].MemoryMB != 1024 {
+		t.Fatalf("unexpected flavors %v", flavors)
+	} else if requests["avail.linodeplans"] != 2 || transport.requests != 2 {
+		t.Fatalf("expected 2 plan requests through the transport, got %d and %d", requests["avail.linodeplans"], transport.requests)
+	}
+
+	if err := ln.StopInstance("1"); err == nil {
+		t.Fatalf("expected shutdown to fail after 503")
+	} else if requests["linode.shutdown"] != 1 {
+		t.Fatalf("shutdown was sent %d times, expected once", requests["linode.shutdown"])
+	}
+
+	ln = MakeLinode("bad", common.WithAPIURL(server.URL))
+	if _, err := ln.ListInstances(); !errors.Is(err, compute.ErrAuth) {
+		t.Fatalf("expected auth error, got %v", err)
+	}
+}
+
+type countingTransport struct {
+	requests int
+}
+
+func (transport *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport.requests++
+	return http.DefaultTransport.RoundTrip(req)
+}
@@ -0,0 +1,477 @@
+// Package simulator provides a local stand-in for the Linode API v3.
+//
+// The server checks the API key posted with every request and answers with
+// the ERRORARRAY/DATA envelope. Datacenters, plans, kernels and distributions
+// are fixed, and Linodes, disks and images are kept in memory, so that the API
+// client and the compute adapter can be tested without an account.
+package simulator
+
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "net/http/httptest"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+
+// Distribution that disks can be created from.
+const DISTRIBUTION_ID = 146
+
+// Kernel that matches "Latest 64 bit".
+const KERNEL_ID = 138
+
+// Linode status codes.
+const (
+	STATUS_BEING_CREATED = -1
+	STATUS_BRAND_NEW     = 0
+	STATUS_RUNNING       = 1
+	STATUS_POWERED_OFF   = 2
+)
+
+type datacenter struct {
+	id       int
+	location string
+	abbr     string
+}
+
+type plan struct {
+	id    int
+	label string
+	ram   int
+	disk  int
+	xfer  int
+	cores int
+}
+
+var DATACENTERS = []datacenter{
+	{2, "Dallas, TX, USA", "dallas"},
+	{6, "Newark, NJ, USA", "newark"},
+	{7, "London, England, UK", "london"},
+}
+
+var PLANS = []plan{
+	{1, "Linode 1024", 1024, 24, 1000, 1},
+	{2, "Linode 2048", 2048, 48, 2000, 1},
+	{4, "Linode 4096", 4096, 96, 3000, 2},
+}
+
+type linode struct {
+	id           int
+	label        string
+	status       int
+	datacenterID int
+	planID       int
+	ip           string
+	configs      int
+
+	// number of list requests before a booting Linode is running
+	pendingPolls int
+}
+
+type disk struct {
+	id       int
+	linodeID int
+	label    string
+	diskType string
+	size     int
+}
+
+type image struct {
+	id          int
+	label       string
+	description string
+	minSize     int
+	status      string
+
+	pendingPolls int
+}
+
+// An ERRORARRAY entry.
+type apiError struct {
+	code    int
+	message string
+}
+
+func (err *apiError) Error() string {
+	return err.message
+}
+
+func notFound() *apiError {
+	return &apiError{5, "Object not found"}
+}
+
+func invalid(message string) *apiError {
+	return &apiError{8, message}
+}
+
+// Server is a Linode API simulator listening on a local port.
+type Server struct {
+	*httptest.Server
+
+	ApiKey string
+
+	// Number of list requests for which booting Linodes and new images are
+	// still pending.
+	PendingPolls int
+
+	mu      sync.Mutex
+	nextID  int
+	linodes map[int]*linode
+	disks   map[int]*disk
+	images  map[int]*image
+}
+
+// Starts a simulator that accepts the given API key.
+func NewServer(apiKey string) *Server {
+	s := &Server{
+		ApiKey:       apiKey,
+		PendingPolls: 1,
+		nextID:       1000,
+		linodes:      make(map[int]*linode),
+		disks:        make(map[int]*disk),
+		images:       make(map[int]*image),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Returns the API endpoint URL that the client should use.
+func (s *Server) APIURL() string {
+	return s.URL + "/"
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	// parameter names are case-insensitive
+	params := make(map[string]string)
+	for k, v := range r.Form {
+		params[strings.ToLower(k)] = v[0]
+	}
+	action := params["api_action"]
+
+	data, err := s.handle(action, params)
+	response := map[string]interface{}{
+		"ACTION":     action,
+		"ERRORARRAY": []interface{}{},
+		"DATA":       data,
+	}
+	if err != nil {
+		response["ERRORARRAY"] = []interface{}{map[string]interface{}{
+			"ERRORCODE":    err.code,
+			"ERRORMESSAGE": err.message,
+		}}
+		response["DATA"] = map[string]interface{}{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) handle(action string, params map[string]string) (interface{}, *apiError) {
+	if params["api_key"] != s.ApiKey {
+		return nil, &apiError{4, "Authentication failed"}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch action {
+	case "avail.datacenters":
+		var data []interface{}
+		for _, dc := range DATACENTERS {
+			data = append(data, map[string]interface{}{"DATACENTERID": dc.id, "LOCATION": dc.location, "ABBR": dc.abbr})
+		}
+		return data, nil
+	case "avail.linodeplans":
+		var data []interface{}
+		for _, plan := range PLANS {
+			data = append(data, map[string]interface{}{
+				"PLANID": plan.id,
+				"LABEL":  plan.label,
+				"RAM":    plan.ram,
+				"DISK":   plan.disk,
+				"XFER":   plan.xfer,
+				"CORES":  plan.cores,
+			})
+		}
+		return data, nil
+	case "avail.kernels":
+		return []interface{}{
+			map[string]interface{}{"KERNELID": KERNEL_ID, "LABEL": "Latest 64 bit (4.5.5-x86_64-linode69)"},
+			map[string]interface{}{"KERNELID": 137, "LABEL": "Latest 32 bit (4.5.5-x86-linode84)"},
+		}, nil
+	case "avail.distributions":
+		return []interface{}{
+			map[string]interface{}{"DISTRIBUTIONID": DISTRIBUTION_ID, "LABEL": "Ubuntu 16.04 LTS", "IS64BIT": 1, "MINIMAGESIZE": 1300},
+		}, nil
+	case "linode.create":
+		return s.create(params)
+	case "linode.list":
+		return s.list(params), nil
+	case "image.list":
+		return s.imageList(params), nil
+	case "image.delete":
+		imageID, _ := strconv.Atoi(params["imageid"])
+		if s.images[imageID] == nil {
+			return nil, notFound()
+		}
+		delete(s.images, imageID)
+		return map[string]interface{}{"IMAGEID": imageID}, nil
+	}
+
+	linodeID, _ := strconv.Atoi(params["linodeid"])
+	linode := s.linodes[linodeID]
+	if linode == nil {
+		if strings.HasPrefix(action, "linode.") {
+			return nil, notFound()
+		}
+		return nil, &apiError{3, "The requested class does not exist"}
+	}
+
+	switch action {
+	case "linode.boot", "linode.reboot":
+		if linode.configs == 0 {
+			return nil, invalid("Linode has no configuration profiles")
+		}
+		if linode.status == STATUS_BRAND_NEW {
+			linode.pendingPolls = s.PendingPolls
+		}
+		linode.status = STATUS_RUNNING
+		return map[string]interface{}{"JobID": s.newID()}, nil
+	case "linode.shutdown":
+		linode.status = STATUS_POWERED_OFF
+		return map[string]interface{}{"JobID": s.newID()}, nil
+	case "linode.delete":
+		if len(s.linodeDisks(linode.id)) > 0 && params["skipchecks"] != "true" {
+			return nil, &apiError{41, "Linode must have no disks before delete"}
+		}
+		for _, disk := range s.linodeDisks(linode.id) {
+			delete(s.disks, disk.id)
+		}
+		delete(s.linodes, linode.id)
+		return map[string]interface{}{"LinodeID": linode.id}, nil
+	case "linode.ip.list":
+		return []interface{}{map[string]interface{}{
+			"IPADDRESSID": linode.id,
+			"LINODEID":    linode.id,
+			"ISPUBLIC":    1,
+			"IPADDRESS":   linode.ip,
+		}}, nil
+	case "linode.config.create":
+		return s.configCreate(linode, params)
+	case "linode.disk.createfromdistribution", "linode.disk.createfromimage", "linode.disk.create":
+		return s.diskCreate(linode, action, params)
+	case "linode.disk.list":
+		var data []interface{}
+		for _, disk := range s.linodeDisks(linode.id) {
+			data = append(data, map[string]interface{}{
+				"DISKID":   disk.id,
+				"LINODEID": disk.linodeID,
+				"LABEL":    disk.label,
+				"TYPE":     disk.diskType,
+				"SIZE":     disk.size,
+				"STATUS":   1,
+			})
+		}
+		return data, nil
+	case "linode.disk.imagize":
+		diskID, _ := strconv.Atoi(params["diskid"])
+		disk := s.disks[diskID]
+		if disk == nil || disk.linodeID != linode.id {
+			return nil, notFound()
+		} else if disk.diskType == "swap" {
+			return nil, invalid("Cannot imagize a swap disk")
+		}
+		image := &image{
+			id:           s.newID(),
+			label:        params["label"],
+			description:  params["description"],
+			minSize:      disk.size,
+			status:       "pending",
+			pendingPolls: s.PendingPolls,
+		}
+		if image.label == "" {
+			image.label = fmt.Sprintf("%s (%s)", disk.label, linode.label)
+		}
+		s.images[image.id] = image
+		return map[string]interface{}{"JobID": s.newID(), "ImageID": image.id}, nil
+	default:
+		return nil, &apiError{3, "The requested class does not exist"}
+	}
+}
+
+func (s *Server) newID() int {
+	s.nextID++
+	return s.nextID
+}
+
+func findPlan(id int) *plan {
+	for i := range PLANS {
+		if PLANS[i].id == id {
+			return &PLANS[i]
+		}
+	}
+	return nil
+}
+
+func (s *Server) linodeDisks(linodeID int) []*disk {
+	var disks []*disk
+	for _, disk := range s.disks {
+		if disk.linodeID == linodeID {
+			disks = append(disks, disk)
+		}
+	}
+	sort.Slice(disks, func(i, j int) bool { return disks[i].id < disks[j].id })
+	return disks
+}
+
+func (s *Server) create(params map[string]string) (interface{}, *apiError) {
+	datacenterID, _ := strconv.Atoi(params["datacenterid"])
+	planID, _ := strconv.Atoi(params["planid"])
+	found := false
+	for _, dc := range DATACENTERS {
+		found = found || dc.id == datacenterID
+	}
+	if !found {
+		return nil, &apiError{7, "Invalid DatacenterID"}
+	} else if findPlan(planID) == nil {
+		return nil, &apiError{7, "Invalid PlanID"}
+	}
+	id := s.newID()
+	s.linodes[id] = &linode{
+		id:           id,
+		label:        fmt.Sprintf("linode%d", id),
+		status:       STATUS_BRAND_NEW,
+		datacenterID: datacenterID,
+		planID:       planID,
+		ip:           fmt.Sprintf("192.0.2.%d", id%250+1),
+	}
+	return map[string]interface{}{"LinodeID": id}, nil
+}
+
+func (s *Server) list(params map[string]string) interface{} {
+	var linodes []*linode
+	if params["linodeid"] != "" {
+		linodeID, _ := strconv.Atoi(params["linodeid"])
+		if linode := s.linodes[linodeID]; linode != nil {
+			linodes = append(linodes, linode)
+		}
+	} else {
+		for _, linode := range s.linodes {
+			linodes = append(linodes, linode)
+		}
+		sort.Slice(linodes, func(i, j int) bool { return linodes[i].id < linodes[j].id })
+	}
+
+	data := []interface{}{}
+	for _, linode := range linodes {
+		status := linode.status
+		if linode.pendingPolls > 0 {
+			linode.pendingPolls--
+			status = STATUS_BEING_CREATED
+		}
+		plan := findPlan(linode.planID)
+		data = append(data, map[string]interface{}{
+			"LINODEID":     linode.id,
+			"LABEL":        linode.label,
+			"STATUS":       status,
+			"DATACENTERID": linode.datacenterID,
+			"PLANID":       linode.planID,
+			"TOTALHD":      plan.disk * 1024,
+			"TOTALRAM":     plan.ram,
+		})
+	}
+	return data
+}
+
+func (s *Server) diskCreate(linode *linode, action string, params map[string]string) (interface{}, *apiError) {
+	size, _ := strconv.Atoi(params["size"])
+	disk := &disk{
+		linodeID: linode.id,
+		label:    params["label"],
+		diskType: "ext4",
+		size:     size,
+	}
+	switch action {
+	case "linode.disk.createfromdistribution":
+		if params["distributionid"] != strconv.Itoa(DISTRIBUTION_ID) {
+			return nil, &apiError{7, "Invalid DistributionID"}
+		} else if size < 1300 {
+			return nil, invalid("Size must be at least 1300")
+		} else if params["rootpass"] == "" {
+			return nil, &apiError{6, "rootPass is required"}
+		}
+	case "linode.disk.createfromimage":
+		imageID, _ := strconv.Atoi(params["imageid"])
+		image := s.images[imageID]
+		if image == nil || image.status != "available" {
+			return nil, &apiError{7, "Invalid ImageID"}
+		} else if size < image.minSize {
+			return nil, invalid(fmt.Sprintf("Size must be at least %d", image.minSize))
+		}
+	case "linode.disk.create":
+		disk.diskType = params["type"]
+		if disk.diskType != "ext4" && disk.diskType != "ext3" && disk.diskType != "swap" && disk.diskType != "raw" {
+			return nil, &apiError{7, "Invalid Type"}
+		}
+	}
+
+	used := 0
+	for _, other := range s.linodeDisks(linode.id) {
+		used += other.size
+	}
+	if size <= 0 || used+size > findPlan(linode.planID).disk*1024 {
+		return nil, invalid("Not enough free space")
+	}
+	disk.id = s.newID()
+	s.disks[disk.id] = disk
+	return map[string]interface{}{"JobID": s.newID(), "DiskID": disk.id}, nil
+}
+
+func (s *Server) configCreate(linode *linode, params map[string]string) (interface{}, *apiError) {
+	if params["kernelid"] != strconv.Itoa(KERNEL_ID) && params["kernelid"] != "137" {
+		return nil, &apiError{7, "Invalid KernelID"}
+	}
+	for _, diskID := range strings.Split(params["disklist"], ",") {
+		id, _ := strconv.Atoi(diskID)
+		if disk := s.disks[id]; disk == nil || disk.linodeID != linode.id {
+			return nil, &apiError{7, "Invalid DiskList"}
+		}
+	}
+	linode.configs++
+	return map[string]interface{}{"ConfigID": s.newID()}, nil
+}
+
+func (s *Server) imageList(params map[string]string) interface{} {
+	var images []*image
+	for _, image := range s.images {
+		if params["imageid"] == "" || params["imageid"] == strconv.Itoa(image.id) {
+			images = append(images, image)
+		}
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].id < images[j].id })
+
+	data := []interface{}{}
+	for _, image := range images {
+		if image.pendingPolls > 0 {
+			image.pendingPolls--
+		} else {
+			image.status = "available"
+		}
+		if image.status != "available" && params["pending"] != "1" {
+			continue
+		}
+		data = append(data, map[string]interface{}{
+			"IMAGEID":     image.id,
+			"LABEL":       image.label,
+			"DESCRIPTION": image.description,
+			"MINSIZE":     image.minSize,
+			"STATUS":      image.status,
+			"TYPE":        "manual",
+		})
+	}
+	return data
+}
@@ -0,0 +1,230 @@
+// Package api is a client for the Lobster panel API.
+//
+// Requests are JSON over REST under {Url}/api/. Each request is signed with an
+// Authorization header "lobster {ApiId}:{nonce}:{signature}", where the
+// signature is the hex HMAC-SHA512 of "{path}\n{nonce}\n{body}" keyed by the
+// API key. Failed requests return a non-2xx status with an error message.
+package api
+
+import "github.com/LunaNode/cloug/provider/common"
+
+import "bytes"
+import "crypto/hmac"
+import "crypto/sha512"
+import "encoding/hex"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "strconv"
+import "strings"
+import "time"
+
+type Client struct {
+	// Base URL of the panel; requests are sent to {Url}/api/{path}.
+	Url    string
+	ApiId  string
+	ApiKey string
+
+	// Client used for API requests. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// Returns the HMAC-SHA512 signature of a request.
+func Sign(apiKey string, path string, nonce string, body []byte) string {
+	hasher := hmac.New(sha512.New, []byte(apiKey))
+	hasher.Write([]byte(path + "\n" + nonce + "\n"))
+	hasher.Write(body)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func (client *Client) request(method string, path string, request interface{}, response interface{}) error {
+	var body []byte
+	if request != nil {
+		var err error
+		body, err = json.Marshal(request)
+		if err != nil {
+			return err
+		}
+	}
+
+	nonce := strconv.FormatInt(time.Now().UnixNano(), 10)
+	targetUrl := strings.TrimRight(client.Url, "/") + "/api/" + path
+	httpRequest, err := http.NewRequest(method, targetUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpRequest.Header.Set("Authorization", fmt.Sprintf("lobster %s:%s:%s", client.ApiId, nonce, Sign(client.ApiKey, path, nonce, body)))
+
+	httpClient := client.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	httpResponse, err := httpClient.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	responseBytes, err := ioutil.ReadAll(httpResponse.Body)
+	httpResponse.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	if httpResponse.StatusCode < 200 || httpResponse.StatusCode >= 300 {
+		var errorResponse ErrorResponse
+		message := strings.TrimSpace(string(responseBytes))
+		if json.Unmarshal(responseBytes, &errorResponse) == nil && errorResponse.Error != "" {
+			message = errorResponse.Error
+		} else if message == "" {
+			message = httpResponse.Status
+		}
+		return common.HTTPStatusError(httpResponse.StatusCode, errors.New(message))
+	}
+
+	if response != nil {
+		if err := json.Unmarshal(responseBytes, response); err != nil {
+			return fmt.Errorf("error decoding %s response: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// virtual machines
+
+func (client *Client) VmCreate(name string, planId int, imageId int, options *VmCreateOptions) (int, error) {
+	request := VmCreateRequest{
+		Name:    name,
+		PlanId:  planId,
+		ImageId: imageId,
+	}
+	if options != nil {
+		request.VmCreateOptions = *options
+	}
+	var response CreateResponse
+	err := client.request("POST", "vms", request, &response)
+	return response.Id, err
+}
+
+func (client *Client) VmDelete(vmId int) error {
+	return client.request("DELETE", fmt.Sprintf("vms/%d", vmId), nil, nil)
+}
+
+func (client *Client) VmList() ([]*VirtualMachine, error) {
+	var response VmListResponse
+	err := client.request("GET", "vms", nil, &response)
+	return response.VirtualMachines, err
+}
+
+func (client *Client) VmInfo(vmId int) (*VmInfoResponse, error) {
+	var response VmInfoResponse
+	if err := client.request("GET", fmt.Sprintf("vms/%d", vmId), nil, &response); err != nil {
+		return nil, err
+	} else if response.VirtualMachine == nil {
+		return nil, fmt.Errorf("missing virtual machine in info response for %d", vmId)
+	}
+	return &response, nil
+}
+
+// Performs a power action (start, stop, reboot) or a rename, in which case value
+// is the new name.
+func (client *Client) VmAction(vmId int, action string, value string) error {
+	return client.request("POST", fmt.Sprintf("vms/%d/action", vmId), VmActionRequest{action, value}, nil)
+}
+
+func (client *Client) VmVnc(vmId int) (string, error) {
+	var response VmVncResponse
+	err := client.request("POST", fmt.Sprintf("vms/%d/vnc", vmId), nil, &response)
+	return response.Url, err
+}
+
+func (client *Client) VmReimage(vmId int, imageId int) error {
+	return client.request("POST", fmt.Sprintf("vms/%d/reimage", vmId), VmReimageRequest{imageId}, nil)
+}
+
+func (client *Client) VmResize(vmId int, planId int) error {
+	return client.request("POST", fmt.Sprintf("vms/%d/resize", vmId), VmResizeRequest{planId}, nil)
+}
+
+func (client *Client) VmSnapshot(vmId int, name string) (int, error) {
+	var response CreateResponse
+	err := client.request("POST", fmt.Sprintf("vms/%d/snapshot", vmId), VmSnapshotRequest{name}, &response)
+	return response.Id, err
+}
+
+func (client *Client) VmAddresses(vmId int) ([]*IpAddress, error) {
+	var response VmAddressesResponse
+	err := client.request("GET", fmt.Sprintf("vms/%d/ips", vmId), nil, &response)
+	return response.Addresses, err
+}
+
+func (client *Client) VmAddressAdd(vmId int) error {
+	return client.request("POST", fmt.Sprintf("vms/%d/ips", vmId), nil, nil)
+}
+
+func (client *Client) VmAddressRemove(vmId int, ip string, privateIp string) error {
+	path := fmt.Sprintf("vms/%d/ips/%s", vmId, ip)
+	if privateIp != "" {
+		path += "?private_ip=" + privateIp
+	}
+	return client.request("DELETE", path, nil, nil)
+}
+
+func (client *Client) VmAddressRdns(vmId int, ip string, hostname string) error {
+	return client.request("POST", fmt.Sprintf("vms/%d/ips/%s/rdns", vmId, ip), VmAddressRdnsRequest{hostname}, nil)
+}
+
+// images
+
+func (client *Client) ImageFetch(region string, name string, location string, format string) (int, error) {
+	var response CreateResponse
+	err := client.request("POST", "images", ImageFetchRequest{region, name, location, format}, &response)
+	return response.Id, err
+}
+
+func (client *Client) ImageList() ([]*Image, error) {
+	var response ImageListResponse
+	err := client.request("GET", "images", nil, &response)
+	return response.Images, err
+}
+
+func (client *Client) ImageInfo(imageId int) (*ImageInfoResponse, error) {
+	var response ImageInfoResponse
+	if err := client.request("GET", fmt.Sprintf("images/%d", imageId), nil, &response); err != nil {
+		return nil, err
+	} else if response.Image == nil {
+		return nil, fmt.Errorf("missing image in info response for %d", imageId)
+	}
+	return &response, nil
+}
+
+func (client *Client) ImageDelete(imageId int) error {
+	return client.request("DELETE", fmt.Sprintf("images/%d", imageId), nil, nil)
+}
+
+// plans
+
+func (client *Client) PlanList() ([]*Plan, error) {
+	var response PlanListResponse
+	err := client.request("GET", "plans", nil, &response)
+	return response.Plans, err
+}
+
+// keys
+
+func (client *Client) KeyList() ([]*Key, error) {
+	var response KeyListResponse
+	err := client.request("GET", "keys", nil, &response)
+	return response.Keys, err
+}
+
+func (client *Client) KeyAdd(name string, key string) (int, error) {
+	var response CreateResponse
+	err := client.request("POST", "keys", KeyAddRequest{name, key}, &response)
+	return response.Id, err
+}
+
+func (client *Client) KeyRemove(keyId int) error {
+	return client.request("DELETE", fmt.Sprintf("keys/%d", keyId), nil, nil)
+}
@@ -0,0 +1,145 @@
+package api
+
+// virtual machines
+
+type VirtualMachine struct {
+	Id         int    `json:"id"`
+	Name       string `json:"name"`
+	Region     string `json:"region"`
+	PlanId     int    `json:"plan_id"`
+	ExternalIP string `json:"external_ip"`
+	PrivateIP  string `json:"private_ip"`
+}
+
+type VirtualMachineDetails struct {
+	Status        string `json:"status"`
+	BandwidthUsed int64  `json:"bandwidth_used"`
+	LoginDetails  string `json:"login_details"`
+}
+
+type VmCreateOptions struct {
+	KeyId int `json:"key_id,omitempty"`
+}
+
+type VmCreateRequest struct {
+	Name    string `json:"name"`
+	PlanId  int    `json:"plan_id"`
+	ImageId int    `json:"image_id"`
+	VmCreateOptions
+}
+
+type VmListResponse struct {
+	VirtualMachines []*VirtualMachine `json:"vms"`
+}
+
+type VmInfoResponse struct {
+	VirtualMachine *VirtualMachine        `json:"vm"`
+	Details        *VirtualMachineDetails `json:"details"`
+}
+
+type VmActionRequest struct {
+	Action string `json:"action"`
+	Value  string `json:"value,omitempty"`
+}
+
+type VmVncResponse struct {
+	Url string `json:"url"`
+}
+
+type VmReimageRequest struct {
+	ImageId int `json:"image_id"`
+}
+
+type VmResizeRequest struct {
+	PlanId int `json:"plan_id"`
+}
+
+type VmSnapshotRequest struct {
+	Name string `json:"name"`
+}
+
+type IpAddress struct {
+	Ip        string `json:"ip"`
+	PrivateIp string `json:"private_ip"`
+	CanRdns   bool   `json:"can_rdns"`
+	Hostname  string `json:"hostname"`
+}
+
+type VmAddressesResponse struct {
+	Addresses []*IpAddress `json:"addresses"`
+}
+
+type VmAddressRdnsRequest struct {
+	Hostname string `json:"hostname"`
+}
+
+// images
+
+type Image struct {
+	Id     int    `json:"id"`
+	Name   string `json:"name"`
+	Region string `json:"region"`
+	Status string `json:"status"`
+}
+
+type ImageDetails struct {
+	Status string `json:"status"`
+	Size   int64  `json:"size"`
+}
+
+type ImageFetchRequest struct {
+	Region   string `json:"region"`
+	Name     string `json:"name"`
+	Location string `json:"location"`
+	Format   string `json:"format"`
+}
+
+type ImageListResponse struct {
+	Images []*Image `json:"images"`
+}
+
+type ImageInfoResponse struct {
+	Image   *Image        `json:"image"`
+	Details *ImageDetails `json:"details"`
+}
+
+// plans
+
+type Plan struct {
+	Id        int    `json:"id"`
+	Name      string `json:"name"`
+	Ram       int    `json:"ram"`
+	Cpu       int    `json:"cpu"`
+	Storage   int    `json:"storage"`
+	Bandwidth int    `json:"bandwidth"`
+}
+
+type PlanListResponse struct {
+	Plans []*Plan `json:"plans"`
+}
+
+// keys
+
+type Key struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+type KeyAddRequest struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+type KeyListResponse struct {
+	Keys []*Key `json:"keys"`
+}
+
+// Response of requests that create an object.
+type CreateResponse struct {
+	Id int `json:"id"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
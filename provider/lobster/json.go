@@ -1,5 +1,6 @@
 package lobster
 
+import "github.com/LunaNode/cloug/provider/common"
 import "github.com/LunaNode/cloug/service/compute"
 
 import "encoding/json"
@@ -8,13 +9,17 @@ type LobsterJSONConfig struct {
 	URL    string `json:"url"`
 	ApiID  string `json:"api_id"`
 	ApiKey string `json:"api_key"`
+
+	// Overrides URL if set.
+	APIURL string `json:"api_url"`
 }
 
-func LobsterFromJSON(jsonData []byte) (compute.Provider, error) {
+func LobsterFromJSON(jsonData []byte, options ...common.Option) (compute.Provider, error) {
 	var cfg LobsterJSONConfig
 	err := json.Unmarshal(jsonData, &cfg)
 	if err != nil {
 		return nil, err
 	}
-	return MakeLobster(cfg.URL, cfg.ApiID, cfg.ApiKey), nil
+	options = append([]common.Option{common.WithAPIURL(cfg.APIURL)}, options...)
+	return MakeLobster(cfg.URL, cfg.ApiID, cfg.ApiKey, options...), nil
 }
@@ -1,10 +1,9 @@
 package lobster
 
 import "github.com/LunaNode/cloug/provider/common"
+import "github.com/LunaNode/cloug/provider/lobster/api"
 import "github.com/LunaNode/cloug/service/compute"
 
-import "github.com/LunaNode/lobster/api"
-
 import "errors"
 import "fmt"
 import "strconv"
@@ -16,12 +15,15 @@ type Lobster struct {
 	client *api.Client
 }
 
-func MakeLobster(url string, apiId string, apiKey string) *Lobster {
+// The API URL option takes precedence over url.
+func MakeLobster(url string, apiId string, apiKey string, options ...common.Option) *Lobster {
+	opts := common.MakeHTTPOptions(append([]common.Option{common.WithAPIURL(url)}, options...)...)
 	lobster := new(Lobster)
 	lobster.client = &api.Client{
-		Url:    url,
-		ApiId:  apiId,
-		ApiKey: apiKey,
+		Url:        opts.APIURL,
+		ApiId:      apiId,
+		ApiKey:     apiKey,
+		HTTPClient: opts.HTTPClient(nil),
 	}
 	return lobster
 }
@@ -30,6 +32,14 @@ func (lobster *Lobster) ComputeService() compute.Service {
 	return lobster
 }
 
+func (lobster *Lobster) Capabilities() *compute.Capabilities {
+	return &compute.Capabilities{
+		Operations:     compute.ImplementedOperations(lobster, compute.OpFindImage),
+		ImageSources:   []compute.ImageSource{compute.ImageSourceInstance, compute.ImageSourceURL},
+		InstanceFields: []compute.InstanceField{compute.FieldName, compute.FieldPublicKey},
+	}
+}
+
 func (lobster *Lobster) mapInstanceStatus(status string) compute.InstanceStatus {
 	if status == "Online" {
 		return compute.StatusOnline
@@ -83,7 +93,7 @@ func (lobster *Lobster) vmToInstance(vm *api.VirtualMachine, details *api.Virtua
 func (this *Lobster) findMatchingPlan(ram int, storage int, cpu int) (*api.Plan, error) {
 	plans, err := this.client.PlanList()
 	if err != nil {
-		return nil, err
+		return nil, common.ClassifyError(err)
 	}
 	for _, plan := range plans {
 		if plan.Ram == ram && plan.Storage == storage && plan.Cpu == cpu {
@@ -109,11 +119,11 @@ func (lobster *Lobster) CreateInstance(instance *compute.Instance) (*compute.Ins
 
 	imageIDInt, err := strconv.Atoi(imageID)
 	if err != nil {
-		return nil, fmt.Errorf("invalid image ID: %s", imageID)
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "invalid image ID: %s", imageID)
 	}
 	flavorIDInt, err := strconv.Atoi(flavorID)
 	if err != nil {
-		return nil, fmt.Errorf("invalid flavor ID: %s", flavorID)
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "invalid flavor ID: %s", flavorID)
 	}
 
 	name := instance.Name
@@ -125,13 +135,13 @@ func (lobster *Lobster) CreateInstance(instance *compute.Instance) (*compute.Ins
 	if instance.PublicKey.ID != "" {
 		clientOptions.KeyId, err = strconv.Atoi(instance.PublicKey.ID)
 		if err != nil {
-			return nil, fmt.Errorf("invalid key ID: %s", instance.PublicKey.ID)
+			return nil, compute.Errorf(compute.ErrInvalidArgument, "invalid key ID: %s", instance.PublicKey.ID)
 		}
 	}
 
 	vmID, err := lobster.client.VmCreate(name, flavorIDInt, imageIDInt, &clientOptions)
 	if err != nil {
-		return nil, err
+		return nil, common.ClassifyError(err)
 	} else {
 		return &compute.Instance{
 			ID: strconv.Itoa(vmID),
@@ -142,7 +152,7 @@ func (lobster *Lobster) CreateInstance(instance *compute.Instance) (*compute.Ins
 func (lobster *Lobster) instanceAction(instanceID string, f func(id int) error) error {
 	instanceIDInt, err := strconv.Atoi(instanceID)
 	if err != nil {
-		return fmt.Errorf("invalid instance ID: %s", instanceID)
+		return compute.Errorf(compute.ErrNotFound, "instance %s not found: invalid instance ID", instanceID)
 	} else {
 		return f(instanceIDInt)
 	}
@@ -155,7 +165,7 @@ func (lobster *Lobster) DeleteInstance(instanceID string) error {
 func (lobster *Lobster) ListInstances() ([]*compute.Instance, error) {
 	vms, err := lobster.client.VmList()
 	if err != nil {
-		return nil, err
+		return nil, common.ClassifyError(err)
 	}
 	instances := make([]*compute.Instance, len(vms))
 	for i, vm := range vms {
@@ -165,10 +175,13 @@ func (lobster *Lobster) ListInstances() ([]*compute.Instance, error) {
 }
 
 func (lobster *Lobster) GetInstance(instanceID string) (*compute.Instance, error) {
-	instanceIDInt, _ := strconv.Atoi(instanceID)
+	instanceIDInt, err := strconv.Atoi(instanceID)
+	if err != nil {
+		return nil, compute.Errorf(compute.ErrNotFound, "instance %s not found: invalid instance ID", instanceID)
+	}
 	response, err := lobster.client.VmInfo(instanceIDInt)
 	if err != nil {
-		return nil, err
+		return nil, common.ClassifyError(err)
 	} else {
 		return lobster.vmToInstance(response.VirtualMachine, response.Details), nil
 	}
@@ -176,19 +189,19 @@ func (lobster *Lobster) GetInstance(instanceID string) (*compute.Instance, error
 
 func (lobster *Lobster) StartInstance(instanceID string) error {
 	return lobster.instanceAction(instanceID, func(id int) error {
-		return lobster.client.VmAction(id, "start", "")
+		return common.ClassifyError(lobster.client.VmAction(id, "start", ""))
 	})
 }
 
 func (lobster *Lobster) StopInstance(instanceID string) error {
 	return lobster.instanceAction(instanceID, func(id int) error {
-		return lobster.client.VmAction(id, "stop", "")
+		return common.ClassifyError(lobster.client.VmAction(id, "stop", ""))
 	})
 }
 
 func (lobster *Lobster) RebootInstance(instanceID string) error {
 	return lobster.instanceAction(instanceID, func(id int) error {
-		return lobster.client.VmAction(id, "reboot", "")
+		return common.ClassifyError(lobster.client.VmAction(id, "reboot", ""))
 	})
 }
 
@@ -197,14 +210,14 @@ func (lobster *Lobster) GetVNC(instanceID string) (string, error) {
 	err := lobster.instanceAction(instanceID, func(id int) error {
 		var err error
 		url, err = lobster.client.VmVnc(id)
-		return err
+		return common.ClassifyError(err)
 	})
-	return url, err
+	return url, common.ClassifyError(err)
 }
 
 func (lobster *Lobster) RenameInstance(instanceID string, name string) error {
 	return lobster.instanceAction(instanceID, func(id int) error {
-		return lobster.client.VmAction(id, "rename", name)
+		return common.ClassifyError(lobster.client.VmAction(id, "rename", name))
 	})
 }
 
@@ -215,11 +228,11 @@ func (lobster *Lobster) ReimageInstance(instanceID string, image *compute.Image)
 	}
 	imageIDInt, err := strconv.Atoi(imageID)
 	if err != nil {
-		return fmt.Errorf("invalid image ID: %s", imageID)
+		return compute.Errorf(compute.ErrInvalidArgument, "invalid image ID: %s", imageID)
 	}
 
 	return lobster.instanceAction(instanceID, func(id int) error {
-		return lobster.client.VmReimage(id, imageIDInt)
+		return common.ClassifyError(lobster.client.VmReimage(id, imageIDInt))
 	})
 }
 
@@ -230,11 +243,11 @@ func (lobster *Lobster) ResizeInstance(instanceID string, flavor *compute.Flavor
 	}
 	flavorIDInt, err := strconv.Atoi(flavorID)
 	if err != nil {
-		return fmt.Errorf("invalid flavor ID: %s", flavorID)
+		return compute.Errorf(compute.ErrInvalidArgument, "invalid flavor ID: %s", flavorID)
 	}
 
 	return lobster.instanceAction(instanceID, func(id int) error {
-		return lobster.client.VmResize(id, flavorIDInt)
+		return common.ClassifyError(lobster.client.VmResize(id, flavorIDInt))
 	})
 }
 
@@ -242,7 +255,7 @@ func (lobster *Lobster) CreateImage(imageTemplate *compute.Image) (*compute.Imag
 	if imageTemplate.SourceInstance != "" {
 		instanceIDInt, err := strconv.Atoi(imageTemplate.SourceInstance)
 		if err != nil {
-			return nil, fmt.Errorf("invalid instance ID: %s", imageTemplate.SourceInstance)
+			return nil, compute.Errorf(compute.ErrInvalidArgument, "invalid instance ID: %s", imageTemplate.SourceInstance)
 		}
 
 		name := DEFAULT_NAME
@@ -252,7 +265,7 @@ func (lobster *Lobster) CreateImage(imageTemplate *compute.Image) (*compute.Imag
 
 		imageID, err := lobster.client.VmSnapshot(instanceIDInt, name)
 		if err != nil {
-			return nil, err
+			return nil, common.ClassifyError(err)
 		} else {
 			return &compute.Image{
 				ID:             strconv.Itoa(imageID),
@@ -273,7 +286,7 @@ func (lobster *Lobster) CreateImage(imageTemplate *compute.Image) (*compute.Imag
 
 		imageID, err := lobster.client.ImageFetch(imageTemplate.Regions[0], name, imageTemplate.SourceURL, imageTemplate.Format)
 		if err != nil {
-			return nil, err
+			return nil, common.ClassifyError(err)
 		} else {
 			return &compute.Image{
 				ID:        strconv.Itoa(imageID),
@@ -315,13 +328,13 @@ func (lobster *Lobster) mapImage(apiImage *api.Image, details *api.ImageDetails)
 }
 
 func (lobster *Lobster) FindImage(image *compute.Image) (string, error) {
-	return "", fmt.Errorf("operation not supported")
+	return "", compute.ErrNotSupported
 }
 
 func (lobster *Lobster) ListImages() ([]*compute.Image, error) {
 	apiImages, err := lobster.client.ImageList()
 	if err != nil {
-		return nil, err
+		return nil, common.ClassifyError(err)
 	}
 	images := make([]*compute.Image, len(apiImages))
 	for i, apiImage := range apiImages {
@@ -333,11 +346,11 @@ func (lobster *Lobster) ListImages() ([]*compute.Image, error) {
 func (lobster *Lobster) GetImage(imageID string) (*compute.Image, error) {
 	imageIDInt, err := strconv.Atoi(imageID)
 	if err != nil {
-		return nil, fmt.Errorf("invalid image ID: %s", imageID)
+		return nil, compute.Errorf(compute.ErrNotFound, "image %s not found: invalid image ID", imageID)
 	}
 	response, err := lobster.client.ImageInfo(imageIDInt)
 	if err != nil {
-		return nil, err
+		return nil, common.ClassifyError(err)
 	} else {
 		return lobster.mapImage(response.Image, response.Details), nil
 	}
@@ -346,9 +359,9 @@ func (lobster *Lobster) GetImage(imageID string) (*compute.Image, error) {
 func (lobster *Lobster) DeleteImage(imageID string) error {
 	imageIDInt, err := strconv.Atoi(imageID)
 	if err != nil {
-		return fmt.Errorf("invalid image ID: %s", imageID)
+		return compute.Errorf(compute.ErrNotFound, "image %s not found: invalid image ID", imageID)
 	}
-	return lobster.client.ImageDelete(imageIDInt)
+	return common.ClassifyError(lobster.client.ImageDelete(imageIDInt))
 }
 
 func (lobster *Lobster) ListInstanceAddresses(instanceID string) ([]*compute.Address, error) {
@@ -364,14 +377,14 @@ func (lobster *Lobster) ListInstanceAddresses(instanceID string) ([]*compute.Add
 				Hostname:  addr.Hostname,
 			})
 		}
-		return err
+		return common.ClassifyError(err)
 	})
-	return addresses, err
+	return addresses, common.ClassifyError(err)
 }
 
 func (lobster *Lobster) AddAddressToInstance(instanceID string, address *compute.Address) error {
 	return lobster.instanceAction(instanceID, func(id int) error {
-		return lobster.client.VmAddressAdd(id)
+		return common.ClassifyError(lobster.client.VmAddressAdd(id))
 	})
 }
 
@@ -392,7 +405,7 @@ func (lobster *Lobster) RemoveAddressFromInstance(instanceID string, addressID s
 	}
 
 	return lobster.instanceAction(instanceID, func(id int) error {
-		return lobster.client.VmAddressRemove(id, addr.IP, addr.PrivateIP)
+		return common.ClassifyError(lobster.client.VmAddressRemove(id, addr.IP, addr.PrivateIP))
 	})
 }
 
@@ -405,14 +418,14 @@ func (lobster *Lobster) SetAddressHostname(addressID string, hostname string) er
 	ip := parts[1]
 
 	return lobster.instanceAction(instanceID, func(id int) error {
-		return lobster.client.VmAddressRdns(id, ip, hostname)
+		return common.ClassifyError(lobster.client.VmAddressRdns(id, ip, hostname))
 	})
 }
 
 func (lobster *Lobster) ListFlavors() ([]*compute.Flavor, error) {
 	apiPlans, err := lobster.client.PlanList()
 	if err != nil {
-		return nil, err
+		return nil, common.ClassifyError(err)
 	}
 	flavors := make([]*compute.Flavor, len(apiPlans))
 	for i, plan := range apiPlans {
@@ -439,7 +452,7 @@ func (lobster *Lobster) FindFlavor(flavor *compute.Flavor) (string, error) {
 func (lobster *Lobster) ListPublicKeys() ([]*compute.PublicKey, error) {
 	keys, err := lobster.client.KeyList()
 	if err != nil {
-		return nil, err
+		return nil, common.ClassifyError(err)
 	}
 	publicKeys := make([]*compute.PublicKey, len(keys))
 	for i, key := range keys {
@@ -456,7 +469,7 @@ func (lobster *Lobster) ImportPublicKey(key *compute.PublicKey) (*compute.Public
 	return common.ImportPublicKeyWrapper(key, func(label string, key string) (string, error) {
 		id, err := lobster.client.KeyAdd(label, key)
 		if err != nil {
-			return "", err
+			return "", common.ClassifyError(err)
 		} else {
 			return strconv.Itoa(id), nil
 		}
@@ -466,7 +479,7 @@ func (lobster *Lobster) ImportPublicKey(key *compute.PublicKey) (*compute.Public
 func (lobster *Lobster) RemovePublicKey(keyID string) error {
 	id, err := strconv.Atoi(keyID)
 	if err != nil {
-		return fmt.Errorf("invalid key ID")
+		return compute.Errorf(compute.ErrInvalidArgument, "invalid key ID")
 	}
-	return lobster.client.KeyRemove(id)
+	return common.ClassifyError(lobster.client.KeyRemove(id))
 }
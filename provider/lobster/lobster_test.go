@@ -0,0 +1,84 @@
+package lobster
+
+import "github.com/LunaNode/cloug/provider/common"
+import "github.com/LunaNode/cloug/provider/lobster/api"
+import "github.com/LunaNode/cloug/provider/lobster/simulator"
+import "github.com/LunaNode/cloug/service/compute"
+import "github.com/LunaNode/cloug/service/compute/conformance"
+
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "net/http/httptest"
+import "strconv"
+import "strings"
+import "testing"
+import "time"
+
+func TestConformance(t *testing.T) {
+	server := simulator.NewServer("id", "key")
+	defer server.Close()
+
+	conformance.Run(t, MakeLobster(server.URL, "id", "key"), &conformance.Config{
+		Instance: compute.Instance{
+			Image:  compute.Image{ID: strconv.Itoa(simulator.IMAGE_ID)},
+			Flavor: compute.Flavor{MemoryMB: 512},
+		},
+		ResizeFlavor: &compute.Flavor{MemoryMB: 1024},
+		PublicKey:    []byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJ0S1uMTNPZdfSW6GYaCwMPPVM4oFgNbXx0DMSWf1b4I conformance"),
+		Wait:         compute.WaitOptions{Interval: 10 * time.Millisecond},
+	})
+}
+
+// Requests are signed and sent through the injected transport; GET requests
+// are retried after a 503 while other methods are sent once.
+func TestOptions(t *testing.T) {
+	requests := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/api/")
+		requests[r.Method+" "+path]++
+		body, _ := ioutil.ReadAll(r.Body)
+		parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "lobster "), ":")
+		if len(parts) != 3 || parts[0] != "id" || parts[2] != api.Sign("key", path, parts[1], body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid signature"}`))
+		} else if requests[r.Method+" "+path] == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			fmt.Fprint(w, `{"plans":[{"id":1,"name":"small","ram":512,"cpu":1,"storage":20}]}`)
+		}
+	}))
+	defer server.Close()
+
+	transport := &countingTransport{}
+	lobster := MakeLobster(server.URL, "id", "key", common.WithTransport(transport), common.WithRetry(&common.RetryPolicy{MinBackoff: time.Millisecond}))
+	flavors, err := lobster.ListFlavors()
+	if err != nil {
+		t.Fatalf("error listing flavors: %v", err)
+	} else if len(flavors) != 1 || flavors[0].MemoryMB != 512 {
+		t.Fatalf("unexpected flavors %v", flavors)
+	} else if requests["GET plans"] != 2 || transport.requests != 2 {
+		t.Fatalf("expected 2 plan requests through the transport, got %d and %d", requests["GET plans"], transport.requests)
+	}
+
+	if err := lobster.StopInstance("1"); err == nil {
+		t.Fatalf("expected stop to fail after 503")
+	} else if requests["POST vms/1/action"] != 1 {
+		t.Fatalf("stop was sent %d times, expected once", requests["POST vms/1/action"])
+	}
+
+	lobster = MakeLobster("", "id", "bad", common.WithAPIURL(server.URL))
+	if _, err := lobster.ListInstances(); !errors.Is(err, compute.ErrAuth) {
+		t.Fatalf("expected auth error, got %v", err)
+	}
+}
+
+type countingTransport struct {
+	requests int
+}
+
+func (transport *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport.requests++
+	return http.DefaultTransport.RoundTrip(req)
+}
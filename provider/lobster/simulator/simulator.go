@@ -0,0 +1,429 @@
+// Package simulator provides a local stand-in for the Lobster panel API.
+//
+// The server verifies the HMAC-SHA512 request signature and keeps virtual
+// machines, images, addresses and keys in memory, so that the API client and
+// the compute adapter can be tested without a panel.
+package simulator
+
+import "github.com/LunaNode/cloug/provider/lobster/api"
+
+import "encoding/json"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "net/http/httptest"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+// Maximum difference between the request nonce and the server time.
+const NONCE_WINDOW = 5 * time.Minute
+
+const REGION = "toronto"
+
+// Template image that is available for creating virtual machines.
+const IMAGE_ID = 1
+
+var PLANS = []*api.Plan{
+	{Id: 1, Name: "small", Ram: 512, Cpu: 1, Storage: 20, Bandwidth: 1000},
+	{Id: 2, Name: "medium", Ram: 1024, Cpu: 1, Storage: 40, Bandwidth: 2000},
+}
+
+type vm struct {
+	id        int
+	name      string
+	planID    int
+	imageID   int
+	status    string
+	addresses []*api.IpAddress
+
+	// number of info requests before a building VM comes online
+	pendingPolls int
+}
+
+type image struct {
+	id     int
+	name   string
+	status string
+	size   int64
+
+	pendingPolls int
+}
+
+type httpError struct {
+	status  int
+	message string
+}
+
+func (err *httpError) Error() string {
+	return err.message
+}
+
+func notFound(message string) *httpError {
+	return &httpError{http.StatusNotFound, message}
+}
+
+func badRequest(message string) *httpError {
+	return &httpError{http.StatusBadRequest, message}
+}
+
+// Server is a Lobster API simulator listening on a local port.
+type Server struct {
+	*httptest.Server
+
+	ApiID  string
+	ApiKey string
+
+	// Number of info requests for which new objects are still being built.
+	PendingPolls int
+
+	mu     sync.Mutex
+	nextID int
+	vms    map[int]*vm
+	images map[int]*image
+	keys   map[int]*api.Key
+}
+
+// Starts a simulator that accepts requests signed with the given credentials.
+func NewServer(apiID string, apiKey string) *Server {
+	s := &Server{
+		ApiID:        apiID,
+		ApiKey:       apiKey,
+		PendingPolls: 1,
+		nextID:       100,
+		vms:          make(map[int]*vm),
+		images:       make(map[int]*image),
+		keys:         make(map[int]*api.Key),
+	}
+	s.images[IMAGE_ID] = &image{IMAGE_ID, "Ubuntu 16.04", "active", 2 << 30, 0}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	response, err := s.handle(r)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(err.status)
+		response = map[string]string{"error": err.message}
+	} else if response == nil {
+		response = map[string]string{}
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) handle(r *http.Request) (interface{}, *httpError) {
+	if !strings.HasPrefix(r.URL.Path, "/api/") {
+		return nil, notFound("Not found")
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/api/")
+	signedPath := path
+	if r.URL.RawQuery != "" {
+		signedPath += "?" + r.URL.RawQuery
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, badRequest("Invalid request body")
+	}
+
+	// verify the signature over path, nonce and body
+	parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "lobster "), ":")
+	if len(parts) != 3 || parts[0] != s.ApiID {
+		return nil, &httpError{http.StatusUnauthorized, "Invalid API ID"}
+	}
+	nonce, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Since(time.Unix(0, nonce)) > NONCE_WINDOW || time.Until(time.Unix(0, nonce)) > NONCE_WINDOW {
+		return nil, &httpError{http.StatusUnauthorized, "Invalid nonce"}
+	} else if parts[2] != api.Sign(s.ApiKey, signedPath, parts[1], body) {
+		return nil, &httpError{http.StatusUnauthorized, "Invalid signature"}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	route := r.Method + " " + path
+	elements := strings.Split(path, "/")
+	switch {
+	case route == "GET plans":
+		return api.PlanListResponse{Plans: PLANS}, nil
+	case route == "GET vms":
+		return s.vmList(), nil
+	case route == "POST vms":
+		return s.vmCreate(body)
+	case route == "GET images":
+		return s.imageList(), nil
+	case route == "POST images":
+		return s.imageFetch(body)
+	case route == "GET keys":
+		return s.keyList(), nil
+	case route == "POST keys":
+		return s.keyAdd(body)
+	case elements[0] == "images" && len(elements) == 2:
+		return s.imageRequest(r.Method, elements[1])
+	case r.Method == "DELETE" && elements[0] == "keys" && len(elements) == 2:
+		id, _ := strconv.Atoi(elements[1])
+		if s.keys[id] == nil {
+			return nil, notFound("Key not found")
+		}
+		delete(s.keys, id)
+		return nil, nil
+	case elements[0] == "vms" && len(elements) >= 2:
+		id, _ := strconv.Atoi(elements[1])
+		vm := s.vms[id]
+		if vm == nil {
+			return nil, notFound("Virtual machine not found")
+		}
+		return s.vmRequest(vm, r.Method, strings.Join(elements[2:], "/"), r.URL.Query().Get("private_ip"), body)
+	default:
+		return nil, notFound("Not found")
+	}
+}
+
+func (s *Server) newID() int {
+	s.nextID++
+	return s.nextID
+}
+
+func findPlan(id int) *api.Plan {
+	for _, plan := range PLANS {
+		if plan.Id == id {
+			return plan
+		}
+	}
+	return nil
+}
+
+func (s *Server) newAddress() *api.IpAddress {
+	id := s.newID()
+	return &api.IpAddress{
+		Ip:        fmt.Sprintf("192.0.2.%d", id%250+1),
+		PrivateIp: fmt.Sprintf("10.0.0.%d", id%250+1),
+		CanRdns:   true,
+	}
+}
+
+func (s *Server) apiVM(vm *vm) *api.VirtualMachine {
+	apiVM := &api.VirtualMachine{
+		Id:     vm.id,
+		Name:   vm.name,
+		Region: REGION,
+		PlanId: vm.planID,
+	}
+	if len(vm.addresses) > 0 {
+		apiVM.ExternalIP = vm.addresses[0].Ip
+		apiVM.PrivateIP = vm.addresses[0].PrivateIp
+	}
+	return apiVM
+}
+
+func (s *Server) vmList() interface{} {
+	response := api.VmListResponse{VirtualMachines: []*api.VirtualMachine{}}
+	for _, vm := range s.vms {
+		response.VirtualMachines = append(response.VirtualMachines, s.apiVM(vm))
+	}
+	sort.Slice(response.VirtualMachines, func(i, j int) bool {
+		return response.VirtualMachines[i].Id < response.VirtualMachines[j].Id
+	})
+	return response
+}
+
+func (s *Server) vmCreate(body []byte) (interface{}, *httpError) {
+	var request api.VmCreateRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, badRequest("Invalid request")
+	} else if request.Name == "" {
+		return nil, badRequest("Name must be specified")
+	} else if findPlan(request.PlanId) == nil {
+		return nil, badRequest("Invalid plan")
+	} else if image := s.images[request.ImageId]; image == nil || image.status != "active" {
+		return nil, badRequest("Invalid image")
+	} else if request.KeyId != 0 && s.keys[request.KeyId] == nil {
+		return nil, badRequest("Invalid key")
+	}
+	vm := &vm{
+		id:           s.newID(),
+		name:         request.Name,
+		planID:       request.PlanId,
+		imageID:      request.ImageId,
+		status:       "Online",
+		pendingPolls: s.PendingPolls,
+	}
+	vm.addresses = []*api.IpAddress{s.newAddress()}
+	s.vms[vm.id] = vm
+	return api.CreateResponse{Id: vm.id}, nil
+}
+
+func (s *Server) vmRequest(vm *vm, method string, subpath string, privateIP string, body []byte) (interface{}, *httpError) {
+	route := method + " " + subpath
+	switch {
+	case route == "GET ":
+		status := vm.status
+		if vm.pendingPolls > 0 {
+			vm.pendingPolls--
+			status = "Building"
+		}
+		return api.VmInfoResponse{
+			VirtualMachine: s.apiVM(vm),
+			Details: &api.VirtualMachineDetails{
+				Status:       status,
+				LoginDetails: "username: root; password: " + strconv.Itoa(vm.id*7919),
+			},
+		}, nil
+	case route == "DELETE ":
+		delete(s.vms, vm.id)
+		return nil, nil
+	case route == "POST action":
+		var request api.VmActionRequest
+		json.Unmarshal(body, &request)
+		switch request.Action {
+		case "start", "reboot":
+			vm.status = "Online"
+		case "stop":
+			vm.status = "Offline"
+		case "rename":
+			if request.Value == "" {
+				return nil, badRequest("Name must be specified")
+			}
+			vm.name = request.Value
+		default:
+			return nil, badRequest("Invalid action")
+		}
+		return nil, nil
+	case route == "POST vnc":
+		return api.VmVncResponse{Url: fmt.Sprintf("%s/vnc/%d", s.URL, vm.id)}, nil
+	case route == "POST reimage":
+		var request api.VmReimageRequest
+		json.Unmarshal(body, &request)
+		if image := s.images[request.ImageId]; image == nil || image.status != "active" {
+			return nil, badRequest("Invalid image")
+		}
+		vm.imageID = request.ImageId
+		return nil, nil
+	case route == "POST resize":
+		var request api.VmResizeRequest
+		json.Unmarshal(body, &request)
+		if findPlan(request.PlanId) == nil {
+			return nil, badRequest("Invalid plan")
+		}
+		vm.planID = request.PlanId
+		return nil, nil
+	case route == "POST snapshot":
+		var request api.VmSnapshotRequest
+		json.Unmarshal(body, &request)
+		image := &image{s.newID(), request.Name, "pending", int64(findPlan(vm.planID).Storage) << 30, s.PendingPolls}
+		s.images[image.id] = image
+		return api.CreateResponse{Id: image.id}, nil
+	case route == "GET ips":
+		return api.VmAddressesResponse{Addresses: vm.addresses}, nil
+	case route == "POST ips":
+		vm.addresses = append(vm.addresses, s.newAddress())
+		return nil, nil
+	case strings.HasPrefix(subpath, "ips/"):
+		elements := strings.Split(subpath, "/")
+		for i, address := range vm.addresses {
+			if address.Ip != elements[1] {
+				continue
+			} else if method == "DELETE" && len(elements) == 2 {
+				if privateIP != "" && privateIP != address.PrivateIp {
+					return nil, badRequest("Private IP does not match")
+				}
+				vm.addresses = append(vm.addresses[:i], vm.addresses[i+1:]...)
+				return nil, nil
+			} else if method == "POST" && len(elements) == 3 && elements[2] == "rdns" {
+				var request api.VmAddressRdnsRequest
+				json.Unmarshal(body, &request)
+				address.Hostname = request.Hostname
+				return nil, nil
+			}
+		}
+		return nil, notFound("Address not found")
+	default:
+		return nil, notFound("Not found")
+	}
+}
+
+func (s *Server) apiImage(image *image) *api.Image {
+	return &api.Image{
+		Id:     image.id,
+		Name:   image.name,
+		Region: REGION,
+		Status: image.status,
+	}
+}
+
+func (s *Server) imageList() interface{} {
+	response := api.ImageListResponse{Images: []*api.Image{}}
+	for _, image := range s.images {
+		response.Images = append(response.Images, s.apiImage(image))
+	}
+	sort.Slice(response.Images, func(i, j int) bool {
+		return response.Images[i].Id < response.Images[j].Id
+	})
+	return response
+}
+
+func (s *Server) imageFetch(body []byte) (interface{}, *httpError) {
+	var request api.ImageFetchRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, badRequest("Invalid request")
+	} else if request.Region != REGION {
+		return nil, badRequest("Invalid region")
+	} else if !strings.HasPrefix(request.Location, "http://") && !strings.HasPrefix(request.Location, "https://") {
+		return nil, badRequest("Invalid location")
+	} else if request.Format != "iso" && request.Format != "qcow2" {
+		return nil, badRequest("Invalid format")
+	}
+	image := &image{s.newID(), request.Name, "pending", 0, s.PendingPolls}
+	s.images[image.id] = image
+	return api.CreateResponse{Id: image.id}, nil
+}
+
+func (s *Server) imageRequest(method string, imageID string) (interface{}, *httpError) {
+	id, _ := strconv.Atoi(imageID)
+	image := s.images[id]
+	if image == nil {
+		return nil, notFound("Image not found")
+	}
+	switch method {
+	case "GET":
+		if image.pendingPolls > 0 {
+			image.pendingPolls--
+		} else {
+			image.status = "active"
+		}
+		return api.ImageInfoResponse{
+			Image:   s.apiImage(image),
+			Details: &api.ImageDetails{Status: image.status, Size: image.size},
+		}, nil
+	case "DELETE":
+		delete(s.images, id)
+		return nil, nil
+	default:
+		return nil, notFound("Not found")
+	}
+}
+
+func (s *Server) keyList() interface{} {
+	response := api.KeyListResponse{Keys: []*api.Key{}}
+	for _, key := range s.keys {
+		response.Keys = append(response.Keys, key)
+	}
+	sort.Slice(response.Keys, func(i, j int) bool {
+		return response.Keys[i].Id < response.Keys[j].Id
+	})
+	return response
+}
+
+func (s *Server) keyAdd(body []byte) (interface{}, *httpError) {
+	var request api.KeyAddRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, badRequest("Invalid request")
+	} else if request.Name == "" || !strings.HasPrefix(request.Key, "ssh-") {
+		return nil, badRequest("Invalid key")
+	}
+	key := &api.Key{Id: s.newID(), Name: request.Name, Key: request.Key}
+	s.keys[key.Id] = key
+	return api.CreateResponse{Id: key.Id}, nil
+}
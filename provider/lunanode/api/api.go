@@ -1,7 +1,10 @@
 package api
 
 import (
+	"github.com/LunaNode/cloug/provider/common"
+
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha512"
@@ -21,6 +24,15 @@ type API struct {
 	ApiId         string
 	ApiKey        string
 	ApiPartialKey string
+
+	// URL template with {CATEGORY} and {ACTION} placeholders.
+	// Defaults to LNDYNAMIC_API_URL.
+	URL string
+
+	// Client used for API requests. Defaults to http.DefaultClient.
+	Client *http.Client
+
+	ctx context.Context
 }
 
 func MakeAPI(id string, key string) (*API, error) {
@@ -37,9 +49,26 @@ func MakeAPI(id string, key string) (*API, error) {
 	return api, nil
 }
 
+// Returns a copy of the API that sends requests with the given context.
+func (api *API) WithContext(ctx context.Context) *API {
+	contextAPI := *api
+	contextAPI.ctx = ctx
+	return &contextAPI
+}
+
+func (api *API) context() context.Context {
+	if api.ctx == nil {
+		return context.Background()
+	}
+	return api.ctx
+}
+
 func (api *API) request(category string, action string, params map[string]string, target interface{}) error {
 	// construct URL
-	targetUrl := LNDYNAMIC_API_URL
+	targetUrl := api.URL
+	if targetUrl == "" {
+		targetUrl = LNDYNAMIC_API_URL
+	}
 	targetUrl = strings.Replace(targetUrl, "{CATEGORY}", category, -1)
 	targetUrl = strings.Replace(targetUrl, "{ACTION}", action, -1)
 
@@ -72,7 +101,16 @@ func (api *API) request(category string, action string, params map[string]string
 	values.Set("nonce", nonce)
 	byteBuffer := new(bytes.Buffer)
 	byteBuffer.Write([]byte(values.Encode()))
-	response, err := http.Post(targetUrl, "application/x-www-form-urlencoded", byteBuffer)
+	httpRequest, err := http.NewRequest("POST", targetUrl, byteBuffer)
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	client := api.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(httpRequest.WithContext(api.context()))
 	if err != nil {
 		return err
 	}
@@ -86,10 +124,13 @@ func (api *API) request(category string, action string, params map[string]string
 	// we first decode into generic response for error checking; then into specific response to return
 	var genericResponse GenericResponse
 	if err := json.Unmarshal(responseBytes, &genericResponse); err != nil {
+		if response.StatusCode != http.StatusOK {
+			return common.HTTPStatusError(response.StatusCode, fmt.Errorf("API returned %s", response.Status))
+		}
 		return err
 	} else if genericResponse.Success != "yes" {
 		if genericResponse.Error != "" {
-			return errors.New(genericResponse.Error)
+			return common.MessageError(genericResponse.Error)
 		} else {
 			return errors.New("backend call failed for unknown reason")
 		}
@@ -342,6 +383,15 @@ func (api *API) VolumeDetach(region string, volumeIdentification int) error {
 	}, nil)
 }
 
+// Extend a volume to the given size in gigabytes.
+func (api *API) VolumeExtend(region string, volumeIdentification int, size int) error {
+	return api.request("volume", "extend", map[string]string{
+		"region":    region,
+		"volume_id": strconv.Itoa(volumeIdentification),
+		"size":      strconv.Itoa(size),
+	}, nil)
+}
+
 // plans
 
 func (api *API) PlanList() ([]*Plan, error) {
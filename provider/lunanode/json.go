@@ -1,5 +1,6 @@
 package lunanode
 
+import "github.com/LunaNode/cloug/provider/common"
 import "github.com/LunaNode/cloug/service/compute"
 
 import "encoding/json"
@@ -7,13 +8,14 @@ import "encoding/json"
 type LunaNodeJSONConfig struct {
 	ApiID  string `json:"api_id"`
 	ApiKey string `json:"api_key"`
+	APIURL string `json:"api_url"`
 }
 
-func LunaNodeFromJSON(jsonData []byte) (compute.Provider, error) {
+func LunaNodeFromJSON(jsonData []byte, options ...common.Option) (compute.Provider, error) {
 	var cfg LunaNodeJSONConfig
 	err := json.Unmarshal(jsonData, &cfg)
 	if err != nil {
 		return nil, err
 	}
-	return MakeLunaNode(cfg.ApiID, cfg.ApiKey)
+	return MakeLunaNode(cfg.ApiID, cfg.ApiKey, append([]common.Option{common.WithAPIURL(cfg.APIURL)}, options...)...)
 }
@@ -5,31 +5,66 @@ import lnapi "github.com/LunaNode/cloug/provider/lunanode/api"
 import "github.com/LunaNode/cloug/service/compute"
 import "github.com/LunaNode/cloug/utils"
 
+import "context"
 import "errors"
 import "fmt"
+import "net/http"
 import "strconv"
 import "strings"
 
 const DEFAULT_NAME = "cloug"
 const DEFAULT_REGION = "toronto"
 
+// Regions that are searched when listing region-scoped objects like volumes.
+var REGIONS = []string{"toronto", "montreal", "roubaix"}
+
 type LunaNode struct {
 	api *lnapi.API
 }
 
-func MakeLunaNode(apiId string, apiKey string) (*LunaNode, error) {
+// The API URL option may be a base URL like https://dynamic.lunanode.com/api,
+// or a template with {CATEGORY} and {ACTION} placeholders.
+func MakeLunaNode(apiId string, apiKey string, options ...common.Option) (*LunaNode, error) {
 	api, err := lnapi.MakeAPI(apiId, apiKey)
 	if err != nil {
 		return nil, err
-	} else {
-		return &LunaNode{api}, nil
 	}
+	opts := common.MakeHTTPOptions(append([]common.Option{common.WithIdempotent(idempotentRequest)}, options...)...)
+	if opts.APIURL != "" {
+		api.URL = opts.APIURL
+		if !strings.Contains(api.URL, "{CATEGORY}") {
+			api.URL = strings.TrimRight(api.URL, "/") + "/{CATEGORY}/{ACTION}/"
+		}
+	}
+	api.Client = opts.HTTPClient(nil)
+	return &LunaNode{api}, nil
+}
+
+// Every API call is a POST; list and info actions are safe to retry. The action
+// is the last path element with the default URL template.
+func idempotentRequest(req *http.Request) bool {
+	path := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	action := path[len(path)-1]
+	return action == "list" || action == "info" || action == "details"
 }
 
 func (ln *LunaNode) ComputeService() compute.Service {
 	return ln
 }
 
+func (ln *LunaNode) Capabilities() *compute.Capabilities {
+	return &compute.Capabilities{
+		Operations:     compute.ImplementedOperations(ln),
+		ImageSources:   []compute.ImageSource{compute.ImageSourceInstance, compute.ImageSourceURL},
+		InstanceFields: []compute.InstanceField{compute.FieldName, compute.FieldRegion},
+	}
+}
+
+// Returns a copy of the service whose API calls use the given context.
+func (ln *LunaNode) withContext(ctx context.Context) *LunaNode {
+	return &LunaNode{ln.api.WithContext(ctx)}
+}
+
 func (ln *LunaNode) mapInstanceStatus(status string) compute.InstanceStatus {
 	if status == "Online" {
 		return compute.StatusOnline
@@ -86,11 +121,11 @@ func (ln *LunaNode) CreateInstance(instance *compute.Instance) (*compute.Instanc
 
 	imageIDInt, err := strconv.Atoi(imageID)
 	if err != nil {
-		return nil, fmt.Errorf("invalid image ID: %s", imageID)
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "invalid image ID: %s", imageID)
 	}
 	flavorIDInt, err := strconv.Atoi(flavorID)
 	if err != nil {
-		return nil, fmt.Errorf("invalid flavor ID: %s", flavorID)
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "invalid flavor ID: %s", flavorID)
 	}
 
 	region := instance.Region
@@ -108,17 +143,16 @@ func (ln *LunaNode) CreateInstance(instance *compute.Instance) (*compute.Instanc
 		return nil, err
 	} else {
 		return &compute.Instance{
-			ID: fmt.Sprintf("%d", vmId),
+			ID: vmId,
 		}, nil
 	}
 }
 
-func (ln *LunaNode) instanceAction(instanceID string, f func(id int) error) error {
-	instanceIDInt, err := strconv.Atoi(instanceID)
-	if err != nil {
-		return fmt.Errorf("invalid instance ID: %s", instanceID)
+func (ln *LunaNode) instanceAction(instanceID string, f func(id string) error) error {
+	if instanceID == "" {
+		return errors.New("instance ID is empty")
 	} else {
-		return f(instanceIDInt)
+		return f(instanceID)
 	}
 }
 
@@ -139,8 +173,7 @@ func (ln *LunaNode) ListInstances() ([]*compute.Instance, error) {
 }
 
 func (ln *LunaNode) GetInstance(instanceID string) (*compute.Instance, error) {
-	instanceIDInt, _ := strconv.Atoi(instanceID)
-	vm, info, err := ln.api.VmInfo(instanceIDInt)
+	vm, info, err := ln.api.VmInfo(instanceID)
 	if err != nil {
 		return nil, err
 	} else {
@@ -160,9 +193,37 @@ func (ln *LunaNode) RebootInstance(instanceID string) error {
 	return ln.instanceAction(instanceID, ln.api.VmReboot)
 }
 
+func (ln *LunaNode) CreateInstanceContext(ctx context.Context, instance *compute.Instance) (*compute.Instance, error) {
+	return ln.withContext(ctx).CreateInstance(instance)
+}
+
+func (ln *LunaNode) DeleteInstanceContext(ctx context.Context, instanceID string) error {
+	return ln.withContext(ctx).DeleteInstance(instanceID)
+}
+
+func (ln *LunaNode) ListInstancesContext(ctx context.Context) ([]*compute.Instance, error) {
+	return ln.withContext(ctx).ListInstances()
+}
+
+func (ln *LunaNode) GetInstanceContext(ctx context.Context, instanceID string) (*compute.Instance, error) {
+	return ln.withContext(ctx).GetInstance(instanceID)
+}
+
+func (ln *LunaNode) StartInstanceContext(ctx context.Context, instanceID string) error {
+	return ln.withContext(ctx).StartInstance(instanceID)
+}
+
+func (ln *LunaNode) StopInstanceContext(ctx context.Context, instanceID string) error {
+	return ln.withContext(ctx).StopInstance(instanceID)
+}
+
+func (ln *LunaNode) RebootInstanceContext(ctx context.Context, instanceID string) error {
+	return ln.withContext(ctx).RebootInstance(instanceID)
+}
+
 func (ln *LunaNode) GetVNC(instanceID string) (string, error) {
 	var url string
-	err := ln.instanceAction(instanceID, func(id int) error {
+	err := ln.instanceAction(instanceID, func(id string) error {
 		var err error
 		url, err = ln.api.VmVnc(id)
 		return err
@@ -177,21 +238,17 @@ func (ln *LunaNode) ReimageInstance(instanceID string, image *compute.Image) err
 	}
 	imageIDInt, err := strconv.Atoi(imageID)
 	if err != nil {
-		return fmt.Errorf("invalid image ID: %s", imageID)
+		return compute.Errorf(compute.ErrInvalidArgument, "invalid image ID: %s", imageID)
 	}
 
-	return ln.instanceAction(instanceID, func(id int) error {
+	return ln.instanceAction(instanceID, func(id string) error {
 		return ln.api.VmReimage(id, imageIDInt)
 	})
 }
 
 func (ln *LunaNode) CreateImage(imageTemplate *compute.Image) (*compute.Image, error) {
 	if imageTemplate.SourceInstance != "" {
-		instanceIDInt, err := strconv.Atoi(imageTemplate.SourceInstance)
-		if err != nil {
-			return nil, fmt.Errorf("invalid instance ID: %s", imageTemplate.SourceInstance)
-		}
-		imageID, err := ln.api.VmSnapshot(instanceIDInt)
+		imageID, err := ln.api.VmSnapshot(imageTemplate.SourceInstance)
 		if err != nil {
 			return nil, err
 		} else {
@@ -230,7 +287,7 @@ func (ln *LunaNode) CreateImage(imageTemplate *compute.Image) (*compute.Image, e
 
 func (ln *LunaNode) mapImage(apiImage *lnapi.Image) *compute.Image {
 	image := &compute.Image{
-		ID:      apiImage.ID,
+		ID:      strconv.Itoa(apiImage.ID),
 		Name:    apiImage.Name,
 		Regions: []string{apiImage.Region},
 		Public:  strings.Contains(apiImage.Name, " (template)") || strings.Contains(apiImage.Name, " (ISO)"),
@@ -286,20 +343,25 @@ func (ln *LunaNode) FindImage(image *compute.Image) (string, error) {
 	var bestID int // get highest ID, which corresponds to latest image satisfying specification
 
 	for _, apiImage := range apiImages {
-		if !apiImage.Public {
-			continue
-		}
-
-		// check for search terms
-		fail := false
-		for _, term := range searchTerms {
-			if !strings.Contains(strings.ToLower(apiImage.Name), term) {
-				fail = true
-				break
+		// an explicit name must match exactly, and may select a private image;
+		// otherwise check public images for search terms
+		if image.Name != "" {
+			if apiImage.Name != image.Name {
+				continue
 			}
-		}
-		if fail {
+		} else if !apiImage.Public {
 			continue
+		} else {
+			fail := false
+			for _, term := range searchTerms {
+				if !strings.Contains(strings.ToLower(apiImage.Name), strings.ToLower(term)) {
+					fail = true
+					break
+				}
+			}
+			if fail {
+				continue
+			}
 		}
 
 		// verify region requirements are satisfied
@@ -307,7 +369,7 @@ func (ln *LunaNode) FindImage(image *compute.Image) (string, error) {
 			continue
 		}
 
-		imageID, _ := strconv.Atoi(image.ID)
+		imageID, _ := strconv.Atoi(apiImage.ID)
 
 		if bestImage == nil || imageID > bestID {
 			bestImage = apiImage
@@ -337,7 +399,7 @@ func (ln *LunaNode) ListImages() ([]*compute.Image, error) {
 func (ln *LunaNode) GetImage(imageID string) (*compute.Image, error) {
 	imageIDInt, err := strconv.Atoi(imageID)
 	if err != nil {
-		return nil, fmt.Errorf("invalid image ID: %s", imageID)
+		return nil, compute.Errorf(compute.ErrNotFound, "image %s not found: invalid image ID", imageID)
 	}
 	apiImage, err := ln.api.ImageDetails(imageIDInt)
 	if err != nil {
@@ -350,7 +412,7 @@ func (ln *LunaNode) GetImage(imageID string) (*compute.Image, error) {
 func (ln *LunaNode) DeleteImage(imageID string) error {
 	imageIDInt, err := strconv.Atoi(imageID)
 	if err != nil {
-		return fmt.Errorf("invalid image ID: %s", imageID)
+		return compute.Errorf(compute.ErrNotFound, "image %s not found: invalid image ID", imageID)
 	}
 	return ln.api.ImageDelete(imageIDInt)
 }
@@ -363,7 +425,7 @@ func (ln *LunaNode) ListFlavors() ([]*compute.Flavor, error) {
 	flavors := make([]*compute.Flavor, len(apiPlans))
 	for i, plan := range apiPlans {
 		flavors[i] = &compute.Flavor{
-			ID:   plan.ID,
+			ID:   strconv.Itoa(plan.ID),
 			Name: plan.Name,
 		}
 		flavors[i].MemoryMB, _ = strconv.Atoi(plan.RAM)
@@ -381,3 +443,129 @@ func (ln *LunaNode) FindFlavor(flavor *compute.Flavor) (string, error) {
 	}
 	return common.MatchFlavor(flavor, flavors), nil
 }
+
+// Volume IDs are encoded as region:id since the API requires both.
+func (ln *LunaNode) encodeVolumeID(region string, id int) string {
+	return fmt.Sprintf("%s:%d", region, id)
+}
+
+func (ln *LunaNode) decodeVolumeID(volumeID string) (string, int, error) {
+	parts := strings.SplitN(volumeID, ":", 2)
+	if len(parts) != 2 {
+		return "", 0, compute.Errorf(compute.ErrNotFound, "volume %s not found: invalid volume ID", volumeID)
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, compute.Errorf(compute.ErrNotFound, "volume %s not found: invalid volume ID", volumeID)
+	}
+	return parts[0], id, nil
+}
+
+func (ln *LunaNode) mapVolume(apiVolume *lnapi.Volume) *compute.Volume {
+	volume := &compute.Volume{
+		ID:     ln.encodeVolumeID(apiVolume.Region, apiVolume.ID),
+		Name:   apiVolume.Name,
+		Region: apiVolume.Region,
+	}
+	volume.SizeGB, _ = strconv.Atoi(apiVolume.Size)
+
+	if apiVolume.Status == "available" {
+		volume.Status = compute.VolumeAvailable
+	} else if apiVolume.Status == "in-use" {
+		volume.Status = compute.VolumeInUse
+	} else if apiVolume.Status == "creating" || apiVolume.Status == "downloading" || apiVolume.Status == "extending" {
+		volume.Status = compute.VolumePending
+	} else {
+		volume.Status = compute.VolumeStatus(apiVolume.Status)
+	}
+
+	return volume
+}
+
+func (ln *LunaNode) CreateVolume(volume *compute.Volume) (*compute.Volume, error) {
+	if volume.SizeGB <= 0 {
+		return nil, errors.New("volume size must be set")
+	}
+	region := volume.Region
+	if region == "" {
+		region = DEFAULT_REGION
+	}
+	id, err := ln.api.VolumeCreate(region, volume.SizeGB, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &compute.Volume{
+		ID:     ln.encodeVolumeID(region, id),
+		Region: region,
+		SizeGB: volume.SizeGB,
+		Status: compute.VolumePending,
+	}, nil
+}
+
+// Lists volumes in every region. The call fails if any region fails, since a
+// partial list would look complete to the caller.
+func (ln *LunaNode) ListVolumes() ([]*compute.Volume, error) {
+	var volumes []*compute.Volume
+	for _, region := range REGIONS {
+		apiVolumes, err := ln.api.VolumeList(region)
+		if err != nil {
+			return nil, fmt.Errorf("error listing volumes in %s: %w", region, common.ClassifyError(err))
+		}
+		for _, apiVolume := range apiVolumes {
+			if apiVolume.Region == "" {
+				apiVolume.Region = region
+			}
+			volumes = append(volumes, ln.mapVolume(apiVolume))
+		}
+	}
+	return volumes, nil
+}
+
+func (ln *LunaNode) GetVolume(volumeID string) (*compute.Volume, error) {
+	region, id, err := ln.decodeVolumeID(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	apiVolume, err := ln.api.VolumeInfo(region, id)
+	if err != nil {
+		return nil, err
+	}
+	if apiVolume.Region == "" {
+		apiVolume.Region = region
+	}
+	return ln.mapVolume(apiVolume), nil
+}
+
+func (ln *LunaNode) DeleteVolume(volumeID string) error {
+	region, id, err := ln.decodeVolumeID(volumeID)
+	if err != nil {
+		return err
+	}
+	return ln.api.VolumeDelete(region, id)
+}
+
+func (ln *LunaNode) AttachVolume(volumeID string, instanceID string) error {
+	region, id, err := ln.decodeVolumeID(volumeID)
+	if err != nil {
+		return err
+	}
+	return ln.instanceAction(instanceID, func(vmID string) error {
+		return ln.api.VolumeAttach(region, id, vmID)
+	})
+}
+
+func (ln *LunaNode) DetachVolume(volumeID string) error {
+	region, id, err := ln.decodeVolumeID(volumeID)
+	if err != nil {
+		return err
+	}
+	return ln.api.VolumeDetach(region, id)
+}
+
+func (ln *LunaNode) ResizeVolume(volumeID string, sizeGB int) error {
+	region, id, err := ln.decodeVolumeID(volumeID)
+	if err != nil {
+		return err
+	}
+	return ln.api.VolumeExtend(region, id, sizeGB)
+}
@@ -0,0 +1,45 @@
+package lunanode
+
+import "github.com/LunaNode/cloug/provider/common"
+import "github.com/LunaNode/cloug/provider/lunanode/simulator"
+import "github.com/LunaNode/cloug/service/compute"
+import "github.com/LunaNode/cloug/service/compute/conformance"
+
+import "errors"
+import "strings"
+import "testing"
+import "time"
+
+func TestConformance(t *testing.T) {
+	apiID := "0123456789abcdef"
+	apiKey := strings.Repeat("0123456789abcdef", 8)
+	server := simulator.NewServer(apiID, apiKey)
+	defer server.Close()
+
+	ln, err := MakeLunaNode(apiID, apiKey, common.WithAPIURL(server.URL+"/api"))
+	if err != nil {
+		t.Fatalf("error initializing provider: %v", err)
+	}
+
+	conformance.Run(t, ln, &conformance.Config{
+		Instance: compute.Instance{
+			Flavor: compute.Flavor{MemoryMB: 512},
+		},
+		VolumeSizeGB: 10,
+		Wait:         compute.WaitOptions{Interval: 10 * time.Millisecond},
+	})
+}
+
+func TestBadSignature(t *testing.T) {
+	apiID := "0123456789abcdef"
+	server := simulator.NewServer(apiID, strings.Repeat("0123456789abcdef", 8))
+	defer server.Close()
+
+	ln, err := MakeLunaNode(apiID, strings.Repeat("fedcba9876543210", 8), common.WithAPIURL(server.APIURL()))
+	if err != nil {
+		t.Fatalf("error initializing provider: %v", err)
+	}
+	if _, err := ln.ListInstances(); !errors.Is(err, compute.ErrAuth) {
+		t.Fatalf("expected auth error, got %v", err)
+	}
+}
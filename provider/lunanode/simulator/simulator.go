@@ -0,0 +1,630 @@
+// Package simulator provides a local stand-in for the LunaNode Dynamic API.
+//
+// The server verifies the HMAC-SHA512 request signature and keeps virtual
+// machines, images, volumes and plans in memory, so that the API client and
+// the compute adapter can be tested without an account.
+package simulator
+
+import "crypto/hmac"
+import "crypto/sha512"
+import "encoding/hex"
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "net/http/httptest"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+// Maximum difference between the request nonce and the server time.
+const NONCE_WINDOW = 5 * time.Minute
+
+var REGIONS = []string{"toronto", "montreal", "roubaix"}
+
+type vm struct {
+	id        string
+	hostname  string
+	region    string
+	planID    int
+	imageID   int
+	status    string
+	ip        string
+	privateIP string
+	password  string
+
+	// number of info requests before a building VM comes online
+	pendingPolls int
+}
+
+type image struct {
+	id     int
+	name   string
+	region string
+	size   int
+	status string
+
+	pendingPolls int
+}
+
+type volume struct {
+	id     int
+	label  string
+	region string
+	size   int
+	status string
+	vmID   string
+
+	pendingPolls int
+}
+
+type plan struct {
+	id        int
+	name      string
+	vcpu      int
+	ram       int
+	storage   int
+	bandwidth int
+}
+
+type apiError string
+
+func (err apiError) Error() string {
+	return string(err)
+}
+
+// Server is a LunaNode API simulator listening on a local port.
+type Server struct {
+	*httptest.Server
+
+	ApiID  string
+	ApiKey string
+
+	// Number of info requests for which new objects are still being built.
+	PendingPolls int
+
+	mu      sync.Mutex
+	nextID  int
+	vms     map[string]*vm
+	images  map[int]*image
+	volumes map[int]*volume
+	plans   []*plan
+}
+
+// Starts a simulator that accepts requests signed with the given credentials.
+// The server comes with plan 1 and template image 26, as used by the API tests.
+func NewServer(apiID string, apiKey string) *Server {
+	s := &Server{
+		ApiID:        apiID,
+		ApiKey:       apiKey,
+		PendingPolls: 1,
+		nextID:       100,
+		vms:          make(map[string]*vm),
+		images:       make(map[int]*image),
+		volumes:      make(map[int]*volume),
+		plans: []*plan{
+			{1, "m.512", 1, 512, 18, 1000},
+			{2, "m.1", 1, 1024, 30, 2000},
+			{3, "m.2", 2, 2048, 50, 3000},
+		},
+	}
+	for _, region := range REGIONS {
+		s.nextID++
+		s.images[s.nextID] = &image{s.nextID, "Ubuntu 16.04 64-bit (template)", region, 2252, "active", 0}
+	}
+	s.images[26] = &image{26, "Ubuntu 14.04 64-bit (template)", "toronto", 2252, "active", 0}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Returns the URL template that the API client should use to reach this server.
+func (s *Server) APIURL() string {
+	return s.URL + "/api/{CATEGORY}/{ACTION}/"
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	response, err := s.handle(r)
+	if response == nil {
+		response = make(map[string]interface{})
+	}
+	if err != nil {
+		response = map[string]interface{}{
+			"success": "no",
+			"error":   err.Error(),
+		}
+	} else {
+		response["success"] = "yes"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) handle(r *http.Request) (map[string]interface{}, error) {
+	if r.Method != "POST" {
+		return nil, apiError("Requests must use POST.")
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 3 || parts[0] != "api" {
+		return nil, apiError("Invalid handler.")
+	}
+	handler := parts[1] + "/" + parts[2] + "/"
+
+	// verify the signature over handler|req|nonce
+	if err := r.ParseForm(); err != nil {
+		return nil, apiError("Invalid request body.")
+	} else if r.PostForm.Get("handler") != handler {
+		return nil, apiError("Handler does not match the request path.")
+	}
+	rawParams := r.PostForm.Get("req")
+	nonce := r.PostForm.Get("nonce")
+	nonceInt, err := strconv.ParseInt(nonce, 10, 64)
+	if err != nil || time.Since(time.Unix(nonceInt, 0)) > NONCE_WINDOW || time.Until(time.Unix(nonceInt, 0)) > NONCE_WINDOW {
+		return nil, apiError("Invalid nonce.")
+	}
+	hasher := hmac.New(sha512.New, []byte(s.ApiKey))
+	hasher.Write([]byte(fmt.Sprintf("%s|%s|%s", handler, rawParams, nonce)))
+	expected := hex.EncodeToString(hasher.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(r.PostForm.Get("signature"))) {
+		return nil, apiError("Invalid signature.")
+	}
+
+	params := make(map[string]string)
+	if err := json.Unmarshal([]byte(rawParams), &params); err != nil {
+		return nil, apiError("Invalid request parameters.")
+	} else if params["api_id"] != s.ApiID || len(params["api_partialkey"]) != 64 || !strings.HasPrefix(s.ApiKey, params["api_partialkey"]) {
+		return nil, apiError("Invalid API ID or partial key.")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch handler {
+	case "vm/create/":
+		return s.vmCreate(params)
+	case "vm/list/":
+		return s.vmList()
+	case "vm/info/":
+		return s.vmInfo(params)
+	case "vm/start/", "vm/stop/", "vm/reboot/", "vm/delete/", "vm/diskswap/", "vm/reimage/":
+		return nil, s.vmAction(parts[2], params)
+	case "vm/vnc/":
+		return s.vmVnc(params)
+	case "vm/snapshot/":
+		return s.vmSnapshot(params)
+	case "image/fetch/":
+		return s.imageFetch(params)
+	case "image/list/":
+		return s.imageList(params)
+	case "image/details/":
+		return s.imageDetails(params)
+	case "image/delete/":
+		return nil, s.imageDelete(params)
+	case "volume/create/":
+		return s.volumeCreate(params)
+	case "volume/list/":
+		return s.volumeList(params)
+	case "volume/info/":
+		return s.volumeInfo(params)
+	case "volume/delete/", "volume/attach/", "volume/detach/", "volume/extend/":
+		return nil, s.volumeAction(parts[2], params)
+	case "plan/list/":
+		return s.planList()
+	default:
+		return nil, apiError("Invalid handler.")
+	}
+}
+
+func (s *Server) newID() int {
+	s.nextID++
+	return s.nextID
+}
+
+func (s *Server) findRegion(region string) error {
+	for _, r := range REGIONS {
+		if r == region {
+			return nil
+		}
+	}
+	return apiError("Invalid region specified.")
+}
+
+func (s *Server) findVM(params map[string]string) (*vm, error) {
+	vm := s.vms[params["vm_id"]]
+	if vm == nil {
+		return nil, apiError("Virtual machine not found.")
+	}
+	return vm, nil
+}
+
+func (s *Server) findImage(params map[string]string) (*image, error) {
+	id, _ := strconv.Atoi(params["image_id"])
+	image := s.images[id]
+	if image == nil {
+		return nil, apiError("Image not found.")
+	}
+	return image, nil
+}
+
+func (s *Server) findVolume(params map[string]string) (*volume, error) {
+	id, _ := strconv.Atoi(params["volume_id"])
+	volume := s.volumes[id]
+	if volume == nil || volume.region != params["region"] {
+		return nil, apiError("Volume not found.")
+	}
+	return volume, nil
+}
+
+func (s *Server) findPlan(params map[string]string) (*plan, error) {
+	id, _ := strconv.Atoi(params["plan_id"])
+	for _, plan := range s.plans {
+		if plan.id == id {
+			return plan, nil
+		}
+	}
+	return nil, apiError("Plan not found.")
+}
+
+func (s *Server) vmCreate(params map[string]string) (map[string]interface{}, error) {
+	if params["hostname"] == "" {
+		return nil, apiError("Hostname must be specified.")
+	} else if err := s.findRegion(params["region"]); err != nil {
+		return nil, err
+	}
+	plan, err := s.findPlan(params)
+	if err != nil {
+		return nil, err
+	}
+
+	newVM := &vm{
+		hostname:     params["hostname"],
+		region:       params["region"],
+		planID:       plan.id,
+		status:       "BUILD",
+		pendingPolls: s.PendingPolls,
+	}
+	if params["volume_id"] != "" {
+		volume, err := s.findVolume(params)
+		if err != nil {
+			return nil, err
+		} else if volume.status != "available" {
+			return nil, apiError("Volume is not available.")
+		}
+		newVM.id = strconv.Itoa(s.newID())
+		volume.status = "in-use"
+		volume.vmID = newVM.id
+	} else {
+		image, err := s.findImage(params)
+		if err != nil {
+			return nil, err
+		} else if image.status != "active" {
+			return nil, apiError("Image is not active.")
+		}
+		newVM.imageID = image.id
+		newVM.id = strconv.Itoa(s.newID())
+	}
+	n, _ := strconv.Atoi(newVM.id)
+	newVM.ip = fmt.Sprintf("198.51.100.%d", n%250+1)
+	newVM.privateIP = fmt.Sprintf("10.0.0.%d", n%250+1)
+	newVM.password = fmt.Sprintf("pw%d", n)
+	s.vms[newVM.id] = newVM
+	return map[string]interface{}{"vm_id": newVM.id}, nil
+}
+
+func (s *Server) vmStruct(vm *vm) map[string]interface{} {
+	var plan *plan
+	for _, p := range s.plans {
+		if p.id == vm.planID {
+			plan = p
+		}
+	}
+	return map[string]interface{}{
+		"vm_id":     vm.id,
+		"name":      vm.hostname,
+		"region":    vm.region,
+		"hostname":  vm.hostname,
+		"primaryip": vm.ip,
+		"privateip": vm.privateIP,
+		"plan_id":   strconv.Itoa(vm.planID),
+		"ram":       strconv.Itoa(plan.ram),
+		"vcpu":      strconv.Itoa(plan.vcpu),
+		"storage":   strconv.Itoa(plan.storage),
+		"bandwidth": strconv.Itoa(plan.bandwidth),
+	}
+}
+
+func (s *Server) vmList() (map[string]interface{}, error) {
+	var ids []string
+	for id := range s.vms {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	vms := []interface{}{}
+	for _, id := range ids {
+		vms = append(vms, s.vmStruct(s.vms[id]))
+	}
+	return map[string]interface{}{"vms": vms}, nil
+}
+
+func (s *Server) vmInfo(params map[string]string) (map[string]interface{}, error) {
+	vm, err := s.findVM(params)
+	if err != nil {
+		return nil, err
+	}
+	if vm.status == "BUILD" {
+		if vm.pendingPolls > 0 {
+			vm.pendingPolls--
+		} else {
+			vm.status = "Online"
+		}
+	}
+	extra := s.vmStruct(vm)
+	return map[string]interface{}{
+		"extra": extra,
+		"info": map[string]interface{}{
+			"ip":              vm.ip,
+			"privateip":       extra["privateip"],
+			"status_nohtml":   vm.status,
+			"hostname":        vm.hostname,
+			"bandwidthUsedGB": "0.5",
+			"login_details":   "username: ubuntu; password: " + vm.password,
+			"diskswap":        "",
+		},
+	}, nil
+}
+
+func (s *Server) vmAction(action string, params map[string]string) error {
+	vm, err := s.findVM(params)
+	if err != nil {
+		return err
+	} else if vm.status == "BUILD" && action != "delete" {
+		return apiError("Virtual machine is still being built.")
+	}
+
+	switch action {
+	case "start", "reboot":
+		vm.status = "Online"
+	case "stop":
+		vm.status = "Offline"
+	case "delete":
+		for _, volume := range s.volumes {
+			if volume.vmID == vm.id {
+				volume.vmID = ""
+				volume.status = "available"
+			}
+		}
+		delete(s.vms, vm.id)
+	case "reimage":
+		image, err := s.findImage(params)
+		if err != nil {
+			return err
+		}
+		vm.imageID = image.id
+		vm.status = "BUILD"
+		vm.pendingPolls = s.PendingPolls
+	}
+	return nil
+}
+
+func (s *Server) vmVnc(params map[string]string) (map[string]interface{}, error) {
+	vm, err := s.findVM(params)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"vnc_url": fmt.Sprintf("%s/vnc/%s?token=%d", s.URL, vm.id, time.Now().UnixNano()),
+	}, nil
+}
+
+func (s *Server) addImage(name string, region string, size int) *image {
+	image := &image{
+		id:           s.newID(),
+		name:         name,
+		region:       region,
+		size:         size,
+		status:       "saving",
+		pendingPolls: s.PendingPolls,
+	}
+	s.images[image.id] = image
+	return image
+}
+
+func (s *Server) vmSnapshot(params map[string]string) (map[string]interface{}, error) {
+	vm, err := s.findVM(params)
+	if err != nil {
+		return nil, err
+	} else if params["name"] == "" {
+		return nil, apiError("Name must be specified.")
+	}
+	image := s.addImage(params["name"], vm.region, 2252)
+	return map[string]interface{}{"image_id": strconv.Itoa(image.id)}, nil
+}
+
+func (s *Server) imageFetch(params map[string]string) (map[string]interface{}, error) {
+	if err := s.findRegion(params["region"]); err != nil {
+		return nil, err
+	} else if params["name"] == "" || params["location"] == "" {
+		return nil, apiError("Name and location must be specified.")
+	} else if params["format"] != "iso" && params["format"] != "qcow2" {
+		return nil, apiError("Invalid image format.")
+	}
+	image := s.addImage(params["name"], params["region"], 0)
+	return map[string]interface{}{"image_id": strconv.Itoa(image.id)}, nil
+}
+
+func (s *Server) imageStruct(image *image) map[string]interface{} {
+	if image.status == "saving" {
+		if image.pendingPolls > 0 {
+			image.pendingPolls--
+		} else {
+			image.status = "active"
+		}
+	}
+	return map[string]interface{}{
+		"image_id": strconv.Itoa(image.id),
+		"name":     image.name,
+		"status":   image.status,
+		"size":     strconv.Itoa(image.size),
+		"region":   image.region,
+	}
+}
+
+func (s *Server) imageList(params map[string]string) (map[string]interface{}, error) {
+	var ids []int
+	for id, image := range s.images {
+		if params["region"] == "" || params["region"] == image.region {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	images := []interface{}{}
+	for _, id := range ids {
+		images = append(images, s.imageStruct(s.images[id]))
+	}
+	return map[string]interface{}{"images": images}, nil
+}
+
+func (s *Server) imageDetails(params map[string]string) (map[string]interface{}, error) {
+	image, err := s.findImage(params)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"details": s.imageStruct(image)}, nil
+}
+
+func (s *Server) imageDelete(params map[string]string) error {
+	image, err := s.findImage(params)
+	if err != nil {
+		return err
+	}
+	delete(s.images, image.id)
+	return nil
+}
+
+func (s *Server) volumeCreate(params map[string]string) (map[string]interface{}, error) {
+	if err := s.findRegion(params["region"]); err != nil {
+		return nil, err
+	}
+	size, err := strconv.Atoi(params["size"])
+	if err != nil || size <= 0 {
+		return nil, apiError("Invalid volume size.")
+	}
+	if params["image"] != "" {
+		if _, err := s.findImage(map[string]string{"image_id": params["image"]}); err != nil {
+			return nil, err
+		}
+	}
+	volume := &volume{
+		id:           s.newID(),
+		label:        params["label"],
+		region:       params["region"],
+		size:         size,
+		status:       "creating",
+		pendingPolls: s.PendingPolls,
+	}
+	s.volumes[volume.id] = volume
+	return map[string]interface{}{"volume_id": strconv.Itoa(volume.id)}, nil
+}
+
+func (s *Server) volumeStruct(volume *volume) map[string]interface{} {
+	if volume.status == "creating" || volume.status == "extending" {
+		if volume.pendingPolls > 0 {
+			volume.pendingPolls--
+		} else if volume.vmID != "" {
+			volume.status = "in-use"
+		} else {
+			volume.status = "available"
+		}
+	}
+	return map[string]interface{}{
+		"id":     strconv.Itoa(volume.id),
+		"name":   volume.label,
+		"size":   strconv.Itoa(volume.size),
+		"region": volume.region,
+		"status": volume.status,
+	}
+}
+
+func (s *Server) volumeList(params map[string]string) (map[string]interface{}, error) {
+	if err := s.findRegion(params["region"]); err != nil {
+		return nil, err
+	}
+	var ids []int
+	for id, volume := range s.volumes {
+		if volume.region == params["region"] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	volumes := []interface{}{}
+	for _, id := range ids {
+		volumes = append(volumes, s.volumeStruct(s.volumes[id]))
+	}
+	return map[string]interface{}{"volumes": volumes}, nil
+}
+
+func (s *Server) volumeInfo(params map[string]string) (map[string]interface{}, error) {
+	volume, err := s.findVolume(params)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"volume": s.volumeStruct(volume)}, nil
+}
+
+func (s *Server) volumeAction(action string, params map[string]string) error {
+	volume, err := s.findVolume(params)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "delete":
+		if volume.status == "in-use" {
+			return apiError("Volume is in use.")
+		}
+		delete(s.volumes, volume.id)
+	case "attach":
+		vm, err := s.findVM(params)
+		if err != nil {
+			return err
+		} else if volume.status != "available" {
+			return apiError("Volume is not available.")
+		} else if vm.region != volume.region {
+			return apiError("Volume and virtual machine must be in the same region.")
+		}
+		volume.status = "in-use"
+		volume.vmID = vm.id
+	case "detach":
+		if volume.status != "in-use" {
+			return apiError("Volume is not attached.")
+		}
+		volume.status = "available"
+		volume.vmID = ""
+	case "extend":
+		size, err := strconv.Atoi(params["size"])
+		if err != nil || size <= volume.size {
+			return apiError("Invalid volume size.")
+		} else if volume.status == "in-use" {
+			return apiError("Volume must be detached before extending.")
+		}
+		volume.size = size
+		volume.status = "extending"
+		volume.pendingPolls = s.PendingPolls
+	}
+	return nil
+}
+
+func (s *Server) planList() (map[string]interface{}, error) {
+	plans := []interface{}{}
+	for _, plan := range s.plans {
+		plans = append(plans, map[string]interface{}{
+			"plan_id":   strconv.Itoa(plan.id),
+			"name":      plan.name,
+			"vcpu":      strconv.Itoa(plan.vcpu),
+			"price":     "0.01",
+			"ram":       strconv.Itoa(plan.ram),
+			"storage":   strconv.Itoa(plan.storage),
+			"bandwidth": strconv.Itoa(plan.bandwidth),
+		})
+	}
+	return map[string]interface{}{"plans": plans}, nil
+}
@@ -0,0 +1,211 @@
+package openstack
+
+import "github.com/LunaNode/cloug/provider/common"
+import "github.com/LunaNode/cloug/service/compute"
+
+import "github.com/LunaNode/gophercloud"
+import "github.com/LunaNode/gophercloud/openstack"
+
+import "bytes"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "strings"
+
+// Credentials for MakeOpenStackAuth, and selection of endpoints from the
+// service catalog. Exactly one of a password, a token or an application
+// credential should be set.
+//
+// Domains, tokens and application credentials require Keystone v3, so
+// IdentityEndpoint should then be the v3 endpoint, e.g.
+// https://keystone.example.com:5000/v3.
+type AuthOptions struct {
+	IdentityEndpoint string
+
+	Username string
+	UserID   string
+	Password string
+
+	// Domain of the user, and of the project if given by name.
+	DomainID   string
+	DomainName string
+
+	// Project (tenant) to scope the token to.
+	ProjectID   string
+	ProjectName string
+
+	// Existing token to authenticate with instead of a password.
+	Token string
+
+	// Application credential, given by ID, or by name along with the user.
+	ApplicationCredentialID     string
+	ApplicationCredentialName   string
+	ApplicationCredentialSecret string
+
+	// Region of the endpoints to use; needed if the catalog has several.
+	Region string
+
+	// Endpoint interface: public (the default), internal or admin.
+	Interface string
+}
+
+func (opts *AuthOptions) availability() (gophercloud.Availability, error) {
+	switch opts.Interface {
+	case "", "public", "publicURL":
+		return gophercloud.AvailabilityPublic, nil
+	case "internal", "internalURL":
+		return gophercloud.AvailabilityInternal, nil
+	case "admin", "adminURL":
+		return gophercloud.AvailabilityAdmin, nil
+	default:
+		return "", compute.Errorf(compute.ErrInvalidArgument, "invalid interface %s, expected public, internal or admin", opts.Interface)
+	}
+}
+
+// Authenticates the provider client; gophercloud handles password and token
+// authentication, while application credentials are handled here.
+func authenticate(provider *gophercloud.ProviderClient, opts *AuthOptions) error {
+	if opts.ApplicationCredentialSecret == "" {
+		return openstack.Authenticate(provider, gophercloud.AuthOptions{
+			IdentityEndpoint: opts.IdentityEndpoint,
+			Username:         opts.Username,
+			UserID:           opts.UserID,
+			Password:         opts.Password,
+			DomainID:         opts.DomainID,
+			DomainName:       opts.DomainName,
+			TenantID:         opts.ProjectID,
+			TenantName:       opts.ProjectName,
+			TokenID:          opts.Token,
+		})
+	} else if opts.ApplicationCredentialID == "" && opts.ApplicationCredentialName == "" {
+		return compute.Errorf(compute.ErrInvalidArgument, "application credential secret is set without an ID or name")
+	}
+
+	err := applicationCredentialAuth(provider, opts)
+	if err != nil {
+		return err
+	}
+	provider.ReauthFunc = func() error {
+		return applicationCredentialAuth(provider, opts)
+	}
+	return nil
+}
+
+// Keystone v3 token request, with only the fields that cloug sends.
+type tokenRequest struct {
+	Auth struct {
+		Identity struct {
+			Methods               []string `json:"methods"`
+			ApplicationCredential struct {
+				ID     string     `json:"id,omitempty"`
+				Name   string     `json:"name,omitempty"`
+				Secret string     `json:"secret"`
+				User   *tokenUser `json:"user,omitempty"`
+			} `json:"application_credential"`
+		} `json:"identity"`
+	} `json:"auth"`
+}
+
+type tokenIdentity struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+type tokenUser struct {
+	ID     string         `json:"id,omitempty"`
+	Name   string         `json:"name,omitempty"`
+	Domain *tokenIdentity `json:"domain,omitempty"`
+}
+
+type tokenResponse struct {
+	Token struct {
+		Catalog []struct {
+			Type      string `json:"type"`
+			Name      string `json:"name"`
+			Endpoints []struct {
+				Interface string `json:"interface"`
+				Region    string `json:"region"`
+				RegionID  string `json:"region_id"`
+				URL       string `json:"url"`
+			} `json:"endpoints"`
+		} `json:"catalog"`
+	} `json:"token"`
+}
+
+// Issues a token for the application credential, and locates endpoints in the
+// catalog that comes with it.
+func applicationCredentialAuth(provider *gophercloud.ProviderClient, opts *AuthOptions) error {
+	identityURL := gophercloud.NormalizeURL(opts.IdentityEndpoint)
+	if strings.HasSuffix(identityURL, "/v2.0/") {
+		return compute.Errorf(compute.ErrInvalidArgument, "application credentials require the Keystone v3 endpoint")
+	} else if !strings.HasSuffix(identityURL, "/v3/") {
+		identityURL += "v3/"
+	}
+
+	var request tokenRequest
+	request.Auth.Identity.Methods = []string{"application_credential"}
+	credential := &request.Auth.Identity.ApplicationCredential
+	credential.Secret = opts.ApplicationCredentialSecret
+	if opts.ApplicationCredentialID != "" {
+		credential.ID = opts.ApplicationCredentialID
+	} else {
+		credential.Name = opts.ApplicationCredentialName
+		credential.User = &tokenUser{ID: opts.UserID, Name: opts.Username}
+		if opts.UserID == "" {
+			credential.User.Domain = &tokenIdentity{ID: opts.DomainID, Name: opts.DomainName}
+		}
+	}
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("json error: %v", err)
+	}
+
+	httpRequest, err := http.NewRequest("POST", identityURL+"auth/tokens", bytes.NewReader(requestBytes))
+	if err != nil {
+		return fmt.Errorf("http request error: %v", err)
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpRequest.Header.Set("Accept", "application/json")
+	r, err := provider.HTTPClient.Do(httpRequest)
+	if err != nil {
+		return fmt.Errorf("http request error: %v", err)
+	}
+	defer r.Body.Close()
+	responseBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("http read error: %v", err)
+	}
+	if r.StatusCode != 201 {
+		return common.HTTPStatusError(r.StatusCode, fmt.Errorf("token request failed with status %d: %s", r.StatusCode, string(responseBytes)))
+	}
+	var response tokenResponse
+	err = json.Unmarshal(responseBytes, &response)
+	if err != nil {
+		return fmt.Errorf("json decode error: %v", err)
+	}
+	tokenID := r.Header.Get("X-Subject-Token")
+	if tokenID == "" {
+		return errors.New("token response does not contain X-Subject-Token header")
+	}
+
+	provider.TokenID = tokenID
+	provider.EndpointLocator = func(eo gophercloud.EndpointOpts) (string, error) {
+		for _, service := range response.Token.Catalog {
+			if service.Type != eo.Type || (eo.Name != "" && service.Name != eo.Name) {
+				continue
+			}
+			for _, endpoint := range service.Endpoints {
+				if endpoint.Interface != string(eo.Availability) {
+					continue
+				} else if eo.Region != "" && endpoint.Region != eo.Region && endpoint.RegionID != eo.Region {
+					continue
+				}
+				return gophercloud.NormalizeURL(endpoint.URL), nil
+			}
+		}
+		return "", compute.Errorf(compute.ErrNotFound, "no %s endpoint for %s in the service catalog", eo.Availability, eo.Type)
+	}
+	return nil
+}
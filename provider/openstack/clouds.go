@@ -0,0 +1,127 @@
+package openstack
+
+import "github.com/LunaNode/cloug/service/compute"
+
+import "gopkg.in/yaml.v2"
+
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+
+// Cloud entry in a clouds.yaml file, with the fields that cloug uses.
+type cloudConfig struct {
+	Auth struct {
+		AuthURL                     string `yaml:"auth_url"`
+		Username                    string `yaml:"username"`
+		UserID                      string `yaml:"user_id"`
+		Password                    string `yaml:"password"`
+		ProjectID                   string `yaml:"project_id"`
+		ProjectName                 string `yaml:"project_name"`
+		TenantID                    string `yaml:"tenant_id"`
+		TenantName                  string `yaml:"tenant_name"`
+		DomainID                    string `yaml:"domain_id"`
+		DomainName                  string `yaml:"domain_name"`
+		UserDomainID                string `yaml:"user_domain_id"`
+		UserDomainName              string `yaml:"user_domain_name"`
+		ProjectDomainID             string `yaml:"project_domain_id"`
+		ProjectDomainName           string `yaml:"project_domain_name"`
+		Token                       string `yaml:"token"`
+		ApplicationCredentialID     string `yaml:"application_credential_id"`
+		ApplicationCredentialName   string `yaml:"application_credential_name"`
+		ApplicationCredentialSecret string `yaml:"application_credential_secret"`
+	} `yaml:"auth"`
+	AuthType   string `yaml:"auth_type"`
+	RegionName string `yaml:"region_name"`
+	Interface  string `yaml:"interface"`
+}
+
+// Returns the clouds.yaml locations that are searched when no file is given,
+// in order of precedence.
+func cloudsFileLocations() []string {
+	var locations []string
+	if filename := os.Getenv("OS_CLIENT_CONFIG_FILE"); filename != "" {
+		locations = append(locations, filename)
+	}
+	locations = append(locations, "clouds.yaml")
+	if home, err := os.UserHomeDir(); err == nil {
+		locations = append(locations, filepath.Join(home, ".config", "openstack", "clouds.yaml"))
+	}
+	return append(locations, "/etc/openstack/clouds.yaml")
+}
+
+// Reads the named cloud from a clouds.yaml file. If filename is empty, the
+// first file found in the standard locations is used.
+//
+// AuthOptions has a single domain, so the user domain is used if set, and
+// otherwise the project domain or the domain.
+func loadCloud(filename string, name string) (*AuthOptions, error) {
+	var data []byte
+	var err error
+	if filename != "" {
+		data, err = ioutil.ReadFile(filename)
+	} else {
+		for _, location := range cloudsFileLocations() {
+			data, err = ioutil.ReadFile(location)
+			if !os.IsNotExist(err) {
+				break
+			}
+		}
+	}
+	if os.IsNotExist(err) && filename == "" {
+		return nil, compute.Errorf(compute.ErrNotFound, "clouds.yaml not found")
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading clouds.yaml: %v", err)
+	}
+
+	var file struct {
+		Clouds map[string]cloudConfig `yaml:"clouds"`
+	}
+	err = yaml.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing clouds.yaml: %v", err)
+	}
+	cloud, ok := file.Clouds[name]
+	if !ok {
+		return nil, compute.Errorf(compute.ErrNotFound, "cloud %s not found in clouds.yaml", name)
+	}
+	switch cloud.AuthType {
+	case "", "password", "v2password", "v3password", "token", "v2token", "v3token", "v3applicationcredential":
+	default:
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "unsupported auth_type %s", cloud.AuthType)
+	}
+
+	auth := cloud.Auth
+	domainID, domainName := auth.UserDomainID, auth.UserDomainName
+	if domainID == "" && domainName == "" {
+		domainID, domainName = auth.ProjectDomainID, auth.ProjectDomainName
+	}
+	if domainID == "" && domainName == "" {
+		domainID, domainName = auth.DomainID, auth.DomainName
+	}
+	return &AuthOptions{
+		IdentityEndpoint:            auth.AuthURL,
+		Username:                    auth.Username,
+		UserID:                      auth.UserID,
+		Password:                    auth.Password,
+		DomainID:                    domainID,
+		DomainName:                  domainName,
+		ProjectID:                   firstNonEmpty(auth.ProjectID, auth.TenantID),
+		ProjectName:                 firstNonEmpty(auth.ProjectName, auth.TenantName),
+		Token:                       auth.Token,
+		ApplicationCredentialID:     auth.ApplicationCredentialID,
+		ApplicationCredentialName:   auth.ApplicationCredentialName,
+		ApplicationCredentialSecret: auth.ApplicationCredentialSecret,
+		Region:                      cloud.RegionName,
+		Interface:                   cloud.Interface,
+	}, nil
+}
+
+func firstNonEmpty(strs ...string) string {
+	for _, str := range strs {
+		if str != "" {
+			return str
+		}
+	}
+	return ""
+}
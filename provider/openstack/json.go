@@ -1,5 +1,6 @@
 package openstack
 
+import "github.com/LunaNode/cloug/provider/common"
 import "github.com/LunaNode/cloug/service/compute"
 
 import "encoding/json"
@@ -7,15 +8,84 @@ import "encoding/json"
 type OpenStackJSONConfig struct {
 	URL        string `json:"url"`
 	Username   string `json:"username"`
+	UserID     string `json:"user_id"`
 	Password   string `json:"password"`
 	TenantName string `json:"tenant"`
+
+	// Keystone v3 domain and project; see AuthOptions.
+	DomainID    string `json:"domain_id"`
+	DomainName  string `json:"domain_name"`
+	ProjectID   string `json:"project_id"`
+	ProjectName string `json:"project_name"`
+
+	// Alternatives to the password.
+	Token                       string `json:"token"`
+	ApplicationCredentialID     string `json:"application_credential_id"`
+	ApplicationCredentialName   string `json:"application_credential_name"`
+	ApplicationCredentialSecret string `json:"application_credential_secret"`
+
+	Region    string `json:"region"`
+	Interface string `json:"interface"`
+
+	// If Cloud is set, fields that are not set are taken from that cloud in
+	// CloudsFile, or in the first clouds.yaml found in the standard locations.
+	Cloud      string `json:"cloud"`
+	CloudsFile string `json:"clouds_file"`
+
+	// Pool that floating IPs are allocated from; the default pool if empty.
+	FloatingIPPool string `json:"floating_ip_pool"`
+
+	// Overrides URL if set.
+	APIURL string `json:"api_url"`
 }
 
-func OpenStackFromJSON(jsonData []byte) (compute.Provider, error) {
+func OpenStackFromJSON(jsonData []byte, options ...common.Option) (compute.Provider, error) {
 	var cfg OpenStackJSONConfig
 	err := json.Unmarshal(jsonData, &cfg)
 	if err != nil {
 		return nil, err
 	}
-	return MakeOpenStack(cfg.URL, cfg.Username, cfg.Password, cfg.TenantName)
+	authOpts := &AuthOptions{
+		IdentityEndpoint:            cfg.URL,
+		Username:                    cfg.Username,
+		UserID:                      cfg.UserID,
+		Password:                    cfg.Password,
+		DomainID:                    cfg.DomainID,
+		DomainName:                  cfg.DomainName,
+		ProjectID:                   cfg.ProjectID,
+		ProjectName:                 firstNonEmpty(cfg.ProjectName, cfg.TenantName),
+		Token:                       cfg.Token,
+		ApplicationCredentialID:     cfg.ApplicationCredentialID,
+		ApplicationCredentialName:   cfg.ApplicationCredentialName,
+		ApplicationCredentialSecret: cfg.ApplicationCredentialSecret,
+		Region:                      cfg.Region,
+		Interface:                   cfg.Interface,
+	}
+	if cfg.Cloud != "" {
+		cloud, err := loadCloud(cfg.CloudsFile, cfg.Cloud)
+		if err != nil {
+			return nil, err
+		}
+		authOpts.IdentityEndpoint = firstNonEmpty(authOpts.IdentityEndpoint, cloud.IdentityEndpoint)
+		authOpts.Username = firstNonEmpty(authOpts.Username, cloud.Username)
+		authOpts.UserID = firstNonEmpty(authOpts.UserID, cloud.UserID)
+		authOpts.Password = firstNonEmpty(authOpts.Password, cloud.Password)
+		authOpts.DomainID = firstNonEmpty(authOpts.DomainID, cloud.DomainID)
+		authOpts.DomainName = firstNonEmpty(authOpts.DomainName, cloud.DomainName)
+		authOpts.ProjectID = firstNonEmpty(authOpts.ProjectID, cloud.ProjectID)
+		authOpts.ProjectName = firstNonEmpty(authOpts.ProjectName, cloud.ProjectName)
+		authOpts.Token = firstNonEmpty(authOpts.Token, cloud.Token)
+		authOpts.ApplicationCredentialID = firstNonEmpty(authOpts.ApplicationCredentialID, cloud.ApplicationCredentialID)
+		authOpts.ApplicationCredentialName = firstNonEmpty(authOpts.ApplicationCredentialName, cloud.ApplicationCredentialName)
+		authOpts.ApplicationCredentialSecret = firstNonEmpty(authOpts.ApplicationCredentialSecret, cloud.ApplicationCredentialSecret)
+		authOpts.Region = firstNonEmpty(authOpts.Region, cloud.Region)
+		authOpts.Interface = firstNonEmpty(authOpts.Interface, cloud.Interface)
+	}
+	options = append([]common.Option{common.WithAPIURL(cfg.APIURL)}, options...)
+	os, err := MakeOpenStackAuth(authOpts, options...)
+	if err != nil {
+		return nil, err
+	}
+	os.FloatingIPPool = cfg.FloatingIPPool
+	return os, nil
 }
@@ -7,45 +7,107 @@ import "github.com/LunaNode/cloug/utils"
 import "github.com/LunaNode/gophercloud"
 import "github.com/LunaNode/gophercloud/openstack"
 import "github.com/LunaNode/gophercloud/pagination"
+import "github.com/LunaNode/gophercloud/openstack/blockstorage/v1/volumes"
 import "github.com/LunaNode/gophercloud/openstack/compute/v2/flavors"
 import "github.com/LunaNode/gophercloud/openstack/compute/v2/servers"
 import "github.com/LunaNode/gophercloud/openstack/compute/v2/extensions/startstop"
 import "github.com/LunaNode/gophercloud/openstack/compute/v2/extensions/floatingip"
+import "github.com/LunaNode/gophercloud/openstack/compute/v2/extensions/volumeattach"
 import "github.com/LunaNode/gophercloud/openstack/image/v1/image"
 
+import "context"
+import "encoding/json"
 import "errors"
 import "fmt"
+import "net"
+import "net/url"
 import "strconv"
 import "strings"
 import "time"
 
 const DEFAULT_NAME = "cloug"
 
+// Server metadata key listing the IDs of the floating IPs that were
+// allocated for the server, which are released along with it.
+const FLOATING_IP_METADATA = "cloug_floating_ips"
+
+// Server metadata key holding the error of a floating IP association that
+// was made in the background; it is reported in the floating_ip_error detail.
+const FLOATING_IP_ERROR_METADATA = "cloug_floating_ip_error"
+
+// Nova limits metadata values to 255 characters.
+const METADATA_VALUE_LENGTH = 255
+
+// How long to wait for a new server's port before associating a floating IP.
+const FLOATING_IP_TIMEOUT = 5 * time.Minute
+
+// Number of images to request per page from Glance.
+const IMAGE_PAGE_SIZE = 100
+
 type OpenStack struct {
 	ComputeClient *gophercloud.ServiceClient
 	ImageClient   *gophercloud.ServiceClient
+
+	// Block storage client, or nil if the cloud does not provide block storage.
+	VolumeClient *gophercloud.ServiceClient
+
+	// Neutron client, or nil if the cloud does not provide Neutron.
+	NetworkClient *gophercloud.ServiceClient
+
+	// Pool that floating IPs are allocated from; the default pool if empty.
+	FloatingIPPool string
+
+	// The service that this one was derived from by withContext, if any.
+	parent *OpenStack
 }
 
-func MakeOpenStack(identityEndpoint string, username string, password string, tenantName string) (*OpenStack, error) {
-	os := new(OpenStack)
-	opts := gophercloud.AuthOptions{
+// The API URL option takes precedence over identityEndpoint.
+func MakeOpenStack(identityEndpoint string, username string, password string, tenantName string, options ...common.Option) (*OpenStack, error) {
+	return MakeOpenStackAuth(&AuthOptions{
 		IdentityEndpoint: identityEndpoint,
 		Username:         username,
 		Password:         password,
-		TenantName:       tenantName,
+		ProjectName:      tenantName,
+	}, options...)
+}
+
+// The API URL option takes precedence over authOpts.IdentityEndpoint.
+func MakeOpenStackAuth(authOpts *AuthOptions, options ...common.Option) (*OpenStack, error) {
+	httpOpts := common.MakeHTTPOptions(append([]common.Option{common.WithAPIURL(authOpts.IdentityEndpoint)}, options...)...)
+	opts := *authOpts
+	opts.IdentityEndpoint = httpOpts.APIURL
+	availability, err := opts.availability()
+	if err != nil {
+		return nil, err
+	}
+	endpointOpts := gophercloud.EndpointOpts{
+		Region:       opts.Region,
+		Availability: availability,
+	}
+
+	os := new(OpenStack)
+	provider, err := openstack.NewClient(opts.IdentityEndpoint)
+	if err != nil {
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "invalid identity endpoint: %v", err)
+	}
+	if client := httpOpts.HTTPClient(nil); client != nil {
+		provider.HTTPClient = *client
 	}
-	provider, err := openstack.AuthenticatedClient(opts)
+	err = authenticate(provider, &opts)
 	if err != nil {
-		return nil, fmt.Errorf("openstack authentication error: %v", err)
+		return nil, fmt.Errorf("openstack authentication error: %w", os.mapError(err))
 	}
-	os.ComputeClient, err = openstack.NewComputeV2(provider, gophercloud.EndpointOpts{})
+	os.ComputeClient, err = openstack.NewComputeV2(provider, endpointOpts)
 	if err != nil {
 		return nil, fmt.Errorf("compute client initialization error: %v", err)
 	}
-	os.ImageClient, err = openstack.NewImageV1(provider, gophercloud.EndpointOpts{})
+	os.ImageClient, err = openstack.NewImageV1(provider, endpointOpts)
 	if err != nil {
 		return nil, fmt.Errorf("image client initialization error: %v", err)
 	}
+	// block storage is optional, so failure to find the endpoint is not fatal
+	os.VolumeClient, _ = openstack.NewBlockStorageV1(provider, endpointOpts)
+	os.NetworkClient, _ = openstack.NewNetworkV2(provider, endpointOpts)
 	return os, nil
 }
 
@@ -53,6 +115,65 @@ func (os *OpenStack) ComputeService() compute.Service {
 	return os
 }
 
+func (os *OpenStack) Capabilities() *compute.Capabilities {
+	unsupported := []compute.Operation{compute.OpSetAddressHostname}
+	if os.VolumeClient == nil {
+		unsupported = append(unsupported, compute.OpCreateVolume, compute.OpListVolumes, compute.OpGetVolume, compute.OpDeleteVolume, compute.OpAttachVolume, compute.OpDetachVolume, compute.OpResizeVolume)
+	}
+	if os.NetworkClient == nil {
+		unsupported = append(unsupported, compute.OpCreateSecurityGroup, compute.OpListSecurityGroups, compute.OpGetSecurityGroup, compute.OpDeleteSecurityGroup, compute.OpAddSecurityGroupRule, compute.OpRemoveSecurityGroupRule)
+	}
+	return &compute.Capabilities{
+		Operations:     compute.ImplementedOperations(os, unsupported...),
+		ImageSources:   []compute.ImageSource{compute.ImageSourceInstance, compute.ImageSourceURL},
+		InstanceFields: []compute.InstanceField{compute.FieldName, compute.FieldRegion, compute.FieldPassword, compute.FieldNetworkID},
+	}
+}
+
+// Returns a copy of the service whose API calls use the given context.
+// gophercloud does not accept a context, so we attach it at the HTTP client of
+// a copied provider client; re-authentication is delegated to the original so
+// that a refreshed token is shared.
+func (os *OpenStack) withContext(ctx context.Context) *OpenStack {
+	original := os.ComputeClient.ProviderClient
+	provider := *original
+	provider.HTTPClient = *utils.ContextHTTPClient(ctx, &original.HTTPClient)
+	if original.ReauthFunc != nil {
+		provider.ReauthFunc = func() error {
+			err := original.ReauthFunc()
+			provider.TokenID = original.TokenID
+			return err
+		}
+	}
+
+	withProvider := func(client *gophercloud.ServiceClient) *gophercloud.ServiceClient {
+		if client == nil {
+			return nil
+		}
+		contextClient := *client
+		contextClient.ProviderClient = &provider
+		return &contextClient
+	}
+
+	return &OpenStack{
+		ComputeClient:  withProvider(os.ComputeClient),
+		ImageClient:    withProvider(os.ImageClient),
+		VolumeClient:   withProvider(os.VolumeClient),
+		NetworkClient:  withProvider(os.NetworkClient),
+		FloatingIPPool: os.FloatingIPPool,
+		parent:         os.background(),
+	}
+}
+
+// Returns the service without any context attached, for background work that
+// should outlive the caller's context.
+func (os *OpenStack) background() *OpenStack {
+	if os.parent != nil {
+		return os.parent
+	}
+	return os
+}
+
 func (os *OpenStack) mapInstanceStatus(status string) compute.InstanceStatus {
 	if status == "ACTIVE" {
 		return compute.StatusOnline
@@ -63,6 +184,17 @@ func (os *OpenStack) mapInstanceStatus(status string) compute.InstanceStatus {
 	}
 }
 
+// Classifies errors returned by gophercloud according to the HTTP status code.
+func (os *OpenStack) mapError(err error) error {
+	if responseErr, ok := err.(*gophercloud.UnexpectedResponseCodeError); ok {
+		if responseErr.Actual == 413 {
+			return compute.WrapError(compute.ErrQuotaExceeded, err)
+		}
+		return common.HTTPStatusError(responseErr.Actual, err)
+	}
+	return err
+}
+
 func (os *OpenStack) serverToInstance(server *servers.Server) *compute.Instance {
 	instance := &compute.Instance{
 		ID:     server.ID,
@@ -71,6 +203,19 @@ func (os *OpenStack) serverToInstance(server *servers.Server) *compute.Instance
 		IP:     server.AccessIPv4,
 	}
 
+	var securityGroups []string
+	for _, group := range server.SecurityGroups {
+		if name, ok := group["name"].(string); ok {
+			securityGroups = append(securityGroups, name)
+		}
+	}
+	instance.Details = map[string]string{
+		"security_groups": strings.Join(securityGroups, ","),
+	}
+	if floatingIPError, ok := server.Metadata[FLOATING_IP_ERROR_METADATA].(string); ok && floatingIPError != "" {
+		instance.Details["floating_ip_error"] = floatingIPError
+	}
+
 	servers.ListAddresses(os.ComputeClient, server.ID).EachPage(func(page pagination.Page) (bool, error) {
 		addresses, err := servers.ExtractAddresses(page)
 		if err != nil {
@@ -94,7 +239,58 @@ func (os *OpenStack) serverToInstance(server *servers.Server) *compute.Instance
 	return instance
 }
 
+// Splits a comma-separated list detail.
+func splitDetail(detail string) []string {
+	var values []string
+	for _, value := range strings.Split(detail, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// Returns the networks to attach the server to: NetworkID, then the networks
+// detail, which lists network IDs, each optionally with a fixed IP as in
+// "network-id=10.0.0.5", then the ports detail, which lists IDs of existing
+// ports.
+func instanceNetworks(instance *compute.Instance) ([]servers.Network, error) {
+	var networks []servers.Network
+	if instance.NetworkID != "" {
+		networks = append(networks, servers.Network{UUID: instance.NetworkID})
+	}
+	for _, network := range splitDetail(instance.Detail("networks", "")) {
+		parts := strings.SplitN(network, "=", 2)
+		if len(parts) == 1 {
+			networks = append(networks, servers.Network{UUID: parts[0]})
+		} else if net.ParseIP(parts[1]) == nil {
+			return nil, compute.Errorf(compute.ErrInvalidArgument, "invalid fixed IP %s for network %s", parts[1], parts[0])
+		} else {
+			networks = append(networks, servers.Network{UUID: parts[0], FixedIP: parts[1]})
+		}
+	}
+	for _, port := range splitDetail(instance.Detail("ports", "")) {
+		networks = append(networks, servers.Network{Port: port})
+	}
+	return networks, nil
+}
+
+// Creates a server, and associates a floating IP with it according to the
+// floating_ip detail: "sync" (the default) waits for the server's port and
+// fails if the floating IP cannot be associated, "async" associates it in the
+// background and reports a failure in the floating_ip_error detail of the
+// instance, and "none" skips it. See attachFloatingIP for how the floating IP
+// is chosen.
+//
+// The security_groups detail lists security group names or IDs separated by
+// commas; they apply to the ports that are created for the server, but not to
+// existing ports. See instanceNetworks for the networks and ports details.
 func (os *OpenStack) CreateInstance(instance *compute.Instance) (*compute.Instance, error) {
+	floatingIPMode := instance.Detail("floating_ip", "sync")
+	if floatingIPMode != "async" && floatingIPMode != "sync" && floatingIPMode != "none" {
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "invalid floating_ip %s, expected async, sync or none", floatingIPMode)
+	}
+
 	imageID, err := common.GetMatchingImageID(os, &instance.Image)
 	if err != nil {
 		return nil, err
@@ -118,9 +314,11 @@ func (os *OpenStack) CreateInstance(instance *compute.Instance) (*compute.Instan
 		AvailabilityZone: instance.Region,
 	}
 
-	if instance.NetworkID != "" {
-		opts.Networks = []servers.Network{{UUID: instance.NetworkID}}
+	opts.Networks, err = instanceNetworks(instance)
+	if err != nil {
+		return nil, err
 	}
+	opts.SecurityGroups = splitDetail(instance.Detail("security_groups", ""))
 
 	if opts.Name == "" {
 		opts.Name = DEFAULT_NAME
@@ -129,55 +327,47 @@ func (os *OpenStack) CreateInstance(instance *compute.Instance) (*compute.Instan
 	createResult := servers.Create(os.ComputeClient, opts)
 	server, err := createResult.Extract()
 	if err != nil {
-		return nil, err
+		return nil, os.mapError(err)
 	}
 
-	// try to associate floating IP with this VM
-	// do asynchronously since it might fail until network port is created
-	go func() {
-		for try := 0; try < 6; try++ {
-			time.Sleep(4 * time.Second)
-
-			// find a free floating IP, or find the IP matching requested IP
-			var freeFloatingIP *floatingip.FloatingIP
-			err := floatingip.List(os.ComputeClient).EachPage(func(page pagination.Page) (bool, error) {
-				floatingIPs, err := floatingip.ExtractFloatingIPs(page)
-				if err != nil {
-					return false, err
-				}
-
-				for _, floatingIP := range floatingIPs {
-					if floatingIP.InstanceID == "" && (instance.IP == "" || floatingIP.IP == instance.IP) {
-						freeFloatingIP = &floatingIP
-						return false, nil
-					}
-				}
-				return true, nil
-			})
-			if err != nil {
-				continue
-			} else if freeFloatingIP == nil {
-				continue
-			}
-
-			// associate it
-			err = floatingip.Associate(os.ComputeClient, server.ID, freeFloatingIP.IP).ExtractErr()
-			if err == nil {
-				break
-			}
-		}
-	}()
-
-	return &compute.Instance{
+	// the floating IP can only be associated once the server has a port
+	createdInstance := &compute.Instance{
 		ID:       server.ID,
 		Name:     server.Name,
 		Status:   os.mapInstanceStatus(server.Status),
 		Password: password,
-	}, nil
+	}
+	switch floatingIPMode {
+	case "sync":
+		createdInstance.IP, err = os.attachFloatingIP(server.ID, instance.IP)
+		if err != nil {
+			// without its floating IP, the server is not what was asked for
+			servers.Delete(os.ComputeClient, server.ID)
+			return nil, fmt.Errorf("error associating floating IP: %w", err)
+		}
+	case "async":
+		go os.background().attachFloatingIPAsync(server.ID, instance.IP)
+	}
+	return createdInstance, nil
 }
 
+// Deletes the server, and releases the floating IPs allocated for it.
 func (os *OpenStack) DeleteInstance(instanceID string) error {
-	return servers.Delete(os.ComputeClient, instanceID).ExtractErr()
+	floatingIPIDs, err := os.allocatedFloatingIPs(instanceID)
+	if err != nil {
+		return err
+	}
+	err = os.mapError(servers.Delete(os.ComputeClient, instanceID).ExtractErr())
+	if err != nil {
+		return err
+	}
+	for _, floatingIPID := range floatingIPIDs {
+		err := os.mapError(floatingip.Delete(os.ComputeClient, floatingIPID).ExtractErr())
+		if err != nil && !errors.Is(err, compute.ErrNotFound) {
+			return fmt.Errorf("error releasing floating IP %s: %w", floatingIPID, err)
+		}
+	}
+	return nil
 }
 
 func (os *OpenStack) ListInstances() ([]*compute.Instance, error) {
@@ -196,7 +386,7 @@ func (os *OpenStack) ListInstances() ([]*compute.Instance, error) {
 	})
 
 	if err != nil {
-		return nil, err
+		return nil, os.mapError(err)
 	} else {
 		return instances, nil
 	}
@@ -205,22 +395,50 @@ func (os *OpenStack) ListInstances() ([]*compute.Instance, error) {
 func (os *OpenStack) GetInstance(instanceID string) (*compute.Instance, error) {
 	server, err := servers.Get(os.ComputeClient, instanceID).Extract()
 	if err != nil {
-		return nil, err
+		return nil, os.mapError(err)
 	} else {
 		return os.serverToInstance(server), nil
 	}
 }
 
 func (os *OpenStack) StartInstance(instanceID string) error {
-	return startstop.Start(os.ComputeClient, instanceID).ExtractErr()
+	return os.mapError(startstop.Start(os.ComputeClient, instanceID).ExtractErr())
 }
 
 func (os *OpenStack) StopInstance(instanceID string) error {
-	return startstop.Stop(os.ComputeClient, instanceID).ExtractErr()
+	return os.mapError(startstop.Stop(os.ComputeClient, instanceID).ExtractErr())
 }
 
 func (os *OpenStack) RebootInstance(instanceID string) error {
-	return servers.Reboot(os.ComputeClient, instanceID, servers.HardReboot).ExtractErr()
+	return os.mapError(servers.Reboot(os.ComputeClient, instanceID, servers.HardReboot).ExtractErr())
+}
+
+func (os *OpenStack) CreateInstanceContext(ctx context.Context, instance *compute.Instance) (*compute.Instance, error) {
+	return os.withContext(ctx).CreateInstance(instance)
+}
+
+func (os *OpenStack) DeleteInstanceContext(ctx context.Context, instanceID string) error {
+	return os.withContext(ctx).DeleteInstance(instanceID)
+}
+
+func (os *OpenStack) ListInstancesContext(ctx context.Context) ([]*compute.Instance, error) {
+	return os.withContext(ctx).ListInstances()
+}
+
+func (os *OpenStack) GetInstanceContext(ctx context.Context, instanceID string) (*compute.Instance, error) {
+	return os.withContext(ctx).GetInstance(instanceID)
+}
+
+func (os *OpenStack) StartInstanceContext(ctx context.Context, instanceID string) error {
+	return os.withContext(ctx).StartInstance(instanceID)
+}
+
+func (os *OpenStack) StopInstanceContext(ctx context.Context, instanceID string) error {
+	return os.withContext(ctx).StopInstance(instanceID)
+}
+
+func (os *OpenStack) RebootInstanceContext(ctx context.Context, instanceID string) error {
+	return os.withContext(ctx).RebootInstance(instanceID)
 }
 
 func (os *OpenStack) GetVNC(instanceID string) (string, error) {
@@ -232,7 +450,7 @@ func (os *OpenStack) RenameInstance(instanceID string, name string) error {
 		Name: name,
 	}
 	_, err := servers.Update(os.ComputeClient, instanceID, opts).Extract()
-	return err
+	return os.mapError(err)
 }
 
 func (os *OpenStack) ReimageInstance(instanceID string, image *compute.Image) error {
@@ -244,9 +462,212 @@ func (os *OpenStack) ReimageInstance(instanceID string, image *compute.Image) er
 		ImageID: imageID,
 	}
 	_, err = servers.Rebuild(os.ComputeClient, instanceID, opts).Extract()
+	return os.mapError(err)
+}
+
+// Returns the IDs of the floating IPs allocated for the server.
+func (os *OpenStack) allocatedFloatingIPs(serverID string) ([]string, error) {
+	metadata, err := servers.Metadata(os.ComputeClient, serverID).Extract()
+	if err != nil {
+		return nil, os.mapError(err)
+	} else if metadata[FLOATING_IP_METADATA] == "" {
+		return nil, nil
+	} else {
+		return strings.Split(metadata[FLOATING_IP_METADATA], ","), nil
+	}
+}
+
+func (os *OpenStack) setAllocatedFloatingIPs(serverID string, floatingIPIDs []string) error {
+	var err error
+	if len(floatingIPIDs) == 0 {
+		err = servers.DeleteMetadatum(os.ComputeClient, serverID, FLOATING_IP_METADATA).ExtractErr()
+	} else {
+		opts := servers.MetadataOpts{FLOATING_IP_METADATA: strings.Join(floatingIPIDs, ",")}
+		_, err = servers.UpdateMetadata(os.ComputeClient, serverID, opts).Extract()
+	}
+	return os.mapError(err)
+}
+
+func (os *OpenStack) listFloatingIPs() ([]floatingip.FloatingIP, error) {
+	var floatingIPs []floatingip.FloatingIP
+	err := floatingip.List(os.ComputeClient).EachPage(func(page pagination.Page) (bool, error) {
+		pageFloatingIPs, err := floatingip.ExtractFloatingIPs(page)
+		if err != nil {
+			return false, err
+		}
+		floatingIPs = append(floatingIPs, pageFloatingIPs...)
+		return true, nil
+	})
+	return floatingIPs, os.mapError(err)
+}
+
+// Satisfied once the server is active with an address, so that its port
+// exists.
+func serverHasPort(instance *compute.Instance, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	} else if instance.Status == "error" {
+		return false, errors.New("server is in error state")
+	}
+	return instance.Status == compute.StatusOnline && (instance.IP != "" || instance.PrivateIP != ""), nil
+}
+
+// Waits for the server's port, and associates a floating IP with the server:
+// the floating IP address ip if set, or else a free floating IP from
+// FloatingIPPool, or else a new one allocated from FloatingIPPool. A new
+// floating IP is recorded in the server metadata, so that it is released
+// along with the server. Returns the floating IP address.
+func (os *OpenStack) attachFloatingIP(serverID string, ip string) (string, error) {
+	_, err := compute.WaitForInstance(os, serverID, serverHasPort, &compute.WaitOptions{Timeout: FLOATING_IP_TIMEOUT})
+	if err != nil {
+		return "", fmt.Errorf("error waiting for server port: %w", err)
+	}
+
+	floatingIPs, err := os.listFloatingIPs()
+	if err != nil {
+		return "", fmt.Errorf("error listing floating IPs: %w", err)
+	}
+	if ip != "" {
+		for _, floatingIP := range floatingIPs {
+			if floatingIP.IP != ip {
+				continue
+			} else if floatingIP.InstanceID != "" && floatingIP.InstanceID != serverID {
+				return "", compute.Errorf(compute.ErrConflict, "floating IP %s is associated with server %s", ip, floatingIP.InstanceID)
+			}
+			return ip, os.mapError(floatingip.Associate(os.ComputeClient, serverID, ip).ExtractErr())
+		}
+		return "", compute.Errorf(compute.ErrNotFound, "floating IP %s not found", ip)
+	}
+
+	for _, floatingIP := range floatingIPs {
+		if floatingIP.InstanceID != "" || (os.FloatingIPPool != "" && floatingIP.Pool != os.FloatingIPPool) {
+			continue
+		}
+		// another server may take the same free floating IP concurrently, so
+		// check that the association stuck before settling on it
+		err := floatingip.Associate(os.ComputeClient, serverID, floatingIP.IP).ExtractErr()
+		if err != nil {
+			continue
+		}
+		associated, err := floatingip.Get(os.ComputeClient, floatingIP.ID).Extract()
+		if err == nil && associated.InstanceID == serverID {
+			return floatingIP.IP, nil
+		}
+	}
+	return os.allocateFloatingIP(serverID)
+}
+
+// Allocates a new floating IP from FloatingIPPool, records it in the server
+// metadata and associates it with the server. The floating IP is released if
+// any step fails, or if the server was deleted in the meantime.
+func (os *OpenStack) allocateFloatingIP(serverID string) (string, error) {
+	floatingIP, err := floatingip.Create(os.ComputeClient, floatingip.CreateOpts{Pool: os.FloatingIPPool}).Extract()
+	if err != nil {
+		return "", fmt.Errorf("error allocating floating IP: %w", os.mapError(err))
+	}
+	release := func() {
+		floatingip.Delete(os.ComputeClient, floatingIP.ID)
+	}
+	floatingIPIDs, err := os.allocatedFloatingIPs(serverID)
+	if err != nil {
+		release()
+		return "", err
+	} else if err := os.setAllocatedFloatingIPs(serverID, append(floatingIPIDs, floatingIP.ID)); err != nil {
+		release()
+		return "", fmt.Errorf("error recording floating IP: %w", err)
+	}
+	err = os.mapError(floatingip.Associate(os.ComputeClient, serverID, floatingIP.IP).ExtractErr())
+	if err != nil {
+		release()
+		os.setAllocatedFloatingIPs(serverID, floatingIPIDs)
+		return "", fmt.Errorf("error associating floating IP %s: %w", floatingIP.IP, err)
+	}
+
+	// DeleteInstance may have read the metadata before it was recorded, in
+	// which case nothing else will release the floating IP
+	if _, err := os.allocatedFloatingIPs(serverID); errors.Is(err, compute.ErrNotFound) {
+		release()
+		return "", fmt.Errorf("server %s was deleted while associating floating IP %s: %w", serverID, floatingIP.IP, err)
+	}
+	return floatingIP.IP, nil
+}
+
+// Runs attachFloatingIP, and records a failure in the server metadata, since
+// there is no caller to return it to.
+func (os *OpenStack) attachFloatingIPAsync(serverID string, ip string) {
+	_, err := os.attachFloatingIP(serverID, ip)
+	if err == nil {
+		return
+	}
+	message := err.Error()
+	if len(message) > METADATA_VALUE_LENGTH {
+		message = message[:METADATA_VALUE_LENGTH]
+	}
+	servers.UpdateMetadata(os.ComputeClient, serverID, servers.MetadataOpts{FLOATING_IP_ERROR_METADATA: message})
+}
+
+// Lists the floating IPs associated with the server. Address IDs are floating
+// IP IDs.
+func (os *OpenStack) ListInstanceAddresses(instanceID string) ([]*compute.Address, error) {
+	floatingIPs, err := os.listFloatingIPs()
+	if err != nil {
+		return nil, err
+	}
+	var addresses []*compute.Address
+	for _, floatingIP := range floatingIPs {
+		if floatingIP.InstanceID == instanceID {
+			addresses = append(addresses, &compute.Address{
+				ID:        floatingIP.ID,
+				IP:        floatingIP.IP,
+				PrivateIP: floatingIP.FixedIP,
+			})
+		}
+	}
+	return addresses, nil
+}
+
+// Associates the floating IP address.IP with the server, or else a free or new
+// floating IP from FloatingIPPool.
+func (os *OpenStack) AddAddressToInstance(instanceID string, address *compute.Address) error {
+	_, err := os.attachFloatingIP(instanceID, address.IP)
 	return err
 }
 
+// Disassociates the floating IP from the server, and releases it if it was
+// allocated for the server.
+func (os *OpenStack) RemoveAddressFromInstance(instanceID string, addressID string) error {
+	floatingIP, err := floatingip.Get(os.ComputeClient, addressID).Extract()
+	if err != nil {
+		return os.mapError(err)
+	} else if floatingIP.InstanceID != instanceID {
+		return compute.Errorf(compute.ErrNotFound, "floating IP %s is not associated with server %s", floatingIP.IP, instanceID)
+	}
+	err = floatingip.Disassociate(os.ComputeClient, instanceID, floatingIP.IP).ExtractErr()
+	if err != nil {
+		return os.mapError(err)
+	}
+
+	floatingIPIDs, err := os.allocatedFloatingIPs(instanceID)
+	if err != nil {
+		return err
+	}
+	for i, floatingIPID := range floatingIPIDs {
+		if floatingIPID != addressID {
+			continue
+		}
+		err := os.mapError(floatingip.Delete(os.ComputeClient, addressID).ExtractErr())
+		if err != nil {
+			return fmt.Errorf("error releasing floating IP %s: %w", floatingIP.IP, err)
+		}
+		return os.setAllocatedFloatingIPs(instanceID, append(floatingIPIDs[:i], floatingIPIDs[i+1:]...))
+	}
+	return nil
+}
+
+func (os *OpenStack) SetAddressHostname(addressID string, hostname string) error {
+	return compute.ErrNotSupported
+}
+
 func (os *OpenStack) CreateImage(imageTemplate *compute.Image) (*compute.Image, error) {
 	if imageTemplate.SourceInstance != "" {
 		opts := servers.CreateImageOpts{
@@ -254,7 +675,7 @@ func (os *OpenStack) CreateImage(imageTemplate *compute.Image) (*compute.Image,
 		}
 		imageID, err := servers.CreateImage(os.ComputeClient, imageTemplate.SourceInstance, opts).ExtractImageID()
 		if err != nil {
-			return nil, err
+			return nil, os.mapError(err)
 		} else {
 			return &compute.Image{
 				ID:             imageID,
@@ -275,7 +696,7 @@ func (os *OpenStack) CreateImage(imageTemplate *compute.Image) (*compute.Image,
 		createResult := image.Create(os.ImageClient, opts)
 		apiImage, err := createResult.Extract()
 		if err != nil {
-			return nil, err
+			return nil, os.mapError(err)
 		} else {
 			return &compute.Image{
 				ID:     apiImage.ID,
@@ -288,14 +709,74 @@ func (os *OpenStack) CreateImage(imageTemplate *compute.Image) (*compute.Image,
 	}
 }
 
-func (os *OpenStack) mapImage(apiImage *image.Image) *compute.Image {
+// Image as returned by the Glance v2 API, which has the image properties
+// as top-level fields.
+type glanceImage struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Status       string `json:"status"`
+	Visibility   string `json:"visibility"`
+	Size         int64  `json:"size"`
+	DiskFormat   string `json:"disk_format"`
+	CreatedAt    string `json:"created_at"`
+	OSDistro     string `json:"os_distro"`
+	OSVersion    string `json:"os_version"`
+	Architecture string `json:"architecture"`
+}
+
+// Sends a GET request to the Glance v2 API. The image client is for v1, which
+// does not list image properties, so the path is resolved against the root
+// of the image endpoint.
+func (os *OpenStack) glanceGet(path string, response interface{}) error {
+	root := gophercloud.NormalizeURL(os.ImageClient.Endpoint)
+	root = strings.TrimSuffix(strings.TrimSuffix(root, "v1/"), "v2/")
+	var body interface{}
+	_, err := os.ImageClient.ProviderClient.Request("GET", root+strings.TrimPrefix(path, "/"), gophercloud.RequestOpts{
+		JSONResponse: &body,
+		OkCodes:      []int{200},
+	})
+	if err != nil {
+		return os.mapError(err)
+	}
+	bytes, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("json error: %v", err)
+	}
+	err = json.Unmarshal(bytes, response)
+	if err != nil {
+		return fmt.Errorf("json decode error: %v", err)
+	}
+	return nil
+}
+
+func (os *OpenStack) mapImage(apiImage *glanceImage) *compute.Image {
 	image := &compute.Image{
-		ID:     apiImage.ID,
-		Name:   apiImage.Name,
-		Public: apiImage.Visibility == "public",
+		ID:           apiImage.ID,
+		Name:         apiImage.Name,
+		Type:         compute.TemplateImage,
+		Format:       apiImage.DiskFormat,
+		Public:       apiImage.Visibility == "public",
+		Size:         apiImage.Size,
+		Distribution: strings.ToLower(apiImage.OSDistro),
+		Version:      apiImage.OSVersion,
+		Details: map[string]string{
+			"created_at": apiImage.CreatedAt,
+		},
+	}
+	if apiImage.DiskFormat == "iso" {
+		image.Type = compute.ISOImage
 	}
 
-	image.Size, _ = strconv.ParseInt(apiImage.Size, 10, 64)
+	switch apiImage.Architecture {
+	case "x86_64", "amd64":
+		image.Architecture = compute.ArchAMD64
+	case "aarch64", "arm64":
+		image.Architecture = compute.ArchARM64
+	case "i386", "i686":
+		image.Architecture = compute.Archi386
+	default:
+		image.Architecture = compute.ImageArchitecture(apiImage.Architecture)
+	}
 
 	if apiImage.Status == "active" {
 		image.Status = compute.ImageAvailable
@@ -308,26 +789,112 @@ func (os *OpenStack) mapImage(apiImage *image.Image) *compute.Image {
 	return image
 }
 
+// Fills in the distribution, version and architecture of an image without
+// the os_distro, os_version and architecture properties from its name, e.g.
+// "Ubuntu 22.04 arm64".
+func guessImageProperties(image *compute.Image, distribution string, version string) {
+	name := strings.ToLower(image.Name)
+	if image.Distribution == "" && strings.Contains(name, distribution) {
+		image.Distribution = distribution
+	}
+	if image.Version == "" && version != "" && strings.Contains(name, version) {
+		image.Version = version
+	}
+	if image.Architecture == "" {
+		if strings.Contains(name, "arm64") || strings.Contains(name, "aarch64") {
+			image.Architecture = compute.ArchARM64
+		} else if strings.Contains(name, "i386") || strings.Contains(name, "i686") || strings.Contains(name, "32-bit") {
+			image.Architecture = compute.Archi386
+		} else {
+			image.Architecture = compute.ArchAMD64
+		}
+	}
+}
+
+// Finds the newest available image matching the name if set, or else the
+// distribution, version and architecture, which default to Ubuntu on amd64.
+// These are matched against the os_distro, os_version and architecture image
+// properties, or guessed from the image name if the properties are not set.
 func (os *OpenStack) FindImage(image *compute.Image) (string, error) {
-	return "", errors.New("operation not supported")
+	images, err := os.ListImages()
+	if err != nil {
+		return "", err
+	}
+
+	matchDistribution := "ubuntu"
+	if image.Distribution != "" {
+		matchDistribution = strings.ToLower(image.Distribution)
+	}
+	matchArchitecture := compute.ImageArchitecture(compute.ArchAMD64)
+	if image.Architecture != "" {
+		matchArchitecture = image.Architecture
+	}
+	matchType := image.Type
+	if matchType == "" {
+		matchType = compute.TemplateImage
+	}
+
+	var bestImage *compute.Image
+	for _, candidate := range images {
+		if candidate.Status != compute.ImageAvailable {
+			continue
+		} else if image.Name != "" {
+			if candidate.Name != image.Name {
+				continue
+			}
+		} else {
+			guessImageProperties(candidate, matchDistribution, image.Version)
+			if candidate.Type != matchType || candidate.Distribution != matchDistribution || candidate.Architecture != matchArchitecture {
+				continue
+			} else if image.Version != "" && !common.MatchVersion(image.Version, candidate.Version) {
+				continue
+			}
+		}
+		if bestImage == nil || candidate.Details["created_at"] > bestImage.Details["created_at"] {
+			bestImage = candidate
+		}
+	}
+
+	if bestImage == nil {
+		return "", nil
+	}
+	return bestImage.ID, nil
 }
 
 func (os *OpenStack) ListImages() ([]*compute.Image, error) {
-	return nil, errors.New("operation not supported")
+	var images []*compute.Image
+	path := "v2/images?limit=" + strconv.Itoa(IMAGE_PAGE_SIZE)
+	for path != "" {
+		var response struct {
+			Images []glanceImage `json:"images"`
+			Next   string        `json:"next"`
+		}
+		err := os.glanceGet(path, &response)
+		if err != nil {
+			return nil, err
+		}
+		for i := range response.Images {
+			images = append(images, os.mapImage(&response.Images[i]))
+		}
+		path = response.Next
+	}
+	return images, nil
 }
 
 func (os *OpenStack) GetImage(imageID string) (*compute.Image, error) {
-	apiImage, err := image.Get(os.ImageClient, imageID).Extract()
+	var apiImage glanceImage
+	err := os.glanceGet("v2/images/"+url.PathEscape(imageID), &apiImage)
 	if err != nil {
 		return nil, err
 	} else {
-		return os.mapImage(apiImage), nil
+		return os.mapImage(&apiImage), nil
 	}
 }
 
 func (os *OpenStack) DeleteImage(imageID string) error {
 	err := image.Delete(os.ImageClient, imageID).ExtractErr()
-	if err != nil && !strings.Contains(err.Error(), "Image with identifier "+imageID+" not found") {
+	err = os.mapError(err)
+	if err != nil && !errors.Is(err, compute.ErrNotFound) {
 		return err
 	} else {
 		return nil
@@ -355,7 +922,7 @@ func (os *OpenStack) ListFlavors() ([]*compute.Flavor, error) {
 		return true, nil
 	})
 	if err != nil {
-		return nil, err
+		return nil, os.mapError(err)
 	} else {
 		return flavorList, nil
 	}
@@ -368,3 +935,150 @@ func (os *OpenStack) FindFlavor(flavor *compute.Flavor) (string, error) {
 	}
 	return common.MatchFlavor(flavor, flavors), nil
 }
+
+func (os *OpenStack) volumeClient() (*gophercloud.ServiceClient, error) {
+	if os.VolumeClient == nil {
+		return nil, compute.Errorf(compute.ErrNotSupported, "block storage service is not available")
+	}
+	return os.VolumeClient, nil
+}
+
+func (os *OpenStack) networkClient() (*gophercloud.ServiceClient, error) {
+	if os.NetworkClient == nil {
+		return nil, compute.Errorf(compute.ErrNotSupported, "network service is not available")
+	}
+	return os.NetworkClient, nil
+}
+
+func (os *OpenStack) mapVolume(apiVolume *volumes.Volume) *compute.Volume {
+	volume := &compute.Volume{
+		ID:     apiVolume.ID,
+		Name:   apiVolume.Name,
+		Region: apiVolume.AvailabilityZone,
+		SizeGB: apiVolume.Size,
+	}
+
+	for _, attachment := range apiVolume.Attachments {
+		if serverID, ok := attachment["server_id"].(string); ok {
+			volume.InstanceID = serverID
+		}
+	}
+
+	if apiVolume.Status == "available" {
+		volume.Status = compute.VolumeAvailable
+	} else if apiVolume.Status == "in-use" {
+		volume.Status = compute.VolumeInUse
+	} else if apiVolume.Status == "creating" || apiVolume.Status == "downloading" || apiVolume.Status == "attaching" || apiVolume.Status == "detaching" || apiVolume.Status == "extending" {
+		volume.Status = compute.VolumePending
+	} else {
+		volume.Status = compute.VolumeStatus(strings.ToLower(apiVolume.Status))
+	}
+
+	return volume
+}
+
+func (os *OpenStack) CreateVolume(volume *compute.Volume) (*compute.Volume, error) {
+	client, err := os.volumeClient()
+	if err != nil {
+		return nil, err
+	} else if volume.SizeGB <= 0 {
+		return nil, errors.New("volume size must be set")
+	}
+
+	opts := volumes.CreateOpts{
+		Name:             volume.Name,
+		Size:             volume.SizeGB,
+		AvailabilityZone: volume.Region,
+	}
+	if opts.Name == "" {
+		opts.Name = DEFAULT_NAME
+	}
+
+	apiVolume, err := volumes.Create(client, opts).Extract()
+	if err != nil {
+		return nil, os.mapError(err)
+	} else {
+		return os.mapVolume(apiVolume), nil
+	}
+}
+
+func (os *OpenStack) ListVolumes() ([]*compute.Volume, error) {
+	client, err := os.volumeClient()
+	if err != nil {
+		return nil, err
+	}
+
+	var volumeList []*compute.Volume
+	err = volumes.List(client, volumes.ListOpts{}).EachPage(func(page pagination.Page) (bool, error) {
+		pageVolumes, err := volumes.ExtractVolumes(page)
+		if err != nil {
+			return false, err
+		}
+		for _, apiVolume := range pageVolumes {
+			volumeList = append(volumeList, os.mapVolume(&apiVolume))
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, os.mapError(err)
+	} else {
+		return volumeList, nil
+	}
+}
+
+func (os *OpenStack) GetVolume(volumeID string) (*compute.Volume, error) {
+	client, err := os.volumeClient()
+	if err != nil {
+		return nil, err
+	}
+	apiVolume, err := volumes.Get(client, volumeID).Extract()
+	if err != nil {
+		return nil, os.mapError(err)
+	} else {
+		return os.mapVolume(apiVolume), nil
+	}
+}
+
+func (os *OpenStack) DeleteVolume(volumeID string) error {
+	client, err := os.volumeClient()
+	if err != nil {
+		return err
+	}
+	return os.mapError(volumes.Delete(client, volumeID).ExtractErr())
+}
+
+func (os *OpenStack) AttachVolume(volumeID string, instanceID string) error {
+	opts := volumeattach.CreateOpts{
+		VolumeID: volumeID,
+	}
+	_, err := volumeattach.Create(os.ComputeClient, instanceID, opts).Extract()
+	return os.mapError(err)
+}
+
+func (os *OpenStack) DetachVolume(volumeID string) error {
+	volume, err := os.GetVolume(volumeID)
+	if err != nil {
+		return err
+	} else if volume.InstanceID == "" {
+		return errors.New("volume is not attached to any instance")
+	}
+	// nova uses the volume ID as the attachment ID
+	return os.mapError(volumeattach.Delete(os.ComputeClient, volume.InstanceID, volumeID).ExtractErr())
+}
+
+func (os *OpenStack) ResizeVolume(volumeID string, sizeGB int) error {
+	client, err := os.volumeClient()
+	if err != nil {
+		return err
+	}
+	// the v1 bindings do not wrap the extend action, so we post it directly
+	body := map[string]interface{}{
+		"os-extend": map[string]interface{}{
+			"new_size": sizeGB,
+		},
+	}
+	_, err = client.Post(client.ServiceURL("volumes", volumeID, "action"), body, nil, &gophercloud.RequestOpts{
+		OkCodes: []int{202},
+	})
+	return os.mapError(err)
+}
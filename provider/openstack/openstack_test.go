@@ -0,0 +1,285 @@
+package openstack
+
+import "github.com/LunaNode/cloug/provider/openstack/simulator"
+import "github.com/LunaNode/cloug/service/compute"
+import "github.com/LunaNode/cloug/service/compute/conformance"
+
+import "github.com/LunaNode/gophercloud"
+import "github.com/LunaNode/gophercloud/openstack/compute/v2/servers"
+
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+func TestConformance(t *testing.T) {
+	server := simulator.NewServer("alice", "secret", "demo")
+	defer server.Close()
+	server.AddImage(&simulator.Image{Name: "Ubuntu 22.04", OSDistro: "ubuntu", OSVersion: "22.04", Architecture: "x86_64"})
+
+	os, err := MakeOpenStackAuth(&AuthOptions{
+		IdentityEndpoint: server.IdentityURL(),
+		Username:         "alice",
+		Password:         "secret",
+		DomainName:       server.DomainName,
+		ProjectName:      "demo",
+	})
+	if err != nil {
+		t.Fatalf("error authenticating: %v", err)
+	}
+	os.FloatingIPPool = simulator.FLOATING_IP_POOL
+
+	conformance.Run(t, os, &conformance.Config{
+		Instance: compute.Instance{
+			Image:  compute.Image{Distribution: "ubuntu", Version: "22.04"},
+			Flavor: compute.Flavor{MemoryMB: 512},
+		},
+		VolumeSizeGB: 10,
+		Wait:         compute.WaitOptions{Interval: 10 * time.Millisecond},
+	})
+}
+
+const TEST_CLOUDS = `
+clouds:
+  password:
+    auth:
+      auth_url: https://keystone.example.com:5000/v3
+      username: alice
+      password: secret
+      tenant_name: demo
+      project_domain_id: default
+      user_domain_name: Users
+    region_name: RegionOne
+  appcred:
+    auth_type: v3applicationcredential
+    auth:
+      auth_url: https://keystone.example.com:5000/v3
+      application_credential_id: cred
+      application_credential_secret: secret
+    interface: internal
+  oidc:
+    auth_type: v3oidcpassword
+`
+
+func TestLoadCloud(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "clouds.yaml")
+	if err := ioutil.WriteFile(filename, []byte(TEST_CLOUDS), 0600); err != nil {
+		t.Fatalf("error writing clouds.yaml: %v", err)
+	}
+
+	opts, err := loadCloud(filename, "password")
+	if err != nil {
+		t.Fatalf("loadCloud(password): %v", err)
+	} else if opts.Username != "alice" || opts.ProjectName != "demo" || opts.Region != "RegionOne" {
+		t.Fatalf("unexpected options for password cloud: %+v", opts)
+	} else if opts.DomainName != "Users" || opts.DomainID != "" {
+		t.Fatalf("expected the user domain, got ID %q and name %q", opts.DomainID, opts.DomainName)
+	}
+
+	// the file is also found through OS_CLIENT_CONFIG_FILE
+	os.Setenv("OS_CLIENT_CONFIG_FILE", filename)
+	defer os.Unsetenv("OS_CLIENT_CONFIG_FILE")
+	opts, err = loadCloud("", "appcred")
+	if err != nil {
+		t.Fatalf("loadCloud(appcred): %v", err)
+	} else if opts.ApplicationCredentialID != "cred" || opts.ApplicationCredentialSecret != "secret" || opts.Interface != "internal" {
+		t.Fatalf("unexpected options for appcred cloud: %+v", opts)
+	}
+
+	if _, err := loadCloud(filename, "oidc"); !errors.Is(err, compute.ErrInvalidArgument) {
+		t.Fatalf("expected invalid argument error for unsupported auth type, got %v", err)
+	}
+	if _, err := loadCloud(filename, "missing"); !errors.Is(err, compute.ErrNotFound) {
+		t.Fatalf("expected not found error for missing cloud, got %v", err)
+	}
+	if _, err := loadCloud(filename+".missing", "password"); err == nil || errors.Is(err, compute.ErrNotFound) {
+		t.Fatalf("expected read error for missing file, got %v", err)
+	}
+}
+
+func TestApplicationCredentialAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request tokenRequest
+		if r.Method != "POST" || r.URL.Path != "/v3/auth/tokens" {
+			http.NotFound(w, r)
+			return
+		} else if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		credential := request.Auth.Identity.ApplicationCredential
+		if len(request.Auth.Identity.Methods) != 1 || request.Auth.Identity.Methods[0] != "application_credential" {
+			http.Error(w, "unsupported method", http.StatusBadRequest)
+			return
+		} else if credential.ID != "cred" || credential.Secret != "secret" {
+			http.Error(w, `{"error": {"code": 401, "title": "Unauthorized"}}`, http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("X-Subject-Token", "token")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"token": {"catalog": [{"type": "compute", "name": "nova", "endpoints": [
+			{"interface": "public", "region": "RegionOne", "url": "https://nova.example.com/v2.1"},
+			{"interface": "internal", "region": "RegionOne", "url": "http://nova.internal/v2.1"},
+			{"interface": "public", "region_id": "RegionTwo", "url": "https://nova2.example.com/v2.1"}
+		]}]}}`))
+	}))
+	defer server.Close()
+
+	provider := &gophercloud.ProviderClient{}
+	err := authenticate(provider, &AuthOptions{
+		IdentityEndpoint:            server.URL + "/v3",
+		ApplicationCredentialID:     "cred",
+		ApplicationCredentialSecret: "secret",
+	})
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	} else if provider.TokenID != "token" || provider.ReauthFunc == nil {
+		t.Fatalf("expected token and reauthentication, got token %q", provider.TokenID)
+	}
+
+	tests := []struct {
+		opts gophercloud.EndpointOpts
+		url  string
+	}{
+		{gophercloud.EndpointOpts{Type: "compute", Availability: gophercloud.AvailabilityPublic}, "https://nova.example.com/v2.1/"},
+		{gophercloud.EndpointOpts{Type: "compute", Availability: gophercloud.AvailabilityInternal}, "http://nova.internal/v2.1/"},
+		{gophercloud.EndpointOpts{Type: "compute", Availability: gophercloud.AvailabilityPublic, Region: "RegionTwo"}, "https://nova2.example.com/v2.1/"},
+		{gophercloud.EndpointOpts{Type: "compute", Availability: gophercloud.AvailabilityAdmin}, ""},
+		{gophercloud.EndpointOpts{Type: "volume", Availability: gophercloud.AvailabilityPublic}, ""},
+	}
+	for _, test := range tests {
+		url, err := provider.EndpointLocator(test.opts)
+		if test.url == "" && !errors.Is(err, compute.ErrNotFound) {
+			t.Fatalf("expected not found error for %+v, got %q, %v", test.opts, url, err)
+		} else if test.url != "" && (err != nil || url != test.url) {
+			t.Fatalf("expected %s for %+v, got %q, %v", test.url, test.opts, url, err)
+		}
+	}
+
+	err = authenticate(&gophercloud.ProviderClient{}, &AuthOptions{
+		IdentityEndpoint:            server.URL,
+		ApplicationCredentialID:     "cred",
+		ApplicationCredentialSecret: "wrong",
+	})
+	if !errors.Is(err, compute.ErrAuth) {
+		t.Fatalf("expected auth error for wrong secret, got %v", err)
+	}
+	err = authenticate(&gophercloud.ProviderClient{}, &AuthOptions{
+		IdentityEndpoint:            server.URL + "/v2.0",
+		ApplicationCredentialID:     "cred",
+		ApplicationCredentialSecret: "secret",
+	})
+	if !errors.Is(err, compute.ErrInvalidArgument) {
+		t.Fatalf("expected invalid argument error for Keystone v2 endpoint, got %v", err)
+	}
+}
+
+func TestFindImage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/v2/images" && r.URL.Query().Get("marker") == "" {
+			w.Write([]byte(`{"images": [
+				{"id": "jammy", "name": "jammy", "status": "active", "disk_format": "qcow2", "created_at": "2024-01-01T00:00:00Z", "os_distro": "Ubuntu", "os_version": "22.04", "architecture": "x86_64"},
+				{"id": "ubuntu-2204", "name": "Ubuntu 22.04", "status": "active", "disk_format": "qcow2", "created_at": "2024-02-01T00:00:00Z"},
+				{"id": "ubuntu-2204-arm", "name": "Ubuntu 22.04 arm64", "status": "active", "disk_format": "qcow2", "created_at": "2024-03-01T00:00:00Z"}
+			], "next": "/v2/images?limit=100&marker=ubuntu-2204-arm"}`))
+		} else if r.URL.Path == "/v2/images" {
+			w.Write([]byte(`{"images": [
+				{"id": "ubuntu-2004", "name": "Ubuntu 20.04", "status": "active", "disk_format": "qcow2", "created_at": "2024-04-01T00:00:00Z"},
+				{"id": "ubuntu-queued", "name": "Ubuntu 24.04", "status": "queued", "disk_format": "qcow2", "created_at": "2024-06-01T00:00:00Z"},
+				{"id": "ubuntu-iso", "name": "ubuntu-22.04-live-server.iso", "status": "active", "disk_format": "iso", "created_at": "2024-06-01T00:00:00Z"},
+				{"id": "debian-12", "name": "bookworm", "status": "active", "disk_format": "raw", "created_at": "2024-01-01T00:00:00Z", "os_distro": "debian", "os_version": "12", "architecture": "amd64"}
+			]}`))
+		} else {
+			http.Error(w, `{"message": "image not found"}`, http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	osProvider := &OpenStack{
+		ImageClient: &gophercloud.ServiceClient{
+			ProviderClient: &gophercloud.ProviderClient{},
+			Endpoint:       server.URL + "/v1/",
+		},
+	}
+	tests := []struct {
+		image compute.Image
+		id    string
+	}{
+		{compute.Image{}, "ubuntu-2004"},
+		{compute.Image{Version: "22.04"}, "ubuntu-2204"},
+		{compute.Image{Version: "22.04", Architecture: compute.ArchARM64}, "ubuntu-2204-arm"},
+		{compute.Image{Distribution: "Debian"}, "debian-12"},
+		{compute.Image{Distribution: "debian", Version: "1"}, ""},
+		{compute.Image{Type: compute.ISOImage}, "ubuntu-iso"},
+		{compute.Image{Name: "jammy"}, "jammy"},
+		{compute.Image{Version: "24.04"}, ""},
+	}
+	for _, test := range tests {
+		id, err := osProvider.FindImage(&test.image)
+		if err != nil {
+			t.Fatalf("FindImage(%+v): %v", test.image, err)
+		} else if id != test.id {
+			t.Fatalf("FindImage(%+v): expected %q, got %q", test.image, test.id, id)
+		}
+	}
+
+	if _, err := osProvider.GetImage("missing"); !errors.Is(err, compute.ErrNotFound) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+}
+
+func TestGuessImageProperties(t *testing.T) {
+	tests := []struct {
+		image        compute.Image
+		distribution string
+		version      string
+		expected     compute.Image
+	}{
+		{compute.Image{Name: "Ubuntu 22.04 LTS"}, "ubuntu", "22.04", compute.Image{Distribution: "ubuntu", Version: "22.04", Architecture: compute.ArchAMD64}},
+		{compute.Image{Name: "Ubuntu 22.04 aarch64"}, "ubuntu", "", compute.Image{Distribution: "ubuntu", Architecture: compute.ArchARM64}},
+		{compute.Image{Name: "CentOS 7 i686"}, "ubuntu", "7", compute.Image{Version: "7", Architecture: compute.Archi386}},
+		{compute.Image{Name: "Ubuntu 20.04", Distribution: "debian", Version: "11", Architecture: compute.ArchARM64}, "ubuntu", "20.04", compute.Image{Distribution: "debian", Version: "11", Architecture: compute.ArchARM64}},
+	}
+	for _, test := range tests {
+		image := test.image
+		guessImageProperties(&image, test.distribution, test.version)
+		if image.Distribution != test.expected.Distribution || image.Version != test.expected.Version || image.Architecture != test.expected.Architecture {
+			t.Fatalf("guessImageProperties(%s): expected %s %s %s, got %s %s %s", test.image.Name, test.expected.Distribution, test.expected.Version, test.expected.Architecture, image.Distribution, image.Version, image.Architecture)
+		}
+	}
+}
+
+func TestInstanceNetworks(t *testing.T) {
+	tests := []struct {
+		instance compute.Instance
+		networks []servers.Network
+	}{
+		{compute.Instance{}, nil},
+		{compute.Instance{NetworkID: "net-1"}, []servers.Network{{UUID: "net-1"}}},
+		{
+			compute.Instance{NetworkID: "net-1", Details: map[string]string{"networks": "net-2, net-3=10.0.0.5,", "ports": "port-1"}},
+			[]servers.Network{{UUID: "net-1"}, {UUID: "net-2"}, {UUID: "net-3", FixedIP: "10.0.0.5"}, {Port: "port-1"}},
+		},
+		{compute.Instance{Details: map[string]string{"networks": "net-1=2001:db8::5"}}, []servers.Network{{UUID: "net-1", FixedIP: "2001:db8::5"}}},
+	}
+	for _, test := range tests {
+		networks, err := instanceNetworks(&test.instance)
+		if err != nil {
+			t.Fatalf("instanceNetworks(%+v): %v", test.instance, err)
+		} else if fmt.Sprint(networks) != fmt.Sprint(test.networks) {
+			t.Fatalf("instanceNetworks(%+v): expected %v, got %v", test.instance, test.networks, networks)
+		}
+	}
+
+	_, err := instanceNetworks(&compute.Instance{Details: map[string]string{"networks": "net-1=10.0.0"}})
+	if !errors.Is(err, compute.ErrInvalidArgument) {
+		t.Fatalf("expected invalid argument error for bad fixed IP, got %v", err)
+	}
+}
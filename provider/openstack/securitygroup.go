@@ -0,0 +1,148 @@
+package openstack
+
+import "github.com/LunaNode/cloug/service/compute"
+
+import "github.com/LunaNode/gophercloud/openstack/networking/v2/extensions/security/groups"
+import "github.com/LunaNode/gophercloud/openstack/networking/v2/extensions/security/rules"
+import "github.com/LunaNode/gophercloud/pagination"
+
+import "fmt"
+import "strings"
+
+func (os *OpenStack) mapSecurityGroupRule(apiRule *rules.SecGroupRule) *compute.SecurityGroupRule {
+	return &compute.SecurityGroupRule{
+		ID:         apiRule.ID,
+		Direction:  compute.RuleDirection(apiRule.Direction),
+		Protocol:   apiRule.Protocol,
+		PortMin:    apiRule.PortRangeMin,
+		PortMax:    apiRule.PortRangeMax,
+		RemoteCIDR: apiRule.RemoteIPPrefix,
+	}
+}
+
+func (os *OpenStack) mapSecurityGroup(apiGroup *groups.SecGroup) *compute.SecurityGroup {
+	group := &compute.SecurityGroup{
+		ID:          apiGroup.ID,
+		Name:        apiGroup.Name,
+		Description: apiGroup.Description,
+		Details: map[string]string{
+			"tenant_id": apiGroup.TenantID,
+		},
+	}
+	for i := range apiGroup.Rules {
+		group.Rules = append(group.Rules, os.mapSecurityGroupRule(&apiGroup.Rules[i]))
+	}
+	return group
+}
+
+func (os *OpenStack) CreateSecurityGroup(group *compute.SecurityGroup) (*compute.SecurityGroup, error) {
+	client, err := os.networkClient()
+	if err != nil {
+		return nil, err
+	} else if group.Name == "" {
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "security group name is empty")
+	}
+	apiGroup, err := groups.Create(client, groups.CreateOpts{
+		Name:        group.Name,
+		Description: group.Description,
+	}).Extract()
+	if err != nil {
+		return nil, os.mapError(err)
+	}
+	for _, rule := range group.Rules {
+		_, err := os.AddSecurityGroupRule(apiGroup.ID, rule)
+		if err != nil {
+			groups.Delete(client, apiGroup.ID)
+			return nil, fmt.Errorf("error adding rule to security group: %w", err)
+		}
+	}
+	// the group includes the default egress rules that Neutron adds
+	return os.GetSecurityGroup(apiGroup.ID)
+}
+
+func (os *OpenStack) ListSecurityGroups() ([]*compute.SecurityGroup, error) {
+	client, err := os.networkClient()
+	if err != nil {
+		return nil, err
+	}
+	var securityGroups []*compute.SecurityGroup
+	err = groups.List(client, groups.ListOpts{}).EachPage(func(page pagination.Page) (bool, error) {
+		apiGroups, err := groups.ExtractGroups(page)
+		if err != nil {
+			return false, err
+		}
+		for i := range apiGroups {
+			securityGroups = append(securityGroups, os.mapSecurityGroup(&apiGroups[i]))
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, os.mapError(err)
+	}
+	return securityGroups, nil
+}
+
+func (os *OpenStack) GetSecurityGroup(groupID string) (*compute.SecurityGroup, error) {
+	client, err := os.networkClient()
+	if err != nil {
+		return nil, err
+	}
+	apiGroup, err := groups.Get(client, groupID).Extract()
+	if err != nil {
+		return nil, os.mapError(err)
+	} else {
+		return os.mapSecurityGroup(apiGroup), nil
+	}
+}
+
+func (os *OpenStack) DeleteSecurityGroup(groupID string) error {
+	client, err := os.networkClient()
+	if err != nil {
+		return err
+	}
+	return os.mapError(groups.Delete(client, groupID).ExtractErr())
+}
+
+// The rule applies to IPv6 traffic if RemoteCIDR is an IPv6 prefix, and to
+// IPv4 traffic otherwise.
+func (os *OpenStack) AddSecurityGroupRule(groupID string, rule *compute.SecurityGroupRule) (*compute.SecurityGroupRule, error) {
+	client, err := os.networkClient()
+	if err != nil {
+		return nil, err
+	}
+	opts := rules.CreateOpts{
+		Direction:      string(rule.Direction),
+		EtherType:      "IPv4",
+		SecGroupID:     groupID,
+		PortRangeMin:   rule.PortMin,
+		PortRangeMax:   rule.PortMax,
+		Protocol:       rule.Protocol,
+		RemoteIPPrefix: rule.RemoteCIDR,
+	}
+	if opts.Direction == "" {
+		opts.Direction = string(compute.RuleIngress)
+	}
+	if strings.Contains(rule.RemoteCIDR, ":") {
+		opts.EtherType = "IPv6"
+	}
+	apiRule, err := rules.Create(client, opts).Extract()
+	if err != nil {
+		return nil, os.mapError(err)
+	} else {
+		return os.mapSecurityGroupRule(apiRule), nil
+	}
+}
+
+func (os *OpenStack) RemoveSecurityGroupRule(groupID string, ruleID string) error {
+	client, err := os.networkClient()
+	if err != nil {
+		return err
+	}
+	apiRule, err := rules.Get(client, ruleID).Extract()
+	if err != nil {
+		return os.mapError(err)
+	} else if apiRule.SecGroupID != groupID {
+		return compute.Errorf(compute.ErrNotFound, "rule %s not found in security group %s", ruleID, groupID)
+	}
+	return os.mapError(rules.Delete(client, ruleID).ExtractErr())
+}
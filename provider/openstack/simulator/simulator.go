@@ -0,0 +1,1300 @@
+// Package simulator provides a local stand-in for an OpenStack cloud.
+//
+// Keystone v3 issues tokens for a single user and project, with a catalog that
+// points the compute, image, volume and network services back at the
+// simulator. Nova servers and floating IPs, Glance images, Cinder volumes and
+// Neutron security groups are kept in memory, so that the compute adapter can
+// be tested without a cloud.
+package simulator
+
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "net/http/httptest"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+const REGION = "RegionOne"
+
+const AVAILABILITY_ZONE = "nova"
+
+// Network that servers are attached to unless others are requested.
+const NETWORK_ID = "00000000-0000-4000-8000-00000000cafe"
+
+// Pool that floating IPs are allocated from.
+const FLOATING_IP_POOL = "public"
+
+// Path of the Keystone v3 endpoint, relative to the server URL.
+const IDENTITY_PATH = "/identity/v3"
+
+type flavor struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	RAM   int    `json:"ram"`
+	VCPUs int    `json:"vcpus"`
+	Disk  int    `json:"disk"`
+}
+
+var FLAVORS = []flavor{
+	{"1", "m1.tiny", 512, 1, 1},
+	{"2", "m1.small", 2048, 1, 20},
+	{"3", "m1.medium", 4096, 2, 40},
+}
+
+// Glance v2 image.
+type Image struct {
+	ID              string `json:"id"`
+	Name            string `json:"name"`
+	Status          string `json:"status"`
+	Visibility      string `json:"visibility"`
+	Size            int64  `json:"size"`
+	DiskFormat      string `json:"disk_format"`
+	ContainerFormat string `json:"container_format"`
+	CreatedAt       string `json:"created_at"`
+	OSDistro        string `json:"os_distro,omitempty"`
+	OSVersion       string `json:"os_version,omitempty"`
+	Architecture    string `json:"architecture,omitempty"`
+
+	// number of gets before a queued image is active
+	pendingPolls int
+}
+
+type server struct {
+	id             string
+	name           string
+	status         string
+	imageID        string
+	flavorID       string
+	fixedIP        string
+	metadata       map[string]string
+	securityGroups []string
+	created        string
+
+	// Status that the server changes to after pendingPolls gets.
+	target       string
+	pendingPolls int
+}
+
+type floatingIP struct {
+	ID         string  `json:"id"`
+	IP         string  `json:"ip"`
+	Pool       string  `json:"pool"`
+	InstanceID *string `json:"instance_id"`
+	FixedIP    *string `json:"fixed_ip"`
+}
+
+type volume struct {
+	id       string
+	name     string
+	size     int
+	zone     string
+	status   string
+	serverID string
+	created  string
+
+	pendingPolls int
+}
+
+type securityGroupRule struct {
+	ID             string  `json:"id"`
+	Direction      string  `json:"direction"`
+	EtherType      string  `json:"ethertype"`
+	SecGroupID     string  `json:"security_group_id"`
+	Protocol       *string `json:"protocol"`
+	PortRangeMin   *int    `json:"port_range_min"`
+	PortRangeMax   *int    `json:"port_range_max"`
+	RemoteIPPrefix *string `json:"remote_ip_prefix"`
+	RemoteGroupID  *string `json:"remote_group_id"`
+	TenantID       string  `json:"tenant_id"`
+}
+
+type securityGroup struct {
+	ID          string               `json:"id"`
+	Name        string               `json:"name"`
+	Description string               `json:"description"`
+	TenantID    string               `json:"tenant_id"`
+	Rules       []*securityGroupRule `json:"security_group_rules"`
+}
+
+type apiError struct {
+	code    int
+	message string
+}
+
+func newError(code int, format string, args ...interface{}) *apiError {
+	return &apiError{code, fmt.Sprintf(format, args...)}
+}
+
+func notFound(resource string, id string) *apiError {
+	return newError(http.StatusNotFound, "%s %s could not be found.", resource, id)
+}
+
+func badRequest(format string, args ...interface{}) *apiError {
+	return newError(http.StatusBadRequest, format, args...)
+}
+
+func conflict(format string, args ...interface{}) *apiError {
+	return newError(http.StatusConflict, format, args...)
+}
+
+// Fault names that Nova uses as the key of error bodies.
+var faultNames = map[int]string{
+	http.StatusBadRequest:   "badRequest",
+	http.StatusUnauthorized: "unauthorized",
+	http.StatusNotFound:     "itemNotFound",
+	http.StatusConflict:     "conflictingRequest",
+}
+
+// Server is an OpenStack simulator listening on a local port.
+type Server struct {
+	*httptest.Server
+
+	// Credentials for password authentication.
+	Username    string
+	Password    string
+	DomainName  string
+	ProjectName string
+	ProjectID   string
+
+	// Application credential that is accepted in addition to the password.
+	ApplicationCredentialID     string
+	ApplicationCredentialSecret string
+
+	// Number of gets for which servers, images and volumes stay in a
+	// transitional status, like BUILD or creating.
+	PendingPolls int
+
+	// Maximum number of images in a Glance list page.
+	PageSize int
+
+	mu             sync.Mutex
+	nextID         int
+	tokens         map[string]bool
+	servers        map[string]*server
+	images         []*Image
+	floatingIPs    []*floatingIP
+	volumes        map[string]*volume
+	securityGroups map[string]*securityGroup
+}
+
+// Starts a simulator for the user and project, in the Default domain. There
+// are no images until they are created through the API or added with
+// AddImage; the project has a default security group.
+func NewServer(username string, password string, projectName string) *Server {
+	s := &Server{
+		Username:       username,
+		Password:       password,
+		DomainName:     "Default",
+		ProjectName:    projectName,
+		PendingPolls:   1,
+		PageSize:       25,
+		tokens:         make(map[string]bool),
+		servers:        make(map[string]*server),
+		volumes:        make(map[string]*volume),
+		securityGroups: make(map[string]*securityGroup),
+	}
+	s.ProjectID = s.newID()
+	s.addSecurityGroup("default", "Default security group")
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Returns the URL of the Keystone v3 endpoint.
+func (s *Server) IdentityURL() string {
+	return s.URL + IDENTITY_PATH
+}
+
+// Adds an image, and returns its ID. The ID, status, visibility, formats and
+// creation time are filled in if unset.
+func (s *Server) AddImage(image *Image) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if image.ID == "" {
+		image.ID = s.newID()
+	}
+	if image.Status == "" {
+		image.Status = "active"
+	}
+	if image.Visibility == "" {
+		image.Visibility = "public"
+	}
+	if image.DiskFormat == "" {
+		image.DiskFormat = "qcow2"
+	}
+	if image.ContainerFormat == "" {
+		image.ContainerFormat = "bare"
+	}
+	if image.CreatedAt == "" {
+		image.CreatedAt = timestamp()
+	}
+	s.images = append(s.images, image)
+	return image.ID
+}
+
+func (s *Server) newID() string {
+	s.nextID++
+	return fmt.Sprintf("00000000-0000-4000-8000-%012d", s.nextID)
+}
+
+func timestamp() string {
+	return time.Now().UTC().Format("2006-01-02T15:04:05Z")
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	s.mu.Lock()
+	code, response, err := s.handle(w, r)
+	s.mu.Unlock()
+	if err != nil {
+		name := faultNames[err.code]
+		if name == "" {
+			name = "computeFault"
+		}
+		w.WriteHeader(err.code)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			name: map[string]interface{}{
+				"code":    err.code,
+				"message": err.message,
+			},
+		})
+		return
+	}
+	w.WriteHeader(code)
+	if response != nil {
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// Splits the path after the prefix into its parts, or returns nil if the path
+// does not start with the prefix.
+func pathParts(path string, prefix string) []string {
+	if !strings.HasPrefix(path, prefix+"/") {
+		return nil
+	}
+	return strings.Split(strings.Trim(strings.TrimPrefix(path, prefix), "/"), "/")
+}
+
+func decode(r *http.Request, request interface{}) *apiError {
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		return badRequest("Malformed request body: %v", err)
+	}
+	return nil
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) (int, interface{}, *apiError) {
+	if r.URL.Path == IDENTITY_PATH+"/auth/tokens" && r.Method == "POST" {
+		return s.issueToken(w, r)
+	} else if !s.tokens[r.Header.Get("X-Auth-Token")] {
+		return 0, nil, newError(http.StatusUnauthorized, "The request you have made requires authentication.")
+	}
+
+	if parts := pathParts(r.URL.Path, "/compute/v2.1"); parts != nil {
+		return s.handleCompute(w, r, parts)
+	} else if parts := pathParts(r.URL.Path, "/image"); parts != nil {
+		return s.handleImage(r, parts)
+	} else if parts := pathParts(r.URL.Path, "/volume/v1/"+s.ProjectID); parts != nil {
+		return s.handleVolume(r, parts)
+	} else if parts := pathParts(r.URL.Path, "/network/v2.0"); parts != nil {
+		return s.handleNetwork(r, parts)
+	}
+	return 0, nil, newError(http.StatusNotFound, "The resource could not be found.")
+}
+
+type tokenRequest struct {
+	Auth struct {
+		Identity struct {
+			Methods  []string `json:"methods"`
+			Password struct {
+				User struct {
+					Name     string `json:"name"`
+					Password string `json:"password"`
+					Domain   struct {
+						ID   string `json:"id"`
+						Name string `json:"name"`
+					} `json:"domain"`
+				} `json:"user"`
+			} `json:"password"`
+			Token struct {
+				ID string `json:"id"`
+			} `json:"token"`
+			ApplicationCredential struct {
+				ID     string `json:"id"`
+				Secret string `json:"secret"`
+			} `json:"application_credential"`
+		} `json:"identity"`
+		Scope *struct {
+			Project struct {
+				ID     string `json:"id"`
+				Name   string `json:"name"`
+				Domain struct {
+					ID   string `json:"id"`
+					Name string `json:"name"`
+				} `json:"domain"`
+			} `json:"project"`
+		} `json:"scope"`
+	} `json:"auth"`
+}
+
+func (s *Server) issueToken(w http.ResponseWriter, r *http.Request) (int, interface{}, *apiError) {
+	var request tokenRequest
+	if err := decode(r, &request); err != nil {
+		return 0, nil, err
+	}
+	identity := request.Auth.Identity
+	unauthorized := newError(http.StatusUnauthorized, "The request you have made requires authentication.")
+	if len(identity.Methods) != 1 {
+		return 0, nil, badRequest("Expected a single authentication method")
+	}
+	switch identity.Methods[0] {
+	case "password":
+		user := identity.Password.User
+		if user.Name != s.Username || user.Password != s.Password || (user.Domain.Name != s.DomainName && user.Domain.ID != "default") {
+			return 0, nil, unauthorized
+		}
+	case "token":
+		if !s.tokens[identity.Token.ID] {
+			return 0, nil, unauthorized
+		}
+	case "application_credential":
+		credential := identity.ApplicationCredential
+		if s.ApplicationCredentialID == "" || credential.ID != s.ApplicationCredentialID || credential.Secret != s.ApplicationCredentialSecret {
+			return 0, nil, unauthorized
+		}
+	default:
+		return 0, nil, badRequest("Unsupported authentication method %s", identity.Methods[0])
+	}
+	if scope := request.Auth.Scope; scope != nil && scope.Project.ID != s.ProjectID && scope.Project.Name != s.ProjectName {
+		return 0, nil, unauthorized
+	}
+
+	token := s.newID()
+	s.tokens[token] = true
+	w.Header().Set("X-Subject-Token", token)
+	endpoint := func(serviceType string, path string) map[string]interface{} {
+		return map[string]interface{}{
+			"type": serviceType,
+			"name": serviceType,
+			"endpoints": []map[string]string{{
+				"interface": "public",
+				"region":    REGION,
+				"region_id": REGION,
+				"url":       s.URL + path,
+			}},
+		}
+	}
+	return http.StatusCreated, map[string]interface{}{
+		"token": map[string]interface{}{
+			"methods":    identity.Methods,
+			"expires_at": time.Now().Add(time.Hour).UTC().Format("2006-01-02T15:04:05.000000Z"),
+			"project":    map[string]string{"id": s.ProjectID, "name": s.ProjectName},
+			"catalog": []map[string]interface{}{
+				endpoint("identity", IDENTITY_PATH),
+				endpoint("compute", "/compute/v2.1"),
+				endpoint("image", "/image"),
+				endpoint("volume", "/volume/v1/"+s.ProjectID),
+				endpoint("network", "/network"),
+			},
+		},
+	}, nil
+}
+
+// Nova
+
+func (s *Server) handleCompute(w http.ResponseWriter, r *http.Request, parts []string) (int, interface{}, *apiError) {
+	switch {
+	case len(parts) == 2 && parts[0] == "flavors" && parts[1] == "detail" && r.Method == "GET":
+		return http.StatusOK, map[string]interface{}{"flavors": FLAVORS}, nil
+	case len(parts) == 1 && parts[0] == "servers" && r.Method == "POST":
+		return s.createServer(r)
+	case len(parts) == 2 && parts[0] == "servers" && parts[1] == "detail" && r.Method == "GET":
+		return s.listServers()
+	case len(parts) >= 2 && parts[0] == "servers":
+		sv := s.servers[parts[1]]
+		if sv == nil {
+			return 0, nil, notFound("Instance", parts[1])
+		}
+		return s.handleServer(w, r, sv, parts[2:])
+	case len(parts) == 1 && parts[0] == "os-floating-ips" && r.Method == "GET":
+		return http.StatusOK, map[string]interface{}{"floating_ips": s.floatingIPs}, nil
+	case len(parts) == 1 && parts[0] == "os-floating-ips" && r.Method == "POST":
+		return s.allocateFloatingIP(r)
+	case len(parts) == 2 && parts[0] == "os-floating-ips":
+		return s.floatingIPRequest(r.Method, parts[1])
+	}
+	return 0, nil, newError(http.StatusNotFound, "The resource could not be found.")
+}
+
+func findFlavor(id string) *flavor {
+	for i := range FLAVORS {
+		if FLAVORS[i].ID == id {
+			return &FLAVORS[i]
+		}
+	}
+	return nil
+}
+
+func (s *Server) findImage(id string) *Image {
+	for _, image := range s.images {
+		if image.ID == id {
+			return image
+		}
+	}
+	return nil
+}
+
+func (s *Server) findSecurityGroup(nameOrID string) *securityGroup {
+	if group := s.securityGroups[nameOrID]; group != nil {
+		return group
+	}
+	for _, group := range s.securityGroups {
+		if group.Name == nameOrID {
+			return group
+		}
+	}
+	return nil
+}
+
+func (s *Server) createServer(r *http.Request) (int, interface{}, *apiError) {
+	var request struct {
+		Server struct {
+			Name             string `json:"name"`
+			ImageRef         string `json:"imageRef"`
+			FlavorRef        string `json:"flavorRef"`
+			AdminPass        string `json:"adminPass"`
+			AvailabilityZone string `json:"availability_zone"`
+			Networks         []struct {
+				UUID    string `json:"uuid"`
+				Port    string `json:"port"`
+				FixedIP string `json:"fixed_ip"`
+			} `json:"networks"`
+			SecurityGroups []struct {
+				Name string `json:"name"`
+			} `json:"security_groups"`
+			Metadata map[string]string `json:"metadata"`
+		} `json:"server"`
+	}
+	if err := decode(r, &request); err != nil {
+		return 0, nil, err
+	}
+	opts := request.Server
+	if opts.Name == "" {
+		return 0, nil, badRequest("Invalid input for field/attribute name.")
+	} else if image := s.findImage(opts.ImageRef); image == nil || image.Status != "active" {
+		return 0, nil, badRequest("Can not find requested image")
+	} else if findFlavor(opts.FlavorRef) == nil {
+		return 0, nil, badRequest("Flavor %s could not be found.", opts.FlavorRef)
+	} else if opts.AvailabilityZone != "" && opts.AvailabilityZone != AVAILABILITY_ZONE {
+		return 0, nil, badRequest("The requested availability zone is not available")
+	}
+
+	sv := &server{
+		id:           s.newID(),
+		name:         opts.Name,
+		status:       "BUILD",
+		imageID:      opts.ImageRef,
+		flavorID:     opts.FlavorRef,
+		metadata:     make(map[string]string),
+		created:      timestamp(),
+		target:       "ACTIVE",
+		pendingPolls: s.PendingPolls,
+	}
+	sv.fixedIP = fmt.Sprintf("10.0.0.%d", s.nextID%250+2)
+	for _, network := range opts.Networks {
+		if network.Port != "" {
+			return 0, nil, badRequest("Port %s could not be found.", network.Port)
+		} else if network.UUID != NETWORK_ID {
+			return 0, nil, badRequest("Network %s could not be found.", network.UUID)
+		} else if network.FixedIP != "" {
+			sv.fixedIP = network.FixedIP
+		}
+	}
+	for _, group := range opts.SecurityGroups {
+		if s.findSecurityGroup(group.Name) == nil {
+			return 0, nil, badRequest("Security group %s not found for project %s.", group.Name, s.ProjectID)
+		}
+		sv.securityGroups = append(sv.securityGroups, group.Name)
+	}
+	if len(sv.securityGroups) == 0 {
+		sv.securityGroups = []string{"default"}
+	}
+	for key, value := range opts.Metadata {
+		sv.metadata[key] = value
+	}
+	s.servers[sv.id] = sv
+
+	return http.StatusAccepted, map[string]interface{}{
+		"server": map[string]interface{}{
+			"id":              sv.id,
+			"adminPass":       opts.AdminPass,
+			"links":           s.serverLinks(sv),
+			"security_groups": s.serverSecurityGroups(sv),
+		},
+	}, nil
+}
+
+func (s *Server) serverLinks(sv *server) []map[string]string {
+	return []map[string]string{{
+		"rel":  "self",
+		"href": s.URL + "/compute/v2.1/servers/" + sv.id,
+	}}
+}
+
+func (s *Server) serverSecurityGroups(sv *server) []map[string]string {
+	var groups []map[string]string
+	for _, name := range sv.securityGroups {
+		groups = append(groups, map[string]string{"name": name})
+	}
+	return groups
+}
+
+// Addresses of the server by network, which include its floating IPs once
+// the server has been built.
+func (s *Server) serverAddresses(sv *server) map[string]interface{} {
+	addresses := make(map[string]interface{})
+	if sv.status == "BUILD" {
+		return addresses
+	}
+	private := []map[string]interface{}{{"version": 4, "addr": sv.fixedIP, "OS-EXT-IPS:type": "fixed"}}
+	for _, floatingIP := range s.floatingIPs {
+		if floatingIP.InstanceID != nil && *floatingIP.InstanceID == sv.id {
+			private = append(private, map[string]interface{}{"version": 4, "addr": floatingIP.IP, "OS-EXT-IPS:type": "floating"})
+		}
+	}
+	addresses["private"] = private
+	return addresses
+}
+
+func (s *Server) serverView(sv *server) map[string]interface{} {
+	return map[string]interface{}{
+		"id":                          sv.id,
+		"name":                        sv.name,
+		"status":                      sv.status,
+		"tenant_id":                   s.ProjectID,
+		"created":                     sv.created,
+		"image":                       map[string]string{"id": sv.imageID},
+		"flavor":                      map[string]string{"id": sv.flavorID},
+		"addresses":                   s.serverAddresses(sv),
+		"metadata":                    sv.metadata,
+		"links":                       s.serverLinks(sv),
+		"security_groups":             s.serverSecurityGroups(sv),
+		"accessIPv4":                  "",
+		"accessIPv6":                  "",
+		"OS-EXT-AZ:availability_zone": AVAILABILITY_ZONE,
+	}
+}
+
+func (s *Server) listServers() (int, interface{}, *apiError) {
+	var ids []string
+	for id := range s.servers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	list := []interface{}{}
+	for _, id := range ids {
+		list = append(list, s.serverView(s.servers[id]))
+	}
+	return http.StatusOK, map[string]interface{}{"servers": list}, nil
+}
+
+func (s *Server) handleServer(w http.ResponseWriter, r *http.Request, sv *server, parts []string) (int, interface{}, *apiError) {
+	switch {
+	case len(parts) == 0 && r.Method == "GET":
+		if sv.target != "" {
+			if sv.pendingPolls > 0 {
+				sv.pendingPolls--
+			} else {
+				sv.status = sv.target
+				sv.target = ""
+			}
+		}
+		return http.StatusOK, map[string]interface{}{"server": s.serverView(sv)}, nil
+	case len(parts) == 0 && r.Method == "PUT":
+		var request struct {
+			Server struct {
+				Name *string `json:"name"`
+			} `json:"server"`
+		}
+		if err := decode(r, &request); err != nil {
+			return 0, nil, err
+		} else if request.Server.Name != nil {
+			sv.name = *request.Server.Name
+		}
+		return http.StatusOK, map[string]interface{}{"server": s.serverView(sv)}, nil
+	case len(parts) == 0 && r.Method == "DELETE":
+		s.deleteServer(sv)
+		return http.StatusNoContent, nil, nil
+	case len(parts) == 1 && parts[0] == "ips" && r.Method == "GET":
+		return http.StatusOK, map[string]interface{}{"addresses": s.serverAddresses(sv)}, nil
+	case len(parts) == 1 && parts[0] == "action" && r.Method == "POST":
+		return s.serverAction(w, r, sv)
+	case len(parts) >= 1 && parts[0] == "metadata":
+		return s.metadataRequest(r, sv, parts[1:])
+	case len(parts) >= 1 && parts[0] == "os-volume_attachments":
+		return s.volumeAttachmentRequest(r, sv, parts[1:])
+	}
+	return 0, nil, newError(http.StatusNotFound, "The resource could not be found.")
+}
+
+// Deletes the server, which disassociates its floating IPs and detaches its
+// volumes.
+func (s *Server) deleteServer(sv *server) {
+	delete(s.servers, sv.id)
+	for _, floatingIP := range s.floatingIPs {
+		if floatingIP.InstanceID != nil && *floatingIP.InstanceID == sv.id {
+			floatingIP.InstanceID = nil
+			floatingIP.FixedIP = nil
+		}
+	}
+	for _, vol := range s.volumes {
+		if vol.serverID == sv.id {
+			vol.serverID = ""
+			vol.status = "available"
+		}
+	}
+}
+
+// Starts a transition of the server to the target status.
+func (s *Server) transition(sv *server, status string, target string) {
+	sv.status = status
+	sv.target = target
+	sv.pendingPolls = s.PendingPolls
+}
+
+func (s *Server) serverAction(w http.ResponseWriter, r *http.Request, sv *server) (int, interface{}, *apiError) {
+	var request map[string]json.RawMessage
+	if err := decode(r, &request); err != nil {
+		return 0, nil, err
+	} else if len(request) != 1 {
+		return 0, nil, badRequest("Expected a single action")
+	}
+	var action string
+	var body json.RawMessage
+	for name, raw := range request {
+		action, body = name, raw
+	}
+	notInState := conflict("Cannot '%s' instance %s while it is in vm_state %s", action, sv.id, strings.ToLower(sv.status))
+
+	switch action {
+	case "os-start":
+		if sv.status != "SHUTOFF" || sv.target != "" {
+			return 0, nil, notInState
+		}
+		s.transition(sv, "SHUTOFF", "ACTIVE")
+	case "os-stop":
+		if sv.status != "ACTIVE" || sv.target != "" {
+			return 0, nil, notInState
+		}
+		s.transition(sv, "ACTIVE", "SHUTOFF")
+	case "reboot":
+		if (sv.status != "ACTIVE" && sv.status != "SHUTOFF") || sv.target != "" {
+			return 0, nil, notInState
+		}
+		s.transition(sv, "HARD_REBOOT", "ACTIVE")
+	case "rebuild":
+		var opts struct {
+			ImageRef string `json:"imageRef"`
+			Name     string `json:"name"`
+		}
+		json.Unmarshal(body, &opts)
+		if image := s.findImage(opts.ImageRef); image == nil || image.Status != "active" {
+			return 0, nil, badRequest("Can not find requested image")
+		} else if sv.target != "" {
+			return 0, nil, notInState
+		}
+		sv.imageID = opts.ImageRef
+		if opts.Name != "" {
+			sv.name = opts.Name
+		}
+		s.transition(sv, "REBUILD", "ACTIVE")
+		return http.StatusAccepted, map[string]interface{}{"server": s.serverView(sv)}, nil
+	case "createImage":
+		var opts struct {
+			Name string `json:"name"`
+		}
+		json.Unmarshal(body, &opts)
+		if opts.Name == "" {
+			return 0, nil, badRequest("Invalid input for field/attribute name.")
+		}
+		source := s.findImage(sv.imageID)
+		image := &Image{
+			ID:              s.newID(),
+			Name:            opts.Name,
+			Status:          "queued",
+			Visibility:      "private",
+			DiskFormat:      "qcow2",
+			ContainerFormat: "bare",
+			CreatedAt:       timestamp(),
+			pendingPolls:    s.PendingPolls,
+		}
+		if source != nil {
+			image.OSDistro = source.OSDistro
+			image.OSVersion = source.OSVersion
+			image.Architecture = source.Architecture
+		}
+		s.images = append(s.images, image)
+		w.Header().Set("Location", s.URL+"/image/v2/images/"+image.ID)
+	case "addFloatingIp":
+		var opts struct {
+			Address string `json:"address"`
+		}
+		json.Unmarshal(body, &opts)
+		for _, floatingIP := range s.floatingIPs {
+			if floatingIP.IP != opts.Address {
+				continue
+			} else if floatingIP.InstanceID != nil && *floatingIP.InstanceID != sv.id {
+				return 0, nil, badRequest("Floating IP %s is associated with instance %s", opts.Address, *floatingIP.InstanceID)
+			}
+			floatingIP.InstanceID = &sv.id
+			floatingIP.FixedIP = &sv.fixedIP
+			return http.StatusAccepted, nil, nil
+		}
+		return 0, nil, notFound("Floating IP", opts.Address)
+	case "removeFloatingIp":
+		var opts struct {
+			Address string `json:"address"`
+		}
+		json.Unmarshal(body, &opts)
+		for _, floatingIP := range s.floatingIPs {
+			if floatingIP.IP != opts.Address {
+				continue
+			} else if floatingIP.InstanceID == nil || *floatingIP.InstanceID != sv.id {
+				return 0, nil, conflict("Floating IP %s is not associated with instance %s", opts.Address, sv.id)
+			}
+			floatingIP.InstanceID = nil
+			floatingIP.FixedIP = nil
+			return http.StatusAccepted, nil, nil
+		}
+		return 0, nil, notFound("Floating IP", opts.Address)
+	case "os-getVNCConsole":
+		var opts struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal(body, &opts)
+		if opts.Type != "novnc" && opts.Type != "xvpvnc" {
+			return 0, nil, badRequest("Invalid console type %s", opts.Type)
+		} else if sv.status != "ACTIVE" {
+			return 0, nil, conflict("Instance %s is not ready", sv.id)
+		}
+		return http.StatusOK, map[string]interface{}{
+			"console": map[string]string{
+				"type": opts.Type,
+				"url":  s.URL + "/vnc_auto.html?token=" + s.newID(),
+			},
+		}, nil
+	default:
+		return 0, nil, badRequest("There is no such action: %s", action)
+	}
+	return http.StatusAccepted, nil, nil
+}
+
+func (s *Server) metadataRequest(r *http.Request, sv *server, parts []string) (int, interface{}, *apiError) {
+	switch {
+	case len(parts) == 0 && r.Method == "GET":
+		return http.StatusOK, map[string]interface{}{"metadata": sv.metadata}, nil
+	case len(parts) == 0 && (r.Method == "POST" || r.Method == "PUT"):
+		var request struct {
+			Metadata map[string]string `json:"metadata"`
+		}
+		if err := decode(r, &request); err != nil {
+			return 0, nil, err
+		}
+		if r.Method == "PUT" {
+			sv.metadata = make(map[string]string)
+		}
+		for key, value := range request.Metadata {
+			if len(key) > 255 || len(value) > 255 {
+				return 0, nil, badRequest("Metadata item was not found or exceeds 255 characters")
+			}
+			sv.metadata[key] = value
+		}
+		return http.StatusOK, map[string]interface{}{"metadata": sv.metadata}, nil
+	case len(parts) == 1 && r.Method == "DELETE":
+		if _, ok := sv.metadata[parts[0]]; !ok {
+			return 0, nil, notFound("Metadata item", parts[0])
+		}
+		delete(sv.metadata, parts[0])
+		return http.StatusNoContent, nil, nil
+	}
+	return 0, nil, newError(http.StatusNotFound, "The resource could not be found.")
+}
+
+func (s *Server) volumeAttachmentRequest(r *http.Request, sv *server, parts []string) (int, interface{}, *apiError) {
+	attachment := func(vol *volume) map[string]string {
+		return map[string]string{
+			"id":       vol.id,
+			"volumeId": vol.id,
+			"serverId": sv.id,
+			"device":   "/dev/vdb",
+		}
+	}
+	switch {
+	case len(parts) == 0 && r.Method == "GET":
+		list := []interface{}{}
+		for _, vol := range s.volumes {
+			if vol.serverID == sv.id {
+				list = append(list, attachment(vol))
+			}
+		}
+		return http.StatusOK, map[string]interface{}{"volumeAttachments": list}, nil
+	case len(parts) == 0 && r.Method == "POST":
+		var request struct {
+			VolumeAttachment struct {
+				VolumeID string `json:"volumeId"`
+			} `json:"volumeAttachment"`
+		}
+		if err := decode(r, &request); err != nil {
+			return 0, nil, err
+		}
+		vol := s.volumes[request.VolumeAttachment.VolumeID]
+		if vol == nil {
+			return 0, nil, notFound("Volume", request.VolumeAttachment.VolumeID)
+		} else if vol.status != "available" {
+			return 0, nil, badRequest("Invalid volume: volume %s status must be available", vol.id)
+		}
+		vol.serverID = sv.id
+		vol.status = "in-use"
+		return http.StatusOK, map[string]interface{}{"volumeAttachment": attachment(vol)}, nil
+	case len(parts) == 1 && r.Method == "DELETE":
+		vol := s.volumes[parts[0]]
+		if vol == nil || vol.serverID != sv.id {
+			return 0, nil, notFound("Volume attachment", parts[0])
+		}
+		vol.serverID = ""
+		vol.status = "available"
+		return http.StatusAccepted, nil, nil
+	}
+	return 0, nil, newError(http.StatusNotFound, "The resource could not be found.")
+}
+
+func (s *Server) allocateFloatingIP(r *http.Request) (int, interface{}, *apiError) {
+	var request struct {
+		Pool string `json:"pool"`
+	}
+	if err := decode(r, &request); err != nil {
+		return 0, nil, err
+	} else if request.Pool != FLOATING_IP_POOL {
+		return 0, nil, notFound("Floating IP pool", request.Pool)
+	}
+	floatingIP := &floatingIP{
+		ID:   s.newID(),
+		IP:   fmt.Sprintf("203.0.113.%d", s.nextID%250+2),
+		Pool: request.Pool,
+	}
+	s.floatingIPs = append(s.floatingIPs, floatingIP)
+	return http.StatusOK, map[string]interface{}{"floating_ip": floatingIP}, nil
+}
+
+func (s *Server) floatingIPRequest(method string, id string) (int, interface{}, *apiError) {
+	for i, floatingIP := range s.floatingIPs {
+		if floatingIP.ID != id {
+			continue
+		}
+		switch method {
+		case "GET":
+			return http.StatusOK, map[string]interface{}{"floating_ip": floatingIP}, nil
+		case "DELETE":
+			s.floatingIPs = append(s.floatingIPs[:i], s.floatingIPs[i+1:]...)
+			return http.StatusAccepted, nil, nil
+		}
+		return 0, nil, newError(http.StatusMethodNotAllowed, "Method %s is not allowed", method)
+	}
+	return 0, nil, notFound("Floating IP", id)
+}
+
+// Glance
+
+func (s *Server) handleImage(r *http.Request, parts []string) (int, interface{}, *apiError) {
+	switch {
+	case len(parts) == 2 && parts[0] == "v2" && parts[1] == "images" && r.Method == "GET":
+		return s.listImages(r)
+	case len(parts) == 3 && parts[0] == "v2" && parts[1] == "images" && r.Method == "GET":
+		image := s.findImage(parts[2])
+		if image == nil {
+			return 0, nil, notFound("Image", parts[2])
+		}
+		if image.Status != "active" {
+			if image.pendingPolls > 0 {
+				image.pendingPolls--
+			} else {
+				image.Status = "active"
+			}
+		}
+		return http.StatusOK, image, nil
+	case len(parts) == 2 && parts[0] == "v1" && parts[1] == "images" && r.Method == "POST":
+		return s.registerImage(r)
+	case len(parts) == 3 && parts[0] == "v1" && parts[1] == "images" && r.Method == "DELETE":
+		for i, image := range s.images {
+			if image.ID == parts[2] {
+				s.images = append(s.images[:i], s.images[i+1:]...)
+				return http.StatusNoContent, nil, nil
+			}
+		}
+		return 0, nil, notFound("Image", parts[2])
+	}
+	return 0, nil, newError(http.StatusNotFound, "The resource could not be found.")
+}
+
+// Lists images ordered by ID, in pages of at most PageSize images that
+// continue after the marker.
+func (s *Server) listImages(r *http.Request) (int, interface{}, *apiError) {
+	limit := s.PageSize
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return 0, nil, badRequest("limit param must be a positive integer")
+		} else if n < limit {
+			limit = n
+		}
+	}
+	marker := r.URL.Query().Get("marker")
+	if marker != "" && s.findImage(marker) == nil {
+		return 0, nil, badRequest("marker %s could not be found", marker)
+	}
+
+	images := append([]*Image(nil), s.images...)
+	sort.Slice(images, func(i, j int) bool { return images[i].ID < images[j].ID })
+	page := []*Image{}
+	for _, image := range images {
+		if image.ID > marker && len(page) < limit {
+			page = append(page, image)
+		}
+	}
+	response := map[string]interface{}{"images": page}
+	if len(page) == limit && page[len(page)-1].ID != images[len(images)-1].ID {
+		response["next"] = fmt.Sprintf("/v2/images?limit=%d&marker=%s", limit, page[len(page)-1].ID)
+	}
+	return http.StatusOK, response, nil
+}
+
+// Registers an image through Glance v1, which takes the image metadata from
+// the headers and copies the data from x-glance-api-copy-from.
+func (s *Server) registerImage(r *http.Request) (int, interface{}, *apiError) {
+	image := &Image{
+		ID:              s.newID(),
+		Name:            r.Header.Get("x-image-meta-name"),
+		Status:          "queued",
+		Visibility:      "private",
+		DiskFormat:      r.Header.Get("x-image-meta-disk_format"),
+		ContainerFormat: r.Header.Get("x-image-meta-container_format"),
+		CreatedAt:       timestamp(),
+		OSDistro:        r.Header.Get("x-image-meta-property-os_distro"),
+		OSVersion:       r.Header.Get("x-image-meta-property-os_version"),
+		Architecture:    r.Header.Get("x-image-meta-property-architecture"),
+		pendingPolls:    s.PendingPolls,
+	}
+	if image.DiskFormat == "" || image.ContainerFormat == "" {
+		return 0, nil, badRequest("Disk format and container format are required")
+	} else if r.Header.Get("x-glance-api-copy-from") == "" && r.Header.Get("x-image-meta-location") == "" {
+		return 0, nil, badRequest("Image data must be given by x-glance-api-copy-from or x-image-meta-location")
+	}
+	if r.Header.Get("x-image-meta-is_public") == "true" {
+		image.Visibility = "public"
+	}
+	s.images = append(s.images, image)
+	return http.StatusCreated, map[string]interface{}{
+		"image": map[string]interface{}{
+			"id":               image.ID,
+			"name":             image.Name,
+			"status":           image.Status,
+			"disk_format":      image.DiskFormat,
+			"container_format": image.ContainerFormat,
+			"is_public":        image.Visibility == "public",
+		},
+	}, nil
+}
+
+// Cinder
+
+func (s *Server) volumeView(vol *volume) map[string]interface{} {
+	attachments := []map[string]string{}
+	if vol.serverID != "" {
+		attachments = append(attachments, map[string]string{
+			"id":        vol.id,
+			"volume_id": vol.id,
+			"server_id": vol.serverID,
+			"device":    "/dev/vdb",
+		})
+	}
+	return map[string]interface{}{
+		"id":                  vol.id,
+		"display_name":        vol.name,
+		"display_description": "",
+		"size":                vol.size,
+		"availability_zone":   vol.zone,
+		"status":              vol.status,
+		"attachments":         attachments,
+		"created_at":          vol.created,
+		"bootable":            "false",
+		"metadata":            map[string]string{},
+	}
+}
+
+func (s *Server) handleVolume(r *http.Request, parts []string) (int, interface{}, *apiError) {
+	switch {
+	case len(parts) == 1 && parts[0] == "volumes" && r.Method == "GET":
+		var ids []string
+		for id := range s.volumes {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		list := []interface{}{}
+		for _, id := range ids {
+			list = append(list, s.volumeView(s.volumes[id]))
+		}
+		return http.StatusOK, map[string]interface{}{"volumes": list}, nil
+	case len(parts) == 1 && parts[0] == "volumes" && r.Method == "POST":
+		return s.createVolume(r)
+	case len(parts) >= 2 && parts[0] == "volumes":
+		vol := s.volumes[parts[1]]
+		if vol == nil {
+			return 0, nil, notFound("Volume", parts[1])
+		}
+		return s.volumeRequest(r, vol, parts[2:])
+	}
+	return 0, nil, newError(http.StatusNotFound, "The resource could not be found.")
+}
+
+func (s *Server) createVolume(r *http.Request) (int, interface{}, *apiError) {
+	var request struct {
+		Volume struct {
+			Name             string `json:"display_name"`
+			Size             int    `json:"size"`
+			AvailabilityZone string `json:"availability_zone"`
+		} `json:"volume"`
+	}
+	if err := decode(r, &request); err != nil {
+		return 0, nil, err
+	}
+	opts := request.Volume
+	if opts.Size <= 0 {
+		return 0, nil, badRequest("Invalid input received: size must be a positive integer")
+	} else if opts.AvailabilityZone != "" && opts.AvailabilityZone != AVAILABILITY_ZONE {
+		return 0, nil, badRequest("Invalid input received: availability zone %s is invalid", opts.AvailabilityZone)
+	}
+	vol := &volume{
+		id:           s.newID(),
+		name:         opts.Name,
+		size:         opts.Size,
+		zone:         AVAILABILITY_ZONE,
+		status:       "creating",
+		created:      timestamp(),
+		pendingPolls: s.PendingPolls,
+	}
+	s.volumes[vol.id] = vol
+	return http.StatusOK, map[string]interface{}{"volume": s.volumeView(vol)}, nil
+}
+
+func (s *Server) volumeRequest(r *http.Request, vol *volume, parts []string) (int, interface{}, *apiError) {
+	switch {
+	case len(parts) == 0 && r.Method == "GET":
+		if vol.status == "creating" || vol.status == "extending" {
+			if vol.pendingPolls > 0 {
+				vol.pendingPolls--
+			} else {
+				vol.status = "available"
+			}
+		}
+		return http.StatusOK, map[string]interface{}{"volume": s.volumeView(vol)}, nil
+	case len(parts) == 0 && r.Method == "DELETE":
+		if vol.status != "available" && vol.status != "error" {
+			return 0, nil, badRequest("Invalid volume: volume status must be available or error, but current status is: %s", vol.status)
+		}
+		delete(s.volumes, vol.id)
+		return http.StatusAccepted, nil, nil
+	case len(parts) == 1 && parts[0] == "action" && r.Method == "POST":
+		var request struct {
+			Extend *struct {
+				NewSize int `json:"new_size"`
+			} `json:"os-extend"`
+		}
+		if err := decode(r, &request); err != nil {
+			return 0, nil, err
+		} else if request.Extend == nil {
+			return 0, nil, badRequest("There is no such action")
+		} else if vol.status != "available" {
+			return 0, nil, badRequest("Invalid volume: volume status must be available to extend")
+		} else if request.Extend.NewSize <= vol.size {
+			return 0, nil, badRequest("Invalid input received: new size must be greater than %d", vol.size)
+		}
+		vol.size = request.Extend.NewSize
+		vol.status = "extending"
+		vol.pendingPolls = s.PendingPolls
+		return http.StatusAccepted, nil, nil
+	}
+	return 0, nil, newError(http.StatusNotFound, "The resource could not be found.")
+}
+
+// Neutron
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+// Adds a security group with the egress rules that Neutron creates by default.
+func (s *Server) addSecurityGroup(name string, description string) *securityGroup {
+	group := &securityGroup{
+		ID:          s.newID(),
+		Name:        name,
+		Description: description,
+		TenantID:    s.ProjectID,
+	}
+	for _, etherType := range []string{"IPv4", "IPv6"} {
+		group.Rules = append(group.Rules, &securityGroupRule{
+			ID:         s.newID(),
+			Direction:  "egress",
+			EtherType:  etherType,
+			SecGroupID: group.ID,
+			TenantID:   s.ProjectID,
+		})
+	}
+	s.securityGroups[group.ID] = group
+	return group
+}
+
+func (s *Server) findRule(id string) (*securityGroup, int) {
+	for _, group := range s.securityGroups {
+		for i, rule := range group.Rules {
+			if rule.ID == id {
+				return group, i
+			}
+		}
+	}
+	return nil, -1
+}
+
+func (s *Server) handleNetwork(r *http.Request, parts []string) (int, interface{}, *apiError) {
+	switch {
+	case len(parts) == 1 && parts[0] == "security-groups" && r.Method == "GET":
+		var ids []string
+		for id := range s.securityGroups {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		list := []*securityGroup{}
+		for _, id := range ids {
+			list = append(list, s.securityGroups[id])
+		}
+		return http.StatusOK, map[string]interface{}{"security_groups": list}, nil
+	case len(parts) == 1 && parts[0] == "security-groups" && r.Method == "POST":
+		var request struct {
+			SecurityGroup struct {
+				Name        string `json:"name"`
+				Description string `json:"description"`
+			} `json:"security_group"`
+		}
+		if err := decode(r, &request); err != nil {
+			return 0, nil, err
+		} else if request.SecurityGroup.Name == "default" {
+			return 0, nil, conflict("Default security group already exists.")
+		}
+		group := s.addSecurityGroup(request.SecurityGroup.Name, request.SecurityGroup.Description)
+		return http.StatusCreated, map[string]interface{}{"security_group": group}, nil
+	case len(parts) == 2 && parts[0] == "security-groups":
+		group := s.securityGroups[parts[1]]
+		if group == nil {
+			return 0, nil, notFound("Security group", parts[1])
+		}
+		switch r.Method {
+		case "GET":
+			return http.StatusOK, map[string]interface{}{"security_group": group}, nil
+		case "DELETE":
+			for _, sv := range s.servers {
+				for _, name := range sv.securityGroups {
+					if name == group.Name || name == group.ID {
+						return 0, nil, conflict("Security Group %s in use.", group.ID)
+					}
+				}
+			}
+			delete(s.securityGroups, group.ID)
+			return http.StatusNoContent, nil, nil
+		}
+	case len(parts) == 1 && parts[0] == "security-group-rules" && r.Method == "POST":
+		return s.createRule(r)
+	case len(parts) == 2 && parts[0] == "security-group-rules":
+		group, i := s.findRule(parts[1])
+		if group == nil {
+			return 0, nil, notFound("Security group rule", parts[1])
+		}
+		switch r.Method {
+		case "GET":
+			return http.StatusOK, map[string]interface{}{"security_group_rule": group.Rules[i]}, nil
+		case "DELETE":
+			group.Rules = append(group.Rules[:i], group.Rules[i+1:]...)
+			return http.StatusNoContent, nil, nil
+		}
+	}
+	return 0, nil, newError(http.StatusNotFound, "The resource could not be found.")
+}
+
+func (s *Server) createRule(r *http.Request) (int, interface{}, *apiError) {
+	var request struct {
+		Rule struct {
+			Direction      string `json:"direction"`
+			EtherType      string `json:"ethertype"`
+			SecGroupID     string `json:"security_group_id"`
+			Protocol       string `json:"protocol"`
+			PortRangeMin   int    `json:"port_range_min"`
+			PortRangeMax   int    `json:"port_range_max"`
+			RemoteIPPrefix string `json:"remote_ip_prefix"`
+		} `json:"security_group_rule"`
+	}
+	if err := decode(r, &request); err != nil {
+		return 0, nil, err
+	}
+	opts := request.Rule
+	group := s.securityGroups[opts.SecGroupID]
+	if group == nil {
+		return 0, nil, notFound("Security group", opts.SecGroupID)
+	} else if opts.Direction != "ingress" && opts.Direction != "egress" {
+		return 0, nil, badRequest("Invalid input for direction")
+	} else if opts.EtherType != "IPv4" && opts.EtherType != "IPv6" {
+		return 0, nil, badRequest("Invalid input for ethertype")
+	} else if opts.PortRangeMin > opts.PortRangeMax {
+		return 0, nil, conflict("For TCP/UDP protocols, port_range_min must be <= port_range_max")
+	} else if opts.PortRangeMin != 0 && opts.Protocol == "" {
+		return 0, nil, badRequest("Must also specify protocol if port range is given.")
+	}
+
+	rule := &securityGroupRule{
+		ID:         s.newID(),
+		Direction:  opts.Direction,
+		EtherType:  opts.EtherType,
+		SecGroupID: group.ID,
+		TenantID:   s.ProjectID,
+	}
+	if opts.Protocol != "" {
+		rule.Protocol = stringPtr(opts.Protocol)
+	}
+	if opts.PortRangeMin != 0 || opts.PortRangeMax != 0 {
+		rule.PortRangeMin = &opts.PortRangeMin
+		rule.PortRangeMax = &opts.PortRangeMax
+	}
+	if opts.RemoteIPPrefix != "" {
+		rule.RemoteIPPrefix = stringPtr(opts.RemoteIPPrefix)
+	}
+	for _, existing := range group.Rules {
+		if ruleKey(existing) == ruleKey(rule) {
+			return 0, nil, conflict("Security group rule already exists. Rule id is %s.", existing.ID)
+		}
+	}
+	group.Rules = append(group.Rules, rule)
+	return http.StatusCreated, map[string]interface{}{"security_group_rule": rule}, nil
+}
+
+// Identifies what a rule matches, to detect duplicate rules.
+func ruleKey(rule *securityGroupRule) string {
+	deref := func(s *string) string {
+		if s == nil {
+			return ""
+		}
+		return *s
+	}
+	portMin, portMax := 0, 0
+	if rule.PortRangeMin != nil {
+		portMin, portMax = *rule.PortRangeMin, *rule.PortRangeMax
+	}
+	return fmt.Sprintf("%s/%s/%s/%d-%d/%s", rule.Direction, rule.EtherType, deref(rule.Protocol), portMin, portMax, deref(rule.RemoteIPPrefix))
+}
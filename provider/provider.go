@@ -1,8 +1,10 @@
 package provider
 
 import "github.com/LunaNode/cloug/provider/cloudstack"
+import "github.com/LunaNode/cloug/provider/common"
 import "github.com/LunaNode/cloug/provider/digitalocean"
 import "github.com/LunaNode/cloug/provider/ec2"
+import "github.com/LunaNode/cloug/provider/fake"
 import "github.com/LunaNode/cloug/provider/googlecompute"
 import "github.com/LunaNode/cloug/provider/linode"
 import "github.com/LunaNode/cloug/provider/lobster"
@@ -16,7 +18,7 @@ import "github.com/LunaNode/cloug/service/compute"
 import "encoding/json"
 import "fmt"
 
-type ProviderJSONFunc func(jsonData []byte) (compute.Provider, error)
+type ProviderJSONFunc func(jsonData []byte, options ...common.Option) (compute.Provider, error)
 
 var providerJSONFuncs map[string]ProviderJSONFunc = map[string]ProviderJSONFunc{
 	"openstack":     openstack.OpenStackFromJSON,
@@ -30,13 +32,15 @@ var providerJSONFuncs map[string]ProviderJSONFunc = map[string]ProviderJSONFunc{
 	"digitalocean":  digitalocean.DigitalOceanFromJSON,
 	"linode":        linode.LinodeFromJSON,
 	"vultr":         vultr.VultrFromJSON,
+	"fake":          fake.FakeFromJSON,
 }
 
 type ComputeConfig struct {
 	Provider string `json:"provider"`
 }
 
-func ComputeProviderFromJSON(jsonData []byte) (compute.Provider, error) {
+// Options are passed to the provider, e.g. to inject an HTTP client in tests.
+func ComputeProviderFromJSON(jsonData []byte, options ...common.Option) (compute.Provider, error) {
 	var cfg ComputeConfig
 	err := json.Unmarshal(jsonData, &cfg)
 	if err != nil {
@@ -44,5 +48,5 @@ func ComputeProviderFromJSON(jsonData []byte) (compute.Provider, error) {
 	} else if providerJSONFuncs[cfg.Provider] == nil {
 		return nil, fmt.Errorf("invalid provider type %s", cfg.Provider)
 	}
-	return providerJSONFuncs[cfg.Provider](jsonData)
+	return providerJSONFuncs[cfg.Provider](jsonData, options...)
 }
@@ -1,6 +1,10 @@
 package api
 
+import "github.com/LunaNode/cloug/provider/common"
+import "github.com/LunaNode/cloug/service/compute"
+
 import "bytes"
+import "context"
 import "encoding/json"
 import "errors"
 import "fmt"
@@ -9,7 +13,16 @@ import "io/ioutil"
 import "net/url"
 import "net/http"
 import "strconv"
+import "strings"
 import "sync"
+import "time"
+
+const DEFAULT_TASK_POLL_INTERVAL = time.Second
+const DEFAULT_TASK_TIMEOUT = 30 * time.Minute
+
+// Number of lines from the end of the task log that are included in the
+// error for a failed task.
+const TASK_LOG_LINES = 20
 
 type API struct {
 	BaseURL  string
@@ -17,6 +30,27 @@ type API struct {
 	Password string
 	Client   *http.Client
 
+	// Interval between task status requests in WaitForTask.
+	// Defaults to DEFAULT_TASK_POLL_INTERVAL.
+	TaskPollInterval time.Duration
+
+	// Total time that WaitForTask waits for a task; negative to wait until the
+	// context is done. Defaults to DEFAULT_TASK_TIMEOUT.
+	TaskTimeout time.Duration
+
+	ctx  context.Context
+	auth *authState
+}
+
+// Response of list requests that also report the total number of items, like
+// the task log. Data is decoded from the data key.
+type pagedResponse struct {
+	Data  interface{}
+	Total int
+}
+
+// Authentication parameters, shared between copies of an API.
+type authState struct {
 	ticket              string
 	csrfPreventionToken string
 	mu                  sync.Mutex
@@ -28,9 +62,25 @@ func NewAPI(baseURL string, username string, password string) *API {
 		Username: username,
 		Password: password,
 		Client:   &http.Client{},
+		auth:     new(authState),
 	}
 }
 
+// Returns a copy of the API that sends requests with the given context.
+// The copy shares the authentication ticket with the original.
+func (api *API) WithContext(ctx context.Context) *API {
+	contextAPI := *api
+	contextAPI.ctx = ctx
+	return &contextAPI
+}
+
+func (api *API) context() context.Context {
+	if api.ctx == nil {
+		return context.Background()
+	}
+	return api.ctx
+}
+
 func (api *API) request(method string, path string, params map[string]string, response interface{}, setAuthParams bool) error {
 	var body io.Reader
 	if params != nil {
@@ -41,6 +91,10 @@ func (api *API) request(method string, path string, params map[string]string, re
 		body = bytes.NewBufferString(values.Encode())
 	}
 	httpRequest, err := http.NewRequest(method, api.BaseURL+path, body)
+	if err != nil {
+		return fmt.Errorf("http request error: %v", err)
+	}
+	httpRequest = httpRequest.WithContext(api.context())
 	httpRequest.Header.Set("Accept", "application/json")
 
 	if setAuthParams {
@@ -77,6 +131,13 @@ func (api *API) request(method string, path string, params map[string]string, re
 	}
 
 	if r.StatusCode >= 200 && r.StatusCode < 300 {
+		if page, ok := response.(*pagedResponse); ok {
+			if total, ok := jsonMap["total"].(json.Number); ok {
+				totalInt, _ := total.Int64()
+				page.Total = int(totalInt)
+			}
+			response = page.Data
+		}
 		if response != nil {
 			err = json.Unmarshal(dataBytes, response)
 			if err != nil {
@@ -84,30 +145,39 @@ func (api *API) request(method string, path string, params map[string]string, re
 			}
 		}
 	} else {
-		if jsonMap["data"] == nil {
-			return errors.New("API error")
-		} else {
-			return errors.New(string(dataBytes))
+		// Proxmox puts the error message in the HTTP status line, and
+		// parameter errors in the errors field
+		message := r.Status
+		if jsonMap["errors"] != nil {
+			errorsBytes, _ := json.Marshal(jsonMap["errors"])
+			message += ": " + string(errorsBytes)
+		} else if jsonMap["data"] != nil {
+			message += ": " + string(dataBytes)
+		}
+		kind := common.HTTPStatusKind(r.StatusCode)
+		if kind == nil {
+			kind = common.MessageKind(message)
 		}
+		return compute.WrapError(kind, errors.New(message))
 	}
 
 	return nil
 }
 
 func (api *API) getAuthParams() (string, string, error) {
-	api.mu.Lock()
-	defer api.mu.Unlock()
-	if api.ticket == "" || api.csrfPreventionToken == "" {
+	api.auth.mu.Lock()
+	defer api.auth.mu.Unlock()
+	if api.auth.ticket == "" || api.auth.csrfPreventionToken == "" {
 		err := api.authenticate()
 		if err != nil {
 			return "", "", err
 		}
 	}
-	return api.ticket, api.csrfPreventionToken, nil
+	return api.auth.ticket, api.auth.csrfPreventionToken, nil
 }
 
 // Gets the authentication parameters for Proxmox API.
-// Assumes caller has the api.mu lock.
+// Assumes caller has the api.auth.mu lock.
 func (api *API) authenticate() error {
 	var response AuthenticateResponse
 	err := api.request("POST", "/access/ticket", map[string]string{
@@ -118,8 +188,8 @@ func (api *API) authenticate() error {
 		return err
 	}
 
-	api.ticket = response.Ticket
-	api.csrfPreventionToken = response.CSRFPreventionToken
+	api.auth.ticket = response.Ticket
+	api.auth.csrfPreventionToken = response.CSRFPreventionToken
 	return nil
 }
 
@@ -131,6 +201,10 @@ func (api *API) post(path string, params map[string]string, response interface{}
 	return api.request("POST", path, params, response, true)
 }
 
+func (api *API) put(path string, params map[string]string, response interface{}) error {
+	return api.request("PUT", path, params, response, true)
+}
+
 func (api *API) del(path string, params map[string]string, response interface{}) error {
 	return api.request("DELETE", path, params, response, true)
 }
@@ -155,7 +229,22 @@ func (api *API) ListVMsOnNode(node string) ([]VM, error) {
 	}
 }
 
-func (api *API) CreateVM(options *CreateVMOptions) error {
+// Returns the lowest VMID that is free in the whole cluster.
+func (api *API) NextID() (int, error) {
+	var id json.Number
+	err := api.get("/cluster/nextid", &id)
+	if err != nil {
+		return 0, err
+	}
+	vmid, err := id.Int64()
+	if err != nil {
+		return 0, fmt.Errorf("invalid VMID %s: %v", id, err)
+	}
+	return int(vmid), nil
+}
+
+// Creates the VM, and returns the UPID of the create task.
+func (api *API) CreateVM(options *CreateVMOptions) (string, error) {
 	params := map[string]string{
 		"vmid":   strconv.Itoa(options.ID),
 		"name":   options.Name,
@@ -165,6 +254,9 @@ func (api *API) CreateVM(options *CreateVMOptions) error {
 		"ide0":   fmt.Sprintf("volume=%s:%d", options.Storage, options.DiskSize),
 		"cdrom":  fmt.Sprintf("%s,media=cdrom", options.ISO),
 	}
+	if options.Start {
+		params["start"] = "1"
+	}
 
 	// network settings
 	networkDriver := string(options.NetworkDriver)
@@ -177,11 +269,17 @@ func (api *API) CreateVM(options *CreateVMOptions) error {
 		params["net0"] = networkDriver
 	}
 
-	return api.post(fmt.Sprintf("/nodes/%s/qemu", options.Node), params, nil)
+	var upid string
+	err := api.post(fmt.Sprintf("/nodes/%s/qemu", options.Node), params, &upid)
+	return upid, err
 }
 
-func (api *API) DeleteVM(node string, id int) error {
-	return api.del(fmt.Sprintf("nodes/%s/qemu/%d", node, id), nil, nil)
+// The VM operations below run as tasks, and return the UPID of the task.
+
+func (api *API) DeleteVM(node string, id int) (string, error) {
+	var upid string
+	err := api.del(fmt.Sprintf("/nodes/%s/qemu/%d", node, id), nil, &upid)
+	return upid, err
 }
 
 func (api *API) GetVMStatus(node string, id int) (*VM, error) {
@@ -194,18 +292,311 @@ func (api *API) GetVMStatus(node string, id int) (*VM, error) {
 	}
 }
 
-func (api *API) StartVM(node string, id int) error {
-	return api.post(fmt.Sprintf("/nodes/%s/qemu/%d/status/start", node, id), nil, nil)
+func (api *API) StartVM(node string, id int) (string, error) {
+	var upid string
+	err := api.post(fmt.Sprintf("/nodes/%s/qemu/%d/status/start", node, id), nil, &upid)
+	return upid, err
+}
+
+func (api *API) StopVM(node string, id int) (string, error) {
+	var upid string
+	err := api.post(fmt.Sprintf("/nodes/%s/qemu/%d/status/stop", node, id), nil, &upid)
+	return upid, err
+}
+
+func (api *API) ResetVM(node string, id int) (string, error) {
+	var upid string
+	err := api.post(fmt.Sprintf("/nodes/%s/qemu/%d/status/reset", node, id), nil, &upid)
+	return upid, err
+}
+
+func (api *API) ListContainersOnNode(node string) ([]VM, error) {
+	var containers []VM
+	err := api.get(fmt.Sprintf("/nodes/%s/lxc", node), &containers)
+	if err != nil {
+		return nil, err
+	} else {
+		return containers, nil
+	}
+}
+
+// Creates the LXC container, and returns the UPID of the create task.
+func (api *API) CreateContainer(options *CreateContainerOptions) (string, error) {
+	params := map[string]string{
+		"vmid":       strconv.Itoa(options.ID),
+		"ostemplate": options.Template,
+		"cores":      strconv.Itoa(options.Cores),
+		"memory":     strconv.Itoa(options.Memory),
+		"rootfs":     fmt.Sprintf("%s:%d", options.Storage, options.DiskSize),
+		"net0":       fmt.Sprintf("name=eth0,bridge=%s,ip=dhcp,ip6=auto", options.NetworkBridge),
+	}
+	if options.Hostname != "" {
+		params["hostname"] = options.Hostname
+	}
+	if options.Password != "" {
+		params["password"] = options.Password
+	}
+	if options.SSHPublicKeys != "" {
+		params["ssh-public-keys"] = options.SSHPublicKeys
+	}
+	if options.Unprivileged {
+		params["unprivileged"] = "1"
+	}
+	if options.Start {
+		params["start"] = "1"
+	}
+
+	var upid string
+	err := api.post(fmt.Sprintf("/nodes/%s/lxc", options.Node), params, &upid)
+	return upid, err
+}
+
+func (api *API) DeleteContainer(node string, id int) (string, error) {
+	var upid string
+	err := api.del(fmt.Sprintf("/nodes/%s/lxc/%d", node, id), nil, &upid)
+	return upid, err
+}
+
+func (api *API) GetContainerStatus(node string, id int) (*VM, error) {
+	var container VM
+	err := api.get(fmt.Sprintf("/nodes/%s/lxc/%d/status/current", node, id), &container)
+	if err != nil {
+		return nil, err
+	} else {
+		return &container, nil
+	}
+}
+
+func (api *API) StartContainer(node string, id int) (string, error) {
+	var upid string
+	err := api.post(fmt.Sprintf("/nodes/%s/lxc/%d/status/start", node, id), nil, &upid)
+	return upid, err
+}
+
+func (api *API) StopContainer(node string, id int) (string, error) {
+	var upid string
+	err := api.post(fmt.Sprintf("/nodes/%s/lxc/%d/status/stop", node, id), nil, &upid)
+	return upid, err
+}
+
+// Containers have no reset, so this reboots the container from inside.
+func (api *API) RebootContainer(node string, id int) (string, error) {
+	var upid string
+	err := api.post(fmt.Sprintf("/nodes/%s/lxc/%d/status/reboot", node, id), nil, &upid)
+	return upid, err
+}
+
+// Starts a VNC proxy for the VM that accepts connections over the
+// vncwebsocket endpoint.
+func (api *API) VNCProxy(node string, id int) (*VNCProxy, error) {
+	var proxy VNCProxy
+	err := api.post(fmt.Sprintf("/nodes/%s/qemu/%d/vncproxy", node, id), map[string]string{
+		"websocket": "1",
+	}, &proxy)
+	if err != nil {
+		return nil, err
+	} else {
+		return &proxy, nil
+	}
+}
+
+// Returns the websocket URL for a VNC proxy, which must be opened with the
+// PVEAuthCookie of the user who started the proxy.
+func (api *API) VNCWebsocketURL(node string, id int, proxy *VNCProxy) string {
+	baseURL := api.BaseURL
+	if strings.HasPrefix(baseURL, "https://") {
+		baseURL = "wss://" + strings.TrimPrefix(baseURL, "https://")
+	} else if strings.HasPrefix(baseURL, "http://") {
+		baseURL = "ws://" + strings.TrimPrefix(baseURL, "http://")
+	}
+	query := url.Values{}
+	query.Set("port", proxy.Port.String())
+	query.Set("vncticket", proxy.Ticket)
+	return fmt.Sprintf("%s/nodes/%s/qemu/%d/vncwebsocket?%s", baseURL, node, id, query.Encode())
+}
+
+func (api *API) GetVMConfig(node string, id int) (map[string]interface{}, error) {
+	config := make(map[string]interface{})
+	err := api.get(fmt.Sprintf("/nodes/%s/qemu/%d/config", node, id), &config)
+	if err != nil {
+		return nil, err
+	} else {
+		return config, nil
+	}
+}
+
+// Updates the VM configuration synchronously.
+func (api *API) SetVMConfig(node string, id int, params map[string]string) error {
+	return api.put(fmt.Sprintf("/nodes/%s/qemu/%d/config", node, id), params, nil)
+}
+
+// Grows a disk of the VM to the given size in GB.
+func (api *API) ResizeVMDisk(node string, id int, disk string, sizeGB int) error {
+	return api.put(fmt.Sprintf("/nodes/%s/qemu/%d/resize", node, id), map[string]string{
+		"disk": disk,
+		"size": fmt.Sprintf("%dG", sizeGB),
+	}, nil)
+}
+
+// Clones the VM or template, and returns the UPID of the clone task.
+func (api *API) CloneVM(node string, id int, options *CloneVMOptions) (string, error) {
+	params := map[string]string{
+		"newid": strconv.Itoa(options.NewID),
+	}
+	if options.Name != "" {
+		params["name"] = options.Name
+	}
+	if options.Target != "" {
+		params["target"] = options.Target
+	}
+	if options.Full {
+		params["full"] = "1"
+		if options.Storage != "" {
+			params["storage"] = options.Storage
+		}
+	}
+	var upid string
+	err := api.post(fmt.Sprintf("/nodes/%s/qemu/%d/clone", node, id), params, &upid)
+	return upid, err
+}
+
+// Converts the VM to a template.
+func (api *API) ConvertToTemplate(node string, id int) error {
+	return api.post(fmt.Sprintf("/nodes/%s/qemu/%d/template", node, id), nil, nil)
 }
 
-func (api *API) StopVM(node string, id int) error {
-	return api.post(fmt.Sprintf("/nodes/%s/qemu/%d/status/stop", node, id), nil, nil)
+func (api *API) ListStorage(node string) ([]Storage, error) {
+	var storage []Storage
+	err := api.get(fmt.Sprintf("/nodes/%s/storage", node), &storage)
+	if err != nil {
+		return nil, err
+	} else {
+		return storage, nil
+	}
 }
 
-func (api *API) ResetVM(node string, id int) error {
-	return api.post(fmt.Sprintf("/nodes/%s/qemu/%d/status/reset", node, id), nil, nil)
+func (api *API) ListStorageContent(node string, storage string) ([]StorageContent, error) {
+	var content []StorageContent
+	err := api.get(fmt.Sprintf("/nodes/%s/storage/%s/content", node, storage), &content)
+	if err != nil {
+		return nil, err
+	} else {
+		return content, nil
+	}
 }
 
-func (api *API) VNCProxy(node string, id int) error {
-	return api.post(fmt.Sprintf("/nodes/%s/qemu/%d/vncproxy", node, id), nil, nil)
+// Deletes a volume, given by volume ID like "local:iso/ubuntu.iso".
+func (api *API) DeleteStorageContent(node string, volid string) error {
+	storage := strings.SplitN(volid, ":", 2)[0]
+	return api.del(fmt.Sprintf("/nodes/%s/storage/%s/content/%s", node, storage, url.PathEscape(volid)), nil, nil)
+}
+
+// Downloads a file into storage, and returns the UPID of the download task.
+// Content is "iso" or "vztmpl".
+func (api *API) DownloadURL(node string, storage string, content string, filename string, sourceURL string) (string, error) {
+	var upid string
+	err := api.post(fmt.Sprintf("/nodes/%s/storage/%s/download-url", node, storage), map[string]string{
+		"content":  content,
+		"filename": filename,
+		"url":      sourceURL,
+	}, &upid)
+	return upid, err
+}
+
+// Returns the node that runs the task, which is the second field of the UPID.
+func TaskNode(upid string) string {
+	parts := strings.Split(upid, ":")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+func (api *API) GetTaskStatus(upid string) (*TaskStatus, error) {
+	var status TaskStatus
+	err := api.get(fmt.Sprintf("/nodes/%s/tasks/%s/status", TaskNode(upid), url.PathEscape(upid)), &status)
+	if err != nil {
+		return nil, err
+	} else {
+		return &status, nil
+	}
+}
+
+// Returns up to limit lines of the task log, skipping the first start lines,
+// and the total number of lines in the log.
+func (api *API) GetTaskLog(upid string, start int, limit int) ([]string, int, error) {
+	var entries []TaskLogEntry
+	page := &pagedResponse{Data: &entries}
+	err := api.get(fmt.Sprintf("/nodes/%s/tasks/%s/log?start=%d&limit=%d", TaskNode(upid), url.PathEscape(upid), start, limit), page)
+	if err != nil {
+		return nil, 0, err
+	}
+	lines := make([]string, len(entries))
+	for i, entry := range entries {
+		lines[i] = entry.Text
+	}
+	return lines, page.Total, nil
+}
+
+// Returns the last count lines of the task log.
+func (api *API) taskLogTail(upid string, count int) ([]string, error) {
+	lines, total, err := api.GetTaskLog(upid, 0, count)
+	if err != nil || total <= len(lines) {
+		return lines, err
+	}
+	lines, _, err = api.GetTaskLog(upid, total-count, count)
+	return lines, err
+}
+
+// Returns true if the exit status is of a task that succeeded. Tasks that
+// succeed with warnings exit with "WARNINGS: n".
+func taskSucceeded(exitStatus string) bool {
+	return exitStatus == "OK" || strings.HasPrefix(exitStatus, "WARNINGS:")
+}
+
+// Polls the task until it stops, and returns an error if it failed. The error
+// for a failed task includes the end of the task log. If the task timeout
+// expires or the context is done, the returned error wraps the context error.
+func (api *API) WaitForTask(upid string) error {
+	interval := api.TaskPollInterval
+	if interval <= 0 {
+		interval = DEFAULT_TASK_POLL_INTERVAL
+	}
+	ctx := api.context()
+	timeout := api.TaskTimeout
+	if timeout == 0 {
+		timeout = DEFAULT_TASK_TIMEOUT
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	contextAPI := api.WithContext(ctx)
+
+	for {
+		status, err := contextAPI.GetTaskStatus(upid)
+		if ctx.Err() != nil {
+			return fmt.Errorf("error waiting for task %s: %w", upid, ctx.Err())
+		} else if err != nil {
+			return fmt.Errorf("error getting status of task %s: %w", upid, err)
+		} else if status.Status == "stopped" {
+			if taskSucceeded(status.ExitStatus) {
+				return nil
+			}
+			message := fmt.Sprintf("task %s failed: %s", upid, status.ExitStatus)
+			if lines, err := contextAPI.taskLogTail(upid, TASK_LOG_LINES); err == nil && len(lines) > 0 {
+				message += "\n" + strings.Join(lines, "\n")
+			}
+			return compute.WrapError(common.MessageKind(status.ExitStatus), errors.New(message))
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("error waiting for task %s: %w", upid, ctx.Err())
+		}
+	}
 }
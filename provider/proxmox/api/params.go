@@ -1,5 +1,7 @@
 package api
 
+import "encoding/json"
+
 type AuthenticateResponse struct {
 	CSRFPreventionToken string `json:"CSRFPreventionToken"`
 	Ticket              string `json:"ticket"`
@@ -16,12 +18,16 @@ type Node struct {
 	MaxDisk int64 `json:"maxdisk"`
 }
 
+// QEMU virtual machine or LXC container.
 type VM struct {
 	ID     int    `json:"vmid"`
 	Name   string `json:"name"`
 	Status string `json:"status"`
 	CPUs   int    `json:"cpus"`
 
+	// 1 if the VM is a template
+	Template int `json:"template"`
+
 	Memory    int64 `json:"mem"`
 	MaxMemory int64 `json:"maxmem"`
 
@@ -57,8 +63,111 @@ type CreateVMOptions struct {
 
 	// Network driver, defaults to e1000
 	NetworkDriver NetworkDriver
+
+	// Start the VM after it is created
+	Start bool
 }
 
+type CreateContainerOptions struct {
+	ID       int
+	Node     string
+	Hostname string
+
+	// Container template volume, like "local:vztmpl/debian-12-standard_12.7-1_amd64.tar.zst"
+	Template string
+
+	Cores int
+
+	// Amount of RAM in MB
+	Memory int
+
+	// Storage for the root filesystem
+	Storage string
+
+	// Root filesystem size in GB
+	DiskSize int
+
+	// Network bridge name, like "vmbr0"
+	NetworkBridge string
+
+	// Root password and SSH public keys, one per line
+	Password      string
+	SSHPublicKeys string
+
+	Unprivileged bool
+	Start        bool
+}
+
+type CloneVMOptions struct {
+	NewID int
+	Name  string
+
+	// Node to create the clone on, if different from the source node
+	Target string
+
+	// Create a full copy instead of a linked clone
+	Full bool
+
+	// Storage for a full clone, defaults to the storage of the source
+	Storage string
+}
+
+type Storage struct {
+	Storage string `json:"storage"`
+	Type    string `json:"type"`
+
+	// Comma-separated content types, like "images,iso,vztmpl"
+	Content string `json:"content"`
+
+	Active int   `json:"active"`
+	Shared int   `json:"shared"`
+	Avail  int64 `json:"avail"`
+	Total  int64 `json:"total"`
+}
+
+type StorageContent struct {
+	// Volume ID, like "local:iso/ubuntu.iso"
+	VolID string `json:"volid"`
+
+	// Content type, like "iso", "vztmpl" or "images"
+	Content string `json:"content"`
+
+	Format string `json:"format"`
+	Size   int64  `json:"size"`
+	CTime  int64  `json:"ctime"`
+}
+
+type VNCProxy struct {
+	Port   json.Number `json:"port"`
+	Ticket string      `json:"ticket"`
+	User   string      `json:"user"`
+	UPID   string      `json:"upid"`
+}
+
+type TaskStatus struct {
+	UPID   string `json:"upid"`
+	Node   string `json:"node"`
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Status string `json:"status"`
+
+	// "OK" or "WARNINGS: n" if the task succeeded, or else an error message
+	ExitStatus string `json:"exitstatus"`
+}
+
+type TaskLogEntry struct {
+	// Line number, starting from 1
+	N    int    `json:"n"`
+	Text string `json:"t"`
+}
+
+type GuestType string
+
+const (
+	QEMU GuestType = "qemu"
+	LXC            = "lxc"
+)
+
 type OSType string
 
 const (
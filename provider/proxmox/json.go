@@ -1,5 +1,7 @@
 package proxmox
 
+import "github.com/LunaNode/cloug/provider/common"
+import "github.com/LunaNode/cloug/provider/proxmox/api"
 import "github.com/LunaNode/cloug/service/compute"
 
 import "crypto/tls"
@@ -11,26 +13,34 @@ type ProxmoxJSONConfig struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 	Insecure bool   `json:"insecure"`
+
+	// Kind of guest to create by default, "qemu" or "lxc".
+	Type string `json:"type"`
+
+	// Overrides URL if set.
+	APIURL string `json:"api_url"`
 }
 
-func ProxmoxFromJSON(jsonData []byte) (compute.Provider, error) {
+func ProxmoxFromJSON(jsonData []byte, options ...common.Option) (compute.Provider, error) {
 	var cfg ProxmoxJSONConfig
 	err := json.Unmarshal(jsonData, &cfg)
 	if err != nil {
 		return nil, err
 	}
-	proxmox, err := MakeProxmox(cfg.URL, cfg.Username, cfg.Password), nil
-	if err != nil {
-		return nil, err
+
+	if guestType := api.GuestType(cfg.Type); guestType != "" && guestType != api.QEMU && guestType != api.LXC {
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "invalid type %s, expected qemu or lxc", cfg.Type)
 	}
 
+	// an injected client or transport takes precedence over insecure
+	configOptions := []common.Option{common.WithAPIURL(cfg.APIURL)}
 	if cfg.Insecure {
-		proxmox.Client.Client = &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			},
-		}
+		configOptions = append(configOptions, common.WithTransport(&http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}))
 	}
 
-	return proxmox, nil
+	pm := MakeProxmox(cfg.URL, cfg.Username, cfg.Password, append(configOptions, options...)...)
+	pm.DefaultType = api.GuestType(cfg.Type)
+	return pm, nil
 }
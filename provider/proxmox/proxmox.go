@@ -1,24 +1,38 @@
 package proxmox
 
+import "github.com/LunaNode/cloug/provider/common"
 import "github.com/LunaNode/cloug/provider/proxmox/api"
 import "github.com/LunaNode/cloug/service/compute"
+import "github.com/LunaNode/cloug/utils"
 
+import "context"
 import "errors"
 import "fmt"
-import "math/rand"
+import "net/url"
+import "path"
+import "regexp"
 import "strconv"
 import "strings"
 
 const DEFAULT_DISK = 32
 const DEFAULT_MEMORY = 512
+const DEFAULT_STORAGE = "local"
+const DEFAULT_BRIDGE = "vmbr0"
 
 type Proxmox struct {
 	Client *api.API
+
+	// Kind of guest that CreateInstance creates when neither the type detail
+	// nor the image decides it, api.QEMU or api.LXC. Defaults to api.QEMU.
+	DefaultType api.GuestType
 }
 
-func MakeProxmox(baseURL string, username string, password string) *Proxmox {
+// The API URL option takes precedence over baseURL.
+func MakeProxmox(baseURL string, username string, password string, options ...common.Option) *Proxmox {
+	opts := common.MakeHTTPOptions(append([]common.Option{common.WithAPIURL(baseURL)}, options...)...)
 	pm := new(Proxmox)
-	pm.Client = api.NewAPI(baseURL, username, password)
+	pm.Client = api.NewAPI(opts.APIURL, username, password)
+	pm.Client.Client = opts.HTTPClient(pm.Client.Client)
 	return pm
 }
 
@@ -26,6 +40,22 @@ func (pm *Proxmox) ComputeService() compute.Service {
 	return pm
 }
 
+func (pm *Proxmox) Capabilities() *compute.Capabilities {
+	return &compute.Capabilities{
+		Operations:     compute.ImplementedOperations(pm),
+		ImageSources:   []compute.ImageSource{compute.ImageSourceInstance, compute.ImageSourceURL},
+		InstanceFields: []compute.InstanceField{compute.FieldName, compute.FieldPassword, compute.FieldPublicKey, compute.FieldDiskGB},
+	}
+}
+
+// Returns a copy of the service whose API calls use the given context.
+func (pm *Proxmox) withContext(ctx context.Context) *Proxmox {
+	return &Proxmox{
+		Client:      pm.Client.WithContext(ctx),
+		DefaultType: pm.DefaultType,
+	}
+}
+
 func (pm *Proxmox) mapInstanceStatus(status string) compute.InstanceStatus {
 	if status == "running" {
 		return compute.StatusOnline
@@ -36,53 +66,60 @@ func (pm *Proxmox) mapInstanceStatus(status string) compute.InstanceStatus {
 	}
 }
 
-func (pm *Proxmox) vmToInstance(vm *api.VM, node string) *compute.Instance {
+func (pm *Proxmox) vmToInstance(vm *api.VM, node string, guestType api.GuestType) *compute.Instance {
 	return &compute.Instance{
-		ID:     fmt.Sprintf("%s/%d", node, vm.ID),
-		Name:   vm.Name,
-		Status: pm.mapInstanceStatus(vm.Status),
+		ID:      guestID(node, guestType, vm.ID),
+		Name:    vm.Name,
+		Status:  pm.mapInstanceStatus(vm.Status),
+		Details: map[string]string{"type": string(guestType)},
 	}
 }
 
-func (pm *Proxmox) splitInstanceID(id string) (string, int, error) {
-	// id is like "node/vmid"
+// VMs have IDs like "node/vmid", and containers like "node/lxc/vmid".
+func guestID(node string, guestType api.GuestType, vmid int) string {
+	if guestType == api.LXC {
+		return fmt.Sprintf("%s/lxc/%d", node, vmid)
+	} else {
+		return fmt.Sprintf("%s/%d", node, vmid)
+	}
+}
+
+// Splits an instance ID into the node, guest type and VMID. IDs that are not
+// in that form cannot refer to an instance, so they are reported as not found.
+func (pm *Proxmox) splitInstanceID(id string) (string, api.GuestType, int, error) {
 	parts := strings.Split(id, "/")
-	if len(parts) != 2 {
-		return "", 0, fmt.Errorf("invalid id: %s", id)
+	guestType := api.QEMU
+	if len(parts) == 3 && parts[1] == api.LXC {
+		guestType = api.LXC
+		parts = []string{parts[0], parts[2]}
+	} else if len(parts) != 2 {
+		return "", "", 0, compute.Errorf(compute.ErrNotFound, "instance %s not found: invalid id", id)
 	}
 	vmid, err := strconv.Atoi(parts[1])
 	if err != nil {
-		return "", 0, fmt.Errorf("invalid vmid: %s", parts[1])
+		return "", "", 0, compute.Errorf(compute.ErrNotFound, "instance %s not found: invalid vmid %s", id, parts[1])
 	}
-	return parts[0], vmid, nil
+	return parts[0], guestType, vmid, nil
 }
 
-func (pm *Proxmox) CreateInstance(instance *compute.Instance) (*compute.Instance, error) {
-	if instance.Image.ID == "" {
-		return nil, errors.New("image ID must be specified")
-	}
-
-	targetDisk := instance.Flavor.DiskGB
-	if targetDisk == 0 {
-		targetDisk = DEFAULT_DISK
-	}
-	targetMemory := instance.Flavor.MemoryMB
-	if targetMemory == 0 {
-		targetMemory = DEFAULT_MEMORY
-	}
+// Returns true if the volume ID is a container template, like
+// "local:vztmpl/debian-12-standard_12.7-1_amd64.tar.zst".
+func isContainerTemplate(volid string) bool {
+	return strings.Contains(volid, ":vztmpl/")
+}
 
-	// find a node to provision on
-	// currently we just pick the one with sufficient disk space that has most free memory
+// Returns the node with sufficient disk space that has the most free memory.
+func (pm *Proxmox) selectNode(diskGB int) (string, error) {
 	nodes, err := pm.Client.ListNodes()
 	if err != nil {
-		return nil, fmt.Errorf("error listing nodes: %v", err)
+		return "", fmt.Errorf("error listing nodes: %v", err)
 	}
 
 	var bestNode string
 	var bestMemory int64
 
 	for _, node := range nodes {
-		if node.MaxDisk-node.Disk < int64(targetDisk)*1024*1024*1024 {
+		if node.MaxDisk-node.Disk < int64(diskGB)*1024*1024*1024 {
 			continue
 		}
 		freeMemory := node.MaxMemory - node.Memory
@@ -93,74 +130,352 @@ func (pm *Proxmox) CreateInstance(instance *compute.Instance) (*compute.Instance
 	}
 
 	if bestNode == "" {
-		return nil, fmt.Errorf("no node found with sufficient resources")
+		return "", fmt.Errorf("no node found with sufficient resources")
 	}
+	return bestNode, nil
+}
 
-	// find free ID to use on this node
-	var freeID int
+// Returns a function that runs the VM task and waits for it to finish.
+func (pm *Proxmox) waitTask(f func(node string, vmid int) (string, error)) func(node string, vmid int) error {
+	return func(node string, vmid int) error {
+		upid, err := f(node, vmid)
+		if err != nil {
+			return err
+		}
+		return pm.Client.WaitForTask(upid)
+	}
+}
 
-	vms, err := pm.Client.ListVMsOnNode(bestNode)
-	if err != nil {
-		return nil, fmt.Errorf("error listing vms on %s: %v", bestNode, err)
+// Creates a container from a container template, or a VM, either by cloning a
+// template if the image ID is a template ID like "pve1/9000", or else booting
+// from an ISO volume. The type detail, or else DefaultType, selects the kind
+// of guest when finding the image by name. The node detail selects
+// the node, storage the storage for the disks (for ISO installs, default
+// local; for clones, default the template storage), and bridge the network
+// bridge. Clones are full copies unless linked_clone is "true". VMIDs are
+// allocated by the cluster, and JobID is the UPID of the create or clone task.
+// Password and PublicKey cannot be set for ISO installs.
+func (pm *Proxmox) CreateInstance(instance *compute.Instance) (*compute.Instance, error) {
+	guestType := api.GuestType(instance.Detail("type", string(pm.DefaultType)))
+	image := instance.Image
+	if guestType != "" && image.Details["type"] == "" {
+		image.Details = map[string]string{"type": string(guestType)}
+		for k, v := range instance.Image.Details {
+			image.Details[k] = v
+		}
 	}
-	ids := make(map[int]bool)
-	for _, vm := range vms {
-		ids[vm.ID] = true
+	imageID, err := common.GetMatchingImageID(pm, &image)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, i := range rand.Perm(899) {
-		id := i + 100
-		if !ids[id] {
-			freeID = id
-			break
+	if isContainerTemplate(imageID) {
+		if guestType == api.QEMU {
+			return nil, compute.Errorf(compute.ErrInvalidArgument, "image %s is a container template", imageID)
 		}
+		return pm.createContainer(instance, imageID)
+	} else if guestType == api.LXC {
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "image %s is not a container template", imageID)
+	}
+	if templateNode, templateType, templateID, err := pm.splitInstanceID(imageID); err == nil && templateType == api.QEMU {
+		return pm.cloneInstance(instance, templateNode, templateID)
 	}
 
-	if freeID == 0 {
-		return nil, fmt.Errorf("did not find any free ID on node %s", bestNode)
+	// ISO installs have no cloud-init, so credentials cannot be applied
+	if instance.Password != "" || len(instance.PublicKey.Key) > 0 {
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "password and public key are only supported for templates, not ISO image %s", imageID)
+	}
+
+	targetDisk := instance.Flavor.DiskGB
+	if targetDisk == 0 {
+		targetDisk = DEFAULT_DISK
+	}
+	targetMemory := instance.Flavor.MemoryMB
+	if targetMemory == 0 {
+		targetMemory = DEFAULT_MEMORY
+	}
+
+	node := instance.Detail("node", "")
+	if node == "" {
+		node, err = pm.selectNode(targetDisk)
+		if err != nil {
+			return nil, err
+		}
+	}
+	vmid, err := pm.Client.NextID()
+	if err != nil {
+		return nil, fmt.Errorf("error allocating VMID: %w", err)
 	}
 
 	// create the VM
 	opts := api.CreateVMOptions{
-		ID:       freeID,
-		Node:     bestNode,
-		Name:     instance.Name,
-		Cores:    instance.Flavor.NumCores,
-		Memory:   targetMemory,
-		OSType:   api.Linux26,
-		ISO:      instance.Image.ID,
-		Storage:  "local",
-		DiskSize: targetDisk,
+		ID:            vmid,
+		Node:          node,
+		Name:          instance.Name,
+		Cores:         instance.Flavor.NumCores,
+		Memory:        targetMemory,
+		OSType:        api.Linux26,
+		ISO:           imageID,
+		Storage:       instance.Detail("storage", DEFAULT_STORAGE),
+		DiskSize:      targetDisk,
+		NetworkBridge: instance.Detail("bridge", ""),
+		Start:         true,
+	}
+
+	if opts.Cores == 0 {
+		opts.Cores = 1
+	}
+
+	upid, err := pm.Client.CreateVM(&opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create VM on node %s: %v", node, err)
+	} else if err := pm.Client.WaitForTask(upid); err != nil {
+		return nil, fmt.Errorf("failed to create VM on node %s: %w", node, err)
+	}
+
+	return &compute.Instance{
+		ID:    fmt.Sprintf("%s/%d", node, vmid),
+		Name:  instance.Name,
+		JobID: upid,
+	}, nil
+}
+
+// Creates an unprivileged container from the template volume. The node,
+// storage and bridge details work like for VMs.
+func (pm *Proxmox) createContainer(instance *compute.Instance, templateID string) (*compute.Instance, error) {
+	targetDisk := instance.Flavor.DiskGB
+	if targetDisk == 0 {
+		targetDisk = DEFAULT_DISK
+	}
+	targetMemory := instance.Flavor.MemoryMB
+	if targetMemory == 0 {
+		targetMemory = DEFAULT_MEMORY
+	}
+
+	var err error
+	node := instance.Detail("node", "")
+	if node == "" {
+		node, err = pm.selectNode(targetDisk)
+		if err != nil {
+			return nil, err
+		}
+	}
+	vmid, err := pm.Client.NextID()
+	if err != nil {
+		return nil, fmt.Errorf("error allocating VMID: %w", err)
 	}
 
+	password := instance.Password
+	if password == "" {
+		password = utils.Uid(16)
+	}
+	opts := api.CreateContainerOptions{
+		ID:            vmid,
+		Node:          node,
+		Hostname:      instance.Name,
+		Template:      templateID,
+		Cores:         instance.Flavor.NumCores,
+		Memory:        targetMemory,
+		Storage:       instance.Detail("storage", DEFAULT_STORAGE),
+		DiskSize:      targetDisk,
+		NetworkBridge: instance.Detail("bridge", DEFAULT_BRIDGE),
+		Password:      password,
+		SSHPublicKeys: strings.TrimSpace(string(instance.PublicKey.Key)),
+		Unprivileged:  true,
+		Start:         true,
+	}
 	if opts.Cores == 0 {
 		opts.Cores = 1
 	}
 
-	err = pm.Client.CreateVM(&opts)
+	upid, err := pm.Client.CreateContainer(&opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create VM on node %s: %v", bestNode, err)
+		return nil, fmt.Errorf("failed to create container on node %s: %v", node, err)
+	} else if err := pm.Client.WaitForTask(upid); err != nil {
+		return nil, fmt.Errorf("failed to create container on node %s: %w", node, err)
 	}
 
 	return &compute.Instance{
-		ID:   fmt.Sprintf("%s/%d", bestNode, freeID),
-		Name: instance.Name,
+		ID:       guestID(node, api.LXC, vmid),
+		Name:     instance.Name,
+		Username: "root",
+		Password: password,
+		JobID:    upid,
 	}, nil
 }
 
-func (pm *Proxmox) instanceAction(instanceID string, f func(node string, vmid int) error) error {
-	node, vmid, err := pm.splitInstanceID(instanceID)
+// Clones a template and configures the clone through cloud-init, adding a
+// cloud-init drive if the template lacks one.
+func (pm *Proxmox) cloneInstance(instance *compute.Instance, templateNode string, templateID int) (*compute.Instance, error) {
+	node := instance.Detail("node", templateNode)
+	vmid, err := pm.Client.NextID()
+	if err != nil {
+		return nil, fmt.Errorf("error allocating VMID: %w", err)
+	}
+
+	cloneOpts := api.CloneVMOptions{
+		NewID:   vmid,
+		Name:    instance.Name,
+		Full:    instance.Detail("linked_clone", "") != "true",
+		Storage: instance.Detail("storage", ""),
+	}
+	if node != templateNode {
+		cloneOpts.Target = node
+	}
+	upid, err := pm.Client.CloneVM(templateNode, templateID, &cloneOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to clone template %s/%d: %w", templateNode, templateID, err)
+	} else if err := pm.Client.WaitForTask(upid); err != nil {
+		return nil, fmt.Errorf("failed to clone template %s/%d: %w", templateNode, templateID, err)
+	}
+
+	password := instance.Password
+	if password == "" {
+		password = utils.Uid(16)
+	}
+	err = pm.configureClone(node, vmid, instance, password)
+	if err != nil {
+		// the clone is not usable, so remove it
+		pm.waitTask(pm.Client.DeleteVM)(node, vmid)
+		return nil, err
+	}
+
+	return &compute.Instance{
+		ID:       fmt.Sprintf("%s/%d", node, vmid),
+		Name:     instance.Name,
+		Username: instance.Username,
+		Password: password,
+		JobID:    upid,
+	}, nil
+}
+
+func (pm *Proxmox) configureClone(node string, vmid int, instance *compute.Instance, password string) error {
+	config, err := pm.Client.GetVMConfig(node, vmid)
+	if err != nil {
+		return fmt.Errorf("error getting configuration of VM %d: %w", vmid, err)
+	}
+
+	params := map[string]string{
+		"cipassword": password,
+		"ipconfig0":  "ip=dhcp",
+	}
+	if instance.Username != "" {
+		params["ciuser"] = instance.Username
+	}
+	if len(instance.PublicKey.Key) > 0 {
+		// Proxmox expects the keys percent-encoded
+		params["sshkeys"] = strings.Replace(url.QueryEscape(strings.TrimSpace(string(instance.PublicKey.Key))), "+", "%20", -1)
+	}
+	if instance.Flavor.NumCores > 0 {
+		params["cores"] = strconv.Itoa(instance.Flavor.NumCores)
+	}
+	if instance.Flavor.MemoryMB > 0 {
+		params["memory"] = strconv.Itoa(instance.Flavor.MemoryMB)
+	}
+	if bridge := instance.Detail("bridge", ""); bridge != "" {
+		params["net0"] = "virtio,bridge=" + bridge
+	}
+
+	hasCloudInit := false
+	for _, value := range config {
+		if str, ok := value.(string); ok && strings.Contains(str, "cloudinit") {
+			hasCloudInit = true
+		}
+	}
+	if !hasCloudInit {
+		params["ide2"] = instance.Detail("storage", DEFAULT_STORAGE) + ":cloudinit"
+	}
+
+	err = pm.Client.SetVMConfig(node, vmid, params)
+	if err != nil {
+		return fmt.Errorf("error configuring VM %d: %w", vmid, err)
+	}
+
+	// Proxmox can only grow disks
+	if disk, sizeGB := bootDisk(config); disk != "" && instance.Flavor.DiskGB > sizeGB {
+		err = pm.Client.ResizeVMDisk(node, vmid, disk, instance.Flavor.DiskGB)
+		if err != nil {
+			return fmt.Errorf("error resizing disk of VM %d: %w", vmid, err)
+		}
+	}
+
+	err = pm.waitTask(pm.Client.StartVM)(node, vmid)
+	if err != nil {
+		return fmt.Errorf("error starting VM %d: %w", vmid, err)
+	}
+	return nil
+}
+
+var diskSizeRegexp = regexp.MustCompile(`(?:^|,)size=(\d+)([KMGT]?)`)
+
+// Returns the name and size in GB of the first disk of the VM configuration.
+// Sizes without a unit are in bytes, as in Proxmox.
+func bootDisk(config map[string]interface{}) (string, int) {
+	for _, disk := range []string{"scsi0", "virtio0", "sata0", "ide0"} {
+		value, ok := config[disk].(string)
+		if !ok {
+			continue
+		}
+		matches := diskSizeRegexp.FindStringSubmatch(value)
+		if matches == nil {
+			return disk, 0
+		}
+		size, _ := strconv.Atoi(matches[1])
+		switch matches[2] {
+		case "":
+			size /= 1024 * 1024 * 1024
+		case "K":
+			size /= 1024 * 1024
+		case "M":
+			size /= 1024
+		case "T":
+			size *= 1024
+		}
+		return disk, size
+	}
+	return "", 0
+}
+
+// Runs vmFunc for a VM, or containerFunc for a container. If containerFunc
+// is nil, the operation is not supported for containers.
+func (pm *Proxmox) instanceAction(instanceID string, vmFunc func(node string, vmid int) error, containerFunc func(node string, vmid int) error) error {
+	node, guestType, vmid, err := pm.splitInstanceID(instanceID)
 	if err != nil {
 		return err
+	} else if guestType != api.LXC {
+		return vmFunc(node, vmid)
+	} else if containerFunc == nil {
+		return compute.Errorf(compute.ErrNotSupported, "operation is not supported for containers")
 	} else {
-		return f(node, vmid)
+		return containerFunc(node, vmid)
+	}
+}
+
+// Returns a function that stops the guest if it is running, since Proxmox
+// refuses to destroy a running guest, and then destroys it.
+func (pm *Proxmox) stopAndDelete(getStatus func(node string, vmid int) (*api.VM, error), stop func(node string, vmid int) (string, error), del func(node string, vmid int) (string, error)) func(node string, vmid int) error {
+	return func(node string, vmid int) error {
+		vm, err := getStatus(node, vmid)
+		if err != nil {
+			return err
+		} else if vm.Status == "running" {
+			if err := pm.waitTask(stop)(node, vmid); err != nil {
+				return err
+			}
+		}
+		return pm.waitTask(del)(node, vmid)
 	}
 }
 
 func (pm *Proxmox) DeleteInstance(instanceID string) error {
-	return pm.instanceAction(instanceID, pm.Client.DeleteVM)
+	return pm.instanceAction(
+		instanceID,
+		pm.stopAndDelete(pm.Client.GetVMStatus, pm.Client.StopVM, pm.Client.DeleteVM),
+		pm.stopAndDelete(pm.Client.GetContainerStatus, pm.Client.StopContainer, pm.Client.DeleteContainer),
+	)
 }
 
+// Lists VMs and containers, with the type detail set to qemu or lxc.
 func (pm *Proxmox) ListInstances() ([]*compute.Instance, error) {
 	nodes, err := pm.Client.ListNodes()
 	if err != nil {
@@ -175,7 +490,21 @@ func (pm *Proxmox) ListInstances() ([]*compute.Instance, error) {
 			return nil, fmt.Errorf("failed to list VMs on node %s: %v", node.Node, err)
 		}
 		for _, vm := range vms {
-			instances = append(instances, pm.vmToInstance(&vm, node.Node))
+			if vm.Template == 1 {
+				continue
+			}
+			instances = append(instances, pm.vmToInstance(&vm, node.Node, api.QEMU))
+		}
+
+		containers, err := pm.Client.ListContainersOnNode(node.Node)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list containers on node %s: %v", node.Node, err)
+		}
+		for _, container := range containers {
+			if container.Template == 1 {
+				continue
+			}
+			instances = append(instances, pm.vmToInstance(&container, node.Node, api.LXC))
 		}
 	}
 
@@ -183,27 +512,322 @@ func (pm *Proxmox) ListInstances() ([]*compute.Instance, error) {
 }
 
 func (pm *Proxmox) GetInstance(instanceID string) (*compute.Instance, error) {
-	node, vmid, err := pm.splitInstanceID(instanceID)
+	node, guestType, vmid, err := pm.splitInstanceID(instanceID)
 	if err != nil {
 		return nil, err
 	}
 
-	vm, err := pm.Client.GetVMStatus(node, vmid)
+	var vm *api.VM
+	if guestType == api.LXC {
+		vm, err = pm.Client.GetContainerStatus(node, vmid)
+	} else {
+		vm, err = pm.Client.GetVMStatus(node, vmid)
+	}
 	if err != nil {
 		return nil, err
 	} else {
-		return pm.vmToInstance(vm, node), nil
+		return pm.vmToInstance(vm, node, guestType), nil
 	}
 }
 
 func (pm *Proxmox) StartInstance(instanceID string) error {
-	return pm.instanceAction(instanceID, pm.Client.StartVM)
+	return pm.instanceAction(instanceID, pm.waitTask(pm.Client.StartVM), pm.waitTask(pm.Client.StartContainer))
 }
 
 func (pm *Proxmox) StopInstance(instanceID string) error {
-	return pm.instanceAction(instanceID, pm.Client.StopVM)
+	return pm.instanceAction(instanceID, pm.waitTask(pm.Client.StopVM), pm.waitTask(pm.Client.StopContainer))
 }
 
 func (pm *Proxmox) RebootInstance(instanceID string) error {
-	return pm.instanceAction(instanceID, pm.Client.ResetVM)
+	return pm.instanceAction(instanceID, pm.waitTask(pm.Client.ResetVM), pm.waitTask(pm.Client.RebootContainer))
+}
+
+func (pm *Proxmox) CreateInstanceContext(ctx context.Context, instance *compute.Instance) (*compute.Instance, error) {
+	return pm.withContext(ctx).CreateInstance(instance)
+}
+
+func (pm *Proxmox) DeleteInstanceContext(ctx context.Context, instanceID string) error {
+	return pm.withContext(ctx).DeleteInstance(instanceID)
+}
+
+func (pm *Proxmox) ListInstancesContext(ctx context.Context) ([]*compute.Instance, error) {
+	return pm.withContext(ctx).ListInstances()
+}
+
+func (pm *Proxmox) GetInstanceContext(ctx context.Context, instanceID string) (*compute.Instance, error) {
+	return pm.withContext(ctx).GetInstance(instanceID)
+}
+
+func (pm *Proxmox) StartInstanceContext(ctx context.Context, instanceID string) error {
+	return pm.withContext(ctx).StartInstance(instanceID)
+}
+
+func (pm *Proxmox) StopInstanceContext(ctx context.Context, instanceID string) error {
+	return pm.withContext(ctx).StopInstance(instanceID)
+}
+
+func (pm *Proxmox) RebootInstanceContext(ctx context.Context, instanceID string) error {
+	return pm.withContext(ctx).RebootInstance(instanceID)
+}
+
+// Returns a websocket URL for the VM console, which must be opened with the
+// PVEAuthCookie of the API user, for example from noVNC.
+func (pm *Proxmox) GetVNC(instanceID string) (string, error) {
+	var vncURL string
+	err := pm.instanceAction(instanceID, func(node string, vmid int) error {
+		proxy, err := pm.Client.VNCProxy(node, vmid)
+		if err != nil {
+			return err
+		}
+		vncURL = pm.Client.VNCWebsocketURL(node, vmid, proxy)
+		return nil
+	}, nil)
+	return vncURL, err
+}
+
+func (pm *Proxmox) templateToImage(vm *api.VM, node string) *compute.Image {
+	return &compute.Image{
+		ID:      fmt.Sprintf("%s/%d", node, vm.ID),
+		Name:    vm.Name,
+		Regions: []string{node},
+		Type:    compute.TemplateImage,
+		Status:  compute.ImageAvailable,
+		Size:    vm.MaxDisk,
+		Details: map[string]string{"type": string(api.QEMU)},
+	}
+}
+
+func (pm *Proxmox) volumeToImage(content *api.StorageContent, storage *api.Storage, node string) *compute.Image {
+	image := &compute.Image{
+		ID:      content.VolID,
+		Name:    path.Base(content.VolID),
+		Regions: []string{node},
+		Type:    compute.ISOImage,
+		Format:  content.Format,
+		Status:  compute.ImageAvailable,
+		Size:    content.Size,
+		Details: map[string]string{"type": string(api.QEMU)},
+	}
+	if content.Content == "vztmpl" {
+		image.Type = compute.TemplateImage
+		image.Details["type"] = string(api.LXC)
+	}
+	if storage.Shared == 1 {
+		image.Details["shared"] = "true"
+	}
+	return image
+}
+
+// Returns true if the comma-separated content types include contentType.
+func hasContent(contentTypes string, contentType string) bool {
+	for _, x := range strings.Split(contentTypes, ",") {
+		if x == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// Lists VM templates, with IDs like "pve1/9000", and ISO and container
+// template volumes, with volume IDs like "local:iso/ubuntu.iso". The type
+// detail is qemu or lxc. A volume ID found on several nodes is listed once,
+// with each node in Regions.
+func (pm *Proxmox) ListImages() ([]*compute.Image, error) {
+	nodes, err := pm.Client.ListNodes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+
+	var images []*compute.Image
+	volumes := make(map[string]*compute.Image)
+	for _, node := range nodes {
+		vms, err := pm.Client.ListVMsOnNode(node.Node)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list VMs on node %s: %w", node.Node, err)
+		}
+		for _, vm := range vms {
+			if vm.Template == 1 {
+				images = append(images, pm.templateToImage(&vm, node.Node))
+			}
+		}
+
+		storages, err := pm.Client.ListStorage(node.Node)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list storage on node %s: %w", node.Node, err)
+		}
+		for _, storage := range storages {
+			if !hasContent(storage.Content, "iso") && !hasContent(storage.Content, "vztmpl") {
+				continue
+			}
+			contents, err := pm.Client.ListStorageContent(node.Node, storage.Storage)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list content of %s on node %s: %w", storage.Storage, node.Node, err)
+			}
+			for _, content := range contents {
+				if content.Content != "iso" && content.Content != "vztmpl" {
+					continue
+				} else if image := volumes[content.VolID]; image != nil {
+					image.Regions = append(image.Regions, node.Node)
+					continue
+				}
+				image := pm.volumeToImage(&content, &storage, node.Node)
+				volumes[content.VolID] = image
+				images = append(images, image)
+			}
+		}
+	}
+	return images, nil
+}
+
+// Finds a template or ISO by name, restricted to the kind of guest in the type
+// detail if it is set.
+func (pm *Proxmox) FindImage(image *compute.Image) (string, error) {
+	if image.Name == "" {
+		return "", nil
+	}
+	images, err := pm.ListImages()
+	if err != nil {
+		return "", err
+	}
+	for _, candidate := range images {
+		if candidate.Name != image.Name || (image.Type != "" && candidate.Type != image.Type) {
+			continue
+		} else if image.Details["type"] != "" && candidate.Details["type"] != image.Details["type"] {
+			continue
+		}
+		return candidate.ID, nil
+	}
+	return "", nil
+}
+
+func (pm *Proxmox) GetImage(imageID string) (*compute.Image, error) {
+	if node, guestType, vmid, err := pm.splitInstanceID(imageID); err == nil && guestType == api.QEMU {
+		vm, err := pm.Client.GetVMStatus(node, vmid)
+		if err != nil {
+			return nil, err
+		} else if vm.Template != 1 {
+			return nil, compute.Errorf(compute.ErrNotFound, "VM %d is not a template", vmid)
+		}
+		return pm.templateToImage(vm, node), nil
+	}
+
+	images, err := pm.ListImages()
+	if err != nil {
+		return nil, err
+	}
+	for _, image := range images {
+		if image.ID == imageID {
+			return image, nil
+		}
+	}
+	return nil, compute.Errorf(compute.ErrNotFound, "image %s not found", imageID)
+}
+
+// Deletes a VM template, or a volume from every node that has it.
+func (pm *Proxmox) DeleteImage(imageID string) error {
+	image, err := pm.GetImage(imageID)
+	if err != nil {
+		return err
+	} else if !strings.Contains(imageID, ":") {
+		return pm.instanceAction(imageID, pm.waitTask(pm.Client.DeleteVM), nil)
+	}
+
+	nodes := image.Regions
+	if image.Details["shared"] == "true" {
+		nodes = nodes[:1]
+	}
+	for _, node := range nodes {
+		if err := pm.Client.DeleteStorageContent(node, imageID); err != nil {
+			return fmt.Errorf("failed to delete %s on node %s: %w", imageID, node, err)
+		}
+	}
+	return nil
+}
+
+// Creates a template from a full clone of a VM, or downloads an ISO from a
+// URL, or a container template if the type detail is lxc. Downloads go to the
+// first node in Regions, or the first node in the cluster, and to the storage
+// given by the storage detail (default local).
+func (pm *Proxmox) CreateImage(imageTemplate *compute.Image) (*compute.Image, error) {
+	if imageTemplate.SourceInstance != "" {
+		node, guestType, vmid, err := pm.splitInstanceID(imageTemplate.SourceInstance)
+		if err != nil {
+			return nil, err
+		} else if guestType == api.LXC {
+			return nil, compute.Errorf(compute.ErrNotSupported, "creating templates from containers is not supported")
+		}
+		templateID, err := pm.Client.NextID()
+		if err != nil {
+			return nil, fmt.Errorf("error allocating VMID: %w", err)
+		}
+		upid, err := pm.Client.CloneVM(node, vmid, &api.CloneVMOptions{
+			NewID: templateID,
+			Name:  imageTemplate.Name,
+			Full:  true,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to clone VM %d: %w", vmid, err)
+		} else if err := pm.Client.WaitForTask(upid); err != nil {
+			return nil, fmt.Errorf("failed to clone VM %d: %w", vmid, err)
+		} else if err := pm.Client.ConvertToTemplate(node, templateID); err != nil {
+			// the clone would otherwise be left behind as an ordinary VM
+			pm.waitTask(pm.Client.DeleteVM)(node, templateID)
+			return nil, fmt.Errorf("failed to convert VM %d to template: %w", templateID, err)
+		}
+		return &compute.Image{
+			ID:             fmt.Sprintf("%s/%d", node, templateID),
+			Name:           imageTemplate.Name,
+			Regions:        []string{node},
+			Type:           compute.TemplateImage,
+			Status:         compute.ImageAvailable,
+			SourceInstance: imageTemplate.SourceInstance,
+			Details:        map[string]string{"type": string(api.QEMU)},
+		}, nil
+	} else if imageTemplate.SourceURL != "" {
+		var node string
+		if len(imageTemplate.Regions) > 0 {
+			node = imageTemplate.Regions[0]
+		} else {
+			nodes, err := pm.Client.ListNodes()
+			if err != nil {
+				return nil, fmt.Errorf("failed to list nodes: %w", err)
+			} else if len(nodes) == 0 {
+				return nil, errors.New("cluster has no nodes")
+			}
+			node = nodes[0].Node
+		}
+
+		filename := imageTemplate.Name
+		if filename == "" {
+			filename = path.Base(imageTemplate.SourceURL)
+		}
+		content, imageType, guestType := "iso", compute.ImageType(compute.ISOImage), api.QEMU
+		if imageTemplate.Details["type"] == api.LXC {
+			content, imageType, guestType = "vztmpl", compute.TemplateImage, api.LXC
+		} else if !strings.HasSuffix(filename, ".iso") {
+			filename += ".iso"
+		}
+		storage := DEFAULT_STORAGE
+		if imageTemplate.Details["storage"] != "" {
+			storage = imageTemplate.Details["storage"]
+		}
+
+		upid, err := pm.Client.DownloadURL(node, storage, content, filename, imageTemplate.SourceURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download %s: %w", imageTemplate.SourceURL, err)
+		} else if err := pm.Client.WaitForTask(upid); err != nil {
+			return nil, fmt.Errorf("failed to download %s: %w", imageTemplate.SourceURL, err)
+		}
+		return &compute.Image{
+			ID:        fmt.Sprintf("%s:%s/%s", storage, content, filename),
+			Name:      filename,
+			Regions:   []string{node},
+			Type:      imageType,
+			Status:    compute.ImageAvailable,
+			SourceURL: imageTemplate.SourceURL,
+			Details:   map[string]string{"type": string(guestType)},
+		}, nil
+	} else {
+		return nil, errors.New("neither source instance nor source URL is set")
+	}
 }
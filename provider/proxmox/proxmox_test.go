@@ -0,0 +1,193 @@
+package proxmox
+
+import "github.com/LunaNode/cloug/provider/proxmox/api"
+import "github.com/LunaNode/cloug/provider/proxmox/simulator"
+import "github.com/LunaNode/cloug/service/compute"
+import "github.com/LunaNode/cloug/service/compute/conformance"
+
+import "context"
+import "errors"
+import "fmt"
+import "path"
+import "strings"
+import "testing"
+import "time"
+
+func TestConformance(t *testing.T) {
+	server := simulator.NewServer("root@pam", "password")
+	defer server.Close()
+
+	pm := MakeProxmox(server.APIURL(), server.Username, server.Password)
+	pm.Client.TaskPollInterval = time.Millisecond
+	conformance.Run(t, pm, &conformance.Config{
+		Instance: compute.Instance{
+			Name:  "cloug-test",
+			Image: compute.Image{ID: simulator.ISO_VOLID},
+		},
+		Wait: compute.WaitOptions{Interval: 10 * time.Millisecond},
+	})
+}
+
+func TestClone(t *testing.T) {
+	server := simulator.NewServer("root@pam", "password")
+	defer server.Close()
+
+	pm := MakeProxmox(server.APIURL(), server.Username, server.Password)
+	pm.Client.TaskPollInterval = time.Millisecond
+	conformance.Run(t, pm, &conformance.Config{
+		Instance: compute.Instance{
+			Name:     "cloug-test",
+			Image:    compute.Image{Name: simulator.TEMPLATE_NAME},
+			Flavor:   compute.Flavor{NumCores: 2, MemoryMB: 2048, DiskGB: 20},
+			Username: "ubuntu",
+			Details:  map[string]string{"node": "pve2"},
+		},
+		Wait: compute.WaitOptions{Interval: 10 * time.Millisecond},
+	})
+
+	image, err := pm.CreateImage(&compute.Image{SourceURL: "https://example.com/debian-12.iso"})
+	if err != nil {
+		t.Fatalf("CreateImage from URL: %v", err)
+	} else if image.ID != "local:iso/debian-12.iso" {
+		t.Fatalf("expected local:iso/debian-12.iso, got %s", image.ID)
+	}
+	if imageID, err := pm.FindImage(&compute.Image{Name: "debian-12.iso"}); err != nil || imageID != image.ID {
+		t.Fatalf("FindImage returned %s, %v", imageID, err)
+	}
+	if err := pm.DeleteImage(image.ID); err != nil {
+		t.Fatalf("DeleteImage: %v", err)
+	}
+}
+
+func TestBadPassword(t *testing.T) {
+	server := simulator.NewServer("root@pam", "password")
+	defer server.Close()
+
+	pm := MakeProxmox(server.APIURL(), server.Username, "wrong password")
+	if _, err := pm.GetInstance("pve1/100"); !errors.Is(err, compute.ErrAuth) {
+		t.Fatalf("expected auth error, got %v", err)
+	}
+}
+
+func TestTaskFailure(t *testing.T) {
+	server := simulator.NewServer("root@pam", "password")
+	defer server.Close()
+
+	pm := MakeProxmox(server.APIURL(), server.Username, server.Password)
+	pm.Client.TaskPollInterval = time.Millisecond
+	instance, err := pm.CreateInstance(&compute.Instance{Image: compute.Image{ID: simulator.ISO_VOLID}})
+	if err != nil {
+		t.Fatalf("CreateInstance: %v", err)
+	} else if !strings.HasSuffix(instance.ID, "/100") || !strings.HasPrefix(instance.JobID, "UPID:") {
+		t.Fatalf("expected VMID 100 with a UPID, got %s and %s", instance.ID, instance.JobID)
+	}
+
+	if err := pm.StopInstance(instance.ID); err != nil {
+		t.Fatalf("StopInstance: %v", err)
+	}
+	server.TaskErrors["qmstart"] = "start failed: QEMU exited with code 1"
+	for i := 1; i <= 100; i++ {
+		server.TaskOutput["qmstart"] = append(server.TaskOutput["qmstart"], fmt.Sprintf("output %d", i))
+	}
+	err = pm.StartInstance(instance.ID)
+	if err == nil || !strings.Contains(err.Error(), "TASK ERROR: start failed") {
+		t.Fatalf("expected start failure with task log, got %v", err)
+	} else if !strings.Contains(err.Error(), "output 100") || strings.Contains(err.Error(), "output 82") {
+		t.Fatalf("expected the last %d lines of the task log, got %v", api.TASK_LOG_LINES, err)
+	}
+
+	server.PendingPolls = 1 << 30
+	pm.Client.TaskTimeout = 20 * time.Millisecond
+	if err := pm.StopInstance(instance.ID); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected task timeout, got %v", err)
+	}
+}
+
+func TestTaskWarnings(t *testing.T) {
+	server := simulator.NewServer("root@pam", "password")
+	defer server.Close()
+
+	pm := MakeProxmox(server.APIURL(), server.Username, server.Password)
+	pm.Client.TaskPollInterval = time.Millisecond
+	server.TaskWarnings["qmclone"] = 1
+	instance, err := pm.CreateInstance(&compute.Instance{Image: compute.Image{Name: simulator.TEMPLATE_NAME}})
+	if err != nil {
+		t.Fatalf("CreateInstance: %v", err)
+	} else if _, err := pm.GetInstance(instance.ID); err != nil {
+		t.Fatalf("expected clone to be kept, got %v", err)
+	}
+}
+
+func TestISOCredentials(t *testing.T) {
+	server := simulator.NewServer("root@pam", "password")
+	defer server.Close()
+
+	pm := MakeProxmox(server.APIURL(), server.Username, server.Password)
+	pm.Client.TaskPollInterval = time.Millisecond
+	_, err := pm.CreateInstance(&compute.Instance{
+		Image:    compute.Image{ID: simulator.ISO_VOLID},
+		Password: "secret",
+	})
+	if !errors.Is(err, compute.ErrInvalidArgument) {
+		t.Fatalf("expected invalid argument error for password on ISO install, got %v", err)
+	}
+}
+
+func TestContainer(t *testing.T) {
+	server := simulator.NewServer("root@pam", "password")
+	defer server.Close()
+
+	pm := MakeProxmox(server.APIURL(), server.Username, server.Password)
+	pm.Client.TaskPollInterval = time.Millisecond
+	pm.DefaultType = api.LXC
+	instance, err := pm.CreateInstance(&compute.Instance{
+		Name:  "edge1",
+		Image: compute.Image{Name: path.Base(simulator.CONTAINER_TEMPLATE_VOLID)},
+	})
+	if err != nil {
+		t.Fatalf("CreateInstance: %v", err)
+	} else if !strings.Contains(instance.ID, "/lxc/") {
+		t.Fatalf("expected container ID, got %s", instance.ID)
+	}
+
+	instances, err := pm.ListInstances()
+	if err != nil {
+		t.Fatalf("ListInstances: %v", err)
+	} else if len(instances) != 1 || instances[0].ID != instance.ID || instances[0].Details["type"] != "lxc" {
+		t.Fatalf("expected only the container with type lxc, got %v", instances)
+	}
+
+	for _, f := range []func(string) error{pm.StopInstance, pm.StartInstance, pm.RebootInstance} {
+		if err := f(instance.ID); err != nil {
+			t.Fatalf("power action: %v", err)
+		}
+	}
+	if instance, err := pm.GetInstance(instance.ID); err != nil || instance.Status != compute.StatusOnline {
+		t.Fatalf("expected online container, got %v, %v", instance, err)
+	}
+	if _, err := pm.GetVNC(instance.ID); !errors.Is(err, compute.ErrNotSupported) {
+		t.Fatalf("expected GetVNC to be unsupported for containers, got %v", err)
+	}
+	if err := pm.DeleteInstance(instance.ID); err != nil {
+		t.Fatalf("DeleteInstance: %v", err)
+	}
+}
+
+func TestBootDisk(t *testing.T) {
+	tests := []struct {
+		value  string
+		sizeGB int
+	}{
+		{"local-lvm:vm-100-disk-0,size=32G", 32},
+		{"local-lvm:vm-100-disk-0,size=2T", 2048},
+		{"local-lvm:vm-100-disk-0,size=10240M", 10},
+		{"local-lvm:vm-100-disk-0,size=34359738368", 32},
+		{"local-lvm:vm-100-disk-0", 0},
+	}
+	for _, test := range tests {
+		disk, sizeGB := bootDisk(map[string]interface{}{"virtio0": test.value})
+		if disk != "virtio0" || sizeGB != test.sizeGB {
+			t.Fatalf("%s: expected virtio0 of %d GB, got %s of %d GB", test.value, test.sizeGB, disk, sizeGB)
+		}
+	}
+}
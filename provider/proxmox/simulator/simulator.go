@@ -0,0 +1,862 @@
+// Package simulator provides a local stand-in for the Proxmox VE API.
+//
+// The server issues tickets from /access/ticket and requires the ticket
+// cookie on every other request, plus the CSRF prevention token on writes.
+// Nodes, QEMU virtual machines and their configuration, templates, LXC
+// containers, local storage and tasks are kept in memory, so that the API client and the
+// compute adapter can be tested without a cluster.
+package simulator
+
+import "crypto/rand"
+import "encoding/hex"
+import "encoding/json"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "net/http/httptest"
+import "net/url"
+import "regexp"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+const GIGABYTE = 1024 * 1024 * 1024
+
+// ISO volume that is available in local storage on every node.
+const ISO_VOLID = "local:iso/ubuntu-16.04-server-amd64.iso"
+
+// Container template that is available in local storage on every node.
+const CONTAINER_TEMPLATE_VOLID = "local:vztmpl/debian-12-standard_12.7-1_amd64.tar.zst"
+
+// Cloud-init template that exists on pve1 when the simulator starts.
+const TEMPLATE_ID = "pve1/9000"
+const TEMPLATE_NAME = "ubuntu-cloud"
+
+var NODES = []string{"pve1", "pve2"}
+
+type vm struct {
+	id       int
+	node     string
+	name     string
+	status   string
+	cores    int
+	memoryMB int64
+	diskGB   int64
+	template bool
+
+	// true for LXC containers, which are managed under /lxc instead of /qemu
+	container bool
+
+	// configuration keys other than name, cores and memory, like scsi0
+	config map[string]string
+}
+
+type task struct {
+	upid       string
+	node       string
+	taskType   string
+	id         string
+	exitStatus string
+
+	// number of status requests for which the task is still running
+	pendingPolls int
+}
+
+// List response that reports the total number of items, like the task log.
+type page struct {
+	data  interface{}
+	total int
+}
+
+type apiError struct {
+	status int
+
+	// Proxmox reports the error message as the HTTP reason phrase
+	reason string
+
+	// parameter errors, reported in the errors field
+	errors map[string]string
+}
+
+func errorf(status int, format string, a ...interface{}) *apiError {
+	return &apiError{status: status, reason: fmt.Sprintf(format, a...)}
+}
+
+func parameterError(param string, format string, a ...interface{}) *apiError {
+	return &apiError{
+		status: http.StatusBadRequest,
+		reason: "Parameter verification failed.",
+		errors: map[string]string{param: fmt.Sprintf(format, a...)},
+	}
+}
+
+// Server is a Proxmox VE API simulator listening on a local port.
+type Server struct {
+	*httptest.Server
+
+	Username string
+	Password string
+
+	// Number of status requests for which new tasks are still running.
+	PendingPolls int
+
+	// Error messages for tasks of the given types, like qmstart, which fail
+	// instead of running.
+	TaskErrors map[string]string
+
+	// Number of warnings for tasks of the given types, which then succeed
+	// with exit status "WARNINGS: n".
+	TaskWarnings map[string]int
+
+	// Lines that tasks of the given types write to their log before the
+	// final line.
+	TaskOutput map[string][]string
+
+	mu                  sync.Mutex
+	ticket              string
+	csrfPreventionToken string
+	vms                 map[int]*vm
+	tasks               map[string]*task
+	taskCounter         int
+
+	// volume IDs in local storage, with their sizes, by node
+	volumes map[string]map[string]int64
+}
+
+// Starts a simulator that accepts the given user credentials.
+func NewServer(username string, password string) *Server {
+	s := &Server{
+		Username:            username,
+		Password:            password,
+		PendingPolls:        1,
+		TaskErrors:          make(map[string]string),
+		TaskWarnings:        make(map[string]int),
+		TaskOutput:          make(map[string][]string),
+		ticket:              "PVE:" + username + ":" + randomHex(16),
+		csrfPreventionToken: fmt.Sprintf("%X:%s", time.Now().Unix(), randomHex(16)),
+		vms:                 make(map[int]*vm),
+		volumes:             make(map[string]map[string]int64),
+		tasks:               make(map[string]*task),
+	}
+	for _, node := range NODES {
+		s.volumes[node] = map[string]int64{
+			ISO_VOLID:                870842368,
+			CONTAINER_TEMPLATE_VOLID: 126038264,
+		}
+	}
+	s.vms[9000] = &vm{
+		id:       9000,
+		node:     "pve1",
+		name:     TEMPLATE_NAME,
+		status:   "stopped",
+		cores:    1,
+		memoryMB: 1024,
+		diskGB:   2,
+		template: true,
+		config: map[string]string{
+			"scsi0": "local:9000/base-9000-disk-0.raw,size=2G",
+			"ide2":  "local:9000/vm-9000-cloudinit.qcow2,media=cdrom",
+			"net0":  "virtio=BC:24:11:00:90:00,bridge=vmbr0",
+		},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Returns the API base URL that the client should use.
+func (s *Server) APIURL() string {
+	return s.URL + "/api2/json"
+}
+
+func randomHex(n int) string {
+	bytes := make([]byte, n)
+	if _, err := rand.Read(bytes); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(bytes)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	data, err := s.handle(r)
+	if err == nil {
+		body := map[string]interface{}{"data": data}
+		if p, ok := data.(*page); ok {
+			body["data"] = p.data
+			body["total"] = p.total
+		}
+		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+		json.NewEncoder(w).Encode(body)
+		return
+	}
+
+	body := map[string]interface{}{"data": nil}
+	if err.errors != nil {
+		body["errors"] = err.errors
+	}
+	bodyBytes, _ := json.Marshal(body)
+
+	// net/http always writes the standard reason phrase, so take over the
+	// connection to write the message into the status line like Proxmox does
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, err.reason, err.status)
+		return
+	}
+	conn, buf, hijackErr := hijacker.Hijack()
+	if hijackErr != nil {
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintf(buf, "HTTP/1.1 %d %s\r\n", err.status, err.reason)
+	fmt.Fprintf(buf, "Content-Type: application/json;charset=UTF-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n", len(bodyBytes))
+	buf.Write(bodyBytes)
+	buf.Flush()
+}
+
+var vmPathRegexp = regexp.MustCompile(`^/nodes/([^/]+)/(qemu|lxc)/(\d+)(/.*)?$`)
+var taskPathRegexp = regexp.MustCompile(`^/nodes/([^/]+)/tasks/([^/]+)/(status|log)$`)
+var storagePathRegexp = regexp.MustCompile(`^/nodes/([^/]+)/storage(?:/([^/]+)(/content|/download-url)(?:/(.+))?)?$`)
+
+func (s *Server) handle(r *http.Request) (interface{}, *apiError) {
+	if !strings.HasPrefix(r.URL.Path, "/api2/json/") {
+		return nil, errorf(http.StatusNotImplemented, "Method '%s %s' not implemented", r.Method, r.URL.Path)
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/api2/json")
+
+	// like Proxmox, parse the body as a form even without a Content-Type
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "unable to read request body")
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "unable to parse request body")
+	}
+
+	if path == "/access/ticket" && r.Method == "POST" {
+		return s.createTicket(form)
+	}
+
+	// all other requests need the ticket, and writes need the CSRF token too
+	if cookie, err := r.Cookie("PVEAuthCookie"); err != nil || cookie.Value != s.ticket {
+		return nil, errorf(http.StatusUnauthorized, "authentication failure")
+	} else if r.Method != "GET" && r.Header.Get("CSRFPreventionToken") != s.csrfPreventionToken {
+		return nil, errorf(http.StatusUnauthorized, "Permission check failed (invalid csrf token)")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if path == "/nodes" && r.Method == "GET" {
+		return s.listNodes()
+	} else if path == "/cluster/nextid" && r.Method == "GET" {
+		return s.nextID(), nil
+	} else if matches := taskPathRegexp.FindStringSubmatch(path); matches != nil && r.Method == "GET" {
+		return s.taskRequest(matches[1], matches[2], matches[3], r.URL.Query())
+	} else if matches := storagePathRegexp.FindStringSubmatch(path); matches != nil {
+		if err := s.checkNode(matches[1]); err != nil {
+			return nil, err
+		}
+		return s.storageRequest(r.Method, matches[1], matches[2], matches[3], matches[4], form)
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) == 3 && parts[0] == "nodes" && (parts[2] == "qemu" || parts[2] == "lxc") {
+		container := parts[2] == "lxc"
+		if err := s.checkNode(parts[1]); err != nil {
+			return nil, err
+		} else if r.Method == "GET" {
+			return s.listVMs(parts[1], container)
+		} else if r.Method == "POST" && container {
+			return s.createContainer(parts[1], form)
+		} else if r.Method == "POST" {
+			return s.createVM(parts[1], form)
+		}
+	} else if matches := vmPathRegexp.FindStringSubmatch(path); matches != nil {
+		if err := s.checkNode(matches[1]); err != nil {
+			return nil, err
+		}
+		container := matches[2] == "lxc"
+		vmid, _ := strconv.Atoi(matches[3])
+		vm := s.vms[vmid]
+		if vm == nil || vm.node != matches[1] || vm.container != container {
+			configDir := "qemu-server"
+			if container {
+				configDir = "lxc"
+			}
+			return nil, errorf(http.StatusInternalServerError, "Configuration file 'nodes/%s/%s/%d.conf' does not exist", matches[1], configDir, vmid)
+		} else if container {
+			return s.containerRequest(r.Method, vm, matches[4])
+		}
+		return s.vmRequest(r.Method, vm, matches[4], form)
+	}
+
+	return nil, errorf(http.StatusNotImplemented, "Method '%s %s' not implemented", r.Method, path)
+}
+
+func (s *Server) createTicket(form url.Values) (interface{}, *apiError) {
+	if form.Get("username") != s.Username || form.Get("password") != s.Password {
+		return nil, errorf(http.StatusUnauthorized, "authentication failure")
+	}
+	return map[string]interface{}{
+		"username":            s.Username,
+		"ticket":              s.ticket,
+		"CSRFPreventionToken": s.csrfPreventionToken,
+	}, nil
+}
+
+func (s *Server) checkNode(node string) *apiError {
+	for _, n := range NODES {
+		if n == node {
+			return nil
+		}
+	}
+	return errorf(http.StatusInternalServerError, "hostname lookup '%s' failed - failed to get address info for: %s: Name or service not known", node, node)
+}
+
+func (s *Server) listNodes() (interface{}, *apiError) {
+	nodes := []interface{}{}
+	for i, node := range NODES {
+		var memory, disk int64
+		for _, vm := range s.vms {
+			if vm.node == node {
+				memory += vm.memoryMB * 1024 * 1024
+				disk += vm.diskGB * GIGABYTE
+			}
+		}
+		nodes = append(nodes, map[string]interface{}{
+			"node":    node,
+			"status":  "online",
+			"mem":     memory,
+			"maxmem":  int64(16+i*16) * GIGABYTE,
+			"disk":    disk,
+			"maxdisk": int64(500) * GIGABYTE,
+		})
+	}
+	return nodes, nil
+}
+
+// Returns the lowest VMID that is not used anywhere in the cluster.
+func (s *Server) nextID() string {
+	for id := 100; ; id++ {
+		if s.vms[id] == nil {
+			return strconv.Itoa(id)
+		}
+	}
+}
+
+func (s *Server) checkStorage(storage string) *apiError {
+	if storage != "local" {
+		return errorf(http.StatusInternalServerError, "storage '%s' does not exist", storage)
+	}
+	return nil
+}
+
+func (s *Server) storageRequest(method string, node string, storage string, action string, volid string, form url.Values) (interface{}, *apiError) {
+	if storage == "" {
+		if method != "GET" {
+			return nil, errorf(http.StatusNotImplemented, "Method '%s /nodes/%s/storage' not implemented", method, node)
+		}
+		return []interface{}{
+			map[string]interface{}{
+				"storage": "local",
+				"type":    "dir",
+				"content": "iso,vztmpl,images,rootdir",
+				"active":  1,
+				"shared":  0,
+				"avail":   int64(400) * GIGABYTE,
+				"total":   int64(500) * GIGABYTE,
+			},
+		}, nil
+	} else if err := s.checkStorage(storage); err != nil {
+		return nil, err
+	}
+
+	volumes := s.volumes[node]
+	switch {
+	case method == "GET" && action == "/content" && volid == "":
+		var volids []string
+		for volid := range volumes {
+			volids = append(volids, volid)
+		}
+		sort.Strings(volids)
+		content := []interface{}{}
+		for _, volid := range volids {
+			contentType, format := "iso", "iso"
+			if strings.Contains(volid, ":vztmpl/") {
+				contentType, format = "vztmpl", "tzst"
+			}
+			content = append(content, map[string]interface{}{
+				"volid":   volid,
+				"content": contentType,
+				"format":  format,
+				"size":    volumes[volid],
+				"ctime":   time.Now().Unix(),
+			})
+		}
+		return content, nil
+	case method == "DELETE" && action == "/content" && volid != "":
+		if _, ok := volumes[volid]; !ok {
+			return nil, errorf(http.StatusInternalServerError, "volume '%s' does not exist", volid)
+		}
+		delete(volumes, volid)
+		return s.startTask(node, "imgdel", 0), nil
+	case method == "POST" && action == "/download-url":
+		content := form.Get("content")
+		if content != "iso" && content != "vztmpl" {
+			return nil, parameterError("content", "value '%s' does not have a value in the enumeration 'iso, vztmpl'", content)
+		} else if content == "iso" && !strings.HasSuffix(form.Get("filename"), ".iso") {
+			return nil, parameterError("filename", "wrong file extension")
+		} else if content == "vztmpl" && !strings.Contains(form.Get("filename"), ".tar.") {
+			return nil, parameterError("filename", "wrong file extension")
+		} else if !strings.HasPrefix(form.Get("url"), "http://") && !strings.HasPrefix(form.Get("url"), "https://") {
+			return nil, parameterError("url", "invalid format - invalid URL")
+		}
+		volumes[storage+":"+content+"/"+form.Get("filename")] = GIGABYTE
+		return s.startTask(node, "download", 0), nil
+	default:
+		return nil, errorf(http.StatusNotImplemented, "Method '%s /nodes/%s/storage/%s%s' not implemented", method, node, storage, action)
+	}
+}
+
+func (s *Server) startTask(node string, taskType string, id int) string {
+	s.taskCounter++
+	upid := fmt.Sprintf("UPID:%s:%08X:%08X:%08X:%s:%d:%s:", node, 1000+s.taskCounter, s.taskCounter, time.Now().Unix(), taskType, id, s.Username)
+	s.tasks[upid] = &task{
+		upid:         upid,
+		node:         node,
+		taskType:     taskType,
+		id:           strconv.Itoa(id),
+		exitStatus:   "OK",
+		pendingPolls: s.PendingPolls,
+	}
+	if message := s.TaskErrors[taskType]; message != "" {
+		s.tasks[upid].exitStatus = message
+	} else if warnings := s.TaskWarnings[taskType]; warnings > 0 {
+		s.tasks[upid].exitStatus = fmt.Sprintf("WARNINGS: %d", warnings)
+	}
+	return upid
+}
+
+// Returns true if the task did not fail, although it may have warnings.
+func (task *task) succeeded() bool {
+	return task.exitStatus == "OK" || strings.HasPrefix(task.exitStatus, "WARNINGS:")
+}
+
+func (s *Server) taskRequest(node string, upid string, action string, query url.Values) (interface{}, *apiError) {
+	task := s.tasks[upid]
+	if task == nil || task.node != node {
+		return nil, errorf(http.StatusBadRequest, "unable to parse worker upid '%s'", upid)
+	}
+
+	if action == "log" {
+		lines := []string{fmt.Sprintf("%s %s", task.taskType, task.id)}
+		lines = append(lines, s.TaskOutput[task.taskType]...)
+		if task.exitStatus == "OK" {
+			lines = append(lines, "TASK OK")
+		} else if task.succeeded() {
+			lines = append(lines, "TASK "+task.exitStatus)
+		} else {
+			lines = append(lines, task.exitStatus, "TASK ERROR: "+task.exitStatus)
+		}
+
+		// like Proxmox, return 50 lines from the start by default
+		start, _ := strconv.Atoi(query.Get("start"))
+		limit := 50
+		if query.Get("limit") != "" {
+			limit, _ = strconv.Atoi(query.Get("limit"))
+		}
+		log := []interface{}{}
+		for i := start; i < len(lines) && i < start+limit; i++ {
+			log = append(log, map[string]interface{}{"n": i + 1, "t": lines[i]})
+		}
+		return &page{data: log, total: len(lines)}, nil
+	}
+
+	status := map[string]interface{}{
+		"upid":   task.upid,
+		"node":   task.node,
+		"type":   task.taskType,
+		"id":     task.id,
+		"status": "running",
+	}
+	if task.pendingPolls > 0 {
+		task.pendingPolls--
+	} else {
+		status["status"] = "stopped"
+		status["exitstatus"] = task.exitStatus
+	}
+	return status, nil
+}
+
+func (s *Server) vmStruct(vm *vm) map[string]interface{} {
+	result := map[string]interface{}{
+		"vmid":    vm.id,
+		"name":    vm.name,
+		"status":  vm.status,
+		"cpus":    vm.cores,
+		"maxmem":  vm.memoryMB * 1024 * 1024,
+		"maxdisk": vm.diskGB * GIGABYTE,
+		"mem":     0,
+		"disk":    0,
+	}
+	if vm.template {
+		result["template"] = 1
+	}
+	if vm.container {
+		result["type"] = "lxc"
+	}
+	if vm.status == "running" {
+		result["mem"] = vm.memoryMB * 1024 * 1024 / 2
+	}
+	return result
+}
+
+func (s *Server) listVMs(node string, container bool) (interface{}, *apiError) {
+	var ids []int
+	for id, vm := range s.vms {
+		if vm.node == node && vm.container == container {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	vms := []interface{}{}
+	for _, id := range ids {
+		vms = append(vms, s.vmStruct(s.vms[id]))
+	}
+	return vms, nil
+}
+
+var diskRegexp = regexp.MustCompile(`^(?:volume=)?([a-z0-9-]+):(\d+)`)
+
+func (s *Server) createVM(node string, form url.Values) (interface{}, *apiError) {
+	vmid, err := strconv.Atoi(form.Get("vmid"))
+	if err != nil || vmid < 100 {
+		return nil, parameterError("vmid", "invalid format - value must be an integer >= 100")
+	} else if s.vms[vmid] != nil {
+		return nil, errorf(http.StatusInternalServerError, "unable to create VM %d: config file already exists", vmid)
+	}
+
+	newVM := &vm{
+		id:       vmid,
+		node:     node,
+		name:     form.Get("name"),
+		status:   "stopped",
+		cores:    1,
+		memoryMB: 512,
+		config:   make(map[string]string),
+	}
+	if newVM.name == "" {
+		newVM.name = fmt.Sprintf("VM%d", vmid)
+	}
+	if form.Get("cores") != "" {
+		if newVM.cores, err = strconv.Atoi(form.Get("cores")); err != nil || newVM.cores < 1 {
+			return nil, parameterError("cores", "invalid format - value must be a positive integer")
+		}
+	}
+	if form.Get("memory") != "" {
+		if newVM.memoryMB, err = strconv.ParseInt(form.Get("memory"), 10, 64); err != nil || newVM.memoryMB < 16 {
+			return nil, parameterError("memory", "invalid format - value must be an integer >= 16")
+		}
+	}
+	for _, key := range []string{"ide0", "scsi0", "virtio0", "sata0"} {
+		if form.Get(key) == "" {
+			continue
+		}
+		matches := diskRegexp.FindStringSubmatch(form.Get(key))
+		if matches == nil {
+			return nil, parameterError(key, "invalid format - unable to parse drive options")
+		} else if err := s.checkStorage(matches[1]); err != nil {
+			return nil, err
+		}
+		newVM.diskGB, _ = strconv.ParseInt(matches[2], 10, 64)
+		newVM.config[key] = fmt.Sprintf("%s:%d/vm-%d-disk-0.raw,size=%dG", matches[1], vmid, vmid, newVM.diskGB)
+	}
+	if cdrom := form.Get("cdrom"); cdrom != "" {
+		volid := strings.Split(cdrom, ",")[0]
+		if _, ok := s.volumes[node][volid]; !ok && volid != "none" && volid != "cdrom" {
+			return nil, errorf(http.StatusInternalServerError, "volume '%s' does not exist", volid)
+		}
+		newVM.config["ide2"] = volid + ",media=cdrom"
+	}
+	if form.Get("net0") != "" {
+		newVM.config["net0"] = form.Get("net0")
+	}
+
+	s.vms[vmid] = newVM
+	if form.Get("start") == "1" {
+		newVM.status = "running"
+	}
+	return s.startTask(node, "qmcreate", vmid), nil
+}
+
+func (s *Server) vmConfig(vm *vm) map[string]interface{} {
+	config := map[string]interface{}{
+		"name":   vm.name,
+		"cores":  vm.cores,
+		"memory": vm.memoryMB,
+		"digest": randomHex(20),
+	}
+	if vm.template {
+		config["template"] = 1
+	}
+	for key, value := range vm.config {
+		config[key] = value
+	}
+	return config
+}
+
+func (s *Server) setVMConfig(vm *vm, form url.Values) (interface{}, *apiError) {
+	for key := range form {
+		value := form.Get(key)
+		switch key {
+		case "name":
+			vm.name = value
+		case "cores":
+			cores, err := strconv.Atoi(value)
+			if err != nil || cores < 1 {
+				return nil, parameterError("cores", "invalid format - value must be a positive integer")
+			}
+			vm.cores = cores
+		case "memory":
+			memoryMB, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || memoryMB < 16 {
+				return nil, parameterError("memory", "invalid format - value must be an integer >= 16")
+			}
+			vm.memoryMB = memoryMB
+		case "ide2":
+			if strings.HasSuffix(value, ":cloudinit") {
+				storage := strings.TrimSuffix(value, ":cloudinit")
+				if err := s.checkStorage(storage); err != nil {
+					return nil, err
+				}
+				value = fmt.Sprintf("%s:%d/vm-%d-cloudinit.qcow2,media=cdrom", storage, vm.id, vm.id)
+			}
+			vm.config[key] = value
+		case "sshkeys":
+			if _, err := url.QueryUnescape(value); err != nil || strings.Contains(value, " ") {
+				return nil, parameterError("sshkeys", "invalid urlencoded string")
+			}
+			vm.config[key] = value
+		case "cipassword":
+			// Proxmox stores a hash of the password
+			vm.config[key] = "**********"
+		case "ciuser", "ipconfig0", "net0":
+			vm.config[key] = value
+		default:
+			return nil, parameterError(key, "property is not defined in schema and the schema does not allow additional properties")
+		}
+	}
+	return nil, nil
+}
+
+var sizeRegexp = regexp.MustCompile(`size=\d+G`)
+
+func (s *Server) resizeVM(vm *vm, form url.Values) (interface{}, *apiError) {
+	disk := form.Get("disk")
+	if vm.config[disk] == "" {
+		return nil, parameterError("disk", "no such disk '%s'", disk)
+	}
+	sizeGB, err := strconv.ParseInt(strings.TrimSuffix(form.Get("size"), "G"), 10, 64)
+	if err != nil || !strings.HasSuffix(form.Get("size"), "G") {
+		return nil, parameterError("size", "invalid format - value does not match the regex pattern")
+	} else if sizeGB < vm.diskGB {
+		return nil, errorf(http.StatusInternalServerError, "unable to shrink disk size")
+	}
+	vm.diskGB = sizeGB
+	vm.config[disk] = sizeRegexp.ReplaceAllString(vm.config[disk], fmt.Sprintf("size=%dG", sizeGB))
+	return nil, nil
+}
+
+func (s *Server) cloneVM(source *vm, form url.Values) (interface{}, *apiError) {
+	newid, err := strconv.Atoi(form.Get("newid"))
+	if err != nil || newid < 100 {
+		return nil, parameterError("newid", "invalid format - value must be an integer >= 100")
+	} else if s.vms[newid] != nil {
+		return nil, errorf(http.StatusInternalServerError, "unable to create VM %d: config file already exists", newid)
+	} else if form.Get("full") != "1" && !source.template {
+		return nil, errorf(http.StatusInternalServerError, "Linked clone feature for VM %d is only available for templates", source.id)
+	}
+
+	node := source.node
+	if target := form.Get("target"); target != "" {
+		if err := s.checkNode(target); err != nil {
+			return nil, err
+		}
+		node = target
+	}
+	if storage := form.Get("storage"); storage != "" {
+		if err := s.checkStorage(storage); err != nil {
+			return nil, err
+		}
+	}
+
+	clone := &vm{
+		id:       newid,
+		node:     node,
+		name:     form.Get("name"),
+		status:   "stopped",
+		cores:    source.cores,
+		memoryMB: source.memoryMB,
+		diskGB:   source.diskGB,
+		config:   make(map[string]string),
+	}
+	if clone.name == "" {
+		clone.name = fmt.Sprintf("Copy-of-VM-%s", source.name)
+	}
+	for key, value := range source.config {
+		clone.config[key] = strings.Replace(value, strconv.Itoa(source.id), strconv.Itoa(newid), -1)
+	}
+	s.vms[newid] = clone
+	return s.startTask(source.node, "qmclone", source.id), nil
+}
+
+func (s *Server) vmRequest(method string, vm *vm, subpath string, form url.Values) (interface{}, *apiError) {
+	switch {
+	case method == "DELETE" && subpath == "":
+		if vm.status == "running" {
+			return nil, errorf(http.StatusInternalServerError, "VM %d is running - destroy failed", vm.id)
+		}
+		delete(s.vms, vm.id)
+		return s.startTask(vm.node, "qmdestroy", vm.id), nil
+	case method == "GET" && subpath == "/status/current":
+		return s.vmStruct(vm), nil
+	case method == "GET" && subpath == "/config":
+		return s.vmConfig(vm), nil
+	case method == "PUT" && subpath == "/config":
+		return s.setVMConfig(vm, form)
+	case method == "PUT" && subpath == "/resize":
+		return s.resizeVM(vm, form)
+	case method == "POST" && subpath == "/clone":
+		return s.cloneVM(vm, form)
+	case method == "POST" && subpath == "/template":
+		if vm.status == "running" {
+			return nil, errorf(http.StatusInternalServerError, "VM %d is running - unable to convert to template", vm.id)
+		}
+		vm.template = true
+		return nil, nil
+	case method == "POST" && subpath == "/status/start":
+		if vm.template {
+			return nil, errorf(http.StatusInternalServerError, "you can't start a vm if it's a template")
+		} else if vm.status == "running" {
+			return nil, errorf(http.StatusInternalServerError, "VM %d already running", vm.id)
+		}
+		upid := s.startTask(vm.node, "qmstart", vm.id)
+		if s.tasks[upid].succeeded() {
+			vm.status = "running"
+		}
+		return upid, nil
+	case method == "POST" && (subpath == "/status/stop" || subpath == "/status/shutdown"):
+		vm.status = "stopped"
+		return s.startTask(vm.node, "qm"+strings.TrimPrefix(subpath, "/status/"), vm.id), nil
+	case method == "POST" && subpath == "/status/reset":
+		if vm.status != "running" {
+			return nil, errorf(http.StatusInternalServerError, "VM %d not running", vm.id)
+		}
+		return s.startTask(vm.node, "qmreset", vm.id), nil
+	case method == "POST" && subpath == "/vncproxy":
+		if vm.status != "running" {
+			return nil, errorf(http.StatusInternalServerError, "VM %d not running", vm.id)
+		}
+		return map[string]interface{}{
+			"port":   strconv.Itoa(5900 + vm.id%100),
+			"ticket": "PVEVNC:" + randomHex(16),
+			"user":   s.Username,
+			"cert":   "",
+			"upid":   s.startTask(vm.node, "vncproxy", vm.id),
+		}, nil
+	default:
+		return nil, errorf(http.StatusNotImplemented, "Method '%s /nodes/%s/qemu/%d%s' not implemented", method, vm.node, vm.id, subpath)
+	}
+}
+
+var rootfsRegexp = regexp.MustCompile(`^([a-z0-9-]+):(\d+)$`)
+
+func (s *Server) createContainer(node string, form url.Values) (interface{}, *apiError) {
+	vmid, err := strconv.Atoi(form.Get("vmid"))
+	if err != nil || vmid < 100 {
+		return nil, parameterError("vmid", "invalid format - value must be an integer >= 100")
+	} else if s.vms[vmid] != nil {
+		return nil, errorf(http.StatusInternalServerError, "unable to create CT %d - CT %d already exists on node '%s'", vmid, vmid, s.vms[vmid].node)
+	} else if _, ok := s.volumes[node][form.Get("ostemplate")]; !ok || !strings.Contains(form.Get("ostemplate"), ":vztmpl/") {
+		return nil, errorf(http.StatusInternalServerError, "volume '%s' does not exist", form.Get("ostemplate"))
+	} else if password := form.Get("password"); password != "" && len(password) < 5 {
+		return nil, parameterError("password", "value must have a minimum length of 5")
+	} else if net0 := form.Get("net0"); net0 != "" && !strings.Contains(net0, "bridge=") {
+		return nil, parameterError("net0", "missing property - 'bridge' is required")
+	}
+
+	newContainer := &vm{
+		id:        vmid,
+		node:      node,
+		name:      form.Get("hostname"),
+		status:    "stopped",
+		cores:     1,
+		memoryMB:  512,
+		diskGB:    4,
+		container: true,
+		config:    make(map[string]string),
+	}
+	if newContainer.name == "" {
+		newContainer.name = fmt.Sprintf("CT%d", vmid)
+	}
+	if form.Get("cores") != "" {
+		if newContainer.cores, err = strconv.Atoi(form.Get("cores")); err != nil || newContainer.cores < 1 {
+			return nil, parameterError("cores", "invalid format - value must be a positive integer")
+		}
+	}
+	if form.Get("memory") != "" {
+		if newContainer.memoryMB, err = strconv.ParseInt(form.Get("memory"), 10, 64); err != nil || newContainer.memoryMB < 16 {
+			return nil, parameterError("memory", "invalid format - value must be an integer >= 16")
+		}
+	}
+	if rootfs := form.Get("rootfs"); rootfs != "" {
+		matches := rootfsRegexp.FindStringSubmatch(rootfs)
+		if matches == nil {
+			return nil, parameterError("rootfs", "invalid format - unable to parse volume options")
+		} else if err := s.checkStorage(matches[1]); err != nil {
+			return nil, err
+		}
+		newContainer.diskGB, _ = strconv.ParseInt(matches[2], 10, 64)
+	}
+
+	s.vms[vmid] = newContainer
+	if form.Get("start") == "1" {
+		newContainer.status = "running"
+	}
+	return s.startTask(node, "vzcreate", vmid), nil
+}
+
+func (s *Server) containerRequest(method string, container *vm, subpath string) (interface{}, *apiError) {
+	switch {
+	case method == "DELETE" && subpath == "":
+		if container.status == "running" {
+			return nil, errorf(http.StatusInternalServerError, "CT %d is running - destroy failed", container.id)
+		}
+		delete(s.vms, container.id)
+		return s.startTask(container.node, "vzdestroy", container.id), nil
+	case method == "GET" && subpath == "/status/current":
+		return s.vmStruct(container), nil
+	case method == "POST" && subpath == "/status/start":
+		if container.status == "running" {
+			return nil, errorf(http.StatusInternalServerError, "CT %d already running", container.id)
+		}
+		upid := s.startTask(container.node, "vzstart", container.id)
+		if s.tasks[upid].succeeded() {
+			container.status = "running"
+		}
+		return upid, nil
+	case method == "POST" && (subpath == "/status/stop" || subpath == "/status/shutdown"):
+		container.status = "stopped"
+		return s.startTask(container.node, "vz"+strings.TrimPrefix(subpath, "/status/"), container.id), nil
+	case method == "POST" && subpath == "/status/reboot":
+		if container.status != "running" {
+			return nil, errorf(http.StatusInternalServerError, "CT %d not running", container.id)
+		}
+		return s.startTask(container.node, "vzreboot", container.id), nil
+	default:
+		return nil, errorf(http.StatusNotImplemented, "Method '%s /nodes/%s/lxc/%d%s' not implemented", method, container.node, container.id, subpath)
+	}
+}
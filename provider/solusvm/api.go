@@ -1,6 +1,9 @@
 package solusvm
 
+import "github.com/LunaNode/cloug/provider/common"
+
 import "bytes"
+import "context"
 import "crypto/rand"
 import "crypto/tls"
 import "encoding/xml"
@@ -11,6 +14,7 @@ import "net"
 import "net/http"
 import "net/url"
 import "strconv"
+import "strings"
 import "time"
 
 type API struct {
@@ -18,6 +22,55 @@ type API struct {
 	ApiId    string
 	ApiKey   string
 	Insecure bool // InsecureSkipVerify true in tls.Config
+
+	// Client used for API requests. If nil, a shared client is used that
+	// respects Insecure.
+	Client *http.Client
+
+	ctx context.Context
+}
+
+// Shared clients for APIs without an injected client, so that connections
+// are reused across requests.
+var defaultClient = makeDefaultClient(false)
+var insecureClient = makeDefaultClient(true)
+
+func makeDefaultClient(insecure bool) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: insecure,
+			},
+			Dial: (&net.Dialer{
+				Timeout: 30 * time.Second,
+			}).Dial,
+		},
+	}
+}
+
+func (this *API) httpClient() *http.Client {
+	if this.Client != nil {
+		return this.Client
+	} else if this.Insecure {
+		return insecureClient
+	} else {
+		return defaultClient
+	}
+}
+
+// Returns a copy of the API that sends requests with the given context.
+func (this *API) WithContext(ctx context.Context) *API {
+	contextAPI := *this
+	contextAPI.ctx = ctx
+	return &contextAPI
+}
+
+func (this *API) context() context.Context {
+	if this.ctx == nil {
+		return context.Background()
+	}
+	return this.ctx
 }
 
 func (this *API) uid() string {
@@ -51,17 +104,12 @@ func (this *API) request(action string, params map[string]string, target interfa
 	byteBuffer := new(bytes.Buffer)
 	byteBuffer.Write([]byte(values.Encode()))
 
-	c := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: this.Insecure,
-			},
-			Dial: (&net.Dialer{
-				Timeout: 30 * time.Second,
-			}).Dial,
-		},
+	httpRequest, err := http.NewRequest("POST", this.Url, byteBuffer)
+	if err != nil {
+		return err
 	}
-	response, err := c.PostForm(this.Url, values)
+	httpRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response, err := this.httpClient().Do(httpRequest.WithContext(this.context()))
 
 	if err != nil {
 		return err
@@ -82,7 +130,7 @@ func (this *API) request(action string, params map[string]string, target interfa
 		return err
 	} else if genericResponse.Status != "success" {
 		if genericResponse.Message != "" {
-			return errors.New(genericResponse.Message)
+			return common.MessageError(genericResponse.Message)
 		} else {
 			return errors.New("backend call failed for unknown reason")
 		}
@@ -100,7 +148,9 @@ func (this *API) request(action string, params map[string]string, target interfa
 
 // virtual machines
 
-func (this *API) VmCreate(virtType string, nodeGroup string, hostname string, imageIdentification string, memory int, diskspace int, cpu int) (int, string, error) {
+// Creates a virtual server on the plan. Memory, disk space and CPU override
+// the plan unless they are zero.
+func (this *API) VmCreate(virtType string, nodeGroup string, hostname string, imageIdentification string, plan string, memory int, diskspace int, cpu int) (int, string, error) {
 	rootPassword := this.uid()
 	params := make(map[string]string)
 	params["type"] = virtType
@@ -108,7 +158,7 @@ func (this *API) VmCreate(virtType string, nodeGroup string, hostname string, im
 	params["hostname"] = hostname
 	params["password"] = rootPassword
 	params["username"] = "cloug"
-	params["plan"] = "Cloug " + virtType
+	params["plan"] = plan
 	params["template"] = imageIdentification
 	params["ips"] = "1"
 
@@ -116,12 +166,16 @@ func (this *API) VmCreate(virtType string, nodeGroup string, hostname string, im
 	// however their documentation does not specify any way to provide a custom burst memory
 	// currently we work around this by adjusting the memory after the VM is provisioned
 	// TODO: open ticket with SolusVM and see if there's better way!
-	if virtType != "openvz" {
+	if virtType != "openvz" && memory != 0 {
 		params["custommemory"] = fmt.Sprintf("%d", memory)
 	}
-	params["customdiskspace"] = fmt.Sprintf("%d", diskspace)
-	params["custombandwidth"] = "99999"
-	params["customcpu"] = fmt.Sprintf("%d", cpu)
+	if diskspace != 0 {
+		params["customdiskspace"] = fmt.Sprintf("%d", diskspace)
+		params["custombandwidth"] = "99999"
+	}
+	if cpu != 0 {
+		params["customcpu"] = fmt.Sprintf("%d", cpu)
+	}
 	var response APIVmCreateResponse
 	err := this.request("vserver-create", params, &response)
 	if err != nil {
@@ -133,19 +187,21 @@ func (this *API) VmCreate(virtType string, nodeGroup string, hostname string, im
 		return 0, "", err
 	}
 
-	if virtType == "openvz" {
+	if virtType == "openvz" && memory != 0 {
 		// apply custom memory work-around described above
 		// we sleep for a bit to give time for provisioning
 		// TODO: reportError?
+		// the caller's context may be done by the time this runs, so we detach from it
 		go func() {
+			api := this.WithContext(context.Background())
 			time.Sleep(15 * time.Second)
-			this.VmStop(vmId)
+			api.VmStop(vmId)
 			time.Sleep(time.Second)
 			params := make(map[string]string)
 			params["memory"] = fmt.Sprintf("%d|%d", memory, memory)
-			this.vmAction(vmId, "vserver-change-memory", params)
+			api.vmAction(vmId, "vserver-change-memory", params)
 			time.Sleep(5 * time.Second)
-			this.VmStart(vmId)
+			api.VmStart(vmId)
 		}()
 	}
 
@@ -262,3 +318,85 @@ func (this *API) VmResizeCpu(vmIdentification int, cpu int) error {
 	params["cpu"] = fmt.Sprintf("%d", cpu)
 	return this.vmAction(vmIdentification, "vserver-change-cpu", params)
 }
+
+// nodes, plans and templates
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item != "" && item != "--none--" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (this *API) NodeIds(virtType string) ([]int, error) {
+	params := make(map[string]string)
+	params["type"] = virtType
+	var response APINodeIdsResponse
+	err := this.request("node-idlist", params, &response)
+	if err != nil {
+		return nil, err
+	}
+	var nodeIds []int
+	for _, str := range splitList(response.Nodes) {
+		nodeId, err := strconv.Atoi(str)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node ID %s", str)
+		}
+		nodeIds = append(nodeIds, nodeId)
+	}
+	return nodeIds, nil
+}
+
+func (this *API) NodeVirtualServers(nodeId int) ([]APIVirtualServer, error) {
+	params := make(map[string]string)
+	params["nodeid"] = fmt.Sprintf("%d", nodeId)
+	var response APINodeVirtualServersResponse
+	err := this.request("node-virtualservers", params, &response)
+	if err != nil {
+		return nil, err
+	} else {
+		return response.VirtualServers, nil
+	}
+}
+
+// Returns the names of the plans for the virtualization type.
+func (this *API) ListPlans(virtType string) ([]string, error) {
+	params := make(map[string]string)
+	params["type"] = virtType
+	var response APIListPlansResponse
+	err := this.request("listplans", params, &response)
+	if err != nil {
+		return nil, err
+	} else {
+		return splitList(response.Plans), nil
+	}
+}
+
+func (this *API) ListTemplates(virtType string) ([]APITemplate, error) {
+	params := make(map[string]string)
+	params["type"] = virtType
+	params["listpipefriendly"] = "true"
+	var response APIListTemplatesResponse
+	err := this.request("listtemplates", params, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	// the field depends on the virtualization type, and each template is
+	// listed as filename|friendly name
+	var templates []APITemplate
+	for _, list := range []string{response.Templates, response.TemplatesHvm, response.TemplatesKvm} {
+		for _, item := range splitList(list) {
+			parts := strings.SplitN(item, "|", 2)
+			template := APITemplate{Filename: parts[0], Name: parts[0]}
+			if len(parts) == 2 && parts[1] != "" {
+				template.Name = parts[1]
+			}
+			templates = append(templates, template)
+		}
+	}
+	return templates, nil
+}
@@ -1,5 +1,6 @@
 package solusvm
 
+import "github.com/LunaNode/cloug/provider/common"
 import "github.com/LunaNode/cloug/service/compute"
 
 import "encoding/json"
@@ -11,22 +12,29 @@ type SolusJSONConfig struct {
 	Insecure  bool   `json:"insecure"`
 	VirtType  string `json:"virt_type"`
 	NodeGroup string `json:"node_group"`
+
+	// IDs of the nodes in the node group; if empty, instances are listed
+	// from every node of the virtualization type.
+	NodeIds []int `json:"node_ids"`
+
+	// Overrides URL if set.
+	APIURL string `json:"api_url"`
 }
 
-func SolusVMFromJSON(jsonData []byte) (compute.Provider, error) {
+func SolusVMFromJSON(jsonData []byte, options ...common.Option) (compute.Provider, error) {
 	var cfg SolusJSONConfig
 	err := json.Unmarshal(jsonData, &cfg)
 	if err != nil {
 		return nil, err
 	}
-	return &SolusVM{
-		VirtType: cfg.VirtType,
-		NodeGroup: cfg.NodeGroup,
-		Api: &API{
-			Url: cfg.URL,
-			ApiId: cfg.ApiID,
-			ApiKey: cfg.ApiKey,
-			Insecure: cfg.Insecure,
-		},
-	}, nil
+
+	// an injected client or transport takes precedence over insecure
+	configOptions := []common.Option{common.WithAPIURL(cfg.APIURL)}
+	if cfg.Insecure {
+		configOptions = append(configOptions, common.WithTransport(insecureClient.Transport))
+	}
+	solus := MakeSolusVM(cfg.URL, cfg.ApiID, cfg.ApiKey, cfg.VirtType, cfg.NodeGroup, append(configOptions, options...)...)
+	solus.Api.Insecure = cfg.Insecure
+	solus.NodeIds = cfg.NodeIds
+	return solus, nil
 }
@@ -38,4 +38,45 @@ type APIVmInfoResponse struct {
 	InternalIps string   `xml:"internalips"`
 	State       string   `xml:"state"`
 	Bandwidth   string   `xml:"bandwidth"`
+	Hostname    string   `xml:"hostname"`
+}
+
+// nodes, plans and templates
+
+type APINodeIdsResponse struct {
+	XMLName xml.Name `xml:"root"`
+	Nodes   string   `xml:"nodes"`
+}
+
+type APIVirtualServer struct {
+	VmId      string `xml:"vserverid"`
+	Hostname  string `xml:"hostname"`
+	Ip        string `xml:"ipaddress"`
+	Template  string `xml:"template"`
+	Type      string `xml:"type"`
+	State     string `xml:"state"`
+	Memory    string `xml:"memory"`
+	Diskspace string `xml:"hdd"`
+}
+
+type APINodeVirtualServersResponse struct {
+	XMLName        xml.Name           `xml:"root"`
+	VirtualServers []APIVirtualServer `xml:"virtualservers>virtualserver"`
+}
+
+type APIListPlansResponse struct {
+	XMLName xml.Name `xml:"root"`
+	Plans   string   `xml:"plans"`
+}
+
+type APIListTemplatesResponse struct {
+	XMLName      xml.Name `xml:"root"`
+	Templates    string   `xml:"templates"`
+	TemplatesHvm string   `xml:"templateshvm"`
+	TemplatesKvm string   `xml:"templateskvm"`
+}
+
+type APITemplate struct {
+	Filename string
+	Name     string
 }
@@ -0,0 +1,425 @@
+// Package simulator provides a local stand-in for the SolusVM admin API.
+//
+// The server checks the API ID and key posted with every request and answers
+// with XML fragments that have no root element, like SolusVM does. Nodes,
+// plans and templates are fixed, and virtual servers are kept in memory, so
+// that the API client and the compute adapter can be tested without a
+// SolusVM master.
+package simulator
+
+import "bytes"
+import "encoding/xml"
+import "fmt"
+import "net/http"
+import "net/http/httptest"
+import "net/url"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+
+// Template that is available for creating virtual servers, and its friendly
+// name.
+const TEMPLATE = "ubuntu-16.04-x86_64"
+const TEMPLATE_NAME = "Ubuntu 16.04 64bit"
+
+// Plan that is available for every virtualization type, besides the
+// "Cloug <virt type>" plan.
+const PLAN = "VPS 1G"
+
+// Nodes that host every virtualization type; virtual servers are placed on
+// them in turn.
+var NODE_IDS = []int{1, 2}
+
+var VIRT_TYPES = []string{"openvz", "xen", "xenhvm", "kvm"}
+
+type vserver struct {
+	id        int
+	nodeID    int
+	virtType  string
+	nodeGroup string
+	hostname  string
+	template  string
+	plan      string
+	state     string
+	memory    string
+	disk      int
+	cpu       int
+	ips       []string
+	internal  string
+	password  string
+	tunTap    bool
+}
+
+// A response field, written as <key>value</key>. The value is a string, or a
+// []field for nested elements.
+type field struct {
+	key   string
+	value interface{}
+}
+
+// Server is a SolusVM API simulator listening on a local port.
+type Server struct {
+	*httptest.Server
+
+	ApiID  string
+	ApiKey string
+
+	mu       sync.Mutex
+	nextID   int
+	nextIP   int
+	vservers map[int]*vserver
+}
+
+// Starts a simulator that accepts the given API ID and key.
+func NewServer(apiID string, apiKey string) *Server {
+	s := &Server{
+		ApiID:    apiID,
+		ApiKey:   apiKey,
+		nextID:   100,
+		nextIP:   10,
+		vservers: make(map[int]*vserver),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Returns the API endpoint URL that the client should use.
+func (s *Server) APIURL() string {
+	return s.URL + "/api/admin/command.php"
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	fields, message := s.handle(r)
+	status := "success"
+	if message != "" && fields == nil {
+		status = "error"
+	}
+
+	var buf bytes.Buffer
+	s.writeField(&buf, field{"status", status})
+	s.writeField(&buf, field{"statusmsg", message})
+	for _, f := range fields {
+		s.writeField(&buf, f)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.Write(buf.Bytes())
+}
+
+func (s *Server) writeField(buf *bytes.Buffer, f field) {
+	buf.WriteString("<" + f.key + ">")
+	if children, ok := f.value.([]field); ok {
+		for _, child := range children {
+			s.writeField(buf, child)
+		}
+	} else {
+		xml.EscapeText(buf, []byte(f.value.(string)))
+	}
+	buf.WriteString("</" + f.key + ">")
+}
+
+// Handles a request, returning the response fields and status message.
+// A nil field list with a message indicates an error.
+func (s *Server) handle(r *http.Request) ([]field, string) {
+	if r.Method != "POST" || r.URL.Path != "/api/admin/command.php" {
+		return nil, "Invalid request"
+	} else if err := r.ParseForm(); err != nil {
+		return nil, "Invalid request"
+	}
+	form := r.PostForm
+	if form.Get("id") != s.ApiID || form.Get("key") != s.ApiKey {
+		return nil, "Invalid id or key"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	action := form.Get("action")
+	switch action {
+	case "vserver-create":
+		return s.create(form)
+	case "node-idlist":
+		if !validVirtType(form.Get("type")) {
+			return nil, "Invalid virtualization type"
+		}
+		var nodeIDs []string
+		for _, nodeID := range NODE_IDS {
+			nodeIDs = append(nodeIDs, strconv.Itoa(nodeID))
+		}
+		return []field{{"nodes", strings.Join(nodeIDs, ",")}}, ""
+	case "node-virtualservers":
+		return s.nodeVirtualServers(form.Get("nodeid"))
+	case "listplans":
+		if !validVirtType(form.Get("type")) {
+			return nil, "Invalid virtualization type"
+		}
+		return []field{{"plans", "Cloug " + form.Get("type") + "," + PLAN}}, ""
+	case "listtemplates":
+		return s.listTemplates(form)
+	}
+
+	vserverID, _ := strconv.Atoi(form.Get("vserverid"))
+	vserver := s.vservers[vserverID]
+	if vserver == nil {
+		return nil, "Virtual server not found"
+	}
+
+	switch action {
+	case "vserver-infoall":
+		return s.infoall(vserver), ""
+	case "vserver-boot":
+		vserver.state = "online"
+		return []field{}, "Virtual server booted"
+	case "vserver-shutdown":
+		vserver.state = "offline"
+		return []field{}, "Virtual server shutdown"
+	case "vserver-reboot":
+		vserver.state = "online"
+		return []field{}, "Virtual server rebooted"
+	case "vserver-terminate":
+		delete(s.vservers, vserver.id)
+		return []field{}, "Virtual server terminated"
+	case "vserver-rebuild":
+		if form.Get("template") != TEMPLATE {
+			return nil, "Template not found"
+		}
+		vserver.template = form.Get("template")
+		return []field{}, "Virtual server is being rebuilt"
+	case "vserver-hostname":
+		if form.Get("hostname") == "" {
+			return nil, "Hostname not specified"
+		}
+		vserver.hostname = form.Get("hostname")
+		return []field{{"hostname", vserver.hostname}}, "Hostname changed"
+	case "vserver-vnc":
+		return s.vnc(vserver)
+	case "vserver-console":
+		return s.console(vserver)
+	case "vserver-tun-enable", "vserver-tun-disable":
+		if vserver.virtType != "openvz" {
+			return nil, "TUN/TAP is only available for OpenVZ"
+		}
+		vserver.tunTap = action == "vserver-tun-enable"
+		return []field{}, "TUN/TAP updated"
+	case "vserver-addip":
+		ip := s.newIP()
+		vserver.ips = append(vserver.ips, ip)
+		return []field{{"ipaddress", ip}}, "IP address added"
+	case "vserver-delip":
+		return s.delip(vserver, form.Get("ipaddr"))
+	case "vserver-change-hdd":
+		return s.changeResource(&vserver.disk, form.Get("hdd"), "Hard disk")
+	case "vserver-change-cpu":
+		return s.changeResource(&vserver.cpu, form.Get("cpu"), "CPU")
+	case "vserver-change-memory":
+		for _, part := range strings.Split(form.Get("memory"), "|") {
+			if n, err := strconv.Atoi(part); err != nil || n <= 0 {
+				return nil, "Invalid memory amount"
+			}
+		}
+		vserver.memory = form.Get("memory")
+		return []field{}, "Memory updated"
+	default:
+		return nil, "Invalid action"
+	}
+}
+
+func (s *Server) newIP() string {
+	s.nextIP++
+	return fmt.Sprintf("203.0.113.%d", s.nextIP%250+1)
+}
+
+func validVirtType(virtType string) bool {
+	for _, validType := range VIRT_TYPES {
+		if virtType == validType {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) nodeVirtualServers(nodeIDStr string) ([]field, string) {
+	nodeID, _ := strconv.Atoi(nodeIDStr)
+	found := false
+	for _, id := range NODE_IDS {
+		found = found || id == nodeID
+	}
+	if !found {
+		return nil, "Node not found"
+	}
+
+	var ids []int
+	for id, vserver := range s.vservers {
+		if vserver.nodeID == nodeID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	vservers := []field{}
+	for _, id := range ids {
+		vserver := s.vservers[id]
+		vservers = append(vservers, field{"virtualserver", []field{
+			{"vserverid", strconv.Itoa(vserver.id)},
+			{"ctid-xid", fmt.Sprintf("%s%d", vserver.virtType, vserver.id)},
+			{"clientid", "1"},
+			{"ipaddress", vserver.ips[0]},
+			{"hostname", vserver.hostname},
+			{"template", vserver.template},
+			{"hdd", strconv.Itoa(vserver.disk)},
+			{"memory", vserver.memory},
+			{"type", vserver.virtType},
+			{"state", vserver.state},
+		}})
+	}
+	return []field{{"virtualservers", vservers}}, ""
+}
+
+func (s *Server) listTemplates(form url.Values) ([]field, string) {
+	virtType := form.Get("type")
+	if !validVirtType(virtType) {
+		return nil, "Invalid virtualization type"
+	}
+	template := TEMPLATE
+	if form.Get("listpipefriendly") == "true" {
+		template += "|" + TEMPLATE_NAME
+	}
+	fields := []field{{"templates", "--none--"}, {"templateshvm", "--none--"}, {"templateskvm", "--none--"}}
+	switch virtType {
+	case "xenhvm":
+		fields[1].value = template
+	case "kvm":
+		fields[2].value = template
+	default:
+		fields[0].value = template
+	}
+	return fields, ""
+}
+
+func (s *Server) create(form url.Values) ([]field, string) {
+	if !validVirtType(form.Get("type")) {
+		return nil, "Invalid virtualization type"
+	} else if form.Get("nodegroup") == "" {
+		return nil, "Node group not specified"
+	} else if len(form.Get("hostname")) < 4 {
+		return nil, "Hostname must be at least 4 characters"
+	} else if form.Get("password") == "" || form.Get("username") == "" {
+		return nil, "Client username and password required"
+	} else if form.Get("plan") != "Cloug "+form.Get("type") && form.Get("plan") != PLAN {
+		return nil, "Plan not found"
+	} else if form.Get("template") != TEMPLATE {
+		return nil, "Template not found"
+	}
+
+	s.nextID++
+	vserver := &vserver{
+		id:        s.nextID,
+		nodeID:    NODE_IDS[s.nextID%len(NODE_IDS)],
+		virtType:  form.Get("type"),
+		nodeGroup: form.Get("nodegroup"),
+		hostname:  form.Get("hostname"),
+		template:  form.Get("template"),
+		plan:      form.Get("plan"),
+		state:     "online",
+		memory:    form.Get("custommemory"),
+		disk:      20,
+		cpu:       1,
+		password:  form.Get("password"),
+		internal:  fmt.Sprintf("10.10.0.%d", s.nextID%250+1),
+	}
+	if vserver.memory == "" {
+		vserver.memory = "1024"
+	}
+	if form.Get("customdiskspace") != "" {
+		vserver.disk, _ = strconv.Atoi(form.Get("customdiskspace"))
+	}
+	if form.Get("customcpu") != "" {
+		vserver.cpu, _ = strconv.Atoi(form.Get("customcpu"))
+	}
+	ips, _ := strconv.Atoi(form.Get("ips"))
+	if ips < 1 {
+		ips = 1
+	}
+	for i := 0; i < ips; i++ {
+		vserver.ips = append(vserver.ips, s.newIP())
+	}
+	s.vservers[vserver.id] = vserver
+
+	return []field{
+		{"mainipaddress", vserver.ips[0]},
+		{"extraipaddress", strings.Join(vserver.ips[1:], ",")},
+		{"rootpassword", vserver.password},
+		{"vserverid", strconv.Itoa(vserver.id)},
+		{"consoleuser", fmt.Sprintf("console-%d", vserver.id)},
+		{"consolepassword", "console"},
+		{"hostname", vserver.hostname},
+		{"virtid", fmt.Sprintf("%s%d", vserver.virtType, vserver.id)},
+		{"nodeid", "1"},
+	}, "Virtual server created"
+}
+
+func (s *Server) infoall(vserver *vserver) []field {
+	ips := append([]string(nil), vserver.ips...)
+	sort.Strings(ips)
+	mainIP := ""
+	if len(vserver.ips) > 0 {
+		mainIP = vserver.ips[0]
+	}
+	// bandwidth is total,used,free,percent in bytes
+	total := int64(1024) * 1024 * 1024 * 1024
+	used := int64(vserver.id) * 1024 * 1024
+	return []field{
+		{"state", vserver.state},
+		{"mainipaddress", mainIP},
+		{"ipaddresses", strings.Join(ips, ",")},
+		{"internalips", vserver.internal},
+		{"type", vserver.virtType},
+		{"hostname", vserver.hostname},
+		{"node", fmt.Sprintf("node%d", vserver.nodeID)},
+		{"bandwidth", fmt.Sprintf("%d,%d,%d,%d", total, used, total-used, used*100/total)},
+	}
+}
+
+func (s *Server) vnc(vserver *vserver) ([]field, string) {
+	if vserver.virtType == "openvz" {
+		return nil, "VNC is not available for OpenVZ"
+	}
+	return []field{
+		{"vncip", "192.0.2.1"},
+		{"vncport", strconv.Itoa(5900 + vserver.id)},
+		{"vncpassword", "vnc" + strconv.Itoa(vserver.id)},
+	}, ""
+}
+
+func (s *Server) console(vserver *vserver) ([]field, string) {
+	if vserver.virtType != "openvz" && vserver.virtType != "xen" {
+		return nil, "Serial console is not available for this virtualization type"
+	}
+	return []field{
+		{"consoleip", "192.0.2.1"},
+		{"consoleport", "22"},
+		{"consoleusername", fmt.Sprintf("console-%d", vserver.id)},
+		{"consolepassword", "console"},
+	}, ""
+}
+
+func (s *Server) delip(vserver *vserver, ip string) ([]field, string) {
+	for i, addr := range vserver.ips {
+		if addr == ip {
+			if i == 0 {
+				return nil, "Main IP address cannot be removed"
+			}
+			vserver.ips = append(vserver.ips[:i], vserver.ips[i+1:]...)
+			return []field{}, "IP address removed"
+		}
+	}
+	return nil, "IP address not found"
+}
+
+func (s *Server) changeResource(target *int, value string, label string) ([]field, string) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return nil, "Invalid " + strings.ToLower(label) + " amount"
+	}
+	*target = n
+	return []field{}, label + " updated"
+}
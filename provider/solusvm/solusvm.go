@@ -1,7 +1,9 @@
 package solusvm
 
+import "github.com/LunaNode/cloug/provider/common"
 import "github.com/LunaNode/cloug/service/compute"
 
+import "context"
 import "fmt"
 import "strconv"
 import "strings"
@@ -15,12 +17,47 @@ type SolusVM struct {
 	VirtType  string
 	NodeGroup string
 	Api       *API
+
+	// IDs of the nodes in NodeGroup, which ListInstances enumerates. The API
+	// does not report which nodes belong to a group, so if this is empty,
+	// ListInstances enumerates every node of VirtType.
+	NodeIds []int
+}
+
+// The API URL option takes precedence over apiURL. Requests are POSTs that
+// carry the action in the body, so only rate limited requests are retried.
+func MakeSolusVM(apiURL string, apiID string, apiKey string, virtType string, nodeGroup string, options ...common.Option) *SolusVM {
+	opts := common.MakeHTTPOptions(append([]common.Option{common.WithAPIURL(apiURL)}, options...)...)
+	return &SolusVM{
+		VirtType:  virtType,
+		NodeGroup: nodeGroup,
+		Api: &API{
+			Url:    opts.APIURL,
+			ApiId:  apiID,
+			ApiKey: apiKey,
+			Client: opts.HTTPClient(defaultClient),
+		},
+	}
 }
 
 func (solus *SolusVM) ComputeService() compute.Service {
 	return solus
 }
 
+func (solus *SolusVM) Capabilities() *compute.Capabilities {
+	return &compute.Capabilities{
+		Operations:     compute.ImplementedOperations(solus, compute.OpSetAddressHostname, compute.OpCreateImage, compute.OpDeleteImage),
+		InstanceFields: []compute.InstanceField{compute.FieldName, compute.FieldDiskGB},
+	}
+}
+
+// Returns a copy of the service whose API calls use the given context.
+func (solus *SolusVM) withContext(ctx context.Context) *SolusVM {
+	contextSolus := *solus
+	contextSolus.Api = solus.Api.WithContext(ctx)
+	return &contextSolus
+}
+
 func (solus *SolusVM) mapInstanceStatus(status string) compute.InstanceStatus {
 	if status == "online" {
 		return compute.StatusOnline
@@ -34,6 +71,7 @@ func (solus *SolusVM) mapInstanceStatus(status string) compute.InstanceStatus {
 func (solus *SolusVM) vmToInstance(id int, apiInfo *APIVmInfoResponse) *compute.Instance {
 	instance := &compute.Instance{
 		ID:        strconv.Itoa(id),
+		Name:      apiInfo.Hostname,
 		IP:        apiInfo.Ip,
 		PrivateIP: apiInfo.InternalIps,
 		Status:    solus.mapInstanceStatus(apiInfo.State),
@@ -59,11 +97,15 @@ func (solus *SolusVM) vmToInstance(id int, apiInfo *APIVmInfoResponse) *compute.
 	return instance
 }
 
+// Creates the virtual server on the plan given by the flavor ID or name, with
+// any resources set in the flavor overriding the plan. Without a plan, it uses
+// the "Cloug <virt type>" plan with default resources.
 func (solus *SolusVM) CreateInstance(instance *compute.Instance) (*compute.Instance, error) {
 	name := DEFAULT_NAME
-	ram := DEFAULT_RAM
-	disk := DEFAULT_DISK
-	cores := DEFAULT_CORES
+	plan := instance.Flavor.ID
+	ram := instance.Flavor.MemoryMB
+	disk := instance.Flavor.DiskGB
+	cores := instance.Flavor.NumCores
 
 	if instance.Name != "" {
 		name = instance.Name
@@ -71,22 +113,38 @@ func (solus *SolusVM) CreateInstance(instance *compute.Instance) (*compute.Insta
 			name += ".cloug"
 		}
 	}
-	if instance.Flavor.MemoryMB != 0 {
-		ram = instance.Flavor.MemoryMB
-	}
-	if instance.Flavor.DiskGB != 0 {
-		disk = instance.Flavor.DiskGB
+
+	imageID, err := common.GetMatchingImageID(solus, &instance.Image)
+	if err != nil {
+		return nil, err
 	}
-	if instance.Flavor.NumCores != 0 {
-		cores = instance.Flavor.NumCores
+
+	if plan == "" && instance.Flavor.Name != "" {
+		plan, err = solus.FindFlavor(&instance.Flavor)
+		if err != nil {
+			return nil, err
+		} else if plan == "" {
+			return nil, compute.Errorf(compute.ErrNotFound, "plan %s not found", instance.Flavor.Name)
+		}
+	} else if plan == "" {
+		plan = "Cloug " + solus.VirtType
+		if ram == 0 {
+			ram = DEFAULT_RAM
+		}
+		if disk == 0 {
+			disk = DEFAULT_DISK
+		}
+		if cores == 0 {
+			cores = DEFAULT_CORES
+		}
 	}
 
-	vmID, password, err := solus.Api.VmCreate(solus.VirtType, solus.NodeGroup, name, instance.Image.ID, ram, disk, cores)
+	vmID, password, err := solus.Api.VmCreate(solus.VirtType, solus.NodeGroup, name, imageID, plan, ram, disk, cores)
 	if err != nil {
 		return nil, err
 	} else {
 		return &compute.Instance{
-			ID: strconv.Itoa(vmID),
+			ID:       strconv.Itoa(vmID),
 			Password: password,
 		}, nil
 	}
@@ -95,7 +153,7 @@ func (solus *SolusVM) CreateInstance(instance *compute.Instance) (*compute.Insta
 func (solus *SolusVM) instanceAction(instanceID string, f func(id int) error) error {
 	instanceIDInt, err := strconv.Atoi(instanceID)
 	if err != nil {
-		return fmt.Errorf("invalid instance ID: %s", instanceID)
+		return compute.Errorf(compute.ErrNotFound, "instance %s not found: invalid instance ID", instanceID)
 	} else {
 		return f(instanceIDInt)
 	}
@@ -105,12 +163,49 @@ func (solus *SolusVM) DeleteInstance(instanceID string) error {
 	return solus.instanceAction(instanceID, solus.Api.VmDelete)
 }
 
+// Lists the virtual servers of VirtType on the NodeIds nodes, or on every node
+// of VirtType if NodeIds is empty.
 func (solus *SolusVM) ListInstances() ([]*compute.Instance, error) {
-	return nil, fmt.Errorf("not implemented")
+	nodeIds := solus.NodeIds
+	if len(nodeIds) == 0 {
+		var err error
+		nodeIds, err = solus.Api.NodeIds(solus.VirtType)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list nodes: %w", err)
+		}
+	}
+
+	var instances []*compute.Instance
+	for _, nodeId := range nodeIds {
+		vservers, err := solus.Api.NodeVirtualServers(nodeId)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list virtual servers on node %d: %w", nodeId, err)
+		}
+		for _, vserver := range vservers {
+			// Xen nodes host both paravirtualized and HVM servers
+			if strings.Replace(vserver.Type, " ", "", -1) != strings.Replace(solus.VirtType, " ", "", -1) {
+				continue
+			}
+			id, err := strconv.Atoi(vserver.VmId)
+			if err != nil {
+				return nil, fmt.Errorf("invalid virtual server ID %s: %w", vserver.VmId, err)
+			}
+			instances = append(instances, solus.vmToInstance(id, &APIVmInfoResponse{
+				Ip:       vserver.Ip,
+				Ips:      vserver.Ip,
+				State:    vserver.State,
+				Hostname: vserver.Hostname,
+			}))
+		}
+	}
+	return instances, nil
 }
 
 func (solus *SolusVM) GetInstance(instanceID string) (*compute.Instance, error) {
-	instanceIDInt, _ := strconv.Atoi(instanceID)
+	instanceIDInt, err := strconv.Atoi(instanceID)
+	if err != nil {
+		return nil, compute.Errorf(compute.ErrNotFound, "instance %s not found: invalid instance ID", instanceID)
+	}
 	apiInfo, err := solus.Api.VmInfo(instanceIDInt)
 	if err != nil {
 		return nil, err
@@ -131,6 +226,34 @@ func (solus *SolusVM) RebootInstance(instanceID string) error {
 	return solus.instanceAction(instanceID, solus.Api.VmReboot)
 }
 
+func (solus *SolusVM) CreateInstanceContext(ctx context.Context, instance *compute.Instance) (*compute.Instance, error) {
+	return solus.withContext(ctx).CreateInstance(instance)
+}
+
+func (solus *SolusVM) DeleteInstanceContext(ctx context.Context, instanceID string) error {
+	return solus.withContext(ctx).DeleteInstance(instanceID)
+}
+
+func (solus *SolusVM) ListInstancesContext(ctx context.Context) ([]*compute.Instance, error) {
+	return solus.withContext(ctx).ListInstances()
+}
+
+func (solus *SolusVM) GetInstanceContext(ctx context.Context, instanceID string) (*compute.Instance, error) {
+	return solus.withContext(ctx).GetInstance(instanceID)
+}
+
+func (solus *SolusVM) StartInstanceContext(ctx context.Context, instanceID string) error {
+	return solus.withContext(ctx).StartInstance(instanceID)
+}
+
+func (solus *SolusVM) StopInstanceContext(ctx context.Context, instanceID string) error {
+	return solus.withContext(ctx).StopInstance(instanceID)
+}
+
+func (solus *SolusVM) RebootInstanceContext(ctx context.Context, instanceID string) error {
+	return solus.withContext(ctx).RebootInstance(instanceID)
+}
+
 func (solus *SolusVM) GetVNC(instanceID string) (string, error) {
 	var url string
 	err := solus.instanceAction(instanceID, func(id int) error {
@@ -165,8 +288,12 @@ func (solus *SolusVM) RenameInstance(instanceID string, name string) error {
 }
 
 func (solus *SolusVM) ReimageInstance(instanceID string, image *compute.Image) error {
+	imageID, err := common.GetMatchingImageID(solus, image)
+	if err != nil {
+		return err
+	}
 	return solus.instanceAction(instanceID, func(id int) error {
-		return solus.Api.VmReimage(id, image.ID)
+		return solus.Api.VmReimage(id, imageID)
 	})
 }
 
@@ -205,8 +332,8 @@ func (solus *SolusVM) ListInstanceAddresses(instanceID string) ([]*compute.Addre
 
 		for _, addrString := range strings.Split(apiInfo.Ips, ",") {
 			addresses = append(addresses, &compute.Address{
-				ID:        instanceID + ":" + addrString,
-				IP:        addrString,
+				ID: instanceID + ":" + addrString,
+				IP: addrString,
 			})
 		}
 		return nil
@@ -240,5 +367,94 @@ func (solus *SolusVM) RemoveAddressFromInstance(instanceID string, addressID str
 }
 
 func (solus *SolusVM) SetAddressHostname(addressID string, hostname string) error {
-	return fmt.Errorf("operation not supported")
+	return compute.ErrNotSupported
+}
+
+// Lists the plans for VirtType. The API only reports plan names, so the
+// flavors have no resources.
+func (solus *SolusVM) ListFlavors() ([]*compute.Flavor, error) {
+	plans, err := solus.Api.ListPlans(solus.VirtType)
+	if err != nil {
+		return nil, err
+	}
+	flavors := make([]*compute.Flavor, len(plans))
+	for i, plan := range plans {
+		flavors[i] = &compute.Flavor{
+			ID:   plan,
+			Name: plan,
+		}
+	}
+	return flavors, nil
+}
+
+// Finds a plan by name.
+func (solus *SolusVM) FindFlavor(flavor *compute.Flavor) (string, error) {
+	if flavor.Name == "" {
+		return "", nil
+	}
+	flavors, err := solus.ListFlavors()
+	if err != nil {
+		return "", err
+	}
+	for _, candidate := range flavors {
+		if candidate.Name == flavor.Name {
+			return candidate.ID, nil
+		}
+	}
+	return "", nil
+}
+
+func (solus *SolusVM) ListImages() ([]*compute.Image, error) {
+	templates, err := solus.Api.ListTemplates(solus.VirtType)
+	if err != nil {
+		return nil, err
+	}
+	images := make([]*compute.Image, len(templates))
+	for i, template := range templates {
+		images[i] = &compute.Image{
+			ID:     template.Filename,
+			Name:   template.Name,
+			Type:   compute.TemplateImage,
+			Status: compute.ImageAvailable,
+		}
+	}
+	return images, nil
+}
+
+// Finds a template by friendly name or filename.
+func (solus *SolusVM) FindImage(image *compute.Image) (string, error) {
+	if image.Name == "" {
+		return "", nil
+	}
+	images, err := solus.ListImages()
+	if err != nil {
+		return "", err
+	}
+	for _, candidate := range images {
+		if candidate.Name == image.Name || candidate.ID == image.Name {
+			return candidate.ID, nil
+		}
+	}
+	return "", nil
+}
+
+func (solus *SolusVM) GetImage(imageID string) (*compute.Image, error) {
+	images, err := solus.ListImages()
+	if err != nil {
+		return nil, err
+	}
+	for _, image := range images {
+		if image.ID == imageID {
+			return image, nil
+		}
+	}
+	return nil, compute.Errorf(compute.ErrNotFound, "template %s not found", imageID)
+}
+
+func (solus *SolusVM) CreateImage(image *compute.Image) (*compute.Image, error) {
+	return nil, compute.ErrNotSupported
+}
+
+func (solus *SolusVM) DeleteImage(imageID string) error {
+	return compute.ErrNotSupported
 }
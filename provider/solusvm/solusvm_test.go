@@ -0,0 +1,93 @@
+package solusvm
+
+import "github.com/LunaNode/cloug/provider/solusvm/simulator"
+import "github.com/LunaNode/cloug/service/compute"
+import "github.com/LunaNode/cloug/service/compute/conformance"
+
+import "errors"
+import "testing"
+import "time"
+
+func makeTestSolusVM(server *simulator.Server, apiKey string) *SolusVM {
+	return MakeSolusVM(server.APIURL(), server.ApiID, apiKey, "kvm", "1")
+}
+
+func TestConformance(t *testing.T) {
+	server := simulator.NewServer("apiid", "apikey")
+	defer server.Close()
+
+	conformance.Run(t, makeTestSolusVM(server, server.ApiKey), &conformance.Config{
+		Instance: compute.Instance{
+			Name:  "cloug-test",
+			Image: compute.Image{ID: simulator.TEMPLATE},
+		},
+		ResizeFlavor: &compute.Flavor{MemoryMB: 1024, DiskGB: 20, NumCores: 2},
+		Wait:         compute.WaitOptions{Interval: 10 * time.Millisecond},
+	})
+}
+
+func TestBadKey(t *testing.T) {
+	server := simulator.NewServer("apiid", "apikey")
+	defer server.Close()
+
+	solus := makeTestSolusVM(server, "wrong key")
+	if _, err := solus.GetInstance("100"); !errors.Is(err, compute.ErrAuth) {
+		t.Fatalf("expected auth error, got %v", err)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	server := simulator.NewServer("apiid", "apikey")
+	defer server.Close()
+
+	solus := makeTestSolusVM(server, server.ApiKey)
+	instance, err := solus.CreateInstance(&compute.Instance{
+		Name:   "cloug-plan",
+		Image:  compute.Image{Name: simulator.TEMPLATE_NAME},
+		Flavor: compute.Flavor{Name: simulator.PLAN},
+	})
+	if err != nil {
+		t.Fatalf("CreateInstance: %v", err)
+	}
+
+	instances, err := solus.ListInstances()
+	if err != nil {
+		t.Fatalf("ListInstances: %v", err)
+	} else if len(instances) != 1 || instances[0].ID != instance.ID || instances[0].Name != "cloug-plan" {
+		t.Fatalf("expected only %s named cloug-plan, got %v", instance.ID, instances)
+	}
+
+	_, err = solus.CreateInstance(&compute.Instance{
+		Image:  compute.Image{ID: simulator.TEMPLATE},
+		Flavor: compute.Flavor{Name: "missing plan"},
+	})
+	if !errors.Is(err, compute.ErrNotFound) {
+		t.Fatalf("expected missing plan error, got %v", err)
+	}
+}
+
+func TestListNodeIds(t *testing.T) {
+	server := simulator.NewServer("apiid", "apikey")
+	defer server.Close()
+
+	// the simulator places servers on alternating nodes
+	solus := makeTestSolusVM(server, server.ApiKey)
+	for i := 0; i < 2; i++ {
+		_, err := solus.CreateInstance(&compute.Instance{Image: compute.Image{ID: simulator.TEMPLATE}})
+		if err != nil {
+			t.Fatalf("CreateInstance: %v", err)
+		}
+	}
+
+	if instances, err := solus.ListInstances(); err != nil {
+		t.Fatalf("ListInstances: %v", err)
+	} else if len(instances) != 2 {
+		t.Fatalf("expected instances from every node, got %d", len(instances))
+	}
+	solus.NodeIds = simulator.NODE_IDS[:1]
+	if instances, err := solus.ListInstances(); err != nil {
+		t.Fatalf("ListInstances: %v", err)
+	} else if len(instances) != 1 {
+		t.Fatalf("expected instances from node %d only, got %d", simulator.NODE_IDS[0], len(instances))
+	}
+}
@@ -1,22 +1,24 @@
 package vultr
 
+import "github.com/LunaNode/cloug/provider/common"
 import "github.com/LunaNode/cloug/service/compute"
 
-import vultr "github.com/LunaNode/vultr/lib"
-
 import "encoding/json"
 
 type VultrJSONConfig struct {
 	ApiKey string `json:"api_key"`
+	APIURL string `json:"api_url"`
+
+	// Defaults to RATE_LIMIT and RATE_LIMIT_BURST.
+	common.RateLimitConfig
 }
 
-func VultrFromJSON(jsonData []byte) (compute.Provider, error) {
+func VultrFromJSON(jsonData []byte, options ...common.Option) (compute.Provider, error) {
 	var cfg VultrJSONConfig
 	err := json.Unmarshal(jsonData, &cfg)
 	if err != nil {
 		return nil, err
 	}
-	return &Vultr{
-		client: vultr.NewClient(cfg.ApiKey, nil),
-	}, nil
+	options = append([]common.Option{common.WithAPIURL(cfg.APIURL), cfg.Option(RATE_LIMIT, RATE_LIMIT_BURST)}, options...)
+	return MakeVultr(cfg.ApiKey, options...), nil
 }
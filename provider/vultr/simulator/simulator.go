@@ -0,0 +1,594 @@
+// Package simulator provides a local stand-in for the Vultr API v1.
+//
+// The server checks the API-Key header, takes form-encoded POST requests and
+// answers like the v1 API: lists are objects keyed by ID, most numbers are
+// strings, empty lists are [] and failures are plain text with status 412.
+// Regions, plans, operating systems and applications are fixed, and servers,
+// snapshots and SSH keys are kept in memory, so that the compute adapter can
+// be tested without an account.
+package simulator
+
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "net/http/httptest"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+// Operating system that servers can be created from.
+const OS_ID = 215
+
+// Operating systems that select another image source.
+const (
+	OS_CUSTOM      = 159
+	OS_SNAPSHOT    = 164
+	OS_APPLICATION = 186
+)
+
+type region struct {
+	id   int
+	name string
+	code string
+}
+
+type plan struct {
+	id    int
+	ram   int
+	disk  int
+	vcpus int
+	price string
+}
+
+type operatingSystem struct {
+	id     int
+	name   string
+	family string
+}
+
+type application struct {
+	id   int
+	name string
+}
+
+var REGIONS = []region{
+	{1, "New Jersey", "EWR"},
+	{2, "Chicago", "ORD"},
+	{7, "Amsterdam", "AMS"},
+}
+
+var PLANS = []plan{
+	{200, 512, 20, 1, "2.50"},
+	{201, 1024, 25, 1, "5.00"},
+	{202, 2048, 40, 1, "10.00"},
+}
+
+var OPERATING_SYSTEMS = []operatingSystem{
+	{OS_ID, "Ubuntu 16.04 x64", "ubuntu"},
+	{230, "FreeBSD 11 x64", "freebsd"},
+	{OS_CUSTOM, "Custom", "iso"},
+	{OS_SNAPSHOT, "Snapshot", "snapshot"},
+	{OS_APPLICATION, "Application", "application"},
+}
+
+var APPLICATIONS = []application{
+	{1, "LEMP"},
+	{2, "WordPress"},
+}
+
+type server struct {
+	id       int
+	label    string
+	status   string
+	power    string
+	regionID int
+	planID   int
+	osID     int
+	password string
+	ip       string
+	created  string
+
+	// power status that the server reaches once pendingPolls is zero
+	target       string
+	pendingPolls int
+}
+
+type snapshot struct {
+	id          string
+	description string
+	size        int64
+	status      string
+	created     string
+
+	pendingPolls int
+}
+
+type sshKey struct {
+	id      string
+	name    string
+	key     string
+	created string
+}
+
+// A failure, which the v1 API reports as a plain text body.
+type apiError struct {
+	code    int
+	message string
+}
+
+func invalid(format string, args ...interface{}) *apiError {
+	return &apiError{http.StatusPreconditionFailed, fmt.Sprintf(format, args...)}
+}
+
+// Server is a Vultr API simulator listening on a local port.
+type Server struct {
+	*httptest.Server
+
+	ApiKey string
+
+	// Number of list requests for which new servers and snapshots are still
+	// pending, and for which power actions are still in progress.
+	PendingPolls int
+
+	mu        sync.Mutex
+	nextID    int
+	servers   map[int]*server
+	snapshots map[string]*snapshot
+	keys      map[string]*sshKey
+}
+
+// Starts a simulator that accepts the given API key.
+func NewServer(apiKey string) *Server {
+	s := &Server{
+		ApiKey:       apiKey,
+		PendingPolls: 1,
+		nextID:       1000,
+		servers:      make(map[int]*server),
+		snapshots:    make(map[string]*snapshot),
+		keys:         make(map[string]*sshKey),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Returns the API endpoint URL that the client should use.
+func (s *Server) APIURL() string {
+	return s.URL + "/"
+}
+
+func findRegion(id int) *region {
+	for i := range REGIONS {
+		if REGIONS[i].id == id {
+			return &REGIONS[i]
+		}
+	}
+	return nil
+}
+
+func findPlan(id int) *plan {
+	for i := range PLANS {
+		if PLANS[i].id == id {
+			return &PLANS[i]
+		}
+	}
+	return nil
+}
+
+func findOS(id int) *operatingSystem {
+	for i := range OPERATING_SYSTEMS {
+		if OPERATING_SYSTEMS[i].id == id {
+			return &OPERATING_SYSTEMS[i]
+		}
+	}
+	return nil
+}
+
+func findApplication(id int) *application {
+	for i := range APPLICATIONS {
+		if APPLICATIONS[i].id == id {
+			return &APPLICATIONS[i]
+		}
+	}
+	return nil
+}
+
+func timestamp() string {
+	return time.Now().UTC().Format("2006-01-02 15:04:05")
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	response, err := s.handle(r)
+	s.mu.Unlock()
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(err.code)
+		w.Write([]byte(err.message))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if response != nil {
+		// the client compares the body to [] exactly, so no trailing newline
+		body, _ := json.Marshal(response)
+		w.Write(body)
+	}
+}
+
+func (s *Server) handle(r *http.Request) (interface{}, *apiError) {
+	apiKey := r.Header.Get("API-Key")
+	if apiKey == "" {
+		apiKey = r.URL.Query().Get("api_key")
+	}
+	if apiKey != s.ApiKey {
+		return nil, &apiError{http.StatusForbidden, "Invalid API key.  Check that your API key is correct and that API access is enabled."}
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	if path == r.URL.Path {
+		return nil, &apiError{http.StatusNotFound, "Invalid API location.  Check the URL that you are using."}
+	}
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil {
+			return nil, &apiError{http.StatusBadRequest, "Unable to parse the request body"}
+		}
+	}
+
+	getters := map[string]func(r *http.Request) (interface{}, *apiError){
+		"regions/list":  s.listRegions,
+		"plans/list":    s.listPlans,
+		"os/list":       s.listOS,
+		"app/list":      s.listApplications,
+		"server/list":   s.listServers,
+		"snapshot/list": s.listSnapshots,
+		"sshkey/list":   s.listKeys,
+	}
+	posters := map[string]func(r *http.Request) (interface{}, *apiError){
+		"server/create":    s.createServer,
+		"server/destroy":   s.destroyServer,
+		"server/start":     s.powerAction("running"),
+		"server/halt":      s.powerAction("stopped"),
+		"server/reboot":    s.powerAction("running"),
+		"snapshot/create":  s.createSnapshot,
+		"snapshot/destroy": s.destroySnapshot,
+		"sshkey/create":    s.createKey,
+		"sshkey/destroy":   s.destroyKey,
+	}
+	if f := getters[path]; f != nil {
+		if r.Method != "GET" {
+			return nil, &apiError{http.StatusMethodNotAllowed, "Invalid HTTP method.  Check that the method (POST|GET) matches what the documentation indicates."}
+		}
+		return f(r)
+	} else if f := posters[path]; f != nil {
+		if r.Method != "POST" {
+			return nil, &apiError{http.StatusMethodNotAllowed, "Invalid HTTP method.  Check that the method (POST|GET) matches what the documentation indicates."}
+		}
+		return f(r)
+	}
+	return nil, &apiError{http.StatusNotFound, "Invalid API location.  Check the URL that you are using."}
+}
+
+// Returns the objects keyed by ID, or an empty array if there are none as
+// the v1 API does.
+func keyed(m map[string]interface{}) interface{} {
+	if len(m) == 0 {
+		return []interface{}{}
+	}
+	return m
+}
+
+func (s *Server) listRegions(r *http.Request) (interface{}, *apiError) {
+	m := make(map[string]interface{})
+	for _, region := range REGIONS {
+		m[strconv.Itoa(region.id)] = map[string]interface{}{
+			"DCID":            strconv.Itoa(region.id),
+			"name":            region.name,
+			"regioncode":      region.code,
+			"ddos_protection": false,
+			"block_storage":   false,
+		}
+	}
+	return keyed(m), nil
+}
+
+func (s *Server) listPlans(r *http.Request) (interface{}, *apiError) {
+	var locations []int
+	for _, region := range REGIONS {
+		locations = append(locations, region.id)
+	}
+	m := make(map[string]interface{})
+	for _, plan := range PLANS {
+		m[strconv.Itoa(plan.id)] = map[string]interface{}{
+			"VPSPLANID":           strconv.Itoa(plan.id),
+			"name":                fmt.Sprintf("%d MB RAM,%d GB SSD,1.00 TB BW", plan.ram, plan.disk),
+			"vcpu_count":          strconv.Itoa(plan.vcpus),
+			"ram":                 strconv.Itoa(plan.ram),
+			"disk":                strconv.Itoa(plan.disk),
+			"bandwidth":           "1.00",
+			"price_per_month":     plan.price,
+			"plan_type":           "SSD",
+			"windows":             false,
+			"available_locations": locations,
+		}
+	}
+	return keyed(m), nil
+}
+
+func (s *Server) listOS(r *http.Request) (interface{}, *apiError) {
+	m := make(map[string]interface{})
+	for _, os := range OPERATING_SYSTEMS {
+		m[strconv.Itoa(os.id)] = map[string]interface{}{
+			"OSID":    os.id,
+			"name":    os.name,
+			"arch":    "x64",
+			"family":  os.family,
+			"windows": false,
+		}
+	}
+	return keyed(m), nil
+}
+
+func (s *Server) listApplications(r *http.Request) (interface{}, *apiError) {
+	m := make(map[string]interface{})
+	for _, app := range APPLICATIONS {
+		m[strconv.Itoa(app.id)] = map[string]interface{}{
+			"APPID":      strconv.Itoa(app.id),
+			"name":       app.name,
+			"short_name": strings.ToLower(app.name),
+			"surcharge":  0,
+		}
+	}
+	return keyed(m), nil
+}
+
+// Servers
+
+func (s *Server) findServer(r *http.Request) (*server, *apiError) {
+	id, _ := strconv.Atoi(r.FormValue("SUBID"))
+	if srv := s.servers[id]; srv != nil {
+		return srv, nil
+	}
+	return nil, invalid("Invalid server.  Check SUBID value and ensure your API key matches the server's account")
+}
+
+// Counts a list request of the server and finishes its installation or power
+// action once it has been polled enough.
+func (s *Server) poll(srv *server) {
+	if srv.pendingPolls > 0 {
+		srv.pendingPolls--
+		return
+	}
+	srv.status = "active"
+	if srv.target != "" {
+		srv.power = srv.target
+		srv.target = ""
+	}
+}
+
+func (s *Server) mapServer(srv *server) map[string]interface{} {
+	plan := findPlan(srv.planID)
+	state := "ok"
+	if srv.status == "pending" {
+		state = "installingbooting"
+	} else if srv.target != "" {
+		state = "locked"
+	}
+	kvmURL := ""
+	if srv.status == "active" {
+		kvmURL = fmt.Sprintf("%s/console/?SUBID=%d", s.URL, srv.id)
+	}
+	return map[string]interface{}{
+		"SUBID":                strconv.Itoa(srv.id),
+		"label":                srv.label,
+		"os":                   findOS(srv.osID).name,
+		"OSID":                 strconv.Itoa(srv.osID),
+		"ram":                  fmt.Sprintf("%d MB", plan.ram),
+		"disk":                 fmt.Sprintf("Virtual %d GB", plan.disk),
+		"vcpu_count":           strconv.Itoa(plan.vcpus),
+		"VPSPLANID":            strconv.Itoa(plan.id),
+		"cost_per_month":       plan.price,
+		"DCID":                 strconv.Itoa(srv.regionID),
+		"location":             findRegion(srv.regionID).name,
+		"main_ip":              srv.ip,
+		"netmask_v4":           "255.255.254.0",
+		"gateway_v4":           "203.0.113.1",
+		"internal_ip":          "",
+		"default_password":     srv.password,
+		"date_created":         srv.created,
+		"status":               srv.status,
+		"power_status":         srv.power,
+		"server_state":         state,
+		"current_bandwidth_gb": 0,
+		"allowed_bandwidth_gb": "1000",
+		"pending_charges":      "0.00",
+		"kvm_url":              kvmURL,
+		"auto_backups":         "no",
+		"tag":                  "",
+	}
+}
+
+// Lists all servers, or the server with the SUBID parameter by itself.
+func (s *Server) listServers(r *http.Request) (interface{}, *apiError) {
+	if r.FormValue("SUBID") != "" {
+		srv, err := s.findServer(r)
+		if err != nil {
+			return nil, err
+		}
+		s.poll(srv)
+		return s.mapServer(srv), nil
+	}
+	m := make(map[string]interface{})
+	for _, srv := range s.servers {
+		s.poll(srv)
+		m[strconv.Itoa(srv.id)] = s.mapServer(srv)
+	}
+	return keyed(m), nil
+}
+
+func (s *Server) createServer(r *http.Request) (interface{}, *apiError) {
+	regionID, _ := strconv.Atoi(r.FormValue("DCID"))
+	planID, _ := strconv.Atoi(r.FormValue("VPSPLANID"))
+	osID, _ := strconv.Atoi(r.FormValue("OSID"))
+	if findRegion(regionID) == nil {
+		return nil, invalid("Invalid datacenter specified")
+	} else if findPlan(planID) == nil {
+		return nil, invalid("Invalid plan specified")
+	} else if findOS(osID) == nil {
+		return nil, invalid("Invalid operating system specified")
+	}
+
+	switch osID {
+	case OS_CUSTOM:
+		return nil, invalid("Invalid ISO specified")
+	case OS_SNAPSHOT:
+		snapshot := s.snapshots[r.FormValue("SNAPSHOTID")]
+		if snapshot == nil || snapshot.status != "complete" {
+			return nil, invalid("Invalid snapshot specified")
+		}
+	case OS_APPLICATION:
+		appID, _ := strconv.Atoi(r.FormValue("APPID"))
+		if findApplication(appID) == nil {
+			return nil, invalid("Invalid application specified")
+		}
+	}
+	for _, keyID := range strings.Split(r.FormValue("SSHKEYID"), ",") {
+		if keyID != "" && s.keys[keyID] == nil {
+			return nil, invalid("Invalid SSH key specified")
+		}
+	}
+
+	s.nextID++
+	srv := &server{
+		id:           s.nextID,
+		label:        r.FormValue("label"),
+		status:       "pending",
+		power:        "running",
+		regionID:     regionID,
+		planID:       planID,
+		osID:         osID,
+		password:     fmt.Sprintf("pw%d", s.nextID),
+		ip:           fmt.Sprintf("203.0.113.%d", s.nextID%250+2),
+		created:      timestamp(),
+		pendingPolls: s.PendingPolls,
+	}
+	s.servers[srv.id] = srv
+	return map[string]string{"SUBID": strconv.Itoa(srv.id)}, nil
+}
+
+func (s *Server) destroyServer(r *http.Request) (interface{}, *apiError) {
+	srv, err := s.findServer(r)
+	if err != nil {
+		return nil, err
+	}
+	delete(s.servers, srv.id)
+	return nil, nil
+}
+
+// Returns a handler for an action that changes the power status, which takes
+// effect after PendingPolls list requests.
+func (s *Server) powerAction(target string) func(r *http.Request) (interface{}, *apiError) {
+	return func(r *http.Request) (interface{}, *apiError) {
+		srv, err := s.findServer(r)
+		if err != nil {
+			return nil, err
+		} else if srv.status != "active" {
+			return nil, invalid("Server is currently locked")
+		}
+		srv.target = target
+		srv.pendingPolls = s.PendingPolls
+		return nil, nil
+	}
+}
+
+// Snapshots
+
+func (s *Server) listSnapshots(r *http.Request) (interface{}, *apiError) {
+	m := make(map[string]interface{})
+	for _, snapshot := range s.snapshots {
+		if snapshot.pendingPolls > 0 {
+			snapshot.pendingPolls--
+		} else {
+			snapshot.status = "complete"
+		}
+		m[snapshot.id] = map[string]interface{}{
+			"SNAPSHOTID":   snapshot.id,
+			"date_created": snapshot.created,
+			"description":  snapshot.description,
+			"size":         strconv.FormatInt(snapshot.size, 10),
+			"status":       snapshot.status,
+			"OSID":         strconv.Itoa(OS_ID),
+			"APPID":        "0",
+		}
+	}
+	return keyed(m), nil
+}
+
+func (s *Server) createSnapshot(r *http.Request) (interface{}, *apiError) {
+	srv, err := s.findServer(r)
+	if err != nil {
+		return nil, err
+	}
+	s.nextID++
+	snapshot := &snapshot{
+		id:           fmt.Sprintf("%013x", s.nextID),
+		description:  r.FormValue("description"),
+		size:         int64(findPlan(srv.planID).disk) * 1024 * 1024 * 1024,
+		status:       "pending",
+		created:      timestamp(),
+		pendingPolls: s.PendingPolls,
+	}
+	s.snapshots[snapshot.id] = snapshot
+	return map[string]string{"SNAPSHOTID": snapshot.id}, nil
+}
+
+func (s *Server) destroySnapshot(r *http.Request) (interface{}, *apiError) {
+	id := r.FormValue("SNAPSHOTID")
+	if s.snapshots[id] == nil {
+		return nil, invalid("Invalid snapshot ID")
+	}
+	delete(s.snapshots, id)
+	return nil, nil
+}
+
+// SSH keys
+
+func (s *Server) listKeys(r *http.Request) (interface{}, *apiError) {
+	m := make(map[string]interface{})
+	for _, key := range s.keys {
+		m[key.id] = map[string]interface{}{
+			"SSHKEYID":     key.id,
+			"name":         key.name,
+			"ssh_key":      key.key,
+			"date_created": key.created,
+		}
+	}
+	return keyed(m), nil
+}
+
+func (s *Server) createKey(r *http.Request) (interface{}, *apiError) {
+	name := r.FormValue("name")
+	key := strings.TrimSpace(r.FormValue("ssh_key"))
+	if name == "" {
+		return nil, invalid("Missing SSH key name")
+	} else if fields := strings.Fields(key); len(fields) < 2 || !strings.HasPrefix(fields[0], "ssh-") {
+		return nil, invalid("Invalid SSH key")
+	}
+	s.nextID++
+	sshKey := &sshKey{
+		id:      fmt.Sprintf("%013x", s.nextID),
+		name:    name,
+		key:     key,
+		created: timestamp(),
+	}
+	s.keys[sshKey.id] = sshKey
+	return map[string]string{"SSHKEYID": sshKey.id}, nil
+}
+
+func (s *Server) destroyKey(r *http.Request) (interface{}, *apiError) {
+	id := r.FormValue("SSHKEYID")
+	if s.keys[id] == nil {
+		return nil, invalid("Invalid SSH key")
+	}
+	delete(s.keys, id)
+	return nil, nil
+}
@@ -12,18 +12,48 @@ import "strings"
 const DEFAULT_NAME = "cloug"
 const DEFAULT_REGION = "New Jersey"
 
+// Vultr allows two requests per second.
+const RATE_LIMIT = 2
+const RATE_LIMIT_BURST = 2
+
 type Vultr struct {
 	client *vultr.Client
 }
 
+func MakeVultr(apiKey string, options ...common.Option) *Vultr {
+	opts := common.MakeHTTPOptions(append([]common.Option{common.WithRateLimit(RATE_LIMIT, RATE_LIMIT_BURST)}, options...)...)
+	return &Vultr{
+		client: vultr.NewClient(apiKey, &vultr.Options{
+			HTTPClient: opts.HTTPClient(nil),
+			Endpoint:   opts.APIURL,
+		}),
+	}
+}
+
 func (vt *Vultr) ComputeService() compute.Service {
 	return vt
 }
 
+func (vt *Vultr) Capabilities() *compute.Capabilities {
+	return &compute.Capabilities{
+		Operations:     compute.ImplementedOperations(vt, compute.OpFindImage),
+		ImageSources:   []compute.ImageSource{compute.ImageSourceInstance},
+		InstanceFields: []compute.InstanceField{compute.FieldName, compute.FieldRegion, compute.FieldPublicKey},
+	}
+}
+
+// Vultr reports a SUBID that is not on the account as an invalid server.
+func (vt *Vultr) mapServerError(err error) error {
+	if err != nil && strings.Contains(strings.ToLower(err.Error()), "invalid server") {
+		return compute.WrapError(compute.ErrNotFound, err)
+	}
+	return common.ClassifyError(err)
+}
+
 func (vt *Vultr) findOSByName(name string) (int, error) {
 	osList, err := vt.client.GetOS()
 	if err != nil {
-		return 0, err
+		return 0, common.ClassifyError(err)
 	}
 
 	for _, os := range osList {
@@ -44,7 +74,7 @@ func (vt *Vultr) findRegion(str string) (int, error) {
 
 	regions, err := vt.client.GetRegions()
 	if err != nil {
-		return 0, fmt.Errorf("error listing regions: %v", err)
+		return 0, fmt.Errorf("error listing regions: %w", common.ClassifyError(err))
 	}
 	for _, region := range regions {
 		if strings.ToLower(region.Name) == strings.ToLower(str) {
@@ -70,7 +100,7 @@ func (vt *Vultr) CreateInstance(instance *compute.Instance) (*compute.Instance,
 
 	flavorIDInt, err := strconv.Atoi(flavorID)
 	if err != nil {
-		return nil, fmt.Errorf("invalid flavor ID: %s", flavorID)
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "invalid flavor ID: %s", flavorID)
 	}
 
 	name := instance.Name
@@ -113,7 +143,7 @@ func (vt *Vultr) CreateInstance(instance *compute.Instance) (*compute.Instance,
 		serverOptions.OS = appOSID
 		serverOptions.Application, _ = strconv.Atoi(imageParts[1])
 	} else {
-		return nil, fmt.Errorf("invalid image type " + imageParts[0])
+		return nil, compute.Errorf(compute.ErrInvalidArgument, "invalid image type %s", imageParts[0])
 	}
 
 	if instance.PublicKey.ID != "" {
@@ -131,7 +161,7 @@ func (vt *Vultr) CreateInstance(instance *compute.Instance) (*compute.Instance,
 
 	server, err := vt.client.CreateServer(name, regionID, flavorIDInt, serverOptions)
 	if err != nil {
-		return nil, err
+		return nil, common.ClassifyError(err)
 	} else {
 		return &compute.Instance{
 			ID: server.ID,
@@ -140,7 +170,7 @@ func (vt *Vultr) CreateInstance(instance *compute.Instance) (*compute.Instance,
 }
 
 func (vt *Vultr) DeleteInstance(instanceID string) error {
-	return vt.client.DeleteServer(instanceID)
+	return vt.mapServerError(vt.client.DeleteServer(instanceID))
 }
 
 func (vt *Vultr) mapInstanceStatus(status string, powerStatus string) compute.InstanceStatus {
@@ -176,7 +206,7 @@ func (vt *Vultr) serverToInstance(server vultr.Server) *compute.Instance {
 func (vt *Vultr) ListInstances() ([]*compute.Instance, error) {
 	servers, err := vt.client.GetServers()
 	if err != nil {
-		return nil, err
+		return nil, common.ClassifyError(err)
 	}
 	instances := make([]*compute.Instance, len(servers))
 	for i, server := range servers {
@@ -188,28 +218,28 @@ func (vt *Vultr) ListInstances() ([]*compute.Instance, error) {
 func (vt *Vultr) GetInstance(instanceID string) (*compute.Instance, error) {
 	server, err := vt.client.GetServer(instanceID)
 	if err != nil {
-		return nil, err
+		return nil, vt.mapServerError(err)
 	} else {
 		return vt.serverToInstance(server), nil
 	}
 }
 
 func (vt *Vultr) StartInstance(instanceID string) error {
-	return vt.client.StartServer(instanceID)
+	return vt.mapServerError(vt.client.StartServer(instanceID))
 }
 
 func (vt *Vultr) StopInstance(instanceID string) error {
-	return vt.client.HaltServer(instanceID)
+	return vt.mapServerError(vt.client.HaltServer(instanceID))
 }
 
 func (vt *Vultr) RebootInstance(instanceID string) error {
-	return vt.client.RebootServer(instanceID)
+	return vt.mapServerError(vt.client.RebootServer(instanceID))
 }
 
 func (vt *Vultr) GetVNC(instanceID string) (string, error) {
 	server, err := vt.client.GetServer(instanceID)
 	if err != nil {
-		return "", fmt.Errorf("failed to get server details: %v", err)
+		return "", fmt.Errorf("failed to get server details: %w", vt.mapServerError(err))
 	} else if server.KVMUrl == "" {
 		return "", fmt.Errorf("console is not ready yet")
 	} else {
@@ -226,7 +256,7 @@ func (vt *Vultr) CreateImage(imageTemplate *compute.Image) (*compute.Image, erro
 
 		snapshot, err := vt.client.CreateSnapshot(imageTemplate.SourceInstance, name)
 		if err != nil {
-			return nil, err
+			return nil, common.ClassifyError(err)
 		} else {
 			return &compute.Image{
 				ID:             fmt.Sprintf("snapshot:%s", snapshot.ID),
@@ -234,7 +264,7 @@ func (vt *Vultr) CreateImage(imageTemplate *compute.Image) (*compute.Image, erro
 			}, nil
 		}
 	} else if imageTemplate.SourceURL != "" {
-		return nil, fmt.Errorf("creating image from source URL is not supported on vultr provider")
+		return nil, compute.Errorf(compute.ErrNotSupported, "creating image from source URL is not supported on vultr provider")
 	} else {
 		return nil, fmt.Errorf("neither source instance nor source URL is set")
 	}
@@ -257,7 +287,7 @@ func (vt *Vultr) mapSnapshot(snapshot *vultr.Snapshot) *compute.Image {
 }
 
 func (vt *Vultr) FindImage(image *compute.Image) (string, error) {
-	return "", fmt.Errorf("operation not supported")
+	return "", compute.ErrNotSupported
 }
 
 func (vt *Vultr) ListImages() ([]*compute.Image, error) {
@@ -265,7 +295,7 @@ func (vt *Vultr) ListImages() ([]*compute.Image, error) {
 
 	osList, err := vt.client.GetOS()
 	if err != nil {
-		return nil, err
+		return nil, common.ClassifyError(err)
 	}
 	for _, os := range osList {
 		images = append(images, &compute.Image{
@@ -276,7 +306,7 @@ func (vt *Vultr) ListImages() ([]*compute.Image, error) {
 
 	apps, err := vt.client.GetApplications()
 	if err != nil {
-		return nil, err
+		return nil, common.ClassifyError(err)
 	}
 	for _, app := range apps {
 		images = append(images, &compute.Image{
@@ -287,7 +317,7 @@ func (vt *Vultr) ListImages() ([]*compute.Image, error) {
 
 	snapshots, err := vt.client.GetSnapshots()
 	if err != nil {
-		return nil, err
+		return nil, common.ClassifyError(err)
 	}
 	for _, snapshot := range snapshots {
 		images = append(images, vt.mapSnapshot(&snapshot))
@@ -299,36 +329,36 @@ func (vt *Vultr) ListImages() ([]*compute.Image, error) {
 func (vt *Vultr) GetImage(imageID string) (*compute.Image, error) {
 	imageParts := strings.SplitN(imageID, ":", 2)
 	if len(imageParts) != 2 {
-		return nil, fmt.Errorf("malformed image identification: missing colon")
+		return nil, compute.Errorf(compute.ErrNotFound, "image %s not found: missing colon", imageID)
 	} else if imageParts[0] != "snapshot" {
-		return nil, fmt.Errorf("GetImage only supports snapshot images")
+		return nil, compute.Errorf(compute.ErrNotSupported, "GetImage only supports snapshot images")
 	}
 	snapshots, err := vt.client.GetSnapshots()
 	if err != nil {
-		return nil, err
+		return nil, common.ClassifyError(err)
 	}
 	for _, snapshot := range snapshots {
 		if snapshot.ID == imageParts[1] {
 			return vt.mapSnapshot(&snapshot), nil
 		}
 	}
-	return nil, fmt.Errorf("image not found")
+	return nil, compute.Errorf(compute.ErrNotFound, "image not found")
 }
 
 func (vt *Vultr) DeleteImage(imageID string) error {
 	imageParts := strings.SplitN(imageID, ":", 2)
 	if len(imageParts) != 2 {
-		return fmt.Errorf("malformed image identification: missing colon")
+		return compute.Errorf(compute.ErrNotFound, "image %s not found: missing colon", imageID)
 	} else if imageParts[0] != "snapshot" {
-		return fmt.Errorf("can only delete snapshot images")
+		return compute.Errorf(compute.ErrNotSupported, "can only delete snapshot images")
 	}
-	return vt.client.DeleteSnapshot(imageParts[1])
+	return common.ClassifyError(vt.client.DeleteSnapshot(imageParts[1]))
 }
 
 func (vt *Vultr) ListFlavors() ([]*compute.Flavor, error) {
 	apiPlans, err := vt.client.GetPlans()
 	if err != nil {
-		return nil, err
+		return nil, common.ClassifyError(err)
 	}
 	flavors := make([]*compute.Flavor, len(apiPlans))
 	for i, apiPlan := range apiPlans {
@@ -354,7 +384,7 @@ func (vt *Vultr) FindFlavor(flavor *compute.Flavor) (string, error) {
 func (vt *Vultr) ListPublicKeys() ([]*compute.PublicKey, error) {
 	keys, err := vt.client.GetSSHKeys()
 	if err != nil {
-		return nil, err
+		return nil, common.ClassifyError(err)
 	}
 	publicKeys := make([]*compute.PublicKey, len(keys))
 	for i, key := range keys {
@@ -371,7 +401,7 @@ func (vt *Vultr) ImportPublicKey(key *compute.PublicKey) (*compute.PublicKey, er
 	return common.ImportPublicKeyWrapper(key, func(label string, key string) (string, error) {
 		vtKey, err := vt.client.CreateSSHKey(label, key)
 		if err != nil {
-			return "", err
+			return "", common.ClassifyError(err)
 		} else {
 			return vtKey.ID, nil
 		}
@@ -379,5 +409,5 @@ func (vt *Vultr) ImportPublicKey(key *compute.PublicKey) (*compute.PublicKey, er
 }
 
 func (vt *Vultr) RemovePublicKey(keyID string) error {
-	return vt.client.DeleteSSHKey(keyID)
+	return common.ClassifyError(vt.client.DeleteSSHKey(keyID))
 }
@@ -0,0 +1,24 @@
+package vultr
+
+import "github.com/LunaNode/cloug/provider/common"
+import "github.com/LunaNode/cloug/provider/vultr/simulator"
+import "github.com/LunaNode/cloug/service/compute"
+import "github.com/LunaNode/cloug/service/compute/conformance"
+
+import "fmt"
+import "testing"
+import "time"
+
+func TestConformance(t *testing.T) {
+	server := simulator.NewServer("key")
+	defer server.Close()
+
+	conformance.Run(t, MakeVultr("key", common.WithAPIURL(server.APIURL()), common.WithRateLimit(0, 0)), &conformance.Config{
+		Instance: compute.Instance{
+			Image:  compute.Image{ID: fmt.Sprintf("os:%d", simulator.OS_ID)},
+			Flavor: compute.Flavor{MemoryMB: 1024},
+		},
+		PublicKey: []byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJ0S1uMTNPZdfSW6GYaCwMPPVM4oFgNbXx0DMSWf1b4I conformance"),
+		Wait:      compute.WaitOptions{Interval: 10 * time.Millisecond},
+	})
+}
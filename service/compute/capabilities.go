@@ -0,0 +1,163 @@
+package compute
+
+// Operation identifies a method of Service or of one of the optional service
+// interfaces. The value is the method name.
+type Operation string
+
+const (
+	OpCreateInstance Operation = "CreateInstance"
+	OpDeleteInstance Operation = "DeleteInstance"
+	OpListInstances  Operation = "ListInstances"
+	OpGetInstance    Operation = "GetInstance"
+	OpStartInstance  Operation = "StartInstance"
+	OpStopInstance   Operation = "StopInstance"
+	OpRebootInstance Operation = "RebootInstance"
+
+	OpGetVNC          Operation = "GetVNC"
+	OpRenameInstance  Operation = "RenameInstance"
+	OpReimageInstance Operation = "ReimageInstance"
+	OpResizeInstance  Operation = "ResizeInstance"
+
+	OpCreateImage Operation = "CreateImage"
+	OpFindImage   Operation = "FindImage"
+	OpListImages  Operation = "ListImages"
+	OpGetImage    Operation = "GetImage"
+	OpDeleteImage Operation = "DeleteImage"
+
+	OpListInstanceAddresses     Operation = "ListInstanceAddresses"
+	OpAddAddressToInstance      Operation = "AddAddressToInstance"
+	OpRemoveAddressFromInstance Operation = "RemoveAddressFromInstance"
+	OpSetAddressHostname        Operation = "SetAddressHostname"
+
+	OpListFlavors Operation = "ListFlavors"
+	OpFindFlavor  Operation = "FindFlavor"
+
+	OpListPublicKeys  Operation = "ListPublicKeys"
+	OpImportPublicKey Operation = "ImportPublicKey"
+	OpRemovePublicKey Operation = "RemovePublicKey"
+
+	OpCreateVolume Operation = "CreateVolume"
+	OpListVolumes  Operation = "ListVolumes"
+	OpGetVolume    Operation = "GetVolume"
+	OpDeleteVolume Operation = "DeleteVolume"
+	OpAttachVolume Operation = "AttachVolume"
+	OpDetachVolume Operation = "DetachVolume"
+	OpResizeVolume Operation = "ResizeVolume"
+
+	OpCreateSecurityGroup     Operation = "CreateSecurityGroup"
+	OpListSecurityGroups      Operation = "ListSecurityGroups"
+	OpGetSecurityGroup        Operation = "GetSecurityGroup"
+	OpDeleteSecurityGroup     Operation = "DeleteSecurityGroup"
+	OpAddSecurityGroupRule    Operation = "AddSecurityGroupRule"
+	OpRemoveSecurityGroupRule Operation = "RemoveSecurityGroupRule"
+)
+
+// ImageSource identifies an Image field that CreateImage can create an image from.
+type ImageSource string
+
+const (
+	ImageSourceInstance ImageSource = "SourceInstance"
+	ImageSourceURL      ImageSource = "SourceURL"
+)
+
+// InstanceField identifies an Instance field that CreateInstance may honor.
+type InstanceField string
+
+const (
+	FieldName      InstanceField = "Name"
+	FieldRegion    InstanceField = "Region"
+	FieldPassword  InstanceField = "Password"
+	FieldPublicKey InstanceField = "PublicKey"
+	FieldNetworkID InstanceField = "NetworkID"
+	FieldDiskGB    InstanceField = "Flavor.DiskGB"
+)
+
+// Capabilities describes what a provider actually implements.
+type Capabilities struct {
+	// Operations that are implemented, i.e., that do not always fail with ErrNotSupported.
+	Operations []Operation
+
+	// Sources that CreateImage accepts.
+	ImageSources []ImageSource
+
+	// Instance fields that CreateInstance uses; other fields are ignored.
+	InstanceFields []InstanceField
+}
+
+func (c *Capabilities) Supports(op Operation) bool {
+	for _, x := range c.Operations {
+		if x == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Capabilities) SupportsImageSource(source ImageSource) bool {
+	for _, x := range c.ImageSources {
+		if x == source {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Capabilities) Honors(field InstanceField) bool {
+	for _, x := range c.InstanceFields {
+		if x == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the operations of Service and of each optional service interface that
+// service implements, excluding the specified unsupported operations.
+func ImplementedOperations(service Service, unsupported ...Operation) []Operation {
+	ops := []Operation{OpCreateInstance, OpDeleteInstance, OpListInstances, OpGetInstance, OpStartInstance, OpStopInstance, OpRebootInstance}
+	if _, ok := service.(VNCService); ok {
+		ops = append(ops, OpGetVNC)
+	}
+	if _, ok := service.(RenameService); ok {
+		ops = append(ops, OpRenameInstance)
+	}
+	if _, ok := service.(ReimageService); ok {
+		ops = append(ops, OpReimageInstance)
+	}
+	if _, ok := service.(ResizeService); ok {
+		ops = append(ops, OpResizeInstance)
+	}
+	if _, ok := service.(ImageService); ok {
+		ops = append(ops, OpCreateImage, OpFindImage, OpListImages, OpGetImage, OpDeleteImage)
+	}
+	if _, ok := service.(AddressService); ok {
+		ops = append(ops, OpListInstanceAddresses, OpAddAddressToInstance, OpRemoveAddressFromInstance, OpSetAddressHostname)
+	}
+	if _, ok := service.(FlavorService); ok {
+		ops = append(ops, OpListFlavors, OpFindFlavor)
+	}
+	if _, ok := service.(KeypairService); ok {
+		ops = append(ops, OpListPublicKeys, OpImportPublicKey, OpRemovePublicKey)
+	}
+	if _, ok := service.(VolumeService); ok {
+		ops = append(ops, OpCreateVolume, OpListVolumes, OpGetVolume, OpDeleteVolume, OpAttachVolume, OpDetachVolume, OpResizeVolume)
+	}
+	if _, ok := service.(SecurityGroupService); ok {
+		ops = append(ops, OpCreateSecurityGroup, OpListSecurityGroups, OpGetSecurityGroup, OpDeleteSecurityGroup, OpAddSecurityGroupRule, OpRemoveSecurityGroupRule)
+	}
+
+	var implemented []Operation
+	for _, op := range ops {
+		supported := true
+		for _, x := range unsupported {
+			if x == op {
+				supported = false
+				break
+			}
+		}
+		if supported {
+			implemented = append(implemented, op)
+		}
+	}
+	return implemented
+}
@@ -0,0 +1,26 @@
+package compute
+
+import "testing"
+
+type vncService struct {
+	Service
+}
+
+func (s *vncService) GetVNC(instanceID string) (string, error) {
+	return "", nil
+}
+
+func TestImplementedOperations(t *testing.T) {
+	capabilities := &Capabilities{
+		Operations: ImplementedOperations(&vncService{}, OpListInstances),
+	}
+	if !capabilities.Supports(OpCreateInstance) || !capabilities.Supports(OpGetVNC) {
+		t.Fatalf("expected CreateInstance and GetVNC in %v", capabilities.Operations)
+	}
+	if capabilities.Supports(OpListInstances) {
+		t.Fatalf("expected ListInstances to be excluded from %v", capabilities.Operations)
+	}
+	if capabilities.Supports(OpCreateImage) {
+		t.Fatalf("did not expect image operations in %v", capabilities.Operations)
+	}
+}
@@ -2,6 +2,9 @@ package compute
 
 type Provider interface {
 	ComputeService() Service
+
+	// Describes which operations and CreateInstance fields the provider supports.
+	Capabilities() *Capabilities
 }
 
 type Service interface {
@@ -79,3 +82,37 @@ type KeypairService interface {
 	ImportPublicKey(key *PublicKey) (*PublicKey, error)
 	RemovePublicKey(keyID string) error
 }
+
+type VolumeService interface {
+	// Creates a new volume.
+	// SizeGB is required. Other fields may be ignored by some providers.
+	CreateVolume(volume *Volume) (*Volume, error)
+
+	ListVolumes() ([]*Volume, error)
+	GetVolume(volumeID string) (*Volume, error)
+	DeleteVolume(volumeID string) error
+
+	// Attaches a volume to an instance in the same region.
+	AttachVolume(volumeID string, instanceID string) error
+
+	// Detaches a volume from whatever instance it is attached to.
+	DetachVolume(volumeID string) error
+
+	// Grows the volume to the specified size.
+	// Shrinking volumes is generally not supported.
+	ResizeVolume(volumeID string, sizeGB int) error
+}
+
+type SecurityGroupService interface {
+	// Creates a security group with the specified rules.
+	// Name is required.
+	CreateSecurityGroup(group *SecurityGroup) (*SecurityGroup, error)
+
+	ListSecurityGroups() ([]*SecurityGroup, error)
+	GetSecurityGroup(groupID string) (*SecurityGroup, error)
+	DeleteSecurityGroup(groupID string) error
+
+	// Adds a rule to the security group, and returns the rule with its ID set.
+	AddSecurityGroupRule(groupID string, rule *SecurityGroupRule) (*SecurityGroupRule, error)
+	RemoveSecurityGroupRule(groupID string, ruleID string) error
+}
@@ -0,0 +1,436 @@
+// Package conformance runs a standard lifecycle against a compute.Provider and
+// reports deviations from the semantics documented in package compute.
+//
+// Every provider runs the suite offline in its TestConformance. Providers of
+// remote APIs run it against a stateful stand-in of the API on a local
+// httptest server.
+package conformance
+
+import "github.com/LunaNode/cloug/service/compute"
+
+import "errors"
+import "testing"
+import "time"
+
+const BOGUS_ID = "cloug-conformance-missing"
+
+type Config struct {
+	// Template for the instance that is created. It should select an image
+	// and a flavor that are cheap to provision.
+	Instance compute.Instance
+
+	// Flavor to resize the instance to. Resizing is skipped if this is nil.
+	ResizeFlavor *compute.Flavor
+
+	// Public key imported when the provider implements KeypairService.
+	PublicKey []byte
+
+	// Size of the volume created when the provider implements VolumeService.
+	// Volumes are skipped if this is zero.
+	VolumeSizeGB int
+
+	// Polling policy used while waiting for instances to change state.
+	Wait compute.WaitOptions
+}
+
+type suite struct {
+	service      compute.Service
+	capabilities *compute.Capabilities
+	cfg          *Config
+}
+
+// Runs the conformance suite against the provider. Each step is a subtest; a
+// step whose operation is not in the provider's capabilities instead checks
+// that the operation fails with compute.ErrNotSupported.
+func Run(t *testing.T, provider compute.Provider, cfg *Config) {
+	s := &suite{
+		service:      provider.ComputeService(),
+		capabilities: provider.Capabilities(),
+		cfg:          cfg,
+	}
+
+	t.Run("Capabilities", s.testCapabilities)
+	t.Run("Flavors", s.testFlavors)
+	t.Run("Images", s.testImages)
+	t.Run("MissingInstance", s.testMissingInstance)
+	t.Run("SecurityGroups", s.testSecurityGroups)
+
+	var instanceID string
+	if !t.Run("CreateInstance", func(t *testing.T) { instanceID = s.testCreate(t) }) {
+		return
+	}
+	defer func() {
+		if instanceID != "" {
+			s.service.DeleteInstance(instanceID)
+		}
+	}()
+
+	t.Run("GetInstance", func(t *testing.T) { s.testGet(t, instanceID) })
+	t.Run("ListInstances", func(t *testing.T) { s.testList(t, instanceID) })
+	t.Run("StopStartReboot", func(t *testing.T) { s.testPower(t, instanceID) })
+	t.Run("RenameInstance", func(t *testing.T) { s.testRename(t, instanceID) })
+	t.Run("ResizeInstance", func(t *testing.T) { s.testResize(t, instanceID) })
+	t.Run("VNC", func(t *testing.T) { s.testVNC(t, instanceID) })
+	t.Run("Addresses", func(t *testing.T) { s.testAddresses(t, instanceID) })
+	t.Run("Snapshot", func(t *testing.T) { s.testSnapshot(t, instanceID) })
+	t.Run("Keypairs", s.testKeypairs)
+	t.Run("Volumes", func(t *testing.T) { s.testVolumes(t, instanceID) })
+	if t.Run("DeleteInstance", func(t *testing.T) { s.testDelete(t, instanceID) }) {
+		instanceID = ""
+	}
+}
+
+// Checks the result of an operation against the capabilities.
+// Returns true if the operation is supported and succeeded.
+func (s *suite) check(t *testing.T, op compute.Operation, err error) bool {
+	if !s.capabilities.Supports(op) {
+		if !errors.Is(err, compute.ErrNotSupported) {
+			t.Errorf("%s is not in capabilities, but returned %v instead of ErrNotSupported", op, err)
+		}
+		return false
+	} else if err != nil {
+		t.Errorf("%s failed: %v", op, err)
+		return false
+	}
+	return true
+}
+
+// Lookups of IDs that do not exist must fail with ErrNotFound, including IDs
+// that the provider could never have issued.
+func isMissing(err error) bool {
+	return errors.Is(err, compute.ErrNotFound)
+}
+
+func (s *suite) wait(t *testing.T, instanceID string, predicate compute.InstancePredicate, state string) *compute.Instance {
+	wait := s.cfg.Wait
+	instance, err := compute.WaitForInstance(s.service, instanceID, predicate, &wait)
+	if err != nil {
+		t.Fatalf("error waiting for instance to be %s: %v", state, err)
+	}
+	return instance
+}
+
+func (s *suite) testCapabilities(t *testing.T) {
+	implemented := &compute.Capabilities{
+		Operations: compute.ImplementedOperations(s.service),
+	}
+	for _, op := range s.capabilities.Operations {
+		if !implemented.Supports(op) {
+			t.Errorf("capabilities include %s, but the service does not implement its interface", op)
+		}
+	}
+}
+
+func (s *suite) testFlavors(t *testing.T) {
+	flavorService, ok := s.service.(compute.FlavorService)
+	if !ok {
+		t.Skip("FlavorService not implemented")
+	}
+	_, err := flavorService.ListFlavors()
+	s.check(t, compute.OpListFlavors, err)
+
+	flavorID, err := flavorService.FindFlavor(&compute.Flavor{MemoryMB: 1 << 30})
+	if s.check(t, compute.OpFindFlavor, err) && flavorID != "" {
+		t.Errorf("FindFlavor returned %s for an impossible flavor, expected empty ID", flavorID)
+	}
+}
+
+func (s *suite) testImages(t *testing.T) {
+	imageService, ok := s.service.(compute.ImageService)
+	if !ok {
+		t.Skip("ImageService not implemented")
+	}
+	_, err := imageService.ListImages()
+	s.check(t, compute.OpListImages, err)
+
+	imageID, err := imageService.FindImage(&compute.Image{Name: BOGUS_ID})
+	if s.check(t, compute.OpFindImage, err) && imageID != "" {
+		t.Errorf("FindImage returned %s for a missing image, expected empty ID", imageID)
+	}
+
+	_, err = imageService.GetImage(BOGUS_ID)
+	if s.capabilities.Supports(compute.OpGetImage) && !isMissing(err) {
+		t.Errorf("GetImage on a missing image returned %v, expected ErrNotFound", err)
+	}
+}
+
+func (s *suite) testMissingInstance(t *testing.T) {
+	_, err := s.service.GetInstance(BOGUS_ID)
+	if !isMissing(err) {
+		t.Errorf("GetInstance on a missing instance returned %v, expected ErrNotFound", err)
+	}
+}
+
+func (s *suite) testSecurityGroups(t *testing.T) {
+	securityGroupService, ok := s.service.(compute.SecurityGroupService)
+	if !ok {
+		t.Skip("SecurityGroupService not implemented")
+	}
+	_, err := securityGroupService.GetSecurityGroup(BOGUS_ID)
+	if s.capabilities.Supports(compute.OpGetSecurityGroup) && !isMissing(err) {
+		t.Errorf("GetSecurityGroup on a missing group returned %v, expected ErrNotFound", err)
+	}
+
+	group, err := securityGroupService.CreateSecurityGroup(&compute.SecurityGroup{
+		Name:        "cloug-conformance",
+		Description: "cloug conformance",
+		Rules: []*compute.SecurityGroupRule{{
+			Direction: compute.RuleIngress,
+			Protocol:  "tcp",
+			PortMin:   22,
+			PortMax:   22,
+		}},
+	})
+	if !s.check(t, compute.OpCreateSecurityGroup, err) {
+		return
+	}
+	defer func() {
+		s.check(t, compute.OpDeleteSecurityGroup, securityGroupService.DeleteSecurityGroup(group.ID))
+	}()
+
+	groups, err := securityGroupService.ListSecurityGroups()
+	if s.check(t, compute.OpListSecurityGroups, err) {
+		found := false
+		for _, g := range groups {
+			found = found || g.ID == group.ID
+		}
+		if !found {
+			t.Errorf("ListSecurityGroups did not include group %s", group.ID)
+		}
+	}
+
+	rule, err := securityGroupService.AddSecurityGroupRule(group.ID, &compute.SecurityGroupRule{
+		Direction: compute.RuleIngress,
+		Protocol:  "tcp",
+		PortMin:   80,
+		PortMax:   80,
+	})
+	if !s.check(t, compute.OpAddSecurityGroupRule, err) {
+		return
+	}
+	fetched, err := securityGroupService.GetSecurityGroup(group.ID)
+	if s.check(t, compute.OpGetSecurityGroup, err) {
+		found := false
+		for _, r := range fetched.Rules {
+			found = found || r.ID == rule.ID
+		}
+		if !found {
+			t.Errorf("GetSecurityGroup did not include rule %s", rule.ID)
+		}
+	}
+	s.check(t, compute.OpRemoveSecurityGroupRule, securityGroupService.RemoveSecurityGroupRule(group.ID, rule.ID))
+}
+
+func (s *suite) testCreate(t *testing.T) string {
+	template := s.cfg.Instance
+	instance, err := s.service.CreateInstance(&template)
+	if err != nil {
+		t.Fatalf("CreateInstance failed: %v", err)
+	} else if instance.ID == "" {
+		t.Fatalf("CreateInstance returned an empty instance ID")
+	}
+	s.wait(t, instance.ID, compute.InstanceOnline, "online")
+	return instance.ID
+}
+
+func (s *suite) testGet(t *testing.T, instanceID string) {
+	instance, err := s.service.GetInstance(instanceID)
+	if err != nil {
+		t.Fatalf("GetInstance failed: %v", err)
+	} else if instance.ID != instanceID {
+		t.Errorf("GetInstance returned ID %s, expected %s", instance.ID, instanceID)
+	}
+}
+
+func (s *suite) testList(t *testing.T, instanceID string) {
+	instances, err := s.service.ListInstances()
+	if !s.check(t, compute.OpListInstances, err) {
+		return
+	}
+	for _, instance := range instances {
+		if instance.ID == instanceID {
+			return
+		}
+	}
+	t.Errorf("ListInstances did not include instance %s", instanceID)
+}
+
+func (s *suite) testPower(t *testing.T, instanceID string) {
+	if s.check(t, compute.OpStopInstance, s.service.StopInstance(instanceID)) {
+		s.wait(t, instanceID, compute.InstanceOffline, "offline")
+	}
+	if s.check(t, compute.OpStartInstance, s.service.StartInstance(instanceID)) {
+		s.wait(t, instanceID, compute.InstanceOnline, "online")
+	}
+	if s.check(t, compute.OpRebootInstance, s.service.RebootInstance(instanceID)) {
+		s.wait(t, instanceID, compute.InstanceOnline, "online")
+	}
+}
+
+func (s *suite) testRename(t *testing.T, instanceID string) {
+	renameService, ok := s.service.(compute.RenameService)
+	if !ok {
+		t.Skip("RenameService not implemented")
+	}
+	name := "cloug-conformance"
+	if !s.check(t, compute.OpRenameInstance, renameService.RenameInstance(instanceID, name)) {
+		return
+	}
+	instance, err := s.service.GetInstance(instanceID)
+	if err != nil {
+		t.Fatalf("GetInstance failed: %v", err)
+	} else if instance.Name != "" && instance.Name != name {
+		t.Errorf("instance name is %s after rename, expected %s", instance.Name, name)
+	}
+}
+
+func (s *suite) testResize(t *testing.T, instanceID string) {
+	resizeService, ok := s.service.(compute.ResizeService)
+	if !ok {
+		t.Skip("ResizeService not implemented")
+	} else if s.cfg.ResizeFlavor == nil {
+		t.Skip("no resize flavor configured")
+	}
+	if s.check(t, compute.OpResizeInstance, resizeService.ResizeInstance(instanceID, s.cfg.ResizeFlavor)) {
+		s.wait(t, instanceID, compute.InstanceOnline, "online")
+	}
+}
+
+func (s *suite) testVNC(t *testing.T, instanceID string) {
+	vncService, ok := s.service.(compute.VNCService)
+	if !ok {
+		t.Skip("VNCService not implemented")
+	}
+	url, err := vncService.GetVNC(instanceID)
+	if s.check(t, compute.OpGetVNC, err) && url == "" {
+		t.Errorf("GetVNC returned an empty URL")
+	}
+}
+
+func (s *suite) testAddresses(t *testing.T, instanceID string) {
+	addressService, ok := s.service.(compute.AddressService)
+	if !ok {
+		t.Skip("AddressService not implemented")
+	}
+	addresses, err := addressService.ListInstanceAddresses(instanceID)
+	if !s.check(t, compute.OpListInstanceAddresses, err) {
+		return
+	}
+	for _, address := range addresses {
+		if address.CanDNS {
+			s.check(t, compute.OpSetAddressHostname, addressService.SetAddressHostname(address.ID, "conformance.example.com"))
+			break
+		}
+	}
+}
+
+func (s *suite) testSnapshot(t *testing.T, instanceID string) {
+	imageService, ok := s.service.(compute.ImageService)
+	if !ok {
+		t.Skip("ImageService not implemented")
+	}
+	image, err := imageService.CreateImage(&compute.Image{
+		Name:           "cloug-conformance",
+		SourceInstance: instanceID,
+	})
+	if !s.capabilities.SupportsImageSource(compute.ImageSourceInstance) || !s.capabilities.Supports(compute.OpCreateImage) {
+		if !errors.Is(err, compute.ErrNotSupported) {
+			t.Errorf("snapshots are not in capabilities, but CreateImage returned %v instead of ErrNotSupported", err)
+		}
+		return
+	} else if err != nil {
+		t.Fatalf("CreateImage failed: %v", err)
+	} else if image.ID == "" {
+		t.Fatalf("CreateImage returned an empty image ID")
+	}
+
+	_, err = imageService.GetImage(image.ID)
+	s.check(t, compute.OpGetImage, err)
+	s.check(t, compute.OpDeleteImage, imageService.DeleteImage(image.ID))
+}
+
+func (s *suite) testKeypairs(t *testing.T) {
+	keypairService, ok := s.service.(compute.KeypairService)
+	if !ok {
+		t.Skip("KeypairService not implemented")
+	} else if len(s.cfg.PublicKey) == 0 {
+		t.Skip("no public key configured")
+	}
+	key, err := keypairService.ImportPublicKey(&compute.PublicKey{
+		Label: "cloug-conformance",
+		Key:   s.cfg.PublicKey,
+	})
+	if !s.check(t, compute.OpImportPublicKey, err) {
+		return
+	}
+	keys, err := keypairService.ListPublicKeys()
+	if s.check(t, compute.OpListPublicKeys, err) {
+		found := false
+		for _, k := range keys {
+			found = found || k.ID == key.ID
+		}
+		if !found {
+			t.Errorf("ListPublicKeys did not include key %s", key.ID)
+		}
+	}
+	s.check(t, compute.OpRemovePublicKey, keypairService.RemovePublicKey(key.ID))
+}
+
+func (s *suite) testVolumes(t *testing.T, instanceID string) {
+	volumeService, ok := s.service.(compute.VolumeService)
+	if !ok {
+		t.Skip("VolumeService not implemented")
+	} else if s.cfg.VolumeSizeGB == 0 {
+		t.Skip("no volume size configured")
+	}
+	instance, err := s.service.GetInstance(instanceID)
+	if err != nil {
+		t.Fatalf("GetInstance failed: %v", err)
+	}
+	volume, err := volumeService.CreateVolume(&compute.Volume{
+		Name:   "cloug-conformance",
+		Region: instance.Region,
+		SizeGB: s.cfg.VolumeSizeGB,
+	})
+	if !s.check(t, compute.OpCreateVolume, err) {
+		return
+	}
+	defer func() {
+		s.check(t, compute.OpDeleteVolume, volumeService.DeleteVolume(volume.ID))
+	}()
+
+	if !s.waitVolume(t, volumeService, volume.ID) {
+		return
+	}
+	if s.check(t, compute.OpAttachVolume, volumeService.AttachVolume(volume.ID, instanceID)) {
+		s.check(t, compute.OpDetachVolume, volumeService.DetachVolume(volume.ID))
+	}
+}
+
+// Waits until the volume is no longer pending.
+func (s *suite) waitVolume(t *testing.T, volumeService compute.VolumeService, volumeID string) bool {
+	interval := s.cfg.Wait.Interval
+	if interval <= 0 {
+		interval = compute.DEFAULT_WAIT_INTERVAL
+	}
+	deadline := time.Now().Add(compute.DEFAULT_WAIT_TIMEOUT)
+	for {
+		volume, err := volumeService.GetVolume(volumeID)
+		if !s.check(t, compute.OpGetVolume, err) {
+			return false
+		} else if volume.Status != compute.VolumePending {
+			return true
+		} else if time.Now().After(deadline) {
+			t.Errorf("volume %s is still pending", volumeID)
+			return false
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (s *suite) testDelete(t *testing.T, instanceID string) {
+	if err := s.service.DeleteInstance(instanceID); err != nil {
+		t.Fatalf("DeleteInstance failed: %v", err)
+	}
+	s.wait(t, instanceID, compute.InstanceDeleted, "deleted")
+}
@@ -0,0 +1,101 @@
+package compute
+
+import "context"
+
+// ContextService is like Service, but each call accepts a context that can be
+// used to cancel the call or to put a deadline on it.
+type ContextService interface {
+	CreateInstanceContext(ctx context.Context, instance *Instance) (*Instance, error)
+	DeleteInstanceContext(ctx context.Context, instanceID string) error
+	ListInstancesContext(ctx context.Context) ([]*Instance, error)
+	GetInstanceContext(ctx context.Context, instanceID string) (*Instance, error)
+	StartInstanceContext(ctx context.Context, instanceID string) error
+	StopInstanceContext(ctx context.Context, instanceID string) error
+	RebootInstanceContext(ctx context.Context, instanceID string) error
+}
+
+// Returns a ContextService for the specified service.
+// If the service implements ContextService, it is returned directly, and the
+// context is passed down to the provider's API requests. Otherwise, calls are
+// wrapped so that they return as soon as the context is done; in that case the
+// underlying call is not interrupted and keeps running in the background.
+func WithContext(service Service) ContextService {
+	if contextService, ok := service.(ContextService); ok {
+		return contextService
+	}
+	return &contextWrapper{service}
+}
+
+type contextWrapper struct {
+	service Service
+}
+
+// Runs f in the background and waits for it to finish or for ctx to be done.
+// Returns the context error if ctx is done first.
+func runWithContext(ctx context.Context, f func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *contextWrapper) CreateInstanceContext(ctx context.Context, instance *Instance) (*Instance, error) {
+	var created *Instance
+	var err error
+	if ctxErr := runWithContext(ctx, func() { created, err = w.service.CreateInstance(instance) }); ctxErr != nil {
+		return nil, ctxErr
+	}
+	return created, err
+}
+
+func (w *contextWrapper) DeleteInstanceContext(ctx context.Context, instanceID string) error {
+	return w.action(ctx, instanceID, w.service.DeleteInstance)
+}
+
+func (w *contextWrapper) ListInstancesContext(ctx context.Context) ([]*Instance, error) {
+	var instances []*Instance
+	var err error
+	if ctxErr := runWithContext(ctx, func() { instances, err = w.service.ListInstances() }); ctxErr != nil {
+		return nil, ctxErr
+	}
+	return instances, err
+}
+
+func (w *contextWrapper) GetInstanceContext(ctx context.Context, instanceID string) (*Instance, error) {
+	var instance *Instance
+	var err error
+	if ctxErr := runWithContext(ctx, func() { instance, err = w.service.GetInstance(instanceID) }); ctxErr != nil {
+		return nil, ctxErr
+	}
+	return instance, err
+}
+
+func (w *contextWrapper) StartInstanceContext(ctx context.Context, instanceID string) error {
+	return w.action(ctx, instanceID, w.service.StartInstance)
+}
+
+func (w *contextWrapper) StopInstanceContext(ctx context.Context, instanceID string) error {
+	return w.action(ctx, instanceID, w.service.StopInstance)
+}
+
+func (w *contextWrapper) RebootInstanceContext(ctx context.Context, instanceID string) error {
+	return w.action(ctx, instanceID, w.service.RebootInstance)
+}
+
+func (w *contextWrapper) action(ctx context.Context, instanceID string, f func(string) error) error {
+	var err error
+	if ctxErr := runWithContext(ctx, func() { err = f(instanceID) }); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
@@ -0,0 +1,39 @@
+package compute
+
+import "context"
+import "testing"
+import "time"
+
+type blockingService struct {
+	Service
+	release chan struct{}
+}
+
+func (s *blockingService) GetInstance(instanceID string) (*Instance, error) {
+	<-s.release
+	return &Instance{ID: instanceID}, nil
+}
+
+func TestWithContextCancel(t *testing.T) {
+	service := &blockingService{release: make(chan struct{})}
+	defer close(service.release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	instance, err := WithContext(service).GetInstanceContext(ctx, "1")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got instance=%v err=%v", instance, err)
+	}
+}
+
+func TestWithContextResult(t *testing.T) {
+	service := &blockingService{release: make(chan struct{})}
+	close(service.release)
+
+	instance, err := WithContext(service).GetInstanceContext(context.Background(), "1")
+	if err != nil {
+		t.Fatalf("returned error: %v", err)
+	} else if instance.ID != "1" {
+		t.Fatalf("unexpected instance ID %s", instance.ID)
+	}
+}
@@ -0,0 +1,55 @@
+package compute
+
+import "errors"
+import "fmt"
+
+// Kinds of errors that providers map their API failures onto.
+// Callers should check for these with errors.Is, since the returned error
+// usually wraps the provider's own error.
+var (
+	ErrNotSupported    = errors.New("operation not supported")
+	ErrNotFound        = errors.New("not found")
+	ErrQuotaExceeded   = errors.New("quota exceeded")
+	ErrRateLimited     = errors.New("rate limited")
+	ErrAuth            = errors.New("authentication failed")
+	ErrInvalidArgument = errors.New("invalid argument")
+	ErrConflict        = errors.New("conflict")
+)
+
+// Error is an error returned by a provider, classified as one of the Err* kinds.
+type Error struct {
+	// One of the Err* variables above.
+	Kind error
+
+	// The underlying error from the provider.
+	Err error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Classifies err as the specified kind.
+// Returns nil if err is nil; if kind is nil, err is returned unchanged.
+func WrapError(kind error, err error) error {
+	if err == nil || kind == nil {
+		return err
+	}
+	return &Error{
+		Kind: kind,
+		Err:  err,
+	}
+}
+
+// Formats an error message and classifies it as the specified kind.
+func Errorf(kind error, format string, a ...interface{}) error {
+	return WrapError(kind, fmt.Errorf(format, a...))
+}
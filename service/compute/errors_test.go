@@ -0,0 +1,25 @@
+package compute
+
+import "errors"
+import "fmt"
+import "testing"
+
+func TestWrapError(t *testing.T) {
+	apiErr := errors.New("server 123 does not exist")
+	err := fmt.Errorf("error getting instance: %w", WrapError(ErrNotFound, apiErr))
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected %v to be ErrNotFound", err)
+	}
+	if !errors.Is(err, apiErr) {
+		t.Fatalf("expected %v to wrap the API error", err)
+	}
+	if errors.Is(err, ErrAuth) {
+		t.Fatalf("did not expect %v to be ErrAuth", err)
+	}
+	if WrapError(ErrNotFound, nil) != nil {
+		t.Fatalf("expected wrapping a nil error to return nil")
+	}
+	if WrapError(nil, apiErr) != apiErr {
+		t.Fatalf("expected wrapping with a nil kind to return the error unchanged")
+	}
+}
@@ -40,4 +40,5 @@ type ImageArchitecture string
 const (
 	ArchAMD64 = "amd64"
 	Archi386  = "i386"
+	ArchARM64 = "arm64"
 )
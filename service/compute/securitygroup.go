@@ -0,0 +1,34 @@
+package compute
+
+type SecurityGroup struct {
+	ID          string
+	Name        string
+	Description string
+	Rules       []*SecurityGroupRule
+
+	// Key-value additional details of the security group.
+	Details map[string]string
+}
+
+type SecurityGroupRule struct {
+	ID        string
+	Direction RuleDirection
+
+	// Protocol such as tcp, udp or icmp, or empty for any protocol.
+	Protocol string
+
+	// Port range for tcp and udp; zero for all ports.
+	PortMin int
+	PortMax int
+
+	// Source of ingress traffic or destination of egress traffic, in CIDR
+	// notation. Empty matches any IPv4 address; use ::/0 for any IPv6 address.
+	RemoteCIDR string
+}
+
+type RuleDirection string
+
+const (
+	RuleIngress RuleDirection = "ingress"
+	RuleEgress  RuleDirection = "egress"
+)
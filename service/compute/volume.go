@@ -0,0 +1,24 @@
+package compute
+
+type Volume struct {
+	ID     string
+	Name   string
+	Region string
+	SizeGB int
+	Status VolumeStatus
+
+	// ID of the instance that the volume is attached to, or empty if the
+	// volume is not attached.
+	InstanceID string
+
+	// Key-value additional details of the volume.
+	Details map[string]string
+}
+
+type VolumeStatus string
+
+const (
+	VolumeAvailable VolumeStatus = "available"
+	VolumeInUse                  = "in-use"
+	VolumePending                = "pending"
+)
@@ -0,0 +1,134 @@
+package compute
+
+import "context"
+import "errors"
+import "fmt"
+import "time"
+
+const DEFAULT_WAIT_INTERVAL = 2 * time.Second
+const DEFAULT_WAIT_MAX_INTERVAL = 30 * time.Second
+const DEFAULT_WAIT_BACKOFF = 1.5
+const DEFAULT_WAIT_TIMEOUT = 10 * time.Minute
+
+// InstancePredicate is called with the result of each GetInstance call made by
+// WaitForInstance. It returns true once the instance reaches the desired state,
+// or an error to stop waiting.
+type InstancePredicate func(instance *Instance, err error) (bool, error)
+
+type WaitOptions struct {
+	// Delay before the first retry.
+	// Defaults to DEFAULT_WAIT_INTERVAL.
+	Interval time.Duration
+
+	// Upper bound on the delay between retries.
+	// Defaults to DEFAULT_WAIT_MAX_INTERVAL.
+	MaxInterval time.Duration
+
+	// Factor by which the delay grows after each retry; 1 polls at a fixed interval.
+	// Defaults to DEFAULT_WAIT_BACKOFF.
+	Backoff float64
+
+	// Total time to wait before giving up; negative to wait until the context is done.
+	// Defaults to DEFAULT_WAIT_TIMEOUT.
+	Timeout time.Duration
+
+	// Context that cancels the wait. Defaults to context.Background().
+	Context context.Context
+}
+
+// Polls the instance until predicate is satisfied, and returns the last instance seen.
+// Rate limit errors are retried. If the timeout expires or the context is done, the
+// returned error wraps the context error.
+func WaitForInstance(service Service, instanceID string, predicate InstancePredicate, opts *WaitOptions) (*Instance, error) {
+	if opts == nil {
+		opts = &WaitOptions{}
+	}
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = DEFAULT_WAIT_INTERVAL
+	}
+	maxInterval := opts.MaxInterval
+	if maxInterval <= 0 {
+		maxInterval = DEFAULT_WAIT_MAX_INTERVAL
+	}
+	backoff := opts.Backoff
+	if backoff < 1 {
+		backoff = DEFAULT_WAIT_BACKOFF
+	}
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = DEFAULT_WAIT_TIMEOUT
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	contextService := WithContext(service)
+	for {
+		instance, err := contextService.GetInstanceContext(ctx, instanceID)
+		if ctx.Err() != nil {
+			return instance, fmt.Errorf("error waiting for instance %s: %w", instanceID, ctx.Err())
+		}
+		done, err := predicate(instance, err)
+		if err != nil && !errors.Is(err, ErrRateLimited) {
+			return instance, err
+		} else if done {
+			return instance, nil
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return instance, fmt.Errorf("error waiting for instance %s: %w", instanceID, ctx.Err())
+		}
+
+		interval = time.Duration(float64(interval) * backoff)
+		if interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
+
+// Satisfied once the instance is online.
+func InstanceOnline(instance *Instance, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	return instance.Status == StatusOnline, nil
+}
+
+// Satisfied once the instance is offline.
+func InstanceOffline(instance *Instance, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	return instance.Status == StatusOffline, nil
+}
+
+// Satisfied once the instance no longer exists.
+// Some providers keep reporting deleted instances for a while, with a status
+// like "deleted" or "terminated".
+func InstanceDeleted(instance *Instance, err error) (bool, error) {
+	if errors.Is(err, ErrNotFound) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return instance.Status == "deleted" || instance.Status == "terminated" || instance.Status == "destroyed", nil
+}
+
+// Satisfied once the instance has been assigned a public or private IP address.
+func InstanceHasIP(instance *Instance, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	return instance.IP != "" || instance.PrivateIP != "", nil
+}
@@ -0,0 +1,43 @@
+package compute
+
+import "context"
+import "errors"
+import "testing"
+import "time"
+
+type countingService struct {
+	Service
+	calls    int
+	onlineAt int
+}
+
+func (s *countingService) GetInstance(instanceID string) (*Instance, error) {
+	s.calls++
+	if s.calls < s.onlineAt {
+		return &Instance{ID: instanceID, Status: "building"}, nil
+	} else if s.calls == s.onlineAt {
+		return nil, ErrRateLimited
+	}
+	return &Instance{ID: instanceID, Status: StatusOnline}, nil
+}
+
+func TestWaitForInstance(t *testing.T) {
+	service := &countingService{onlineAt: 3}
+	instance, err := WaitForInstance(service, "1", InstanceOnline, &WaitOptions{Interval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("wait failed: %v", err)
+	} else if instance.Status != StatusOnline || service.calls != 4 {
+		t.Fatalf("expected online instance after 4 calls, got %v after %d calls", instance, service.calls)
+	}
+}
+
+func TestWaitForInstanceTimeout(t *testing.T) {
+	service := &countingService{onlineAt: 1000000}
+	_, err := WaitForInstance(service, "1", InstanceOnline, &WaitOptions{
+		Interval: time.Millisecond,
+		Timeout:  20 * time.Millisecond,
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
@@ -0,0 +1,28 @@
+package utils
+
+import "context"
+import "net/http"
+
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(request.WithContext(t.ctx))
+}
+
+// Returns a copy of client that attaches ctx to every request it sends.
+// This lets us pass a context to API libraries that only accept an *http.Client.
+func ContextHTTPClient(ctx context.Context, client *http.Client) *http.Client {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	contextClient := *client
+	contextClient.Transport = &contextTransport{
+		ctx:  ctx,
+		base: base,
+	}
+	return &contextClient
+}